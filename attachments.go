@@ -0,0 +1,36 @@
+package courier
+
+import (
+	"context"
+	"sync"
+)
+
+// AttachmentStore is where the attachments of incoming messages are re-hosted. Backends use their own storage unless
+// a separate store, e.g. a different bucket or a CDN, has been registered.
+type AttachmentStore interface {
+	// Put stores the passed in contents at the passed in path, returning the public URL of the stored attachment
+	Put(ctx context.Context, path string, contentType string, contents []byte) (string, error)
+}
+
+// RegisterAttachmentStore registers the store attachments are re-hosted in instead of the backend's own storage, nil
+// meaning we go back to using the backend's storage
+func RegisterAttachmentStore(store AttachmentStore) {
+	attachmentStoreMutex.Lock()
+	defer attachmentStoreMutex.Unlock()
+
+	registeredAttachmentStore = store
+}
+
+// GetAttachmentStore returns the registered attachment store, or the passed in default if one hasn't been registered
+func GetAttachmentStore(defaultStore AttachmentStore) AttachmentStore {
+	attachmentStoreMutex.RLock()
+	defer attachmentStoreMutex.RUnlock()
+
+	if registeredAttachmentStore != nil {
+		return registeredAttachmentStore
+	}
+	return defaultStore
+}
+
+var registeredAttachmentStore AttachmentStore
+var attachmentStoreMutex sync.RWMutex
@@ -0,0 +1,67 @@
+package courier
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testAttachmentStore struct {
+	baseURL string
+	paths   []string
+}
+
+func (s *testAttachmentStore) Put(ctx context.Context, path string, contentType string, contents []byte) (string, error) {
+	s.paths = append(s.paths, path)
+	return s.baseURL + path, nil
+}
+
+func TestAttachmentStore(t *testing.T) {
+	defer RegisterAttachmentStore(nil)
+
+	backendStore := &testAttachmentStore{baseURL: "https://backend.example.com"}
+	cdnStore := &testAttachmentStore{baseURL: "https://cdn.example.com"}
+
+	// without a registered store we use the backend's
+	assert.Equal(t, backendStore, GetAttachmentStore(backendStore))
+
+	RegisterAttachmentStore(cdnStore)
+	store := GetAttachmentStore(backendStore)
+	assert.Equal(t, cdnStore, store)
+
+	url, err := store.Put(context.Background(), "/media/1/abcd.jpg", "image/jpeg", []byte("jpeg"))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://cdn.example.com/media/1/abcd.jpg", url)
+	assert.Equal(t, []string{"/media/1/abcd.jpg"}, cdnStore.paths)
+	assert.Nil(t, backendStore.paths)
+
+	// unregistering it goes back to the backend's
+	RegisterAttachmentStore(nil)
+	assert.Equal(t, backendStore, GetAttachmentStore(backendStore))
+}
+
+func TestAttachmentStoreConcurrently(t *testing.T) {
+	defer RegisterAttachmentStore(nil)
+
+	backendStore := &testAttachmentStore{baseURL: "https://backend.example.com"}
+	cdnStore := &testAttachmentStore{baseURL: "https://cdn.example.com"}
+
+	// stores can be registered while others are being looked up
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			RegisterAttachmentStore(cdnStore)
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NotNil(t, GetAttachmentStore(backendStore))
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, cdnStore, GetAttachmentStore(backendStore))
+}
@@ -130,6 +130,31 @@ func (b *backend) DeleteMsgWithExternalID(ctx context.Context, channel courier.C
 	return nil
 }
 
+// NewOutgoingMsg creates a new outgoing message from the given params
+func (b *backend) NewOutgoingMsg(channel courier.Channel, id courier.MsgID, urn urns.URN, text string, highPriority bool, quickReplies []string, topic string, responseToID int64, responseToExternalID string) courier.Msg {
+	msg := newMsg(MsgOutgoing, channel, urn, text)
+	msg.ID_ = id
+	msg.HighPriority_ = highPriority
+	msg.ResponseToExternalID_ = responseToExternalID
+	if responseToID != 0 {
+		msg.ResponseToID_ = courier.NewMsgID(responseToID)
+	}
+
+	// quick replies and topic are read from our metadata
+	metadata := make(map[string]interface{})
+	if len(quickReplies) > 0 {
+		metadata["quick_replies"] = quickReplies
+	}
+	if topic != "" {
+		metadata["topic"] = topic
+	}
+	if len(metadata) > 0 {
+		msg.Metadata_, _ = json.Marshal(metadata)
+	}
+
+	return msg
+}
+
 // NewIncomingMsg creates a new message from the given params
 func (b *backend) NewIncomingMsg(channel courier.Channel, urn urns.URN, text string) courier.Msg {
 	// remove any control characters
@@ -151,11 +176,6 @@ func (b *backend) NewIncomingMsg(channel courier.Channel, urn urns.URN, text str
 	return msg
 }
 
-// NewOutgoingMsg creates a new outgoing message from the given params
-func (b *backend) NewOutgoingMsg(channel courier.Channel, urn urns.URN, text string) courier.Msg {
-	return newMsg(MsgOutgoing, channel, urn, text)
-}
-
 // PopNextOutgoingMsg pops the next message that needs to be sent
 func (b *backend) PopNextOutgoingMsg(ctx context.Context) (courier.Msg, error) {
 	// pop the next message off our queue
@@ -354,6 +374,11 @@ func (b *backend) WriteMsgStatus(ctx context.Context, status courier.MsgStatus)
 		}
 	}
 
+	// log any extras of the status against its message, which statuses by external id only know once written
+	if err := writeMsgStatusExtra(b, status.(*DBMsgStatus)); err != nil {
+		logrus.WithError(err).WithField("msg", status.ID().String()).Error("error writing status extras")
+	}
+
 	// if we have an id and are marking an outgoing msg as errored, then clear our sent flag
 	if status.ID() != courier.NilMsgID && status.Status() == courier.MsgErrored {
 		err := b.ClearMsgSent(ctx, status.ID())
@@ -672,6 +672,53 @@ func (ts *BackendTestSuite) TestMsgStatus() {
 	ts.Equal(oldContactURN.ContactID, NilContactID)
 	ts.Equal(newContactURN.ContactID, otherContact.ID_)
 	ts.NoError(tx.Commit())
+
+	// extra info on statuses is logged against their messages, which they leave as they are apart from the units
+	// they were sent in, which are their message count
+	ts.b.db.MustExec(`UPDATE msgs_msg SET metadata = '{"topic":"event"}', msg_count = 1 WHERE id = $1`, 10001)
+	status = ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10001), courier.MsgWired)
+	status.SetExtra(courier.MsgStatusExtraUnits, 3)
+	status.SetExtra("send_attempts", 2)
+	status.SetExtra("last_error", "received non 200 status: 503")
+	ts.NoError(ts.b.WriteMsgStatus(ctx, status))
+
+	status = ts.b.NewMsgStatusForExternalID(channel, "ext0", courier.MsgDelivered)
+	status.SetExtra("provider_status", "READ")
+	ts.NoError(ts.b.WriteMsgStatus(ctx, status))
+	time.Sleep(time.Second)
+
+	var metadata string
+	var msgCount int
+	ts.NoError(ts.b.db.QueryRow(`SELECT metadata, msg_count FROM msgs_msg WHERE id = $1`, 10001).Scan(&metadata, &msgCount))
+	ts.Equal(`{"topic":"event"}`, metadata)
+	ts.Equal(3, msgCount)
+
+	var extras []string
+	ts.NoError(ts.b.db.Select(&extras, `SELECT response FROM channels_channellog WHERE msg_id = $1 AND description LIKE 'Status Extras:%' ORDER BY id`, 10001))
+	ts.Equal(2, len(extras))
+	ts.JSONEq(`{"send_attempts":2,"last_error":"received non 200 status: 503"}`, extras[0])
+	ts.JSONEq(`{"provider_status":"READ"}`, extras[1])
+
+	// statuses arriving late don't take messages back to earlier statuses
+	status = ts.b.NewMsgStatusForID(channel, courier.NewMsgID(10001), courier.MsgWired)
+	ts.NoError(ts.b.WriteMsgStatus(ctx, status))
+	time.Sleep(time.Second)
+
+	m = readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.Equal(courier.MsgDelivered, m.Status_)
+
+	status = ts.b.NewMsgStatusForExternalID(channel, "ext0", courier.MsgSent)
+	ts.NoError(ts.b.WriteMsgStatus(ctx, status))
+
+	m = readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.Equal(courier.MsgDelivered, m.Status_)
+
+	// but can still error them
+	status = ts.b.NewMsgStatusForExternalID(channel, "ext0", courier.MsgErrored)
+	ts.NoError(ts.b.WriteMsgStatus(ctx, status))
+
+	m = readMsgFromDB(ts.b, courier.NewMsgID(10001))
+	ts.Equal(courier.MsgErrored, m.Status_)
 }
 
 func (ts *BackendTestSuite) TestHealth() {
@@ -1015,6 +1062,42 @@ func (ts *BackendTestSuite) TestWriteAttachment() {
 	}
 }
 
+type testAttachmentStore struct {
+	paths []string
+}
+
+func (s *testAttachmentStore) Put(ctx context.Context, path string, contentType string, contents []byte) (string, error) {
+	s.paths = append(s.paths, path)
+	return "https://cdn.example.com" + path, nil
+}
+
+func (ts *BackendTestSuite) TestWriteAttachmentToRegisteredStore() {
+	ctx := context.Background()
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("GIF87aandstuff"))
+	}))
+	defer testServer.Close()
+
+	store := &testAttachmentStore{}
+	courier.RegisterAttachmentStore(store)
+	defer courier.RegisterAttachmentStore(nil)
+
+	knChannel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	urn, _ := urns.NewTelURNForCountry("12065551215", knChannel.Country())
+	msg := ts.b.NewIncomingMsg(knChannel, urn, "gif attachment").(*DBMsg)
+	msg.WithAttachment(testServer.URL + "/giffy")
+
+	err := ts.b.WriteMsg(ctx, msg)
+	ts.NoError(err)
+
+	// attachments are stored in the registered store and we use the URL it returns
+	if ts.Equal(1, len(store.paths)) && ts.Equal(1, len(msg.Attachments())) {
+		ts.Equal("image/gif:https://cdn.example.com"+store.paths[0], msg.Attachments()[0])
+		ts.True(strings.HasSuffix(store.paths[0], ".gif"))
+	}
+}
+
 func (ts *BackendTestSuite) TestWriteMsg() {
 	ctx := context.Background()
 	knChannel := ts.getChannel("KN", "dbc126ed-66bc-4e28-b67b-81dc3327c95d")
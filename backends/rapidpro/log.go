@@ -44,6 +44,11 @@ func writeChannelLog(ctx context.Context, b *backend, log *courier.ChannelLog) e
 		return fmt.Errorf("unable to write non-rapidpro channel logs")
 	}
 
+	// we have nowhere else to store the provider's id for the request so append it to our response
+	if log.TraceID != "" {
+		log.Response += "\n\nTrace ID: " + log.TraceID
+	}
+
 	// if we have an error, append to to our response
 	if log.Error != "" {
 		log.Response += "\n\nError: " + log.Error
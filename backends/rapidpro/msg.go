@@ -60,7 +60,7 @@ func writeMsg(ctx context.Context, b *backend, msg courier.Msg) error {
 
 	channel := m.Channel()
 
-	// if we have media, go download it to S3
+	// if we have media, go download it to our attachment store, S3 unless another store is registered
 	for i, attachment := range m.Attachments_ {
 		if strings.HasPrefix(attachment, "http") {
 			url, err := downloadMediaToS3(ctx, b, channel, m.OrgID_, m.UUID_, attachment)
@@ -122,9 +122,9 @@ func newMsg(direction MsgDirection, channel courier.Channel, urn urns.URN, text
 const insertMsgSQL = `
 INSERT INTO
 	msgs_msg(org_id, uuid, direction, text, attachments, msg_count, error_count, high_priority, status,
-             visibility, external_id, channel_id, contact_id, contact_urn_id, created_on, modified_on, next_attempt, queued_on, sent_on)
+             visibility, external_id, channel_id, contact_id, contact_urn_id, created_on, modified_on, next_attempt, queued_on, sent_on, metadata)
     VALUES(:org_id, :uuid, :direction, :text, :attachments, :msg_count, :error_count, :high_priority, :status,
-           :visibility, :external_id, :channel_id, :contact_id, :contact_urn_id, :created_on, :modified_on, :next_attempt, :queued_on, :sent_on)
+           :visibility, :external_id, :channel_id, :contact_id, :contact_urn_id, :created_on, :modified_on, :next_attempt, :queued_on, :sent_on, :metadata)
 RETURNING id
 `
 
@@ -303,7 +303,7 @@ func downloadMediaToS3(ctx context.Context, b *backend, channel courier.Channel,
 		path = fmt.Sprintf("/%s", path)
 	}
 
-	s3URL, err := b.storage.Put(ctx, path, mimeType, body)
+	s3URL, err := courier.GetAttachmentStore(b.storage).Put(ctx, path, mimeType, body)
 	if err != nil {
 		return "", err
 	}
@@ -542,6 +542,7 @@ func (m *DBMsg) SentOn() *time.Time           { return m.SentOn_ }
 func (m *DBMsg) ResponseToID() courier.MsgID  { return m.ResponseToID_ }
 func (m *DBMsg) ResponseToExternalID() string { return m.ResponseToExternalID_ }
 func (m *DBMsg) IsResend() bool               { return m.IsResend_ }
+func (m *DBMsg) AlreadyWritten() bool         { return m.alreadyWritten }
 
 func (m *DBMsg) Channel() courier.Channel { return m.channel }
 func (m *DBMsg) SessionStatus() string    { return m.SessionStatus_ }
@@ -589,6 +590,9 @@ func (m *DBMsg) WithContactName(name string) courier.Msg { m.ContactName_ = name
 // WithReceivedOn can be used to set sent_on on a msg in a chained call
 func (m *DBMsg) WithReceivedOn(date time.Time) courier.Msg { m.SentOn_ = &date; return m }
 
+// WithText can be used to replace the text of a msg in a chained call
+func (m *DBMsg) WithText(text string) courier.Msg { m.Text_ = text; return m }
+
 // WithExternalID can be used to set the external id on a msg in a chained call
 func (m *DBMsg) WithExternalID(id string) courier.Msg { m.ExternalID_ = null.String(id); return m }
 
@@ -607,6 +611,12 @@ func (m *DBMsg) WithAttachment(url string) courier.Msg {
 	return m
 }
 
+// WithAttachments can be used to replace the media urls for a message
+func (m *DBMsg) WithAttachments(urls []string) courier.Msg {
+	m.Attachments_ = urls
+	return m
+}
+
 // WithURNAuth can be used to add a URN auth setting to a message
 func (m *DBMsg) WithURNAuth(auth string) courier.Msg {
 	m.URNAuth_ = auth
@@ -88,6 +88,10 @@ UPDATE msgs_msg SET
 			ELSE 
 				'E' 
 			END 
+		WHEN 
+			(:status = 'W' AND status IN ('S', 'D')) OR (:status = 'S' AND status = 'D')
+		THEN 
+			status 
 		ELSE 
 			:status 
 		END,
@@ -109,7 +113,7 @@ UPDATE msgs_msg SET
 		END,
 	sent_on = CASE 
 		WHEN 
-			:status = 'W' 
+			:status = 'W' AND status NOT IN ('S', 'D')
 		THEN 
 			NOW() 
 		ELSE 
@@ -123,6 +127,7 @@ UPDATE msgs_msg SET
 		ELSE
 			external_id
 		END,
+	msg_count = COALESCE(:units, msg_count),
 	modified_on = :modified_on
 WHERE 
 	msgs_msg.id = :msg_id AND
@@ -145,6 +150,10 @@ UPDATE msgs_msg SET
 			ELSE 
 				'E' 
 			END 
+		WHEN 
+			(:status = 'W' AND status IN ('S', 'D')) OR (:status = 'S' AND status = 'D')
+		THEN 
+			status 
 		ELSE 
 			:status 
 		END,
@@ -172,6 +181,7 @@ UPDATE msgs_msg SET
 		ELSE 
 			NULL 
 		END,
+	msg_count = COALESCE(:units, msg_count),
 	modified_on = :modified_on
 WHERE 
 	msgs_msg.id = (SELECT msgs_msg.id FROM msgs_msg WHERE msgs_msg.external_id = :external_id AND msgs_msg.channel_id = :channel_id AND msgs_msg.direction = 'O' LIMIT 1)
@@ -206,6 +216,34 @@ func writeMsgStatusToDB(ctx context.Context, b *backend, status *DBMsgStatus) er
 	return nil
 }
 
+// writeMsgStatusExtra logs the extras of the passed in status against its message, other than its units which are
+// written to the message itself, so that what providers and our retries tell us about it is kept
+func writeMsgStatusExtra(b *backend, status *DBMsgStatus) error {
+	extra := make(map[string]interface{}, len(status.Extra_))
+	for key, value := range status.Extra_ {
+		if key != courier.MsgStatusExtraUnits {
+			extra[key] = value
+		}
+	}
+	if len(extra) == 0 || status.ID_ == courier.NilMsgID {
+		return nil
+	}
+
+	response, err := json.Marshal(extra)
+	if err != nil {
+		return err
+	}
+
+	b.logCommitter.Queue(&ChannelLog{
+		ChannelID:   status.ChannelID_,
+		MsgID:       status.ID_,
+		Description: fmt.Sprintf("Status Extras: %s", status.Status_),
+		Response:    string(response),
+		CreatedOn:   status.ModifiedOn_,
+	})
+	return nil
+}
+
 func (b *backend) flushStatusFile(filename string, contents []byte) error {
 	status := &DBMsgStatus{}
 	err := json.Unmarshal(contents, status)
@@ -228,6 +266,9 @@ func (b *backend) flushStatusFile(filename string, contents []byte) error {
 		return nil
 	}
 
+	if err == nil {
+		err = writeMsgStatusExtra(b, status)
+	}
 	return err
 }
 
@@ -244,6 +285,10 @@ UPDATE msgs_msg SET
 			ELSE 
 				'E' 
 			END 
+		WHEN 
+			(s.status = 'W' AND msgs_msg.status IN ('S', 'D')) OR (s.status = 'S' AND msgs_msg.status = 'D')
+		THEN 
+			msgs_msg.status 
 		ELSE 
 			s.status 
 		END,
@@ -279,11 +324,12 @@ UPDATE msgs_msg SET
 		ELSE
 			msgs_msg.external_id
 		END,
+	msg_count = COALESCE(s.units::int, msg_count),
 	modified_on = NOW()
 FROM
-	(VALUES(:msg_id, :channel_id, :status, :external_id)) 
+	(VALUES(:msg_id, :channel_id, :status, :external_id, :units)) 
 AS 
-	s(msg_id, channel_id, status, external_id) 
+	s(msg_id, channel_id, status, external_id, units) 
 WHERE 
 	msgs_msg.id = s.msg_id::bigint AND
 	msgs_msg.channel_id = s.channel_id::int AND 
@@ -307,6 +353,10 @@ type DBMsgStatus struct {
 	Status_      courier.MsgStatusValue `json:"status"                   db:"status"`
 	ModifiedOn_  time.Time              `json:"modified_on"              db:"modified_on"`
 
+	// Units_ is the units extra, which is written as the msg_count of the message, while other extras are logged for it
+	Units_ *int                   `json:"units,omitempty"          db:"units"`
+	Extra_ map[string]interface{} `json:"extra,omitempty"`
+
 	logs []*courier.ChannelLog
 }
 
@@ -359,3 +409,15 @@ func (s *DBMsgStatus) AddLog(log *courier.ChannelLog) { s.logs = append(s.logs,
 
 func (s *DBMsgStatus) Status() courier.MsgStatusValue          { return s.Status_ }
 func (s *DBMsgStatus) SetStatus(status courier.MsgStatusValue) { s.Status_ = status }
+
+func (s *DBMsgStatus) Extra() map[string]interface{} { return s.Extra_ }
+func (s *DBMsgStatus) SetExtra(key string, value interface{}) {
+	if s.Extra_ == nil {
+		s.Extra_ = make(map[string]interface{})
+	}
+	s.Extra_[key] = value
+
+	if units, isInt := value.(int); isInt && key == courier.MsgStatusExtraUnits {
+		s.Units_ = &units
+	}
+}
@@ -11,9 +11,19 @@ import (
 )
 
 const (
+	// ConfigAllowedSenders is the list of sender numbers or IDs a channel should only accept messages from
+	ConfigAllowedSenders = "allowed_senders"
+
 	// ConfigAPIKey is a constant key for channel configs
 	ConfigAPIKey = "api_key"
 
+	// ConfigAttachmentLimitAction is what to do with the attachments of incoming messages over the attachment limits,
+	// either truncate (the default) to keep those within the limits, or reject to drop them all
+	ConfigAttachmentLimitAction = "attachment_limit_action"
+
+	// ConfigAttachmentURLRewrite is the template used to rewrite the URLs of incoming attachments
+	ConfigAttachmentURLRewrite = "attachment_url_rewrite"
+
 	// ConfigAuthToken is a constant key for channel configs
 	ConfigAuthToken = "auth_token"
 
@@ -26,27 +36,87 @@ const (
 	// ConfigContentType is a constant key for channel configs
 	ConfigContentType = "content_type"
 
+	// ConfigDedupExternalIDs is whether a channel acknowledges incoming messages with external IDs it has already received
+	// without writing them again, for providers which redeliver messages
+	ConfigDedupExternalIDs = "dedup_external_ids"
+
+	// ConfigDedupTTL is how many seconds a channel which dedups incoming messages remembers their external IDs for,
+	// defaulting to a day
+	ConfigDedupTTL = "dedup_ttl"
+
+	// ConfigEmojiHandling is what to do with emoji in the text of incoming messages, either keep (the default), strip
+	// to remove them, or replace to swap each one for the replacement token
+	ConfigEmojiHandling = "emoji_handling"
+
+	// ConfigEmojiReplacement is the token emoji are replaced with when emoji handling is replace
+	ConfigEmojiReplacement = "emoji_replacement"
+
+	// ConfigInboundFilterPattern is a regular expression the text of incoming messages must match for the channel to
+	// accept them
+	ConfigInboundFilterPattern = "inbound_filter_pattern"
+
+	// ConfigInboundFilterPrefix is a prefix, matched case insensitively, the text of incoming messages must start with
+	// for the channel to accept them
+	ConfigInboundFilterPrefix = "inbound_filter_prefix"
+
+	// ConfigLinkShortenerURL is the URL of the service links in outgoing messages are shortened with, on channels which
+	// support shortening them
+	ConfigLinkShortenerURL = "link_shortener_url"
+
+	// ConfigLinkShortenerToken is the token, if any, we authenticate with against the link shortener service
+	ConfigLinkShortenerToken = "link_shortener_token"
+
+	// ConfigLogPayloads is how often the full payloads of sends on a channel are logged for debugging, 1 in every this
+	// many sends, with secrets redacted
+	ConfigLogPayloads = "log_payloads"
+
+	// ConfigMaxAttachments is the maximum number of attachments we accept on an incoming message
+	ConfigMaxAttachments = "max_attachments"
+
+	// ConfigMaxAttachmentsSize is the maximum total size in bytes of the attachments we accept on an incoming message
+	ConfigMaxAttachmentsSize = "max_attachments_size"
+
 	// ConfigMaxLength is the maximum size of a message in characters
 	ConfigMaxLength = "max_length"
 
+	// ConfigMaxRetries is the maximum number of times a failed send request is retried
+	ConfigMaxRetries = "max_retries"
+
 	// ConfigPassword is a constant key for channel configs
 	ConfigPassword = "password"
 
+	// ConfigProcessingNotifications is whether contacts should be notified that their messages are being processed
+	ConfigProcessingNotifications = "processing_notifications"
+
+	// ConfigRequestTimeout is the timeout in seconds for outgoing requests, which can be set per operation by suffixing
+	// an operation name, e.g. request_timeout_send
+	ConfigRequestTimeout = "request_timeout"
+
 	// ConfigSecret is the secret used for signing commands by the channel
 	ConfigSecret = "secret"
 
+	// ConfigSelfTestURN is a constant key for the URN handlers should send to when self testing a channel
+	ConfigSelfTestURN = "self_test_urn"
+
 	// ConfigSendAuthorization is a constant key for channel configs
 	ConfigSendAuthorization = "send_authorization"
 
 	// ConfigSendBody is a constant key for channel configs
 	ConfigSendBody = "body"
 
+	// ConfigSendJitter is the window in milliseconds over which sends are randomly delayed, to spread out bursts of sends
+	ConfigSendJitter = "send_jitter"
+
 	// ConfigSendMethod is a constant key for channel configs
 	ConfigSendMethod = "method"
 
 	// ConfigSendURL is a constant key for channel configs
 	ConfigSendURL = "send_url"
 
+	// ConfigUploadContentType is the content type attachments are uploaded to providers with, for providers which mis-sniff
+	// them, either a fixed MIME type or "attachment" to use the type the attachment was declared with
+	ConfigUploadContentType = "upload_content_type"
+
 	// ConfigUsername is a constant key for channel configs
 	ConfigUsername = "username"
 
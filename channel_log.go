@@ -65,6 +65,8 @@ func NewChannelLogFromRR(description string, channel Channel, msgID MsgID, rr *u
 		Response:    sanitizeBody(rr.Response),
 		CreatedOn:   time.Now(),
 		Elapsed:     rr.Elapsed,
+		RateLimit:   rr.RateLimit,
+		TraceID:     rr.TraceID,
 	}
 
 	return log
@@ -113,4 +115,10 @@ type ChannelLog struct {
 	Response    string
 	Elapsed     time.Duration
 	CreatedOn   time.Time
+
+	// RateLimit is the rate limit state the provider reported in its response, if any
+	RateLimit *utils.RateLimit
+
+	// TraceID is the id the provider gave the request in its response, if any, for quoting to them when debugging
+	TraceID string
 }
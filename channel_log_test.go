@@ -0,0 +1,37 @@
+package courier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nyaruka/courier/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelLogTraceID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-slack-req-id", "2ce8b0a7f9d1e4c6")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	channel := NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "SL", "2022", "US", nil)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, nil)
+	rr, err := utils.MakeHTTPRequest(req)
+	require.NoError(t, err)
+
+	log := NewChannelLogFromRR("Message Sent", channel, NewMsgID(10), rr)
+	assert.Equal(t, "2ce8b0a7f9d1e4c6", log.TraceID)
+
+	// requests without a trace id header don't have one
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(`{"ok":true}`)) })
+	req, _ = http.NewRequest(http.MethodPost, server.URL, nil)
+	rr, err = utils.MakeHTTPRequest(req)
+	require.NoError(t, err)
+
+	log = NewChannelLogFromRR("Message Sent", channel, NewMsgID(10), rr)
+	assert.Equal(t, "", log.TraceID)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	_ "github.com/lib/pq"
+	"github.com/nyaruka/courier"
+
+	// load channel handler packages which support self testing
+	_ "github.com/nyaruka/courier/handlers/zenvia"
+
+	// load available backends
+	_ "github.com/nyaruka/courier/backends/rapidpro"
+)
+
+func main() {
+	// courier's own config is loaded from courier.toml, the environment and any flags, these being followed by the
+	// type and UUID of the channel to test, e.g. selftest -db=postgres://... ZVW 8eb23e93-5ecb-45ba-b726-3b064e0c56ab
+	config := courier.LoadConfig("courier.toml")
+	if len(os.Args) < 3 {
+		log.Fatalf("usage: selftest [courier flags] <channel type> <channel uuid>")
+	}
+	channelType := courier.ChannelType(os.Args[len(os.Args)-2])
+	channelUUID, err := courier.NewChannelUUID(os.Args[len(os.Args)-1])
+	if err != nil {
+		log.Fatalf("invalid channel UUID: %s", err)
+	}
+
+	handler := courier.GetHandler(channelType)
+	if handler == nil {
+		log.Fatalf("no handler for channel type '%s'", channelType)
+	}
+	tester, isTester := handler.(courier.SelfTester)
+	if !isTester {
+		log.Fatalf("handler for channel type '%s' doesn't support self testing", channelType)
+	}
+
+	// only run the handler being tested, and don't start any senders as we don't want to send anything queued
+	config.IncludeChannels = []string{string(channelType)}
+	config.MaxWorkers = 0
+
+	backend, err := courier.NewBackend(config)
+	if err != nil {
+		log.Fatalf("unable to create backend: %s", err)
+	}
+
+	server := courier.NewServer(config, backend)
+	if err := server.Start(); err != nil {
+		log.Fatalf("unable to start server: %s", err)
+	}
+	defer server.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), courier.SendTimeout)
+	defer cancel()
+
+	channel, err := backend.GetChannel(ctx, channelType, channelUUID)
+	if err != nil {
+		log.Fatalf("unable to load channel: %s", err)
+	}
+
+	msg, err := tester.SelfTestMsg(channel)
+	if err != nil {
+		log.Fatalf("self test failed: %s", err)
+	}
+
+	status, err := server.SendMsg(ctx, msg)
+	if err != nil {
+		log.Fatalf("self test failed: %s", err)
+	}
+
+	for _, l := range status.Logs() {
+		fmt.Printf("%s %s %d %s (%s)\n", l.Method, l.URL, l.StatusCode, l.Description, l.Elapsed)
+		if l.Error != "" {
+			fmt.Printf("  error: %s\n", l.Error)
+		}
+	}
+	fmt.Printf("status: %s external_id: %s\n", status.Status(), status.ExternalID())
+
+	if status.Status() == courier.MsgErrored || status.Status() == courier.MsgFailed {
+		server.Stop()
+		os.Exit(1)
+	}
+}
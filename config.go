@@ -23,6 +23,7 @@ type Config struct {
 	FacebookApplicationSecret string `help:"the Facebook app secret"`
 	FacebookWebhookSecret     string `help:"the secret for Facebook webhook URL verification"`
 	MaxWorkers                int    `help:"the maximum number of go routines that will be used for sending (set to 0 to disable sending)"`
+	MaxInFlightReceives       int    `help:"the maximum number of channel requests that will be handled at once, any more being rejected (set to 0 for no limit)"`
 	LibratoUsername           string `help:"the username that will be used to authenticate to Librato"`
 	LibratoToken              string `help:"the token that will be used to authenticate to Librato"`
 	StatusUsername            string `help:"the username that is needed to authenticate against the /status endpoint"`
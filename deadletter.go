@@ -0,0 +1,90 @@
+package courier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DeadLetterReason is the classified reason a message send failed permanently
+type DeadLetterReason string
+
+// Possible values for DeadLetterReason
+const (
+	DeadLetterInvalidDestination DeadLetterReason = "invalid_destination"
+	DeadLetterAuthFailure        DeadLetterReason = "auth_failure"
+	DeadLetterRejected           DeadLetterReason = "rejected"
+)
+
+// PermanentSendError is returned by handlers when a send failed in a way that retrying won't fix
+type PermanentSendError struct {
+	Reason DeadLetterReason
+	Err    error
+}
+
+// NewPermanentSendError creates a new permanent send error with the passed in reason
+func NewPermanentSendError(reason DeadLetterReason, err error) *PermanentSendError {
+	return &PermanentSendError{Reason: reason, Err: err}
+}
+
+func (e *PermanentSendError) Error() string { return e.Err.Error() }
+func (e *PermanentSendError) Unwrap() error { return e.Err }
+
+// ClassifySendError returns the dead letter reason for the passed in send error and whether it is permanent
+func ClassifySendError(err error) (DeadLetterReason, bool) {
+	var permanent *PermanentSendError
+	if errors.As(err, &permanent) {
+		return permanent.Reason, true
+	}
+	return "", false
+}
+
+// DeadLetterSink is the interface for destinations of messages whose sends failed permanently
+type DeadLetterSink interface {
+	DeadLetter(ctx context.Context, msg Msg, reason DeadLetterReason, err error) error
+}
+
+type noopDeadLetterSink struct{}
+
+func (s noopDeadLetterSink) DeadLetter(context.Context, Msg, DeadLetterReason, error) error {
+	return nil
+}
+
+var deadLetterSink DeadLetterSink = noopDeadLetterSink{}
+var deadLetterSinkMutex sync.RWMutex
+
+// SetDeadLetterSink sets the sink that permanently failed sends are passed to, by default they are discarded
+func SetDeadLetterSink(sink DeadLetterSink) {
+	if sink == nil {
+		sink = noopDeadLetterSink{}
+	}
+
+	deadLetterSinkMutex.Lock()
+	defer deadLetterSinkMutex.Unlock()
+
+	deadLetterSink = sink
+}
+
+func getDeadLetterSink() DeadLetterSink {
+	deadLetterSinkMutex.RLock()
+	defer deadLetterSinkMutex.RUnlock()
+
+	return deadLetterSink
+}
+
+// deadLetterIfPermanent fails the status of a message whose send failed permanently and passes it to our dead letter
+// sink, returning whether it was dead lettered
+func deadLetterIfPermanent(ctx context.Context, msg Msg, status MsgStatus, sendErr error) (bool, error) {
+	reason, isPermanent := ClassifySendError(sendErr)
+	if !isPermanent {
+		return false, nil
+	}
+
+	status.SetStatus(MsgFailed)
+
+	if err := getDeadLetterSink().DeadLetter(ctx, msg, reason, sendErr); err != nil {
+		return true, fmt.Errorf("error dead lettering msg: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,182 @@
+package courier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+)
+
+type deadLetter struct {
+	msg    Msg
+	reason DeadLetterReason
+	err    error
+}
+
+type mockDeadLetterSink struct {
+	letters []deadLetter
+}
+
+func (s *mockDeadLetterSink) DeadLetter(ctx context.Context, msg Msg, reason DeadLetterReason, err error) error {
+	s.letters = append(s.letters, deadLetter{msg, reason, err})
+	return nil
+}
+
+// failingHandler is a handler whose sends always fail with the configured error
+type failingHandler struct {
+	dummyHandler
+	err error
+}
+
+func (h *failingHandler) ChannelType() ChannelType { return ChannelType("FL") }
+
+func (h *failingHandler) SendMsg(ctx context.Context, msg Msg) (MsgStatus, error) {
+	return nil, h.err
+}
+
+func (h *failingHandler) GetChannel(ctx context.Context, r *http.Request) (Channel, error) {
+	return nil, nil
+}
+
+func TestClassifySendError(t *testing.T) {
+	reason, isPermanent := ClassifySendError(NewPermanentSendError(DeadLetterAuthFailure, errors.New("bad token")))
+	assert.True(t, isPermanent)
+	assert.Equal(t, DeadLetterAuthFailure, reason)
+
+	// wrapped permanent errors are still permanent
+	reason, isPermanent = ClassifySendError(fmt.Errorf("error sending: %w", NewPermanentSendError(DeadLetterRejected, errors.New("blocked"))))
+	assert.True(t, isPermanent)
+	assert.Equal(t, DeadLetterRejected, reason)
+
+	reason, isPermanent = ClassifySendError(errors.New("connection reset"))
+	assert.False(t, isPermanent)
+	assert.Equal(t, DeadLetterReason(""), reason)
+
+	_, isPermanent = ClassifySendError(nil)
+	assert.False(t, isPermanent)
+}
+
+func TestDeadLettering(t *testing.T) {
+	sink := &mockDeadLetterSink{}
+	SetDeadLetterSink(sink)
+	defer SetDeadLetterSink(nil)
+
+	mb := NewMockBackend()
+	s := NewServer(NewConfig(), mb)
+	handler := &failingHandler{}
+	handler.Initialize(s)
+	activeHandlers[handler.ChannelType()] = handler
+	defer delete(activeHandlers, handler.ChannelType())
+
+	channel := NewMockChannel("2d8a7e39-f0a8-4b14-8f7e-0c8b6e2e9ad4", "FL", "2020", "US", map[string]interface{}{})
+	sender := NewForeman(s, 1).senders[0]
+
+	// a retryable failure is errored and not dead lettered
+	handler.err = errors.New("connection reset")
+	msg := mb.NewOutgoingMsg(channel, NewMsgID(101), "tel:+250788383383", "test message", false, nil, "", 0, "")
+	sender.sendMessage(msg)
+
+	assert.Equal(t, 1, len(mb.msgStatuses))
+	assert.Equal(t, MsgErrored, mb.msgStatuses[0].Status())
+	assert.Equal(t, 0, len(sink.letters))
+
+	mb.msgStatuses = nil
+
+	// a permanent failure is failed and dead lettered
+	handler.err = NewPermanentSendError(DeadLetterInvalidDestination, errors.New("invalid destination for message"))
+	msg = mb.NewOutgoingMsg(channel, NewMsgID(102), "tel:+1234", "test message", false, nil, "", 0, "")
+	sender.sendMessage(msg)
+
+	assert.Equal(t, 1, len(mb.msgStatuses))
+	assert.Equal(t, MsgFailed, mb.msgStatuses[0].Status())
+	if assert.Equal(t, 1, len(sink.letters)) {
+		assert.Equal(t, msg, sink.letters[0].msg)
+		assert.Equal(t, DeadLetterInvalidDestination, sink.letters[0].reason)
+		assert.EqualError(t, sink.letters[0].err, "invalid destination for message")
+	}
+}
+
+func TestSetDeadLetterSinkConcurrently(t *testing.T) {
+	defer SetDeadLetterSink(nil)
+
+	channel := NewMockChannel("2d8a7e39-f0a8-4b14-8f7e-0c8b6e2e9ad4", "FL", "2020", "US", map[string]interface{}{})
+	sendErr := NewPermanentSendError(DeadLetterRejected, errors.New("rejected"))
+
+	// sinks can be swapped while sends are being dead lettered
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetDeadLetterSink(noopDeadLetterSink{})
+		}()
+		go func() {
+			defer wg.Done()
+			msg := &mockMsg{channel: channel, id: NewMsgID(101), text: "test message", urn: "tel:+250788383383"}
+			_, err := deadLetterIfPermanent(context.Background(), msg, &mockMsgStatus{channel: channel, id: msg.id}, sendErr)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// validatingHandler is a handler which can only deliver to tel URNs
+type validatingHandler struct {
+	dummyHandler
+	sends int
+}
+
+func (h *validatingHandler) ChannelType() ChannelType { return ChannelType("VL") }
+
+func (h *validatingHandler) ValidateURN(urn urns.URN) error {
+	if urn.Scheme() != urns.TelScheme {
+		return fmt.Errorf("can't send to %s URNs", urn.Scheme())
+	}
+	return nil
+}
+
+func (h *validatingHandler) SendMsg(ctx context.Context, msg Msg) (MsgStatus, error) {
+	h.sends++
+	return h.backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgWired), nil
+}
+
+func TestSendValidatesURN(t *testing.T) {
+	sink := &mockDeadLetterSink{}
+	SetDeadLetterSink(sink)
+	defer SetDeadLetterSink(nil)
+
+	mb := NewMockBackend()
+	s := NewServer(NewConfig(), mb)
+	handler := &validatingHandler{}
+	handler.Initialize(s)
+	activeHandlers[handler.ChannelType()] = handler
+	defer delete(activeHandlers, handler.ChannelType())
+
+	channel := NewMockChannel("2d8a7e39-f0a8-4b14-8f7e-0c8b6e2e9ad4", "VL", "2020", "US", map[string]interface{}{})
+	sender := NewForeman(s, 1).senders[0]
+
+	// messages to URNs the handler can deliver to are sent
+	sender.sendMessage(mb.NewOutgoingMsg(channel, NewMsgID(101), "tel:+250788383383", "test message", false, nil, "", 0, ""))
+
+	assert.Equal(t, 1, handler.sends)
+	assert.Equal(t, MsgWired, mb.msgStatuses[0].Status())
+	assert.Equal(t, 1, mb.msgStatuses[0].Extra()[MsgStatusExtraUnits]) // handler doesn't count units so defaults to 1
+
+	mb.msgStatuses = nil
+
+	// others are failed and dead lettered without being sent
+	sender.sendMessage(mb.NewOutgoingMsg(channel, NewMsgID(102), "telegram:12345", "test message", false, nil, "", 0, ""))
+
+	assert.Equal(t, 1, handler.sends)
+	assert.Equal(t, MsgFailed, mb.msgStatuses[0].Status())
+	assert.Nil(t, mb.msgStatuses[0].Extra()[MsgStatusExtraUnits])
+	if assert.Equal(t, 1, len(sink.letters)) {
+		assert.Equal(t, DeadLetterInvalidDestination, sink.letters[0].reason)
+		assert.EqualError(t, sink.letters[0].err, "can't send to telegram URNs")
+	}
+}
@@ -25,6 +25,7 @@ require (
 	github.com/nyaruka/gocommon v1.16.2
 	github.com/nyaruka/librato v1.0.0
 	github.com/nyaruka/null v1.1.1
+	github.com/nyaruka/phonenumbers v1.0.71
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.4.2
@@ -58,7 +59,6 @@ require (
 	github.com/lestrrat-go/option v1.0.0 // indirect
 	github.com/naoina/go-stringutil v0.1.0 // indirect
 	github.com/naoina/toml v0.1.1 // indirect
-	github.com/nyaruka/phonenumbers v1.0.71 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/shopspring/decimal v1.2.0 // indirect
 	golang.org/x/crypto v0.0.0-20220427172511-eb4f295cb31f // indirect
@@ -28,6 +28,14 @@ type ChannelHandler interface {
 	SendMsg(context.Context, Msg) (MsgStatus, error)
 }
 
+// SendFunc sends the passed in message, as the SendMsg of a handler does
+type SendFunc func(context.Context, Msg) (MsgStatus, error)
+
+// SendWrapper is the interface handlers which wrap the sends made through them in behavior of their own should satisfy
+type SendWrapper interface {
+	WrapSend(SendFunc) SendFunc
+}
+
 // URNDescriber is the interface handlers which can look up URN metadata for new contacts should satisfy.
 type URNDescriber interface {
 	DescribeURN(context.Context, Channel, urns.URN) (map[string]string, error)
@@ -38,6 +46,24 @@ type MediaDownloadRequestBuilder interface {
 	BuildDownloadMediaRequest(context.Context, Backend, Channel, string) (*http.Request, error)
 }
 
+// SelfTester is the interface handlers which can verify their configuration by building a message to a test destination
+// should satisfy, the message being sent like any other
+type SelfTester interface {
+	SelfTestMsg(Channel) (Msg, error)
+}
+
+// ProcessingNotifier is the interface handlers which can let contacts know their incoming messages are being processed,
+// e.g. by marking them as read and showing a typing indicator, should satisfy
+type ProcessingNotifier interface {
+	NotifyProcessing(context.Context, Msg) ([]*ChannelLog, error)
+}
+
+// URNValidator is the interface handlers which can check that a URN is one they can deliver to should satisfy, so that
+// messages to other URNs fail before we make a request that is bound to fail
+type URNValidator interface {
+	ValidateURN(urns.URN) error
+}
+
 // RegisterHandler adds a new handler for a channel type, this is called by individual handlers when they are initialized
 func RegisterHandler(handler ChannelHandler) {
 	registeredHandlers[handler.ChannelType()] = handler
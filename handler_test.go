@@ -161,3 +161,47 @@ func TestHandling(t *testing.T) {
 	log, _ := mb.GetLastChannelLog()
 	assert.NotContains(log.Request, "secret")
 }
+
+// wrappingHandler is a handler which wraps its sends in a check of its own
+type wrappingHandler struct {
+	dummyHandler
+	sends int
+}
+
+func (h *wrappingHandler) ChannelType() ChannelType { return ChannelType("WR") }
+
+func (h *wrappingHandler) SendMsg(ctx context.Context, msg Msg) (MsgStatus, error) {
+	h.sends++
+	return h.backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgWired), nil
+}
+
+func (h *wrappingHandler) WrapSend(send SendFunc) SendFunc {
+	return func(ctx context.Context, msg Msg) (MsgStatus, error) {
+		if msg.Text() == "" {
+			return nil, errors.New("nothing to send")
+		}
+		return send(ctx, msg)
+	}
+}
+
+func TestSendWrapping(t *testing.T) {
+	mb := NewMockBackend()
+	s := NewServer(NewConfig(), mb)
+	handler := &wrappingHandler{}
+	handler.Initialize(s)
+	activeHandlers[handler.ChannelType()] = handler
+	defer delete(activeHandlers, handler.ChannelType())
+
+	channel := NewMockChannel("2d8a7e39-f0a8-4b14-8f7e-0c8b6e2e9ad4", "WR", "2020", "US", map[string]interface{}{})
+
+	// sends go through the wrapper of the handler
+	status, err := s.SendMsg(context.Background(), mb.NewOutgoingMsg(channel, NewMsgID(101), "tel:+250788383383", "test message", false, nil, "", 0, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, MsgWired, status.Status())
+	assert.Equal(t, 1, handler.sends)
+
+	// which can stop them being made
+	_, err = s.SendMsg(context.Background(), mb.NewOutgoingMsg(channel, NewMsgID(102), "tel:+250788383383", "", false, nil, "", 0, ""))
+	assert.EqualError(t, err, "nothing to send")
+	assert.Equal(t, 1, handler.sends)
+}
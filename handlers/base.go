@@ -3,9 +3,11 @@ package handlers
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/utils"
 )
 
 // BaseHandler is the base class for most handlers, it just stored the server, name and channel type for the handler
@@ -14,7 +16,10 @@ type BaseHandler struct {
 	name                string
 	server              courier.Server
 	backend             courier.Backend
+	clock               utils.Clock
+	retryBackoff        time.Duration
 	useChannelRouteUUID bool
+	sendMiddleware      []SendMiddleware
 }
 
 // NewBaseHandler returns a newly constructed BaseHandler with the passed in parameters
@@ -43,6 +48,45 @@ func (h *BaseHandler) Backend() courier.Backend {
 	return h.backend
 }
 
+// Clock returns the clock this handler should use for the current time, which is the real clock unless set
+func (h *BaseHandler) Clock() utils.Clock {
+	if h.clock == nil {
+		return utils.RealClock
+	}
+	return h.clock
+}
+
+// SetClock can be used to change the clock on a BaseHandler, e.g. to control time in tests
+func (h *BaseHandler) SetClock(clock utils.Clock) {
+	h.clock = clock
+}
+
+// RetryBackoff returns how long this handler waits before retrying a failed send request, which is the default unless
+// set
+func (h *BaseHandler) RetryBackoff() time.Duration {
+	if h.retryBackoff == 0 {
+		return DefaultRetryBackoff
+	}
+	return h.retryBackoff
+}
+
+// SetRetryBackoff can be used to change how long a BaseHandler waits before retrying failed send requests, e.g. to
+// speed up tests
+func (h *BaseHandler) SetRetryBackoff(backoff time.Duration) {
+	h.retryBackoff = backoff
+}
+
+// UseSendMiddleware adds the passed in middleware to what all sends the server makes through this handler go through,
+// in order
+func (h *BaseHandler) UseSendMiddleware(middleware ...SendMiddleware) {
+	h.sendMiddleware = append(h.sendMiddleware, middleware...)
+}
+
+// WrapSend returns the passed in send wrapped in the middleware of this handler, which the server does for every send
+func (h *BaseHandler) WrapSend(send courier.SendFunc) courier.SendFunc {
+	return ChainSendMiddleware(send, h.sendMiddleware...)
+}
+
 // ChannelType returns the channel type that this handler deals with
 func (h *BaseHandler) ChannelType() courier.ChannelType {
 	return h.channelType
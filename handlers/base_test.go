@@ -1,9 +1,21 @@
 package handlers
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/utils"
+	"github.com/nyaruka/gocommon/urns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -72,3 +84,862 @@ func TestSplitMsgByChannel(t *testing.T) {
 	assert.Equal([]string{" "}, SplitMsgByChannel(channelWithMaxLength, " ", 20))
 	assert.Equal([]string{"This is a message", "longer than 10"}, SplitMsgByChannel(channelWithMaxLength, "This is a message   longer than 10", 20))
 }
+
+func TestSplitMsgAtBoundaries(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{""}, SplitMsgAtBoundaries("", 160))
+	assert.Equal([]string{"Simple message"}, SplitMsgAtBoundaries("Simple message", 160))
+	assert.Equal([]string{"This is a message", "longer than 10"}, SplitMsgAtBoundaries("This is a message longer than 10", 20))
+	assert.Equal([]string{"This is a message", "longer than 10"}, SplitMsgAtBoundaries("This is a message   longer than 10", 20))
+
+	// sentence boundaries near the end of a segment are preferred over later word boundaries
+	assert.Equal([]string{"Hi there Bob.", "How are you doing", "today?"}, SplitMsgAtBoundaries("Hi there Bob. How are you doing today?", 17))
+	assert.Equal([]string{"Your order is ready:", "Go now please"}, SplitMsgAtBoundaries("Your order is ready:\nGo now please", 24))
+
+	// but not those too far from the end
+	assert.Equal([]string{"Yes. This is a long", "sentence"}, SplitMsgAtBoundaries("Yes. This is a long sentence", 20))
+
+	// words are only split when they are longer than the max
+	assert.Equal([]string{"Go to", "https://example.c", "om/path now"}, SplitMsgAtBoundaries("Go to https://example.com/path now", 17))
+	assert.Equal([]string{"abcde", "fghij"}, SplitMsgAtBoundaries("abcdefghij", 5))
+
+	// characters are never split
+	assert.Equal([]string{"ééé", "éé"}, SplitMsgAtBoundaries("ééééé", 7))
+
+	// compared to a fixed length split which can cut words that would fit in the next segment
+	text := "Please remember to bring identification documents with you"
+	assert.Equal([]string{"Please remember", "to bring identificat", "ion documents with", "you"}, SplitMsg(text, 20))
+	assert.Equal([]string{"Please remember to", "bring identification", "documents with you"}, SplitMsgAtBoundaries(text, 20))
+}
+
+func TestSplitMsgByChannelAtBoundaries(t *testing.T) {
+	assert := assert.New(t)
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{courier.ConfigMaxLength: 25})
+
+	assert.Equal([]string{"Thanks for your order.", "We will let you know when", "it ships."}, SplitMsgByChannelAtBoundaries(channel, "Thanks for your order. We will let you know when it ships.", 160))
+	assert.Equal([]string{"Thanks for your order. We will let you know when it ships."}, SplitMsgByChannelAtBoundaries(courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil), "Thanks for your order. We will let you know when it ships.", 160))
+}
+
+func TestRewriteAttachmentURL(t *testing.T) {
+	assert := assert.New(t)
+	var channelWithRewrite = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US",
+		map[string]interface{}{
+			courier.ConfigAttachmentURLRewrite: "https://cdn.example.com/{{host}}/{{path}}",
+		})
+	var channelWithProxy = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US",
+		map[string]interface{}{
+			courier.ConfigAttachmentURLRewrite: "https://proxy.example.com/fetch?src={{url}}",
+		})
+	var channelWithInvalidRewrite = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US",
+		map[string]interface{}{
+			courier.ConfigAttachmentURLRewrite: "cdn.example.com/{{path}}",
+		})
+	var channelWithoutRewrite = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US",
+		map[string]interface{}{})
+
+	rewritten, err := RewriteAttachmentURL(channelWithRewrite, "https://foo.bar/v1/media/41?size=large")
+	assert.NoError(err)
+	assert.Equal("https://cdn.example.com/foo.bar/v1/media/41?size=large", rewritten)
+
+	rewritten, err = RewriteAttachmentURL(channelWithProxy, "https://foo.bar/v1/media/41")
+	assert.NoError(err)
+	assert.Equal("https://proxy.example.com/fetch?src=https%3A%2F%2Ffoo.bar%2Fv1%2Fmedia%2F41", rewritten)
+
+	rewritten, err = RewriteAttachmentURL(channelWithRewrite, "geo:0.000000,1.000000")
+	assert.NoError(err)
+	assert.Equal("geo:0.000000,1.000000", rewritten)
+
+	rewritten, err = RewriteAttachmentURL(channelWithInvalidRewrite, "https://foo.bar/v1/media/41")
+	assert.EqualError(err, "attachment URL rewrite produced an invalid URL: cdn.example.com/v1/media/41")
+	assert.Equal("https://foo.bar/v1/media/41", rewritten)
+
+	rewritten, err = RewriteAttachmentURL(channelWithoutRewrite, "https://foo.bar/v1/media/41")
+	assert.NoError(err)
+	assert.Equal("https://foo.bar/v1/media/41", rewritten)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	channel := courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{})
+	assert.Equal(t, 15*time.Second, RequestTimeout(channel, "send", 15*time.Second))
+
+	channel = courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{"request_timeout": 30})
+	assert.Equal(t, 30*time.Second, RequestTimeout(channel, "send", 15*time.Second))
+	assert.Equal(t, 30*time.Second, RequestTimeout(channel, "upload", 15*time.Second))
+
+	channel = courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{"request_timeout": 30, "request_timeout_upload": "33"})
+	assert.Equal(t, 30*time.Second, RequestTimeout(channel, "send", 15*time.Second))
+	assert.Equal(t, 33*time.Second, RequestTimeout(channel, "upload", 15*time.Second))
+
+	// timeouts longer than sends are given are cut short to that
+	channel = courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{"request_timeout": 30, "request_timeout_upload": "120"})
+	assert.Equal(t, 30*time.Second, RequestTimeout(channel, "send", 15*time.Second))
+	assert.Equal(t, courier.SendTimeout, RequestTimeout(channel, "upload", 15*time.Second))
+}
+
+func TestUploadContentType(t *testing.T) {
+	channel := courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{})
+	assert.Equal(t, "text/plain", UploadContentType(channel, "image/jpeg", "text/plain"))
+
+	channel = courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{"upload_content_type": "attachment"})
+	assert.Equal(t, "image/jpeg", UploadContentType(channel, "image/jpeg", "text/plain"))
+	assert.Equal(t, "text/plain", UploadContentType(channel, "", "text/plain"))
+
+	channel = courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{"upload_content_type": "application/pdf"})
+	assert.Equal(t, "application/pdf", UploadContentType(channel, "image/jpeg", "text/plain"))
+}
+
+func TestStringListConfigForKey(t *testing.T) {
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{
+		"list":   []interface{}{"+1234", " 5678 "},
+		"string": "+1234, 5678,",
+	})
+
+	assert.Equal(t, []string{"+1234", "5678"}, StringListConfigForKey(channel, "list"))
+	assert.Equal(t, []string{"+1234", "5678"}, StringListConfigForKey(channel, "string"))
+	assert.Equal(t, []string{}, StringListConfigForKey(channel, "missing"))
+}
+
+func TestIsSenderAllowed(t *testing.T) {
+	tcs := []struct {
+		config  map[string]interface{}
+		urn     urns.URN
+		allowed bool
+	}{
+		{map[string]interface{}{}, "tel:+250788383383", true},
+		{map[string]interface{}{"allowed_senders": ""}, "tel:+250788383383", true},
+		{map[string]interface{}{"allowed_senders": []interface{}{"+250788383383", "250788383384"}}, "tel:+250788383383", true},
+		{map[string]interface{}{"allowed_senders": []interface{}{"+250788383383", "250788383384"}}, "whatsapp:250788383384", true},
+		{map[string]interface{}{"allowed_senders": []interface{}{"+250788383383", "250788383384"}}, "tel:+250788383385", false},
+		{map[string]interface{}{"allowed_senders": "U0123ABCDEF, U0123ABCDEG"}, "slack:U0123ABCDEG", true},
+		{map[string]interface{}{"allowed_senders": "U0123ABCDEF, U0123ABCDEG"}, "slack:U0123ABCDEH", false},
+		{map[string]interface{}{"allowed_senders": []string{"telegram:12345"}}, "telegram:12345", true},
+		{map[string]interface{}{"allowed_senders": []string{"telegram:12345"}}, "telegram:123456", false},
+	}
+
+	for _, tc := range tcs {
+		channel := courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", tc.config)
+		assert.Equal(t, tc.allowed, IsSenderAllowed(channel, tc.urn), "allowed mismatch for %s with config %v", tc.urn, tc.config)
+	}
+}
+
+func TestMatchesInboundFilter(t *testing.T) {
+	tcs := []struct {
+		config  map[string]interface{}
+		text    string
+		matches bool
+		err     string
+	}{
+		{map[string]interface{}{}, "hello", true, ""},
+		{map[string]interface{}{"inbound_filter_prefix": "/join"}, "/join team", true, ""},
+		{map[string]interface{}{"inbound_filter_prefix": "/join"}, "  /JOIN team", true, ""},
+		{map[string]interface{}{"inbound_filter_prefix": "/join"}, "please /join", false, ""},
+		{map[string]interface{}{"inbound_filter_prefix": "/join"}, "/jo", false, ""},
+		{map[string]interface{}{"inbound_filter_pattern": `^\d{4}$`}, "1234", true, ""},
+		{map[string]interface{}{"inbound_filter_pattern": `^\d{4}$`}, "12345", false, ""},
+		{map[string]interface{}{"inbound_filter_prefix": "code", "inbound_filter_pattern": `\d+`}, "code 12", true, ""},
+		{map[string]interface{}{"inbound_filter_prefix": "code", "inbound_filter_pattern": `\d+`}, "code twelve", false, ""},
+		{map[string]interface{}{"inbound_filter_pattern": `(`}, "hello", true, "invalid inbound filter pattern: error parsing regexp: missing closing ): `(`"},
+	}
+
+	for _, tc := range tcs {
+		channel := courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", tc.config)
+		matches, err := MatchesInboundFilter(channel, tc.text)
+		assert.Equal(t, tc.matches, matches, "matches mismatch for '%s' with config %v", tc.text, tc.config)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	// patterns are compiled once, whichever channels use them
+	channel := courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{"inbound_filter_pattern": "^yes$"})
+	MatchesInboundFilter(channel, "yes")
+	cached, _ := inboundFilters.Load("^yes$")
+	other := courier.NewMockChannel("0b5c3fb6-3ec3-4d3e-9e8c-0f0c2b0f6a0e", "NX", "1234", "EC", map[string]interface{}{"inbound_filter_pattern": "^yes$"})
+	MatchesInboundFilter(other, "no")
+	cachedAgain, _ := inboundFilters.Load("^yes$")
+	assert.Same(t, cached, cachedAgain)
+
+	// and a channel whose pattern changes uses the new one
+	channel = courier.NewMockChannel("7a8ff1d4-f211-4492-9d05-e1905f6da8c8", "NX", "1234", "EC", map[string]interface{}{"inbound_filter_pattern": "^no$"})
+	matches, err := MatchesInboundFilter(channel, "no")
+	assert.NoError(t, err)
+	assert.True(t, matches)
+}
+
+// staticShortener shortens every link to the same short link, failing for links containing "fail"
+type staticShortener struct{}
+
+func (s *staticShortener) Shorten(ctx context.Context, link string) (string, error) {
+	if strings.Contains(link, "fail") {
+		return "", fmt.Errorf("unable to shorten %s", link)
+	}
+	return "https://sho.rt/x", nil
+}
+
+func TestDedupExternalIDs(t *testing.T) {
+	mb := courier.NewMockBackend()
+	h := NewBaseHandler(courier.ChannelType("AC"), "Test")
+	h.SetServer(newServer(mb))
+
+	receive := func(channel courier.Channel, externalID string) int {
+		msg := mb.NewIncomingMsg(channel, "tel:+250788383383", "Hello").WithExternalID(externalID)
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/c/ac/receive", nil)
+		_, err := WriteMsgsAndResponse(context.Background(), &h, []courier.Msg{msg}, w, r)
+		assert.NoError(t, err)
+		return w.Code
+	}
+
+	// by default redelivered messages are written again
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{})
+	assert.Equal(t, 200, receive(channel, "ext1"))
+	assert.Equal(t, 200, receive(channel, "ext1"))
+	assert.Equal(t, 2, mb.LenQueuedMsgs())
+
+	// but channels which dedup acknowledge them without writing them
+	mb.ClearQueueMsgs()
+	channel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"dedup_external_ids": true})
+	assert.Equal(t, 200, receive(channel, "ext2"))
+	assert.Equal(t, 200, receive(channel, "ext2"))
+	assert.Equal(t, 1, mb.LenQueuedMsgs())
+
+	// which doesn't stop messages with other external IDs or none
+	assert.Equal(t, 200, receive(channel, "ext3"))
+	assert.Equal(t, 200, receive(channel, ""))
+	assert.Equal(t, 200, receive(channel, ""))
+	assert.Equal(t, 4, mb.LenQueuedMsgs())
+
+	// and messages we fail to write are written when redelivered
+	mb.ClearQueueMsgs()
+	mb.SetErrorOnQueue(true)
+	msg := mb.NewIncomingMsg(channel, "tel:+250788383383", "Hello").WithExternalID("ext4")
+	_, err := WriteMsgsAndResponse(context.Background(), &h, []courier.Msg{msg}, httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/c/ac/receive", nil))
+	assert.EqualError(t, err, "unable to queue message")
+	mb.SetErrorOnQueue(false)
+	assert.Equal(t, 200, receive(channel, "ext4"))
+	assert.Equal(t, 1, mb.LenQueuedMsgs())
+
+	// external IDs are remembered for a day unless channels are configured to remember them for longer or shorter
+	rc := mb.RedisPool().Get()
+	defer rc.Close()
+	ttl, err := redis.Int(rc.Do("TTL", "nonce:externalid:8eb23e93-5ecb-45ba-b726-3b064e0c56ab:ext4"))
+	assert.NoError(t, err)
+	assert.InDelta(t, 86400, ttl, 5)
+
+	channel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"dedup_external_ids": true, "dedup_ttl": 3600})
+	assert.Equal(t, 200, receive(channel, "ext5"))
+	ttl, err = redis.Int(rc.Do("TTL", "nonce:externalid:8eb23e93-5ecb-45ba-b726-3b064e0c56ab:ext5"))
+	assert.NoError(t, err)
+	assert.InDelta(t, 3600, ttl, 5)
+
+	// and in whatever nonce store is registered
+	store := &memoryNonceStore{claimed: map[string]time.Duration{}}
+	courier.RegisterNonceStore(store)
+	defer courier.RegisterNonceStore(nil)
+
+	mb.ClearQueueMsgs()
+	assert.Equal(t, 200, receive(channel, "ext6"))
+	assert.Equal(t, 200, receive(channel, "ext6"))
+	assert.Equal(t, 1, mb.LenQueuedMsgs())
+	assert.Equal(t, map[string]time.Duration{"externalid:8eb23e93-5ecb-45ba-b726-3b064e0c56ab:ext6": time.Hour}, store.claimed)
+}
+
+type memoryNonceStore struct {
+	claimed map[string]time.Duration
+}
+
+func (s *memoryNonceStore) Claim(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	if _, seen := s.claimed[nonce]; seen {
+		return false, nil
+	}
+	s.claimed[nonce] = ttl
+	return true, nil
+}
+
+func (s *memoryNonceStore) Release(ctx context.Context, nonce string) error {
+	delete(s.claimed, nonce)
+	return nil
+}
+
+// notifyingHandler is a handler which counts the messages it notifies contacts of processing
+type notifyingHandler struct {
+	BaseHandler
+	notified []string
+	mutex    sync.Mutex
+}
+
+func (h *notifyingHandler) NotifyProcessing(ctx context.Context, msg courier.Msg) ([]*courier.ChannelLog, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.notified = append(h.notified, msg.ExternalID())
+	return nil, nil
+}
+
+func TestNotifyProcessing(t *testing.T) {
+	mb := courier.NewMockBackend()
+	h := &notifyingHandler{BaseHandler: NewBaseHandler(courier.ChannelType("AC"), "Test")}
+	h.SetServer(newServer(mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"dedup_external_ids": true, "processing_notifications": true})
+
+	receive := func(msg courier.Msg) {
+		_, err := WriteMsgsAndResponse(context.Background(), h, []courier.Msg{msg}, httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/c/ac/receive", nil))
+		assert.NoError(t, err)
+	}
+
+	// contacts are notified of new messages, but not again for ones we dedup
+	receive(mb.NewIncomingMsg(channel, "tel:+250788383383", "Hello").WithExternalID("ext1"))
+	receive(mb.NewIncomingMsg(channel, "tel:+250788383383", "Hello").WithExternalID("ext1"))
+
+	// or which the backend has already written
+	msg := mb.NewIncomingMsg(channel, "tel:+250788383383", "Hello").WithExternalID("ext2")
+	mb.WriteExternalIDSeen(msg)
+	receive(mb.CheckExternalIDSeen(msg))
+
+	// notifications are tracked by the server so we can wait for them
+	h.Server().WaitGroup().Wait()
+	assert.Equal(t, []string{"ext1"}, h.notified)
+}
+
+// pipeliningHandler is a handler whose incoming messages go through its own pipeline
+type pipeliningHandler struct {
+	BaseHandler
+}
+
+func (h *pipeliningHandler) ReceivePipeline() ReceivePipeline {
+	noSpam := func(r *http.Request, msg courier.Msg) (bool, string) {
+		return !strings.Contains(msg.Text(), "spam"), "message is spam"
+	}
+	return ReceivePipeline{
+		Filters: append([]ReceiveFilter{noSpam}, DefaultReceivePipeline.Filters...),
+		Steps:   DefaultReceivePipeline.Steps,
+	}
+}
+
+func TestReceivePipeline(t *testing.T) {
+	mb := courier.NewMockBackend()
+	h := &pipeliningHandler{BaseHandler: NewBaseHandler(courier.ChannelType("AC"), "Test")}
+	h.SetServer(newServer(mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{})
+	receive := func(texts ...string) (int, string) {
+		msgs := make([]courier.Msg, len(texts))
+		for i, text := range texts {
+			msgs[i] = mb.NewIncomingMsg(channel, "tel:+250788383383", text)
+		}
+		w := httptest.NewRecorder()
+		_, err := WriteMsgsAndResponse(context.Background(), h, msgs, w, httptest.NewRequest(http.MethodPost, "/c/ac/receive", nil))
+		assert.NoError(t, err)
+		return w.Code, w.Body.String()
+	}
+
+	// messages go through the handler's filters as well as the default ones
+	_, body := receive("buy spam")
+	assert.Contains(t, body, "ignoring request, message is spam")
+	assert.Equal(t, 0, mb.LenQueuedMsgs())
+
+	// with only those it accepts going through its steps
+	code, _ := receive("buy spam", "hello")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, 1, mb.LenQueuedMsgs())
+	msg, err := mb.GetLastQueueMsg()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", msg.Text())
+}
+
+func TestShortenLinks(t *testing.T) {
+	tcs := []struct {
+		text      string
+		shortened string
+		err       string
+	}{
+		{"no links", "no links", ""},
+		{"visit https://example.com/some/long/path", "visit https://sho.rt/x", ""},
+		{"visit https://example.com/some/long/path, then http://example.org/another/long/path.", "visit https://sho.rt/x, then https://sho.rt/x.", ""},
+		{"(see https://example.com/some/long/path)", "(see https://sho.rt/x)", ""},
+		{"already short https://a.co", "already short https://a.co", ""},
+		{"https://example.com/fail/long/path and https://example.com/some/long/path", "https://example.com/fail/long/path and https://sho.rt/x", "unable to shorten https://example.com/fail/long/path"},
+	}
+
+	for _, tc := range tcs {
+		shortened, err := ShortenLinks(context.Background(), &staticShortener{}, tc.text)
+		assert.Equal(t, tc.shortened, shortened, "shortened mismatch for '%s'", tc.text)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+}
+
+func TestHTTPLinkShortener(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer sh-token" || string(body) != `{"url":"https://example.com/some/long/path"}` {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "bad request"}`))
+			return
+		}
+		w.Write([]byte(`{"short_url": "https://sho.rt/abc"}`))
+	}))
+	defer server.Close()
+
+	// channels without a shortener URL don't get a shortener
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVS", "2020", "BR", nil)
+	assert.Nil(t, LinkShortenerForChannel(channel))
+
+	channel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVS", "2020", "BR", map[string]interface{}{"link_shortener_url": server.URL, "link_shortener_token": "sh-token"})
+	shortener := LinkShortenerForChannel(channel)
+	assert.Equal(t, &HTTPLinkShortener{URL: server.URL, Token: "sh-token"}, shortener)
+
+	short, err := shortener.Shorten(context.Background(), "https://example.com/some/long/path")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sho.rt/abc", short)
+
+	_, err = shortener.Shorten(context.Background(), "https://example.com/other")
+	assert.EqualError(t, err, "error shortening link: received non 200 status: 400")
+}
+
+func TestTokensMatch(t *testing.T) {
+	assert.True(t, TokensMatch("sesame", "sesame"))
+	assert.False(t, TokensMatch("sesame", "sesam"))
+	assert.False(t, TokensMatch("sesame", "sesame2"))
+	assert.False(t, TokensMatch("sesame", ""))
+	assert.False(t, TokensMatch("", ""))
+}
+
+func TestSendMiddleware(t *testing.T) {
+	mb := courier.NewMockBackend()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"api_key": "123"})
+	msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "tel:+250788383383", "Hello", false, nil, "", 0, "")
+
+	var calls []string
+	recording := func(name string) SendMiddleware {
+		return func(next courier.SendFunc) courier.SendFunc {
+			return func(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+				calls = append(calls, name+" before")
+				status, err := next(ctx, msg)
+				calls = append(calls, name+" after")
+				return status, err
+			}
+		}
+	}
+	shortCircuit := func(next courier.SendFunc) courier.SendFunc {
+		return func(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+			calls = append(calls, "short circuit")
+			return nil, fmt.Errorf("not sending")
+		}
+	}
+	send := func(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+		calls = append(calls, "send")
+		return mb.NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgWired), nil
+	}
+
+	// without middleware, sends are made as they are
+	h := NewBaseHandler(courier.ChannelType("AC"), "Test")
+	status, err := h.WrapSend(send)(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"send"}, calls)
+
+	// middleware runs in the order it's added, the first wrapping all the others
+	calls = nil
+	h.UseSendMiddleware(recording("a"), recording("b"))
+	h.UseSendMiddleware(recording("c"))
+	status, err = h.WrapSend(send)(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"a before", "b before", "c before", "send", "c after", "b after", "a after"}, calls)
+
+	// and can short-circuit sends, which skips the send and any middleware after it
+	calls = nil
+	h = NewBaseHandler(courier.ChannelType("AC"), "Test")
+	h.UseSendMiddleware(recording("a"), shortCircuit, recording("b"))
+	status, err = h.WrapSend(send)(context.Background(), msg)
+	assert.EqualError(t, err, "not sending")
+	assert.Nil(t, status)
+	assert.Equal(t, []string{"a before", "short circuit", "a after"}, calls)
+
+	// like our middleware for required config does for channels without it
+	calls = nil
+	status, err = ChainSendMiddleware(send, RequireConfig("api_key"))(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"send"}, calls)
+
+	calls = nil
+	_, err = ChainSendMiddleware(send, RequireConfig("api_key", "secret"))(context.Background(), msg)
+	assert.EqualError(t, err, "missing secret for AC channel")
+	assert.Nil(t, calls)
+}
+
+func TestSendWithRetries(t *testing.T) {
+	mb := courier.NewMockBackend()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"max_retries": 2})
+
+	attempts := 0
+	failing := func(retryable bool) SendAttempt {
+		return func() (*courier.ChannelLog, bool, error) {
+			attempts++
+			return courier.NewChannelLog("Message Sent", channel, courier.NilMsgID, "POST", "http://example.com", 503, "", "", 0, nil), retryable, fmt.Errorf("attempt %d failed", attempts)
+		}
+	}
+
+	// retryable failures are retried until we exhaust our retries
+	status := mb.NewMsgStatusForID(channel, courier.NewMsgID(10), courier.MsgErrored)
+	err := SendWithRetries(context.Background(), channel, status, time.Millisecond, failing(true))
+	assert.EqualError(t, err, "attempt 3 failed")
+	assert.Equal(t, 3, len(status.Logs()))
+	assert.Equal(t, 3, status.Extra()["send_attempts"])
+	assert.Equal(t, "attempt 3 failed", status.Extra()["last_error"])
+
+	// other failures aren't retried
+	attempts = 0
+	status = mb.NewMsgStatusForID(channel, courier.NewMsgID(10), courier.MsgErrored)
+	err = SendWithRetries(context.Background(), channel, status, time.Millisecond, failing(false))
+	assert.EqualError(t, err, "attempt 1 failed")
+	assert.Equal(t, 1, status.Extra()["send_attempts"])
+
+	// successful sends don't record anything
+	status = mb.NewMsgStatusForID(channel, courier.NewMsgID(10), courier.MsgErrored)
+	err = SendWithRetries(context.Background(), channel, status, time.Millisecond, func() (*courier.ChannelLog, bool, error) { return nil, false, nil })
+	assert.NoError(t, err)
+	assert.Nil(t, status.Extra())
+
+	assert.True(t, IsRetryableResponse(nil))
+	assert.True(t, IsRetryableResponse(&utils.RequestResponse{StatusCode: 429}))
+	assert.True(t, IsRetryableResponse(&utils.RequestResponse{StatusCode: 502}))
+	assert.False(t, IsRetryableResponse(&utils.RequestResponse{StatusCode: 400}))
+}
+
+func TestSetSendResult(t *testing.T) {
+	mb := courier.NewMockBackend()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+
+	status := mb.NewMsgStatusForID(channel, courier.NewMsgID(10), courier.MsgWired)
+	SetSendResult(status, "ext1", time.Date(2022, 5, 24, 17, 30, 52, 478000000, time.FixedZone("", -3*60*60)))
+	assert.Equal(t, "ext1", status.ExternalID())
+	assert.Equal(t, "2022-05-24T20:30:52.478Z", status.Extra()[courier.MsgStatusExtraSentOn])
+
+	// missing values are left unset
+	status = mb.NewMsgStatusForID(channel, courier.NewMsgID(10), courier.MsgWired)
+	SetSendResult(status, "", time.Time{})
+	assert.Equal(t, "", status.ExternalID())
+	assert.Nil(t, status.Extra()[courier.MsgStatusExtraSentOn])
+}
+
+func TestHandleChallenge(t *testing.T) {
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"verify_token": "sesame"})
+
+	// a mock scheme which sends its challenge in headers
+	headerScheme := &ChallengeScheme{
+		TokenConfigKey: "verify_token",
+		ContentType:    "application/json",
+		Parse: func(r *http.Request) (string, string, bool) {
+			challenge := r.Header.Get("X-Challenge")
+			return r.Header.Get("X-Token"), fmt.Sprintf(`{"challenge":"%s"}`, challenge), challenge != ""
+		},
+	}
+
+	tcs := []struct {
+		scheme              *ChallengeScheme
+		method              string
+		url                 string
+		body                string
+		headers             map[string]string
+		expectedIsChallenge bool
+		expectedStatus      int
+		expectedResponse    string
+		expectedContentType string
+		expectedError       string
+	}{
+		{
+			scheme:              NewJSONChallengeScheme("verify_token", "type", "url_verification", "token", "challenge"),
+			method:              "POST",
+			body:                `{"type":"url_verification","token":"sesame","challenge":"abc123"}`,
+			expectedIsChallenge: true,
+			expectedStatus:      200,
+			expectedResponse:    "abc123",
+			expectedContentType: "text/plain",
+		},
+		{
+			scheme:              NewJSONChallengeScheme("verify_token", "type", "url_verification", "token", "challenge"),
+			method:              "POST",
+			body:                `{"type":"url_verification","token":"open","challenge":"abc123"}`,
+			expectedIsChallenge: true,
+			expectedStatus:      403,
+			expectedError:       "wrong verification token for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab",
+		},
+		{
+			scheme:              NewJSONChallengeScheme("verify_token", "type", "url_verification", "token", "challenge"),
+			method:              "POST",
+			body:                `{"type":"event_callback","token":"sesame"}`,
+			expectedIsChallenge: false,
+		},
+		{
+			scheme:              NewQueryChallengeScheme("verify_token", "hub.mode", "subscribe", "hub.verify_token", "hub.challenge"),
+			method:              "GET",
+			url:                 "?hub.mode=subscribe&hub.verify_token=sesame&hub.challenge=xyz789",
+			expectedIsChallenge: true,
+			expectedStatus:      200,
+			expectedResponse:    "xyz789",
+		},
+		{
+			scheme:              NewQueryChallengeScheme("verify_token", "hub.mode", "subscribe", "hub.verify_token", "hub.challenge"),
+			method:              "GET",
+			url:                 "?hub.mode=subscribe&hub.challenge=xyz789",
+			expectedIsChallenge: true,
+			expectedStatus:      403,
+			expectedError:       "wrong verification token for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab",
+		},
+		{
+			scheme:              headerScheme,
+			method:              "POST",
+			headers:             map[string]string{"X-Token": "sesame", "X-Challenge": "def456"},
+			expectedIsChallenge: true,
+			expectedStatus:      200,
+			expectedResponse:    `{"challenge":"def456"}`,
+			expectedContentType: "application/json",
+		},
+		{
+			scheme:              headerScheme,
+			method:              "POST",
+			body:                `{"text":"hello"}`,
+			expectedIsChallenge: false,
+		},
+	}
+
+	for _, tc := range tcs {
+		r := httptest.NewRequest(tc.method, "/receive"+tc.url, strings.NewReader(tc.body))
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+
+		isChallenge, err := HandleChallenge(channel, w, r, tc.scheme)
+		assert.Equal(t, tc.expectedIsChallenge, isChallenge, "is challenge mismatch for %s", tc.body+tc.url)
+		if tc.expectedError != "" {
+			assert.EqualError(t, err, tc.expectedError)
+		} else {
+			assert.NoError(t, err)
+		}
+
+		if tc.expectedIsChallenge {
+			assert.Equal(t, tc.expectedStatus, w.Code)
+			assert.Equal(t, tc.expectedResponse, w.Body.String())
+			if tc.expectedContentType != "" {
+				assert.Equal(t, tc.expectedContentType, w.Header().Get("Content-Type"))
+			}
+		} else {
+			// non-challenge requests are left untouched for the handler
+			body, _ := ReadBody(r, 1000)
+			assert.Equal(t, tc.body, string(body))
+			assert.Equal(t, 0, w.Body.Len())
+		}
+	}
+}
+
+func TestLimitAttachments(t *testing.T) {
+	attachments := []SizedAttachment{
+		{URL: "https://example.com/1.jpg", Size: 4000},
+		{URL: "https://example.com/2.jpg", Size: 7000},
+		{URL: "https://example.com/3.jpg", Size: 1000},
+	}
+
+	tcs := []struct {
+		config          map[string]interface{}
+		expectedKept    []string
+		expectedDropped bool
+	}{
+		{map[string]interface{}{}, []string{"https://example.com/1.jpg", "https://example.com/2.jpg", "https://example.com/3.jpg"}, false},
+		{map[string]interface{}{"max_attachments": 2}, []string{"https://example.com/1.jpg", "https://example.com/2.jpg"}, true},
+		{map[string]interface{}{"max_attachments_size": 12000}, []string{"https://example.com/1.jpg", "https://example.com/2.jpg", "https://example.com/3.jpg"}, false},
+		{map[string]interface{}{"max_attachments_size": 10000}, []string{"https://example.com/1.jpg", "https://example.com/3.jpg"}, true},
+		{map[string]interface{}{"max_attachments_size": 10000, "max_attachments": 1}, []string{"https://example.com/1.jpg"}, true},
+		{map[string]interface{}{"max_attachments_size": 10000, "attachment_limit_action": "reject"}, []string{}, true},
+		{map[string]interface{}{"max_attachments_size": 12000, "attachment_limit_action": "reject"}, []string{"https://example.com/1.jpg", "https://example.com/2.jpg", "https://example.com/3.jpg"}, false},
+	}
+
+	for _, tc := range tcs {
+		channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", tc.config)
+		kept, dropped := LimitAttachments(channel, attachments)
+		assert.Equal(t, tc.expectedKept, kept, "kept mismatch for config %v", tc.config)
+		assert.Equal(t, tc.expectedDropped, dropped, "dropped mismatch for config %v", tc.config)
+	}
+}
+
+func TestDownloadWithLimit(t *testing.T) {
+	defer func(chunkSize int) { DownloadChunkSize = chunkSize }(DownloadChunkSize)
+	DownloadChunkSize = 16
+
+	file := strings.Repeat("0123456789", 10)
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", nil)
+
+	var ranges, auths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		auths = append(auths, r.Header.Get("Authorization"))
+
+		switch r.URL.Path {
+		case "/ranged":
+			// supports range requests and tells us the total size
+			http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(file))
+		case "/ranged-unknown-size":
+			// supports range requests but doesn't know the total size
+			var start, end int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end)
+			if end >= len(file) {
+				end = len(file) - 1
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", start, end))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte(file[start : end+1]))
+		case "/stream":
+			// ignores ranges and streams a file much larger than our limit
+			w.WriteHeader(http.StatusOK)
+			for i := 0; i < 1000000; i++ {
+				if _, err := w.Write([]byte(file)); err != nil {
+					return
+				}
+			}
+		case "/sized":
+			// ignores ranges but tells us the size of a file much larger than our limit
+			w.Header().Set("Content-Length", strconv.Itoa(len(file)*1000000))
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(file))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	download := func(path string, maxSize int) ([]byte, *courier.ChannelLog, error) {
+		ranges = nil
+		return DownloadWithLimit(context.Background(), channel, courier.NewMsgID(10), server.URL+path, nil, maxSize, time.Second)
+	}
+
+	// files under the limit are downloaded in chunks
+	body, log, err := download("/ranged", 200)
+	assert.NoError(t, err)
+	assert.Equal(t, file, string(body))
+	assert.Equal(t, []string{"bytes=0-15", "bytes=16-31", "bytes=32-47", "bytes=48-63", "bytes=64-79", "bytes=80-95", "bytes=96-111"}, ranges)
+	assert.Equal(t, "", log.Error)
+
+	// if we know the total size, we give up after the first chunk
+	body, log, err = download("/ranged", 50)
+	assert.EqualError(t, err, "file is larger than the limit of 50 bytes")
+	assert.Nil(t, body)
+	assert.Equal(t, []string{"bytes=0-15"}, ranges)
+	assert.Equal(t, "file is larger than the limit of 50 bytes", log.Error)
+
+	// otherwise as soon as we've read past the limit
+	body, _, err = download("/ranged-unknown-size", 200)
+	assert.NoError(t, err)
+	assert.Equal(t, file, string(body))
+
+	_, _, err = download("/ranged-unknown-size", 50)
+	assert.EqualError(t, err, "file is larger than the limit of 50 bytes")
+	assert.Equal(t, []string{"bytes=0-15", "bytes=16-31", "bytes=32-47", "bytes=48-63"}, ranges)
+
+	// servers which ignore our ranges are read only up to the limit
+	start := time.Now()
+	_, _, err = download("/stream", 50)
+	assert.EqualError(t, err, "file is larger than the limit of 50 bytes")
+	assert.Equal(t, []string{"bytes=0-15"}, ranges)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// or not at all if they tell us the file's size
+	body, log, err = download("/sized", 50)
+	assert.EqualError(t, err, "file is larger than the limit of 50 bytes")
+	assert.Equal(t, &FileTooLargeError{MaxSize: 50}, err)
+	assert.Nil(t, body)
+	assert.Equal(t, "0 bytes", log.Response)
+	assert.Equal(t, "Attachment too large", log.Description)
+
+	_, log, err = download("/missing", 50)
+	assert.EqualError(t, err, "received non 200 status: 404")
+	assert.Equal(t, 404, log.StatusCode)
+
+	// every request is made with the headers we're given
+	auths = nil
+	_, _, err = DownloadWithLimit(context.Background(), channel, courier.NewMsgID(10), server.URL+"/ranged", http.Header{"Authorization": {"Bearer sesame"}}, 200, time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, auths, 7)
+	for _, auth := range auths {
+		assert.Equal(t, "Bearer sesame", auth)
+	}
+}
+
+func TestHandleEmoji(t *testing.T) {
+	tcs := []struct {
+		config   map[string]interface{}
+		text     string
+		expected string
+	}{
+		{map[string]interface{}{}, "Hello 👋 world", "Hello 👋 world"},
+		{map[string]interface{}{"emoji_handling": "keep"}, "Hello 👋 world :smile:", "Hello 👋 world :smile:"},
+
+		{map[string]interface{}{"emoji_handling": "strip"}, "Hello 👋 world", "Hello world"},
+		{map[string]interface{}{"emoji_handling": "strip"}, "👍🏽 sounds good ✅", "sounds good"},
+		{map[string]interface{}{"emoji_handling": "strip"}, "Family: 👨‍👩‍👧 from 🇧🇷!", "Family: from !"},
+		{map[string]interface{}{"emoji_handling": "strip"}, "I ❤️ it", "I it"},
+		{map[string]interface{}{"emoji_handling": "strip"}, "Nice :thumbsup::skin-tone-2: see you at 10:30", "Nice see you at 10:30"},
+		{map[string]interface{}{"emoji_handling": "strip"}, "No emoji here, café 123", "No emoji here, café 123"},
+		{map[string]interface{}{"emoji_handling": "strip"}, "😀😀😀", ""},
+
+		{map[string]interface{}{"emoji_handling": "replace"}, "Hello 👋 world", "Hello [emoji] world"},
+		{map[string]interface{}{"emoji_handling": "replace"}, "👍🏽👍🏽 ok", "[emoji][emoji] ok"},
+		{map[string]interface{}{"emoji_handling": "replace"}, "Family: 👨‍👩‍👧 from 🇧🇷!", "Family: [emoji] from [emoji]!"},
+		{map[string]interface{}{"emoji_handling": "replace"}, "Done :white_check_mark:", "Done [emoji]"},
+		{map[string]interface{}{"emoji_handling": "replace", "emoji_replacement": "<E>"}, "I ❤️ it", "I <E> it"},
+		{map[string]interface{}{"emoji_handling": "replace"}, "No emoji here, café 123", "No emoji here, café 123"},
+	}
+
+	for _, tc := range tcs {
+		channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", tc.config)
+		assert.Equal(t, tc.expected, HandleEmoji(channel, tc.text), "emoji mismatch for config %v and text %s", tc.config, tc.text)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	mb := courier.NewMockBackend()
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "AC", "2020", "US", map[string]interface{}{"emoji_handling": "replace"})
+	clock := utils.NewFakeClock(time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	newMsg := func(text string, receivedOn time.Time) courier.Msg {
+		return mb.NewIncomingMsg(channel, "tel:+250788383383", text).WithReceivedOn(receivedOn)
+	}
+
+	// individual steps
+	msg := newMsg("  Hello 👋\n", clock.Now())
+	NormalizeEmoji(context.Background(), msg)
+	assert.Equal(t, "  Hello [emoji]\n", msg.Text())
+
+	msg = newMsg("  Hello\n", clock.Now())
+	TrimWhitespace(context.Background(), msg)
+	assert.Equal(t, "Hello", msg.Text())
+
+	msg = newMsg("Hello", clock.Now().Add(time.Hour))
+	ClampReceivedOn(clock)(context.Background(), msg)
+	assert.Equal(t, clock.Now(), *msg.ReceivedOn())
+
+	msg = newMsg("Hello", clock.Now().Add(-time.Hour))
+	ClampReceivedOn(clock)(context.Background(), msg)
+	assert.Equal(t, clock.Now().Add(-time.Hour), *msg.ReceivedOn())
+
+	// steps are run in order, each seeing the result of the previous
+	var seen []string
+	record := func(ctx context.Context, msg courier.Msg) { seen = append(seen, msg.Text()) }
+
+	msg = newMsg(" 👋 Hello ", clock.Now().Add(time.Hour))
+	Normalize(context.Background(), msg, []NormalizeStep{record, NormalizeEmoji, record, TrimWhitespace, record, ClampReceivedOn(clock)})
+	assert.Equal(t, []string{" 👋 Hello ", " [emoji] Hello ", "[emoji] Hello"}, seen)
+	assert.Equal(t, "[emoji] Hello", msg.Text())
+	assert.Equal(t, clock.Now(), *msg.ReceivedOn())
+
+	// handlers without their own steps get the default ones
+	assert.Len(t, normalizeSteps(&BaseHandler{}), len(DefaultNormalizeSteps))
+}
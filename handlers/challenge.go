@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/buger/jsonparser"
+	"github.com/nyaruka/courier"
+)
+
+// ChallengeScheme declares how a provider verifies that a webhook URL is ours, by sending a challenge request with
+// a verification token that we must check before echoing back the challenge
+type ChallengeScheme struct {
+	// TokenConfigKey is the channel config key of the verification token the provider sends
+	TokenConfigKey string
+
+	// ContentType is the content type of our response, defaults to text/plain
+	ContentType string
+
+	// Parse returns the token and challenge of the passed in request, and whether it's a challenge request at all
+	Parse func(r *http.Request) (token string, challenge string, isChallenge bool)
+}
+
+// NewJSONChallengeScheme creates a new scheme for providers which POST a JSON challenge, identified by a type field
+// having the given value, e.g. Slack's {"type": "url_verification", "token": "...", "challenge": "..."}
+func NewJSONChallengeScheme(tokenConfigKey string, typeField string, typeValue string, tokenField string, challengeField string) *ChallengeScheme {
+	return &ChallengeScheme{
+		TokenConfigKey: tokenConfigKey,
+		Parse: func(r *http.Request) (string, string, bool) {
+			body, err := ReadBody(r, 100000)
+			if err != nil {
+				return "", "", false
+			}
+			if value, _ := jsonparser.GetString(body, typeField); value != typeValue {
+				return "", "", false
+			}
+			token, _ := jsonparser.GetString(body, tokenField)
+			challenge, _ := jsonparser.GetString(body, challengeField)
+			return token, challenge, true
+		},
+	}
+}
+
+// NewQueryChallengeScheme creates a new scheme for providers which send the challenge as query parameters, identified
+// by a mode parameter having the given value, e.g. Meta's ?hub.mode=subscribe&hub.verify_token=...&hub.challenge=...
+func NewQueryChallengeScheme(tokenConfigKey string, modeParam string, modeValue string, tokenParam string, challengeParam string) *ChallengeScheme {
+	return &ChallengeScheme{
+		TokenConfigKey: tokenConfigKey,
+		Parse: func(r *http.Request) (string, string, bool) {
+			query := r.URL.Query()
+			if query.Get(modeParam) != modeValue {
+				return "", "", false
+			}
+			return query.Get(tokenParam), query.Get(challengeParam), true
+		},
+	}
+}
+
+// HandleChallenge responds to the passed in request if it's a challenge of the passed in scheme, echoing back the
+// challenge if the token matches the channel's or responding with a 403 if not. It returns whether the request was a
+// challenge, in which case callers should stop processing it.
+func HandleChallenge(channel courier.Channel, w http.ResponseWriter, r *http.Request, scheme *ChallengeScheme) (bool, error) {
+	token, challenge, isChallenge := scheme.Parse(r)
+	if !isChallenge {
+		return false, nil
+	}
+
+	// we don't say why the token didn't match, as that would help guessing it
+	if !TokensMatch(channel.StringConfigForKey(scheme.TokenConfigKey, ""), token) {
+		w.WriteHeader(http.StatusForbidden)
+		return true, fmt.Errorf("wrong verification token for channel: %s", channel.UUID())
+	}
+
+	contentType := scheme.ContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte(challenge))
+	return true, err
+}
+
+// TokensMatch returns whether the passed in token matches the expected one, comparing them in constant time so that the
+// expected token can't be recovered by timing our responses. An empty expected token matches nothing.
+func TokensMatch(expected string, token string) bool {
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/utils"
+)
+
+// DownloadChunkSize is how many bytes we request at a time when downloading files with range requests
+var DownloadChunkSize = 4 << 20
+
+// content ranges look like bytes 0-1023/146515, the total being * if the server doesn't know it
+var contentRangeRegex = regexp.MustCompile(`^bytes \d+-\d+/(\d+|\*)$`)
+
+// FileTooLargeError is the error downloads of files larger than their limit fail with
+type FileTooLargeError struct {
+	MaxSize int
+}
+
+func (e *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file is larger than the limit of %d bytes", e.MaxSize)
+}
+
+// DownloadWithLimit downloads the file at the passed in URL in chunks using range requests, giving up as soon as we
+// know the file is larger than maxSize bytes rather than after downloading all of it. Servers which don't support range
+// requests send us the whole file instead, which we stop reading once it goes over the limit. Each request is sent with
+// the passed in headers, if any. The returned log records all the requests made, and the whole download is cancelled if
+// it takes longer than the channel's download timeout.
+func DownloadWithLimit(ctx context.Context, channel courier.Channel, msgID courier.MsgID, url string, header http.Header, maxSize int, defaultTimeout time.Duration) ([]byte, *courier.ChannelLog, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout(channel, "download", defaultTimeout))
+	defer cancel()
+
+	start := time.Now()
+	body := &bytes.Buffer{}
+	statusCode := 0
+
+	err := func() error {
+		for {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return err
+			}
+			for key, values := range header {
+				req.Header[key] = values
+			}
+			req.Header.Set("User-Agent", utils.HTTPUserAgent)
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", body.Len(), body.Len()+DownloadChunkSize-1))
+
+			resp, err := utils.GetHTTPClient().Do(req)
+			if err != nil {
+				return err
+			}
+			statusCode = resp.StatusCode
+			done, err := readChunk(resp, body, maxSize)
+			resp.Body.Close()
+
+			if err != nil || done {
+				return err
+			}
+		}
+	}()
+
+	log := courier.NewChannelLog("Fetching attachment", channel, msgID, http.MethodGet, url, statusCode, "", fmt.Sprintf("%d bytes", body.Len()), time.Since(start), nil)
+	if err != nil {
+		if _, tooLarge := err.(*FileTooLargeError); tooLarge {
+			log.WithError("Attachment too large", err)
+		} else {
+			log.WithError("error fetching media", err)
+		}
+		return nil, log, err
+	}
+	return body.Bytes(), log, nil
+}
+
+// readChunk reads the body of a range request response into the passed in buffer, returning whether we have the
+// whole file or an error if it's larger than maxSize bytes
+func readChunk(resp *http.Response, body *bytes.Buffer, maxSize int) (bool, error) {
+	tooLarge := &FileTooLargeError{MaxSize: maxSize}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// if the server tells us the total size we can check it before reading anything
+		var total int
+		if match := contentRangeRegex.FindStringSubmatch(resp.Header.Get("Content-Range")); match != nil && match[1] != "*" {
+			total, _ = strconv.Atoi(match[1])
+			if total > maxSize {
+				return false, tooLarge
+			}
+		}
+
+		n, err := io.Copy(body, io.LimitReader(resp.Body, int64(maxSize-body.Len()+1)))
+		if err != nil {
+			return false, err
+		}
+		if body.Len() > maxSize {
+			return false, tooLarge
+		}
+		return n < int64(DownloadChunkSize) || (total > 0 && body.Len() >= total), nil
+
+	case http.StatusOK:
+		// the server ignored our range so this is the whole file, which we can skip reading if it tells us its size
+		if resp.ContentLength > int64(maxSize) {
+			return false, tooLarge
+		}
+		body.Reset()
+		if _, err := io.Copy(body, io.LimitReader(resp.Body, int64(maxSize+1))); err != nil {
+			return false, err
+		}
+		if body.Len() > maxSize {
+			return false, tooLarge
+		}
+		return true, nil
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// we asked for a chunk past the end of a file whose size is a multiple of our chunk size
+		if body.Len() > 0 {
+			return true, nil
+		}
+	}
+
+	return false, fmt.Errorf("received non 200 status: %d", resp.StatusCode)
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/nyaruka/courier"
+)
+
+// values for what to do with emoji in the text of incoming messages
+const (
+	EmojiKeep    = "keep"
+	EmojiStrip   = "strip"
+	EmojiReplace = "replace"
+)
+
+// defaultEmojiReplacement is what emoji are replaced with if the channel doesn't configure its own token
+const defaultEmojiReplacement = "[emoji]"
+
+// shortcodes are how some providers like Slack send emoji, e.g. :smile: or :thumbsup::skin-tone-2:
+var emojiShortcodeRegex = regexp.MustCompile(`:[a-z0-9_+\-]*[a-z][a-z0-9_+\-]*:(:skin-tone-\d:)?`)
+
+const zeroWidthJoiner = '\u200d'
+
+// shortcodes are swapped for this before we look for emoji so that they are replaced in the same way
+const shortcodePlaceholder = '\uFFFC'
+
+// isEmoji returns whether the passed in rune starts an emoji
+func isEmoji(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) || // emoticons, pictographs, transport, flags and other symbols
+		(r >= 0x2600 && r <= 0x27BF) || // miscellaneous symbols and dingbats
+		(r >= 0x2B00 && r <= 0x2BFF) || // arrows and shapes like ⭐
+		(r >= 0x231A && r <= 0x23FF) // technical symbols like ⌚ and ⏰
+}
+
+// isEmojiModifier returns whether the passed in rune modifies the emoji before it, e.g. a skin tone
+func isEmojiModifier(r rune) bool {
+	return r == 0xFE0E || r == 0xFE0F || // variation selectors
+		(r >= 0x1F3FB && r <= 0x1F3FF) || // skin tones
+		r == 0x20E3 || // keycap
+		(r >= 0xE0020 && r <= 0xE007F) // tags used by subdivision flags
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// ReplaceEmoji replaces each emoji in the passed in text, including emoji shortcodes, with the passed in replacement.
+// Sequences like flags, skin tones and joined emoji count as a single emoji. If the replacement is empty, the emoji
+// are stripped along with any space left doubled by removing them.
+func ReplaceEmoji(text string, replacement string) string {
+	text = emojiShortcodeRegex.ReplaceAllString(text, string(shortcodePlaceholder))
+
+	runes := []rune(text)
+	var b strings.Builder
+	replaced := false
+	last := ' '
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		// modifiers without an emoji before them are invisible so can just be dropped
+		if isEmojiModifier(r) || r == zeroWidthJoiner {
+			continue
+		}
+		if !isEmoji(r) && r != shortcodePlaceholder {
+			b.WriteRune(r)
+			last = r
+			continue
+		}
+
+		// find the end of this emoji's sequence
+		j := i + 1
+		if isRegionalIndicator(r) && j < len(runes) && isRegionalIndicator(runes[j]) {
+			j++
+		}
+		for j < len(runes) {
+			if isEmojiModifier(runes[j]) {
+				j++
+			} else if runes[j] == zeroWidthJoiner && j+1 < len(runes) && isEmoji(runes[j+1]) {
+				j += 2
+			} else {
+				break
+			}
+		}
+
+		if replacement == "" {
+			// avoid leaving behind two spaces where there was one either side of the emoji
+			if unicode.IsSpace(last) && j < len(runes) && unicode.IsSpace(runes[j]) {
+				j++
+			}
+		}
+
+		b.WriteString(replacement)
+		replaced = true
+		i = j - 1
+	}
+
+	if replaced && replacement == "" {
+		return strings.TrimSpace(b.String())
+	}
+	return b.String()
+}
+
+// HandleEmoji returns the passed in text of an incoming message with its emoji handled as configured on the channel
+func HandleEmoji(channel courier.Channel, text string) string {
+	switch channel.StringConfigForKey(courier.ConfigEmojiHandling, EmojiKeep) {
+	case EmojiStrip:
+		return ReplaceEmoji(text, "")
+	case EmojiReplace:
+		return ReplaceEmoji(text, channel.StringConfigForKey(courier.ConfigEmojiReplacement, defaultEmojiReplacement))
+	}
+	return text
+}
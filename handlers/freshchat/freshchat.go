@@ -19,6 +19,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/buger/jsonparser"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
 	"github.com/nyaruka/courier/utils"
@@ -82,6 +83,7 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 	}
 	text := ""
 	mediaURL := ""
+	unsupported := ""
 	// our text is either "text" or "image"
 	for _, data := range payload.Data.Message.MessageParts {
 		if data.Text != nil {
@@ -90,9 +92,27 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 		if data.Image != nil {
 			mediaURL = string(data.Image.URL)
 		}
+		if data.unsupported != "" {
+			unsupported = data.unsupported
+		}
+	}
+
+	// if there's nothing we support, deliver a placeholder that flows can still respond to
+	var metadata map[string]interface{}
+	if text == "" && mediaURL == "" && unsupported != "" {
+		courier.LogRequestError(r, channel, fmt.Errorf("unsupported message part %s", unsupported))
+		text, metadata = handlers.UnsupportedContent(unsupported)
 	}
+
 	// build our msg
 	msg := h.Backend().NewIncomingMsg(channel, urn, text).WithReceivedOn(date)
+	if metadata != nil {
+		metadataJSON, err := json.Marshal(metadata)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		msg.WithMetadata(metadataJSON)
+	}
 
 	//add image
 	if mediaURL != "" {
@@ -159,24 +179,36 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(jsonBody))
-
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
+	// retry sends which fail in ways worth retrying, backing off between attempts
+	var rr *utils.RequestResponse
+	err = handlers.SendWithRetries(ctx, msg.Channel(), status, h.RetryBackoff(), func() (*courier.ChannelLog, bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, false, err
+		}
+		req.Header.Set("Content-Type", "application/json")
 
-	var bearer = "Bearer " + authToken
-	req.Header.Set("Authorization", bearer)
+		var bearer = "Bearer " + authToken
+		req.Header.Set("Authorization", bearer)
 
-	rr, err := utils.MakeHTTPRequest(req)
+		rr, err = utils.MakeHTTPRequest(req)
 
-	// record our status and log
-	log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
-	status.AddLog(log)
+		// record our log
+		log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
+		return log, handlers.IsRetryableResponse(rr), err
+	})
 	if err != nil {
 		return status, err
 	}
+
+	// FreshChat returns the conversation with the message we added, which has its id and when it was created
+	externalID, _ := jsonparser.GetString(rr.Body, "messages", "[0]", "id")
+	var sentOn time.Time
+	if createdTime, _ := jsonparser.GetString(rr.Body, "messages", "[0]", "created_time"); createdTime != "" {
+		sentOn, _ = time.Parse(time.RFC3339, createdTime)
+	}
+	handlers.SetSendResult(status, externalID, sentOn)
+
 	status.SetStatus(courier.MsgWired)
 
 	return status, nil
@@ -265,7 +297,29 @@ type Text struct {
 type MessageParts struct {
 	Text  *Text  `json:"text,omitempty"`
 	Image *Image `json:"image,omitempty"`
+
+	unsupported string
+}
+
+// UnmarshalJSON unmarshals a message part, noting its type if it's one we don't support
+func (p *MessageParts) UnmarshalJSON(data []byte) error {
+	type part MessageParts
+	if err := json.Unmarshal(data, (*part)(p)); err != nil {
+		return err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	for field := range fields {
+		if field != "text" && field != "image" {
+			p.unsupported = field
+		}
+	}
+	return nil
 }
+
 type Message struct {
 	MessageParts   []MessageParts `json:"message_parts"`
 	AppID          string         `json:"app_id"`
@@ -1,12 +1,16 @@
 package freshchat
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/courier"
 	. "github.com/nyaruka/courier/handlers"
+	"github.com/stretchr/testify/assert"
 )
 
 var testChannels = []courier.Channel{
@@ -28,6 +32,8 @@ var (
 	invalidSignature = `f7wMD1BBhcj60U0z3dCY519qmxQ8qfVUU212Dapw9vpZfRBfjjmukUK2GwbAb0Nc+TGQHxN4iP4WD+Y/mSx6f4bmkBsvCy3l4OCQ/FEK0y5R7f+GLLDhgbTh90MwuLDHhvxB5dxIeu59leL+4yO+l/8M3Tm48aQurVBi9IAlzFsMtc1S1CiRxsDUb/rD6IRekPa0pUAbkno9qJ/CGXh0kZMdsYzRkzZmKCs79OWrvU94ha0ptyt5wArfmD1oSzY3PjeL2w8LWDc0QV21H/Hvj42azIUqebiNRtZ2E+f34AfQsyfcPuy1k/6qLuYGOdU1uZidPuPcGpeSIm0GW6k9HQ==`
 	invalidURN       = `{"actor":{"actor_type":"user","actor_id":"c0534ff79-8853-11cedfc1f35b"},"action":"message_create","action_time":"2019-06-21T14:21:35.042Z","data":{"message":{"message_parts":[{"text":{"content":"test"}}],"app_id":"55b190fa-5d3c-45c4-bc49-74ddcfcf53d7","actor_id":"c0534f78-b6e9-4f79-8853-11cedfc1f35b","id":"3fce6f90-a01a-44a9-8ab1-8feea6ebc95b","channel_id":"c8fddfaf-622a-4a0e-b060-4f3ccbeab606","conversation_id":"c327498e-f713-481e-8d83-0603e03d2521","message_type":"normal","actor_type":"user","created_time":"2019-06-21T14:21:35Z"}}}`
 )
+var unsupportedReceive = `{"actor":{"actor_type":"user","actor_id":"882f3926-b292-414b-a411-96380db373cd"},"action":"message_create","action_time":"2019-06-21T17:43:20.875Z","data":{"message":{"message_parts":[{"file":{"name":"report.pdf","url":"https://foo.bar/report.pdf"}}],"app_id":"55b190fa-5d3c-45c4-bc49-74ddcfcf53d7","actor_id":"882f3926-b292-414b-a411-96380db373cd","id":"7a454fde-c720-4c97-a61d-0ffe70449eb6","channel_id":"c8fddfaf-622a-4a0e-b060-4f3ccbeab606","conversation_id":"c327498e-f713-481e-8d83-0603e03d2521","message_type":"normal","actor_type":"user","created_time":"2019-06-21T17:43:20.866Z"}}}`
+
 var sigtestCases = []ChannelHandleTestCase{
 	{Label: "Receive Valid w Signature",
 		Headers: map[string]string{
@@ -51,6 +57,13 @@ var testCases = []ChannelHandleTestCase{
 		URL: receiveURL, Data: validReceive, Status: 200, Response: "Message Accepted",
 		Text: Sp("Test 2"), URN: Sp("freshchat:c8fddfaf-622a-4a0e-b060-4f3ccbeab606/882f3926-b292-414b-a411-96380db373cd"), Date: Tp(time.Date(2019, 6, 21, 17, 43, 20, 866000000, time.UTC))},
 
+	{Label: "Receive Unsupported Part",
+		Headers: map[string]string{
+			"Content-Type": "application/json"},
+		URL: receiveURL, Data: unsupportedReceive, Status: 200, Response: "Message Accepted",
+		Text: Sp("[unsupported: file]"), URN: Sp("freshchat:c8fddfaf-622a-4a0e-b060-4f3ccbeab606/882f3926-b292-414b-a411-96380db373cd"), Date: Tp(time.Date(2019, 6, 21, 17, 43, 20, 866000000, time.UTC)),
+		Metadata: json.RawMessage(`{"unsupported_type": "file"}`)},
+
 	{Label: "Bad JSON",
 		Headers: map[string]string{
 			"Content-Type":          "application/json",
@@ -77,8 +90,9 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		Text:           "Simple Message ☺",
 		URN:            "freshchat:0534f78-b6e9-4f79-8853-11cedfc1f35b/c8fddfaf-622a-4a0e-b060-4f3ccbeab606",
 		Status:         "W",
-		ExternalID:     "",
-		ResponseBody:   "",
+		ExternalID:     "6b1d8a4c-8c36-4c55-a4b5-3a1fe0a1d1e9",
+		SentOn:         "2022-05-24T17:30:52.478Z",
+		ResponseBody:   `{"conversation_id":"f2b1a0b8-2b6a-4c4e-8c1e-1b0e6e1d3a4f","messages":[{"id":"6b1d8a4c-8c36-4c55-a4b5-3a1fe0a1d1e9","created_time":"2022-05-24T17:30:52.478Z"}]}`,
 		ResponseStatus: 200,
 		Headers: map[string]string{
 			"Content-Type":  "application/json",
@@ -126,3 +140,47 @@ func TestSending(t *testing.T) {
 	})
 	RunChannelSendTestCases(t, defaultChannel, newHandler("FC", "FreshChat", false), defaultSendTestCases, nil)
 }
+
+func TestSendRetries(t *testing.T) {
+	attempts := 0
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= failures {
+			w.WriteHeader(503)
+			w.Write([]byte(`{"message": "Service Unavailable"}`))
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"messages":[{"id":"6b1d8a4c-8c36-4c55-a4b5-3a1fe0a1d1e9"}]}`))
+	}))
+	defer server.Close()
+
+	defer func(url string) { apiURL = url }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler("FC", "FreshChat", false)
+	h.(*handler).SetRetryBackoff(time.Millisecond)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "FC", "2020", "US", map[string]interface{}{"username": "c8fddfaf-622a-4a0e-b060-4f3ccbeab606", "auth_token": "authtoken", "max_retries": 3})
+	msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "freshchat:0534f78-b6e9-4f79-8853-11cedfc1f35b/c8fddfaf-622a-4a0e-b060-4f3ccbeab606", "Simple Message", false, nil, "", 0, "")
+
+	// a send which succeeds after a retry is wired with both attempts logged
+	failures = 1
+	status, err := h.SendMsg(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "6b1d8a4c-8c36-4c55-a4b5-3a1fe0a1d1e9", status.ExternalID())
+	assert.Equal(t, []string{"Message Send Error", "Message Sent"}, LogDescriptions(status.Logs()))
+
+	// a send which fails every attempt records how many attempts were made and the last error
+	attempts = 0
+	failures = 10
+	status, err = h.SendMsg(context.Background(), msg)
+	assert.EqualError(t, err, "received non 200 status: 503")
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, 4, attempts)
+	assert.Equal(t, 4, status.Extra()["send_attempts"])
+}
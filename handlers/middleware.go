@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nyaruka/courier"
+)
+
+// SendMiddleware wraps sends with behavior of its own, e.g. rate limiting or metrics. It continues a send by calling
+// the next func, or short-circuits it by returning without doing so.
+type SendMiddleware func(next courier.SendFunc) courier.SendFunc
+
+// ChainSendMiddleware returns the passed in send wrapped in the passed in middleware, the first being the outermost so
+// that middleware runs in the order it is passed in
+func ChainSendMiddleware(send courier.SendFunc, middleware ...SendMiddleware) courier.SendFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		send = middleware[i](send)
+	}
+	return send
+}
+
+// RequireConfig returns middleware which errors sends on channels missing any of the passed in config keys, without
+// making them
+func RequireConfig(keys ...string) SendMiddleware {
+	return func(next courier.SendFunc) courier.SendFunc {
+		return func(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+			for _, key := range keys {
+				if msg.Channel().StringConfigForKey(key, "") == "" {
+					return nil, fmt.Errorf("missing %s for %s channel", key, msg.Channel().ChannelType())
+				}
+			}
+			return next(ctx, msg)
+		}
+	}
+}
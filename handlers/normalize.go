@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/utils"
+)
+
+// NormalizeStep is a step incoming messages go through before we write them, e.g. to tidy up their text
+type NormalizeStep func(ctx context.Context, msg courier.Msg)
+
+// InboundNormalizer is the interface handlers which normalize their incoming messages with their own list of steps
+// should satisfy, otherwise their messages go through the default steps
+type InboundNormalizer interface {
+	NormalizeSteps() []NormalizeStep
+}
+
+// DefaultNormalizeSteps are the steps incoming messages go through for handlers without their own
+var DefaultNormalizeSteps = []NormalizeStep{NormalizeEmoji}
+
+// Normalize runs the passed in message through the passed in steps in order
+func Normalize(ctx context.Context, msg courier.Msg, steps []NormalizeStep) {
+	for _, step := range steps {
+		step(ctx, msg)
+	}
+}
+
+// NormalizeEmoji strips or replaces the emoji in the text of the passed in message as configured on its channel
+func NormalizeEmoji(ctx context.Context, msg courier.Msg) {
+	if text := HandleEmoji(msg.Channel(), msg.Text()); text != msg.Text() {
+		msg.WithText(text)
+	}
+}
+
+// TrimWhitespace removes leading and trailing whitespace from the text of the passed in message
+func TrimWhitespace(ctx context.Context, msg courier.Msg) {
+	if text := strings.TrimSpace(msg.Text()); text != msg.Text() {
+		msg.WithText(text)
+	}
+}
+
+// ClampReceivedOn returns a step which replaces a received on in the future, which providers with clocks ahead of ours
+// can give us, with the current time of the passed in clock
+func ClampReceivedOn(clock utils.Clock) NormalizeStep {
+	return func(ctx context.Context, msg courier.Msg) {
+		if now := clock.Now(); msg.ReceivedOn() != nil && msg.ReceivedOn().After(now) {
+			msg.WithReceivedOn(now)
+		}
+	}
+}
+
+// normalizeSteps returns the steps incoming messages of the passed in handler go through
+func normalizeSteps(h ResponseWriter) []NormalizeStep {
+	if normalizer, isNormalizer := h.(InboundNormalizer); isNormalizer {
+		return normalizer.NormalizeSteps()
+	}
+	return DefaultNormalizeSteps
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/sirupsen/logrus"
+)
+
+// ReceiveFilter decides whether an incoming message is accepted, returning why not if it isn't. Requests none of whose
+// messages are accepted are ignored.
+type ReceiveFilter func(r *http.Request, msg courier.Msg) (bool, string)
+
+// ReceiveStep is a step accepted incoming messages go through to be written. Returning false stops the message going any
+// further though it is still acknowledged, e.g. because we've already received it, while an error fails the request.
+type ReceiveStep func(ctx context.Context, h ResponseWriter, r *http.Request, msg courier.Msg) (bool, error)
+
+// ReceivePipeline is the filters and steps incoming messages go through, in order, to be written
+type ReceivePipeline struct {
+	Filters []ReceiveFilter
+	Steps   []ReceiveStep
+}
+
+// ReceivePipeliner is the interface handlers which receive incoming messages through their own pipeline should
+// satisfy, otherwise their messages go through the default pipeline
+type ReceivePipeliner interface {
+	ReceivePipeline() ReceivePipeline
+}
+
+// DefaultReceivePipeline is the pipeline incoming messages go through for handlers without their own
+var DefaultReceivePipeline = ReceivePipeline{
+	Filters: []ReceiveFilter{FilterAllowedSenders, FilterInbound},
+	Steps:   []ReceiveStep{SkipRedelivered, RewriteAttachments, NormalizeMsg, WriteMsg, NotifyProcessing},
+}
+
+// Accepts returns whether the passed in message passes all of our filters, and why not if it doesn't
+func (p ReceivePipeline) Accepts(r *http.Request, msg courier.Msg) (bool, string) {
+	for _, filter := range p.Filters {
+		if accepted, reason := filter(r, msg); !accepted {
+			return false, reason
+		}
+	}
+	return true, ""
+}
+
+// Receive runs the passed in accepted message through our steps
+func (p ReceivePipeline) Receive(ctx context.Context, h ResponseWriter, r *http.Request, msg courier.Msg) error {
+	for _, step := range p.Steps {
+		next, err := step(ctx, h, r, msg)
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
+
+// FilterAllowedSenders doesn't accept messages from senders not on the allowlist of the channel
+func FilterAllowedSenders(r *http.Request, msg courier.Msg) (bool, string) {
+	if !IsSenderAllowed(msg.Channel(), msg.URN()) {
+		courier.LogRequestIgnored(r, msg.Channel(), fmt.Sprintf("ignoring message from sender not on allowlist: %s", msg.URN().Identity()))
+		return false, "sender not on allowlist"
+	}
+	return true, ""
+}
+
+// FilterInbound doesn't accept messages which don't match the inbound filter of the channel
+func FilterInbound(r *http.Request, msg courier.Msg) (bool, string) {
+	matches, err := MatchesInboundFilter(msg.Channel(), msg.Text())
+	if err != nil {
+		courier.LogRequestError(r, msg.Channel(), err)
+	}
+	if !matches {
+		courier.LogRequestIgnored(r, msg.Channel(), fmt.Sprintf("ignoring message not matching inbound filter from: %s", msg.URN().Identity()))
+		return false, "message doesn't match inbound filter"
+	}
+	return true, ""
+}
+
+// SkipRedelivered acknowledges messages that channels which dedup by external ID have already received without
+// writing them again
+func SkipRedelivered(ctx context.Context, h ResponseWriter, r *http.Request, msg courier.Msg) (bool, error) {
+	nonce := dedupNonce(msg)
+	if nonce == "" {
+		return true, nil
+	}
+
+	claimed, err := dedupNonceStore(h).Claim(ctx, nonce, dedupTTL(msg.Channel()))
+	if err != nil {
+		courier.LogRequestError(r, msg.Channel(), fmt.Errorf("error checking for redelivered message: %s", err))
+		return true, nil
+	}
+	if !claimed {
+		courier.LogRequestIgnored(r, msg.Channel(), fmt.Sprintf("ignoring redelivered message with external id: %s", msg.ExternalID()))
+		return false, nil
+	}
+	return true, nil
+}
+
+// RewriteAttachments applies the channel's attachment URL rewrite to the attachments of the passed in message,
+// leaving any attachment that can't be rewritten as it was
+func RewriteAttachments(ctx context.Context, h ResponseWriter, r *http.Request, msg courier.Msg) (bool, error) {
+	if len(msg.Attachments()) == 0 {
+		return true, nil
+	}
+
+	attachments := make([]string, len(msg.Attachments()))
+	for i, attachment := range msg.Attachments() {
+		rewritten, err := RewriteAttachmentURL(msg.Channel(), attachment)
+		if err != nil {
+			courier.LogRequestError(r, msg.Channel(), err)
+		}
+		attachments[i] = rewritten
+	}
+	msg.WithAttachments(attachments)
+	return true, nil
+}
+
+// NormalizeMsg runs the passed in message through the normalize steps of the handler
+func NormalizeMsg(ctx context.Context, h ResponseWriter, r *http.Request, msg courier.Msg) (bool, error) {
+	Normalize(ctx, msg, normalizeSteps(h))
+	return true, nil
+}
+
+// WriteMsg writes the passed in message to our backend, forgetting its external ID if it's deduped by it so that a
+// redelivery of it is written then
+func WriteMsg(ctx context.Context, h ResponseWriter, r *http.Request, msg courier.Msg) (bool, error) {
+	if err := h.Backend().WriteMsg(ctx, msg); err != nil {
+		if nonce := dedupNonce(msg); nonce != "" {
+			dedupNonceStore(h).Release(ctx, nonce)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// NotifyProcessing lets the contact of the passed in message know it is being processed, if the handler supports it,
+// the channel has it enabled and the message is new rather than one the backend had already written. This happens in
+// the background so as not to delay our response, but is tracked by the server so that it completes before the server
+// stops.
+func NotifyProcessing(ctx context.Context, h ResponseWriter, r *http.Request, msg courier.Msg) (bool, error) {
+	notifier, isNotifier := h.(courier.ProcessingNotifier)
+	if !isNotifier || msg.AlreadyWritten() || !msg.Channel().BoolConfigForKey(courier.ConfigProcessingNotifications, false) {
+		return true, nil
+	}
+
+	waitGroup := h.Server().WaitGroup()
+	waitGroup.Add(1)
+
+	go func() {
+		defer waitGroup.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		logs, err := notifier.NotifyProcessing(ctx, msg)
+		if err != nil {
+			logrus.WithField("channel_uuid", msg.Channel().UUID()).WithError(err).Error("error notifying contact of message processing")
+		}
+		if len(logs) > 0 {
+			h.Backend().WriteChannelLogs(ctx, logs)
+		}
+	}()
+	return true, nil
+}
+
+// receivePipeline returns the pipeline incoming messages of the passed in handler go through
+func receivePipeline(h ResponseWriter) ReceivePipeline {
+	if pipeliner, isPipeliner := h.(ReceivePipeliner); isPipeliner {
+		return pipeliner.ReceivePipeline()
+	}
+	return DefaultReceivePipeline
+}
+
+// defaultDedupTTL is how long channels which dedup incoming messages remember their external IDs for by default, which
+// is longer than providers keep redelivering messages for
+const defaultDedupTTL = 24 * time.Hour
+
+// dedupNonce returns the nonce the passed in message is deduped by, or "" if its channel doesn't dedup or it has no
+// external ID to dedup it by
+func dedupNonce(m courier.Msg) string {
+	if m.ExternalID() == "" || !m.Channel().BoolConfigForKey(courier.ConfigDedupExternalIDs, false) {
+		return ""
+	}
+	return fmt.Sprintf("externalid:%s:%s", m.Channel().UUID(), m.ExternalID())
+}
+
+// dedupTTL returns how long the passed in channel remembers the external IDs of incoming messages for
+func dedupTTL(channel courier.Channel) time.Duration {
+	if ttl := channel.IntConfigForKey(courier.ConfigDedupTTL, 0); ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return defaultDedupTTL
+}
+
+// dedupNonceStore returns where the external IDs of incoming messages are remembered for the passed in handler
+func dedupNonceStore(h ResponseWriter) courier.NonceStore {
+	return courier.GetNonceStore(courier.NewRedisNonceStore(h.Backend().RedisPool()))
+}
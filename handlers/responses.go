@@ -9,6 +9,7 @@ import (
 
 // ResponseWriter interace with response methods for success responses
 type ResponseWriter interface {
+	Server() courier.Server
 	Backend() courier.Backend
 	WriteStatusSuccessResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, statuses []courier.MsgStatus) error
 	WriteMsgSuccessResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, msgs []courier.Msg) error
@@ -18,16 +19,32 @@ type ResponseWriter interface {
 
 // WriteMsgsAndResponse writes the passed in message to our backend
 func WriteMsgsAndResponse(ctx context.Context, h ResponseWriter, msgs []courier.Msg, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
-	events := make([]courier.Event, len(msgs), len(msgs))
-	for i, m := range msgs {
-		err := h.Backend().WriteMsg(ctx, m)
-		if err != nil {
-			return nil, err
+	pipeline := receivePipeline(h)
+
+	// drop any messages the pipeline doesn't accept, ignoring the request if that's all of them
+	accepted := make([]courier.Msg, 0, len(msgs))
+	ignoredReason := ""
+	for _, m := range msgs {
+		if ok, reason := pipeline.Accepts(r, m); ok {
+			accepted = append(accepted, m)
+		} else {
+			ignoredReason = reason
 		}
+	}
+	if len(msgs) > 0 && len(accepted) == 0 {
+		return nil, h.WriteRequestIgnored(ctx, w, r, "ignoring request, "+ignoredReason)
+	}
+
+	events := make([]courier.Event, len(accepted), len(accepted))
+	for i, m := range accepted {
 		events[i] = m
+
+		if err := pipeline.Receive(ctx, h, r, m); err != nil {
+			return nil, err
+		}
 	}
 
-	return events, h.WriteMsgSuccessResponse(ctx, w, r, msgs)
+	return events, h.WriteMsgSuccessResponse(ctx, w, r, accepted)
 }
 
 // WriteMsgStatusAndResponse write the passed in status to our backend
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/utils"
+)
+
+// LinkShortener is the interface services which shorten the links in outgoing messages should satisfy
+type LinkShortener interface {
+	Shorten(ctx context.Context, link string) (string, error)
+}
+
+// matches http and https links up to the next whitespace or delimiter
+var linkRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// punctuation which ends a sentence rather than the link it follows
+const linkTrailingPunctuation = `.,;:!?)]}'`
+
+// ShortenLinks returns the passed in text with its links replaced by shortened versions. Links which can't be shortened
+// or whose shortened versions aren't actually shorter are left as they are, the first error encountered being returned
+// along with the text.
+func ShortenLinks(ctx context.Context, shortener LinkShortener, text string) (string, error) {
+	var firstErr error
+
+	shortened := linkRegex.ReplaceAllStringFunc(text, func(match string) string {
+		link := strings.TrimRight(match, linkTrailingPunctuation)
+		trailing := match[len(link):]
+
+		short, err := shortener.Shorten(ctx, link)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return match
+		}
+		if short == "" || len(short) >= len(link) {
+			return match
+		}
+		return short + trailing
+	})
+
+	return shortened, firstErr
+}
+
+// LinkShortenerForChannel returns the shortener configured for the passed in channel, or nil if it doesn't have one
+func LinkShortenerForChannel(channel courier.Channel) LinkShortener {
+	url := channel.StringConfigForKey(courier.ConfigLinkShortenerURL, "")
+	if url == "" {
+		return nil
+	}
+	return &HTTPLinkShortener{URL: url, Token: channel.StringConfigForKey(courier.ConfigLinkShortenerToken, "")}
+}
+
+// HTTPLinkShortener shortens links by posting them as {"url": "..."} to a shortener service which responds with
+// {"short_url": "..."}
+type HTTPLinkShortener struct {
+	URL   string
+	Token string
+}
+
+// Shorten returns the shortened version of the passed in link
+func (s *HTTPLinkShortener) Shorten(ctx context.Context, link string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"url": link})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.Token))
+	}
+
+	rr, err := utils.MakeHTTPRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("error shortening link: %w", err)
+	}
+
+	short, err := jsonparser.GetString(rr.Body, "short_url")
+	if err != nil {
+		return "", fmt.Errorf("unable to get short_url from shortener response")
+	}
+	return short, nil
+}
@@ -3,28 +3,128 @@ package slack
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/buger/jsonparser"
+	"github.com/gofrs/uuid"
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
 	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/gocommon/urns"
+	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
-var apiURL = "https://slack.com/api"
+var (
+	// apiURL is the base URL of the Slack API for channels which don't configure their own
+	apiURL            = "https://slack.com/api"
+	responseURLPrefix = "https://hooks.slack.com/"
+)
+
+const (
+	configBotToken         = "bot_token"
+	configUserToken        = "user_token"
+	configSendAsUser       = "send_as_user"
+	configValidationToken  = "verification_token"
+	configSigningSecret    = "signing_secret"
+	configThreadOnLatest   = "thread_on_latest"
+	configLinkDisplay      = "link_display"
+	configUnfurlLinks      = "unfurl_links"
+	configUnfurlMedia      = "unfurl_media"
+	configMaxFileSize      = "max_file_size"
+	configThumbnails       = "thumbnails"
+	configThumbnailOnly    = "thumbnail_only_size"
+	configCheckMembership  = "check_membership"
+	configPlaceholder      = "placeholder_attachment"
+	configForwardReactions = "forward_reactions"
+	configLegacyFileUpload = "legacy_file_upload"
+	configReplyInThread    = "reply_in_thread"
+	configThreadContext    = "thread_context"
+	configBotUsername      = "bot_username"
+	configBotIconEmoji     = "bot_icon_emoji"
+	configBotIconURL       = "bot_icon_url"
+	configIgnoredBots      = "ignored_bot_ids"
+	configCodeSnippets     = "code_snippets"
+
+	configMessagesPerSecond = "messages_per_second"
+
+	configChannelNameExpiration = "channel_name_expiration"
+
+	configMaxRequestAge = "max_request_age"
+
+	configAPIBaseURL = "api_base_url"
+
+	configChannelUserURNs = "channel_user_urns"
+)
+
+// defaultMaxFileSize is the largest file in bytes we will download, either to upload it to Slack or to re-host it from
+// Slack, if the channel doesn't configure its own limit
+const defaultMaxFileSize = 50 << 20
+
+// values for how links in sent messages are displayed, compact meaning without unfurled previews
+const (
+	linkDisplayCompact  = "compact"
+	linkDisplayExpanded = "expanded"
+)
+
+// values for the response_type of slash command responses, ephemeral meaning only visible to the user who ran the command
+const (
+	responseTypeEphemeral = "ephemeral"
+	responseTypeInChannel = "in_channel"
+)
 
+// targetHome is the message metadata target for publishing to the app home tab rather than a conversation
+const targetHome = "home"
+
+// targetPresence is the message metadata target for setting the presence of the bot user, to one of the presence
+// values below given as the metadata presence, rather than sending to a conversation
+const targetPresence = "presence"
+
+// values for the presence of the bot user, auto meaning it's active when connected
 const (
-	configBotToken        = "bot_token"
-	configUserToken       = "user_token"
-	configValidationToken = "verification_token"
+	presenceAuto = "auto"
+	presenceAway = "away"
+)
+
+// targetWorkflowStep is the message metadata target for reporting the outcome of a Workflow Builder step, whose execute
+// id is given as the metadata workflow_step_execute_id or is what the message is a response to, rather than sending to
+// a conversation. Steps are failed with the metadata error if there is one, otherwise completed with the metadata outputs.
+const targetWorkflowStep = "workflow_step"
+
+// maxMsgLength is the longest text in bytes we post to Slack in one message, longer text being split into several. Slack
+// rejects text over 40000 characters and truncates long messages in its clients.
+const maxMsgLength = 40000
+
+// maxSectionLength is the longest text in bytes we put in a section block, which Slack limits to 3000 characters, so the
+// last part of a message with quick replies, which is posted as a section followed by their buttons, is no longer
+const maxSectionLength = 3000
+
+// maxHomeViewBlocks is the maximum number of blocks Slack allows in a home tab view
+const maxHomeViewBlocks = 100
+
+// default timeouts for outgoing requests, which can be overridden in the channel config per operation, lookups being
+// of users, conversations, their history and files, and shares making files public. The sender gives each send 35s in
+// total, so configured values any longer than that are cut short to it.
+var (
+	sendTimeout     = 15 * time.Second
+	lookupTimeout   = 15 * time.Second
+	downloadTimeout = 20 * time.Second
+	uploadTimeout   = 30 * time.Second
 )
 
 var (
@@ -36,285 +136,2264 @@ func init() {
 	courier.RegisterHandler(newHandler())
 }
 
+// membershipExpiration is how long we remember that a bot is a member of a conversation
+const membershipExpiration = 10 * time.Minute
+
+// userNameExpiration is how long we remember the names of users we've looked up
+const userNameExpiration = time.Hour
+
+// userInfoExpiration is how long we remember the real names of users who message us, a variable so tests can shorten it
+var userInfoExpiration = time.Hour
+
+// defaultMessagesPerSecond is how many messages we post to each conversation per second, which is what Slack allows
+// though it tolerates short bursts, unless the channel configures its own rate
+const defaultMessagesPerSecond = 1
+
+// threadParentExpiration is how long we remember the parent messages of threads that users reply in, of which we
+// remember at most maxThreadParents at a time
+const threadParentExpiration = 10 * time.Minute
+const maxThreadParents = 1000
+
+// channelNameExpiration is how long we remember the names of conversations we've looked up, unless the channel configures
+// its own interval in seconds
+const channelNameExpiration = time.Hour
+
+// receivedEventExpiration is how long we remember the ids of events we've received, which covers the retries Slack makes
+// of deliveries it doesn't think we got, the last of which is around 5 minutes after the first
+const receivedEventExpiration = 10 * time.Minute
+
+// receivedFileExpiration is how long we remember the files we've received, which covers the gap between the message a
+// file is shared with and the file_shared event for it
+const receivedFileExpiration = 10 * time.Minute
+
+// how files we've received were received, as files shared with messages also arrive in file_shared events
+const (
+	fileReceivedInMessage = "message"
+	fileReceivedShared    = "file_shared"
+)
+
 type handler struct {
 	handlers.BaseHandler
+
+	// memberships are the conversations bots are known to be members of, keyed by channel and conversation
+	memberships *cache.Cache
+
+	// userNames are the names of users mentioned in messages, keyed by channel and user
+	userNames *cache.Cache
+
+	// channelNames are the names of conversations messages are received in, keyed by team and conversation
+	channelNames *cache.Cache
+
+	// users are the users who message us, keyed by channel and user
+	users *cache.Cache
+
+	// threadParents are the parent messages of threads users reply in, keyed by channel, conversation and thread
+	threadParents *cache.Cache
+
+	// receivedEvents are the ids of the events we've received, keyed by channel and event
+	receivedEvents *cache.Cache
+
+	// receivedFiles are how the files we've received were received, keyed by channel and file
+	receivedFiles *cache.Cache
+
+	// postLimiter spaces out the messages and files we post to each conversation, keyed by conversation
+	postLimiter *utils.TokenBuckets
 }
 
 func newHandler() courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(courier.ChannelType("SL"), "Slack")}
+	return &handler{
+		BaseHandler:    handlers.NewBaseHandler(courier.ChannelType("SL"), "Slack"),
+		memberships:    cache.New(membershipExpiration, membershipExpiration),
+		userNames:      cache.New(userNameExpiration, userNameExpiration),
+		channelNames:   cache.New(channelNameExpiration, channelNameExpiration),
+		users:          cache.New(userInfoExpiration, userInfoExpiration),
+		threadParents:  cache.New(threadParentExpiration, threadParentExpiration),
+		receivedEvents: cache.New(receivedEventExpiration, receivedEventExpiration),
+		receivedFiles:  cache.New(receivedFileExpiration, receivedFileExpiration),
+		postLimiter:    utils.NewTokenBuckets(utils.RealClock),
+	}
 }
 
+// urlVerification is the challenge Slack sends to verify our events URL, see https://api.slack.com/events/url_verification
+var urlVerification = handlers.NewJSONChallengeScheme(configValidationToken, "type", "url_verification", "token", "challenge")
+
+// retryNumHeader is the header Slack numbers its retries of event deliveries with
+const retryNumHeader = "X-Slack-Retry-Num"
+
+const (
+	signatureHeader          = "X-Slack-Signature"
+	signatureTimestampHeader = "X-Slack-Request-Timestamp"
+	signatureVersion         = "v0"
+)
+
+// maxSignatureAge is how old the timestamp of a signed request can be before we treat it as a replay, unless the channel
+// configures its own age in seconds
+const maxSignatureAge = 5 * time.Minute
+
+// errStaleRequest is the error for signed requests whose timestamps are too far from now, which may be replays
+var errStaleRequest = errors.New("request timestamp too far from now")
+
 func (h *handler) Initialize(s courier.Server) error {
 	h.SetServer(s)
 	s.AddHandlerRoute(h, http.MethodPost, "receive", h.receiveEvent)
+	s.AddHandlerRoute(h, http.MethodPost, "command", h.receiveCommand)
+	s.AddHandlerRoute(h, http.MethodPost, "interaction", h.receiveInteraction)
 	return nil
 }
 
-func handleURLVerification(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moPayload) ([]courier.Event, error) {
-	validationToken := channel.ConfigForKey(configValidationToken, "")
-	if validationToken != payload.Token {
-		w.WriteHeader(http.StatusForbidden)
-		return nil, fmt.Errorf("Wrong validation token for channel: %s", channel.UUID())
+func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) (events []courier.Event, err error) {
+	// channels with a signing secret require requests to be signed with it, otherwise we fall back to the legacy
+	// verification token which Slack includes in every request
+	signingSecret := channel.StringConfigForKey(configSigningSecret, "")
+	if signingSecret != "" {
+		if err := h.validateSignature(channel, signingSecret, r); err != nil {
+			return nil, h.writeSignatureError(ctx, channel, w, r, err)
+		}
+	} else if isChallenge, err := handlers.HandleChallenge(channel, w, r, urlVerification); isChallenge {
+		// failed challenges get an empty 403 rather than our usual error response, which would say why they failed
+		if err != nil {
+			courier.LogRequestError(r, channel, err)
+		}
+		return nil, nil
 	}
-	w.Header().Set("Content-Type", "text/plain")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(payload.Challenge))
-	return nil, nil
-}
 
-func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
 	payload := &moPayload{}
-	err := handlers.DecodeAndValidateJSON(payload, r)
+	err = handlers.DecodeAndValidateJSON(payload, r)
 	if err != nil {
 		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 	}
 
-	if payload.Type == "url_verification" {
-		return handleURLVerification(ctx, channel, w, r, payload)
+	if signingSecret != "" {
+		// a signed challenge is already verified so we can answer it without the token
+		if payload.Type == "url_verification" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusOK)
+			_, err := w.Write([]byte(payload.Challenge))
+			return nil, err
+		}
+	} else if !handlers.TokensMatch(channel.StringConfigForKey(configValidationToken, ""), payload.Token) {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("wrong verification token for channel: %s", channel.UUID()))
+	}
+
+	// Slack retries deliveries it doesn't think we got, marking them as retries, so retries of events we've already
+	// received are only acknowledged. Events we fail to handle are forgotten again so that their retries get another go.
+	if payload.EventID != "" {
+		key := fmt.Sprintf("%s:%s", channel.UUID(), payload.EventID)
+		if r.Header.Get(retryNumHeader) == "" {
+			h.receivedEvents.SetDefault(key, true)
+		} else if h.receivedEvents.Add(key, true, cache.DefaultExpiration) != nil {
+			return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, event already processed")
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		w = sw
+		defer func() {
+			if err != nil || sw.status >= http.StatusBadRequest {
+				h.receivedEvents.Delete(key)
+			}
+		}()
+	}
+
+	switch payload.Event.Type {
+	case "reaction_added":
+		return h.receiveReaction(ctx, channel, w, r, payload)
+	case "reaction_removed":
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, reaction removed")
+	case "workflow_step_execute":
+		return h.receiveWorkflowStep(ctx, channel, w, r, payload)
+	case "file_shared":
+		return h.receiveFileShared(ctx, channel, w, r, payload)
+	}
+
+	// only subtypes which carry something a user said or shared become messages, others like joins and deletions don't
+	if !supportedSubtypes[payload.Event.Subtype] {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, fmt.Sprintf("Ignoring request, unsupported message subtype: %s", payload.Event.Subtype))
+	}
+
+	// edited messages carry the new message content in a nested message and file comments carry theirs in a comment.
+	// Edits are linked to the message they edit by its ts, and for flows comparing them, the text it had before.
+	user, text, botID, appID, blocks, threadTs := payload.Event.User, payload.Event.Text, payload.Event.BotID, payload.Event.AppID, payload.Event.Blocks, payload.Event.ThreadTs
+	var edited map[string]interface{}
+	if payload.Event.Subtype == "message_changed" && payload.Event.Message != nil {
+		user, text, botID, appID, blocks, threadTs = payload.Event.Message.User, payload.Event.Message.Text, payload.Event.Message.BotID, payload.Event.Message.AppID, payload.Event.Message.Blocks, payload.Event.Message.ThreadTs
+		edited = map[string]interface{}{"edited_ts": payload.Event.Message.Ts}
+		if payload.Event.PreviousMessage != nil {
+			edited["previous_text"] = payload.Event.PreviousMessage.Text
+		}
+	} else if payload.Event.Subtype == "file_comment" && payload.Event.Comment != nil {
+		user, text = payload.Event.Comment.User, fileCommentText(payload.Event.File, payload.Event.Comment.Comment)
 	}
 
-	// if event is not a message or is from the bot ignore it
-	if strings.Contains(payload.Event.Type, "message") && payload.Event.BotID == "" {
+	// if event is not a message or is from a bot ignore it
+	if strings.Contains(payload.Event.Type, "message") && !fromBot(channel, payload, user, botID, appID) {
 
 		date := time.Unix(int64(payload.EventTime), 0)
 
-		var userName string
+		var userName, email string
 		var path string
 		if payload.Event.ChannelType == "channel" { //if is a message from a slack channel that bot is in
-			path = payload.Event.Channel
+			path = channelUserPath(channel, payload.Event.Channel, user)
+			userName = h.channelName(ctx, channel, payload.TeamID, payload.Event.Channel)
 		} else if payload.Event.ChannelType == "im" { // if is a direct message from a user
-			path = payload.Event.User
-			userInfo, log, err := getUserInfo(payload.Event.User, channel)
+			path = user
+			profile, err := h.userProfile(ctx, channel, user)
 			if err != nil {
-				h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
 				return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 			}
-			userName = userInfo.User.RealName
+			userName, email = profile.RealName, profile.Email
 		}
 
-		urn, err := urns.NewURNFromParts(urns.SlackScheme, path, "", userName)
+		urn, err := urns.NewURNFromParts(urns.SlackScheme, urnPath(payload, path), "", userName)
 		if err != nil {
 			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 		}
 
-		attachmentURLs := make([]string, 0)
+		attachments := make([]handlers.SizedAttachment, 0)
 		for _, file := range payload.Event.Files {
-			fileURL, err := h.resolveFile(ctx, channel, file)
+			// files whose file_shared events we got first have already become messages of their own
+			fileKey := fmt.Sprintf("%s:%s", channel.UUID(), file.ID)
+			if how, found := h.receivedFiles.Get(fileKey); found && how == fileReceivedShared {
+				continue
+			}
+			h.receivedFiles.SetDefault(fileKey, fileReceivedInMessage)
+
+			fileURL, thumbURL, err := h.resolveFile(ctx, channel, file)
 			if err != nil {
 				courier.LogRequestError(r, channel, err)
-			} else {
-				attachmentURLs = append(attachmentURLs, fileURL)
+				continue
+			}
+			attachments = append(attachments, fileAttachments(channel, file, fileURL, thumbURL)...)
+		}
+
+		attachmentURLs, dropped := handlers.LimitAttachments(channel, attachments)
+		if dropped {
+			courier.LogRequestError(r, channel, errors.New("dropped attachments over the channel's limits"))
+		}
+
+		// messages in threads take their own ts as their external id so that replies to them can be sent to their
+		// thread, which we remember as external ids have to stay unique. Channels which reply in threads do the same for
+		// messages which aren't in threads, so that replies to them start threads under them. Edits keep the id of their
+		// event, as each edit of a message is a message of its own.
+		externalID := payload.EventID
+		if edited == nil && (threadTs != "" || channel.BoolConfigForKey(configReplyInThread, false)) && payload.Event.Ts != "" {
+			externalID = payload.Event.Ts
+			if threadTs != "" && threadTs != payload.Event.Ts {
+				if err := h.rememberThread(channel, payload.Event.Ts, threadTs); err != nil {
+					logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Error("error remembering thread of message")
+				}
+			}
+		}
+
+		// forwarded messages arrive as a shared attachment, whose text we append to any comment the user added
+		var forwarded map[string]interface{}
+		for _, att := range payload.Event.Attachments {
+			if !att.IsShare {
+				continue
+			}
+			if text == "" {
+				text = att.Text
+			} else if att.Text != "" {
+				text = text + "\n\n" + att.Text
+			}
+			forwarded = map[string]interface{}{"author": att.AuthorID, "author_name": att.AuthorName, "ts": att.Ts, "channel": att.ChannelID}
+			break
+		}
+
+		// file shares whose files we couldn't resolve and comments without any text leave nothing to create a message from
+		if text == "" && len(attachmentURLs) == 0 {
+			return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no text or attachments")
+		}
+
+		msg := h.Backend().NewIncomingMsg(channel, urn, text).WithReceivedOn(date).WithExternalID(externalID).WithContactName(userName)
+
+		metadata := make(map[string]interface{})
+
+		if threadTs != "" {
+			metadata["thread_ts"] = threadTs
+
+			// channels can give flows the message replies are to, at the cost of looking it up
+			if threadTs != payload.Event.Ts && channel.BoolConfigForKey(configThreadContext, false) {
+				if parent := h.threadParent(ctx, channel, payload.Event.Channel, threadTs); parent != nil {
+					metadata["thread_parent"] = parent
+				}
+			}
+		}
+
+		// keep the raw blocks of block messages so flows can inspect their structure, not just the flattened text
+		if len(blocks) > 0 && string(blocks) != "null" {
+			metadata["blocks"] = blocks
+		}
+
+		for key, value := range edited {
+			metadata[key] = value
+		}
+
+		// keep who originally wrote forwarded messages and when, so flows can attribute their content
+		if forwarded != nil {
+			metadata["forwarded"] = forwarded
+		}
+
+		// keep the email of users messaging us directly so flows can link them to other records, which we only know
+		// if the app has the users:read.email scope
+		if email != "" {
+			metadata["email"] = email
+		}
+
+		if len(metadata) > 0 {
+			metadataJSON, err := json.Marshal(metadata)
+			if err != nil {
+				return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 			}
+			msg.WithMetadata(metadataJSON)
+		}
+
+		for _, attURL := range attachmentURLs {
+			msg.WithAttachment(attURL)
+		}
+
+		return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	}
+	return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no message")
+}
+
+// fromBot returns whether a message with the passed in sender was posted by a bot rather than a person, so that we don't
+// reply to it and risk a loop. That's the case for messages with a bot id, but also for those posted by our own app or
+// bot user without one, e.g. messages we send as the user who installed the app, and for those posted by the apps or
+// users the channel ignores, e.g. integrations which post as users.
+func fromBot(channel courier.Channel, payload *moPayload, user, botID, appID string) bool {
+	if botID != "" || (appID != "" && appID == payload.APIAppID) {
+		return true
+	}
+	for _, auth := range payload.Authorizations {
+		if auth.IsBot && auth.UserID != "" && auth.UserID == user {
+			return true
+		}
+	}
+	for _, ignored := range handlers.StringListConfigForKey(channel, configIgnoredBots) {
+		if ignored == appID || ignored == user {
+			return true
+		}
+	}
+	return false
+}
+
+// the message subtypes we create messages from, plain messages having no subtype
+var supportedSubtypes = map[string]bool{
+	"":                 true,
+	"file_share":       true,
+	"file_comment":     true,
+	"me_message":       true,
+	"message_changed":  true,
+	"thread_broadcast": true,
+}
+
+// urnPath returns the URN path of the passed in user or conversation id for events from the workspace of the passed
+// in payload. Ids are only unique within a workspace of an Enterprise Grid organization, so events from one are
+// prefixed by their workspace's team id as team/user. Single workspace paths stay bare ids. Contacts already created
+// from Grid workspaces have bare id URNs, which will need migrating to the prefixed form or those contacts will be
+// created again as new ones.
+func urnPath(payload *moPayload, id string) string {
+	for _, auth := range payload.Authorizations {
+		if auth.EnterpriseID == "" {
+			continue
+		}
+
+		teamID := payload.TeamID
+		if teamID == "" {
+			teamID = auth.TeamID
+		}
+		if teamID != "" {
+			return teamID + "/" + id
+		}
+	}
+	return id
+}
+
+// channelUserPath returns the id of the person in the passed in Slack channel, as channel/user like FreshChat's
+// channel/actor paths, so that the same person in different channels and different people in the same channel are
+// different contacts. Contacts already created from channel messages have bare channel URNs, which would be created
+// again as new ones, so only channels configured to identify people this way do, others keeping the bare channel id.
+func channelUserPath(channel courier.Channel, channelID, userID string) string {
+	if userID == "" || !channel.BoolConfigForKey(configChannelUserURNs, false) {
+		return channelID
+	}
+	return channelID + "/" + userID
+}
+
+// urnIDs returns the ids of the conversation and user the passed in URN is for, without any team id prefix. URNs of
+// people in channels are channel/user, while URNs of users are just the user, which is also their conversation as
+// messages to them are sent as direct messages, and URNs of channels themselves have no user.
+func urnIDs(urn urns.URN) (string, string) {
+	parts := strings.Split(urn.Path(), "/")
+	if len(parts) > 1 && strings.HasPrefix(parts[0], "T") {
+		parts = parts[1:]
+	}
+
+	conversation, user := parts[0], ""
+	if len(parts) > 1 {
+		user = parts[1]
+	} else if strings.HasPrefix(conversation, "U") || strings.HasPrefix(conversation, "W") {
+		user = conversation
+	}
+	return conversation, user
+}
+
+// conversationID returns the id of the conversation the passed in URN is for, which messages to it are posted to
+func conversationID(urn urns.URN) string {
+	conversation, _ := urnIDs(urn)
+	return conversation
+}
+
+// fileCommentText returns the text of a message for a comment on a file, prefixed so that it reads as a comment
+func fileCommentText(file *File, comment string) string {
+	if comment == "" {
+		return ""
+	}
+	if file != nil && file.Title != "" {
+		return fmt.Sprintf("Comment on %s: %s", file.Title, comment)
+	}
+	if file != nil && file.Name != "" {
+		return fmt.Sprintf("Comment on %s: %s", file.Name, comment)
+	}
+	return fmt.Sprintf("Comment on file: %s", comment)
+}
+
+// commandForm is what Slack posts to us when a user invokes one of the app's slash commands
+type commandForm struct {
+	Token       string `name:"token"`
+	Command     string `validate:"required" name:"command"`
+	Text        string `name:"text"`
+	UserID      string `validate:"required" name:"user_id"`
+	UserName    string `name:"user_name"`
+	ChannelID   string `validate:"required" name:"channel_id"`
+	ResponseURL string `name:"response_url"`
+	TriggerID   string `name:"trigger_id"`
+}
+
+// receiveCommand creates an incoming message from a slash command, keeping its response URL so that replies can be
+// sent there. Slack requires an answer within 3 seconds so we avoid making any requests of our own here.
+func (h *handler) receiveCommand(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	signingSecret := channel.StringConfigForKey(configSigningSecret, "")
+	if signingSecret != "" {
+		if err := h.validateSignature(channel, signingSecret, r); err != nil {
+			return nil, h.writeSignatureError(ctx, channel, w, r, err)
+		}
+	}
+
+	form := &commandForm{}
+	if err := handlers.DecodeAndValidateForm(form, r); err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	if signingSecret == "" {
+		if !handlers.TokensMatch(channel.StringConfigForKey(configValidationToken, ""), form.Token) {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("wrong verification token for channel: %s", channel.UUID()))
+		}
+	}
+
+	// commands in direct messages come from the user, otherwise from the user in the conversation like other messages
+	path := channelUserPath(channel, form.ChannelID, form.UserID)
+	if strings.HasPrefix(form.ChannelID, "D") {
+		path = form.UserID
+	}
+
+	urn, err := urns.NewURNFromParts(urns.SlackScheme, path, "", "")
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	text := strings.TrimSpace(form.Command + " " + form.Text)
+	msg := h.Backend().NewIncomingMsg(channel, urn, text).WithExternalID(form.TriggerID).WithContactName(form.UserName)
+
+	metadata := map[string]interface{}{"command": form.Command}
+	if form.ResponseURL != "" {
+		metadata["response_url"] = form.ResponseURL
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	msg.WithMetadata(metadataJSON)
+
+	return handlers.WriteMsgsAndResponse(ctx, &emptyResponder{h}, []courier.Msg{msg}, w, r)
+}
+
+// statusWriter records the status of the response written through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// emptyResponder answers slash commands and interactions with an empty response, as anything else is shown to the user
+type emptyResponder struct {
+	*handler
+}
+
+func (e *emptyResponder) WriteMsgSuccessResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, msgs []courier.Msg) error {
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// interactionPayload is the JSON Slack posts to us as the payload field of a form when a user interacts with one of the
+// components of our messages, such as a quick reply button
+type interactionPayload struct {
+	Type  string `json:"type" validate:"required"`
+	Token string `json:"token"`
+	User  struct {
+		ID       string `json:"id" validate:"required"`
+		Username string `json:"username"`
+		Name     string `json:"name"`
+	} `json:"user"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	Container struct {
+		MessageTs string `json:"message_ts"`
+	} `json:"container"`
+	TriggerID   string `json:"trigger_id"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		BlockID  string `json:"block_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+}
+
+// receiveInteraction creates an incoming message from a click on a button, its text being the button's value, which for
+// the quick reply buttons we send is the quick reply, or its action id for buttons without values
+func (h *handler) receiveInteraction(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	signingSecret := channel.StringConfigForKey(configSigningSecret, "")
+	if signingSecret != "" {
+		if err := h.validateSignature(channel, signingSecret, r); err != nil {
+			return nil, h.writeSignatureError(ctx, channel, w, r, err)
+		}
+	}
+
+	payload := &interactionPayload{}
+	if err := json.Unmarshal([]byte(r.FormValue("payload")), payload); err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, errors.Wrap(err, "unable to parse interaction payload"))
+	}
+	if err := handlers.Validate(payload); err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	if signingSecret == "" {
+		if !handlers.TokensMatch(channel.StringConfigForKey(configValidationToken, ""), payload.Token) {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("wrong verification token for channel: %s", channel.UUID()))
+		}
+	}
+
+	if payload.Type != "block_actions" || len(payload.Actions) == 0 {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, fmt.Sprintf("Ignoring request, no actions in %s interaction", payload.Type))
+	}
+	action := payload.Actions[0]
+
+	text := action.Value
+	if text == "" {
+		text = action.ActionID
+	}
+
+	// like commands, interactions in direct messages come from the user, otherwise from the user in the conversation
+	path := channelUserPath(channel, payload.Channel.ID, payload.User.ID)
+	if payload.Channel.ID == "" || strings.HasPrefix(payload.Channel.ID, "D") {
+		path = payload.User.ID
+	}
+
+	urn, err := urns.NewURNFromParts(urns.SlackScheme, path, "", "")
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	contactName := payload.User.Name
+	if contactName == "" {
+		contactName = payload.User.Username
+	}
+	msg := h.Backend().NewIncomingMsg(channel, urn, text).WithExternalID(payload.TriggerID).WithContactName(contactName)
+
+	metadata := map[string]interface{}{"action_id": action.ActionID}
+	if payload.Container.MessageTs != "" {
+		metadata["message_ts"] = payload.Container.MessageTs
+	}
+	if payload.ResponseURL != "" {
+		metadata["response_url"] = payload.ResponseURL
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	msg.WithMetadata(metadataJSON)
+
+	return handlers.WriteMsgsAndResponse(ctx, &emptyResponder{h}, []courier.Msg{msg}, w, r)
+}
+
+// receiveReaction creates an incoming message from a reaction by a user, its text being the emoji's shortcode
+func (h *handler) receiveReaction(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moPayload) ([]courier.Event, error) {
+	botUserID := ""
+	for _, auth := range payload.Authorizations {
+		if auth.IsBot {
+			botUserID = auth.UserID
+		}
+	}
+
+	if botUserID != "" && payload.Event.User == botUserID {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, reaction from bot")
+	}
+
+	// reactions to messages the bot didn't send are only delivered if the channel is configured to forward them
+	if (botUserID == "" || payload.Event.ItemUser != botUserID) && !channel.BoolConfigForKey(configForwardReactions, false) {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, reaction to message not sent by bot")
+	}
+
+	// reactions in direct messages come from the user, those in channels from the user in the channel, like messages
+	var path, userName string
+	itemChannel := payload.Event.Item.Channel
+	if strings.HasPrefix(itemChannel, "D") || itemChannel == "" {
+		path = payload.Event.User
+		profile, err := h.userProfile(ctx, channel, payload.Event.User)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		userName = profile.RealName
+	} else {
+		path = channelUserPath(channel, itemChannel, payload.Event.User)
+		userName = h.channelName(ctx, channel, payload.TeamID, itemChannel)
+	}
+
+	urn, err := urns.NewURNFromParts(urns.SlackScheme, urnPath(payload, path), "", userName)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	date := time.Unix(int64(payload.EventTime), 0)
+	text := fmt.Sprintf(":%s:", payload.Event.Reaction)
+	msg := h.Backend().NewIncomingMsg(channel, urn, text).WithReceivedOn(date).WithExternalID(payload.EventID).WithContactName(userName)
+
+	// keep which message was reacted to so flows can tell what the reaction is a response to
+	metadataJSON, err := json.Marshal(map[string]interface{}{"reaction_to": payload.Event.Item.Ts})
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	msg.WithMetadata(metadataJSON)
+
+	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+}
+
+// receiveFileShared creates an incoming message with just the file shared in a file_shared event as its attachment,
+// from the user who shared it in the conversation they shared it in. Files shared with messages arrive in those too, so
+// whichever of the two we get second doesn't give us the file again.
+func (h *handler) receiveFileShared(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moPayload) (events []courier.Event, err error) {
+	event := payload.Event
+	if event.FileID == "" || event.UserID == "" {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no file or user in file_shared event")
+	}
+	if fromBot(channel, payload, event.UserID, "", "") {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, file shared by bot")
+	}
+
+	fileKey := fmt.Sprintf("%s:%s", channel.UUID(), event.FileID)
+	if err := h.receivedFiles.Add(fileKey, fileReceivedShared, cache.DefaultExpiration); err != nil {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, file already received")
+	}
+
+	// forget the file if we fail to create a message from it so that Slack's retry of the event can give it to us again
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	w = sw
+	defer func() {
+		if err != nil || sw.status >= http.StatusBadRequest {
+			h.receivedFiles.Delete(fileKey)
+		}
+	}()
+
+	// file_shared events only give us the id of the file, so we look up the rest
+	file, err := h.fileInfo(ctx, channel, event.FileID)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	fileURL, thumbURL, err := h.resolveFile(ctx, channel, file)
+	if _, tooLarge := err.(*handlers.FileTooLargeError); tooLarge {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, fmt.Sprintf("Ignoring request, %s", err))
+	}
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	attachmentURLs, dropped := handlers.LimitAttachments(channel, fileAttachments(channel, file, fileURL, thumbURL))
+	if dropped {
+		courier.LogRequestError(r, channel, errors.New("dropped attachments over the channel's limits"))
+	}
+	if len(attachmentURLs) == 0 {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no attachments")
+	}
+
+	// files shared in direct messages come from the user, those shared in channels from the user in the channel
+	var path, userName string
+	if strings.HasPrefix(event.ChannelID, "D") || event.ChannelID == "" {
+		path = event.UserID
+		profile, err := h.userProfile(ctx, channel, event.UserID)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
 		}
+		userName = profile.RealName
+	} else {
+		path = channelUserPath(channel, event.ChannelID, event.UserID)
+		userName = h.channelName(ctx, channel, payload.TeamID, event.ChannelID)
+	}
+
+	urn, err := urns.NewURNFromParts(urns.SlackScheme, urnPath(payload, path), "", userName)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	date := time.Unix(int64(payload.EventTime), 0)
+	msg := h.Backend().NewIncomingMsg(channel, urn, "").WithReceivedOn(date).WithExternalID(payload.EventID).WithContactName(userName)
+	for _, attURL := range attachmentURLs {
+		msg.WithAttachment(attURL)
+	}
+
+	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+}
+
+// receiveWorkflowStep creates an incoming message from the execution of a Workflow Builder step of the app, from the
+// user or in the conversation given as its user or channel input, its text being its inputs. Flows report the outcome of
+// the step by replying to the message, whose external id is the execute id of the step.
+func (h *handler) receiveWorkflowStep(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, payload *moPayload) ([]courier.Event, error) {
+	step := payload.Event.WorkflowStep
+	if step == nil || step.WorkflowStepExecuteID == "" {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, errors.New("missing workflow step in workflow_step_execute event"))
+	}
+
+	inputs := make(map[string]interface{}, len(step.Inputs))
+	for name, input := range step.Inputs {
+		inputs[name] = input.Value
+	}
+
+	path := ""
+	for _, name := range []string{"user", "channel"} {
+		if value, isString := inputs[name].(string); isString && value != "" {
+			path = value
+			break
+		}
+	}
+	if path == "" {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, workflow step has no user or channel input")
+	}
+
+	urn, err := urns.NewURNFromParts(urns.SlackScheme, urnPath(payload, path), "", "")
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	date := time.Unix(int64(payload.EventTime), 0)
+	msg := h.Backend().NewIncomingMsg(channel, urn, workflowStepText(inputs)).WithReceivedOn(date).WithExternalID(step.WorkflowStepExecuteID)
+
+	metadataJSON, err := json.Marshal(map[string]interface{}{
+		"workflow_step": map[string]interface{}{
+			"execute_id":  step.WorkflowStepExecuteID,
+			"workflow_id": step.WorkflowID,
+			"step_id":     step.StepID,
+			"inputs":      inputs,
+		},
+	})
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	msg.WithMetadata(metadataJSON)
+
+	return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+}
+
+// workflowStepText returns the text of a message for a workflow step with the passed in inputs, one per line in order of
+// their names
+func workflowStepText(inputs map[string]interface{}) string {
+	names := make([]string, 0, len(inputs))
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		value, isString := inputs[name].(string)
+		if !isString {
+			valueJSON, _ := json.Marshal(inputs[name])
+			value = string(valueJSON)
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", name, value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NormalizeSteps returns the steps incoming Slack messages go through before we write them
+func (h *handler) NormalizeSteps() []handlers.NormalizeStep {
+	return []handlers.NormalizeStep{h.normalizeText, handlers.NormalizeEmoji, handlers.TrimWhitespace, handlers.ClampReceivedOn(h.Clock())}
+}
+
+// mentions of users, conversations and groups look like <@U0123ABCDEF>, <#C0123ABCDEF|general> or <!here>, the label
+// after the | being optional
+var mentionRegex = regexp.MustCompile(`<([@#!])([^<>|]+)(?:\|([^<>]*))?>`)
+
+// links look like <https://example.com|label>, the label after the | being optional
+var linkRegex = regexp.MustCompile(`<((?:https?|mailto|tel|ftp):[^<>|]*)(?:\|([^<>]*))?>`)
+
+// code is either a block between ``` or inline between single backticks
+var codeRegex = regexp.MustCompile("(?s)```.*?```|`[^`\n]+`")
+
+// the only characters Slack escapes as HTML entities in message text
+var entityReplacer = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+
+// normalizeText is the normalize step which replaces the mrkdwn in the text of incoming messages with plain text
+func (h *handler) normalizeText(ctx context.Context, msg courier.Msg) {
+	if text := h.normalizeMrkdwn(ctx, msg.Channel(), msg.Text()); text != msg.Text() {
+		msg.WithText(text)
+	}
+}
+
+// normalizeMrkdwn returns the passed in mrkdwn as plain text, replacing links with their labels, mentions with readable
+// names and HTML entities with the characters they escape. Code is left untouched.
+func (h *handler) normalizeMrkdwn(ctx context.Context, channel courier.Channel, text string) string {
+	var normalized strings.Builder
+	last := 0
+	for _, code := range codeRegex.FindAllStringIndex(text, -1) {
+		normalized.WriteString(h.normalizeMrkdwnSegment(ctx, channel, text[last:code[0]]))
+		normalized.WriteString(text[code[0]:code[1]])
+		last = code[1]
+	}
+	normalized.WriteString(h.normalizeMrkdwnSegment(ctx, channel, text[last:]))
+	return normalized.String()
+}
+
+// normalizeMrkdwnSegment normalizes a segment of mrkdwn which doesn't contain code
+func (h *handler) normalizeMrkdwnSegment(ctx context.Context, channel courier.Channel, text string) string {
+	text = linkRegex.ReplaceAllStringFunc(text, func(link string) string {
+		parts := linkRegex.FindStringSubmatch(link)
+		if parts[2] != "" {
+			return parts[2]
+		}
+		return parts[1]
+	})
+
+	text = mentionRegex.ReplaceAllStringFunc(text, func(mention string) string {
+		parts := mentionRegex.FindStringSubmatch(mention)
+		kind, id, label := parts[1], parts[2], parts[3]
+
+		switch kind {
+		case "@":
+			if label != "" {
+				return "@" + label
+			}
+			return "@" + h.userName(ctx, channel, id)
+		case "#":
+			if label != "" {
+				return "#" + label
+			}
+			return "#" + id
+		default:
+			// special mentions like <!here> or <!subteam^S0123ABCDEF|@team>, whose labels include their @
+			if label != "" {
+				return label
+			}
+			return "@" + strings.SplitN(id, "^", 2)[0]
+		}
+	})
+
+	return entityReplacer.Replace(text)
+}
+
+// userName returns the name of the Slack user with the passed in id, falling back to the id if we can't look it up
+func (h *handler) userName(ctx context.Context, channel courier.Channel, userID string) string {
+	cacheKey := channel.UUID().String() + ":" + userID
+	if name, found := h.userNames.Get(cacheKey); found {
+		return name.(string)
+	}
+
+	userInfo, log, err := getUserInfo(ctx, userID, channel)
+	if err != nil {
+		if log != nil {
+			h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+		}
+		return userID
+	}
+
+	for _, name := range []string{userInfo.User.Profile.DisplayName, userInfo.User.RealName, userInfo.User.Name} {
+		if name != "" {
+			h.userNames.Set(cacheKey, name, cache.DefaultExpiration)
+			return name
+		}
+	}
+	return userID
+}
+
+// userProfile is what we keep of the Slack users who message us
+type userProfile struct {
+	RealName string
+	Email    string
+}
+
+// userProfile returns the profile of the Slack user with the passed in id, whose real name we name contacts after. Its
+// email is empty if the user doesn't have one or the app lacks the users:read.email scope needed to see it.
+func (h *handler) userProfile(ctx context.Context, channel courier.Channel, userID string) (*userProfile, error) {
+	cacheKey := channel.UUID().String() + ":" + userID
+	if profile, found := h.users.Get(cacheKey); found {
+		return profile.(*userProfile), nil
+	}
+
+	userInfo, log, err := getUserInfo(ctx, userID, channel)
+	if err != nil {
+		if log != nil {
+			h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+		}
+		return nil, err
+	}
+
+	profile := &userProfile{RealName: userInfo.User.RealName, Email: userInfo.User.Profile.Email}
+	h.users.Set(cacheKey, profile, userInfoExpiration)
+	return profile, nil
+}
+
+// threadExpiration is how long we remember the threads of the messages users reply in, in seconds
+const threadExpiration = 7 * 24 * 60 * 60
+
+func threadKey(channel courier.Channel, ts string) string {
+	return fmt.Sprintf("slack-thread:%s:%s", channel.UUID(), ts)
+}
+
+// rememberThread records the thread of the message with the passed in ts, so that replies to it go to that thread
+func (h *handler) rememberThread(channel courier.Channel, ts string, threadTs string) error {
+	rc := h.Backend().RedisPool().Get()
+	defer rc.Close()
+
+	_, err := rc.Do("SET", threadKey(channel, ts), threadTs, "EX", threadExpiration)
+	return err
+}
+
+// threadOf returns the ts of the thread replies to the message with the passed in ts go to, which is that of the thread
+// it's in if it's a reply itself, or its own ts so that replies to it start a thread under it
+func (h *handler) threadOf(channel courier.Channel, ts string) string {
+	rc := h.Backend().RedisPool().Get()
+	defer rc.Close()
+
+	threadTs, err := redis.String(rc.Do("GET", threadKey(channel, ts)))
+	if err != nil || threadTs == "" {
+		return ts
+	}
+	return threadTs
+}
+
+// threadParent is the message which starts a thread, which we give replies in the thread as context
+type threadParent struct {
+	User string `json:"user"`
+	Text string `json:"text"`
+	Ts   string `json:"ts"`
+}
+
+// threadParent returns the message which started the passed in thread in the passed in conversation, or nil if we
+// can't look it up
+func (h *handler) threadParent(ctx context.Context, channel courier.Channel, conversationID string, threadTs string) *threadParent {
+	cacheKey := channel.UUID().String() + ":" + conversationID + ":" + threadTs
+	if parent, found := h.threadParents.Get(cacheKey); found {
+		return parent.(*threadParent)
+	}
+
+	parent, log, err := getThreadParent(ctx, channel, conversationID, threadTs)
+	if err != nil {
+		if log != nil {
+			h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+		}
+		return nil
+	}
+
+	// only remember so many threads, those over our limit being looked up again for each reply
+	if h.threadParents.ItemCount() < maxThreadParents {
+		h.threadParents.Set(cacheKey, parent, cache.DefaultExpiration)
+	}
+	return parent
+}
+
+// channelName returns the name of the Slack conversation with the passed in id in the passed in team, or an empty
+// string if we can't look it up
+func (h *handler) channelName(ctx context.Context, channel courier.Channel, teamID string, conversationID string) string {
+	cacheKey := teamID + ":" + conversationID
+	if name, found := h.channelNames.Get(cacheKey); found {
+		return name.(string)
+	}
+
+	info, log, err := getConversationInfo(ctx, conversationID, channel)
+	if err != nil {
+		if log != nil {
+			h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+		}
+		return ""
+	}
+
+	expiration := channelNameExpiration
+	if seconds := channel.IntConfigForKey(configChannelNameExpiration, 0); seconds > 0 {
+		expiration = time.Duration(seconds) * time.Second
+	}
+	h.channelNames.Set(cacheKey, info.Channel.Name, expiration)
+	return info.Channel.Name
+}
+
+// validateSignature checks the passed in request was signed by Slack with the passed in signing secret and isn't a
+// replay of an old request, see https://api.slack.com/authentication/verifying-requests-from-slack
+func (h *handler) validateSignature(channel courier.Channel, secret string, r *http.Request) error {
+	actual := r.Header.Get(signatureHeader)
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	if actual == "" || timestamp == "" {
+		return fmt.Errorf("missing request signature")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid request timestamp: %s", timestamp)
+	}
+	maxAge := maxSignatureAge
+	if seconds := channel.IntConfigForKey(configMaxRequestAge, 0); seconds > 0 {
+		maxAge = time.Duration(seconds) * time.Second
+	}
+	if age := h.Clock().Now().Sub(time.Unix(seconds, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("%w: %s", errStaleRequest, timestamp)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	// compare signatures in way that isn't sensitive to a timing attack
+	expected := calculateSignature(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(actual)) {
+		return fmt.Errorf("invalid request signature: %s", actual)
+	}
+
+	return nil
+}
+
+// writeSignatureError writes the response to a request whose signature isn't valid, requests which may be replays being
+// forbidden rather than bad requests
+func (h *handler) writeSignatureError(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request, err error) error {
+	if errors.Is(err, errStaleRequest) {
+		courier.LogRequestError(r, channel, err)
+		return courier.WriteDataResponse(ctx, w, http.StatusForbidden, "Forbidden", []interface{}{courier.NewErrorData(err.Error())})
+	}
+	return handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+}
+
+// calculateSignature returns the signature of a request with the passed in timestamp and body
+func calculateSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signatureVersion + ":" + timestamp + ":"))
+	mac.Write(body)
+	return signatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// rateLimitRetries is how many times we retry a request which Slack rejects for exceeding its rate limit
+const rateLimitRetries = 3
+
+// maxRetryAfter is the longest we wait before retrying a rate limited request, whatever Slack tells us
+var maxRetryAfter = time.Minute
+
+// makeRequest makes the request built by the passed in func, retrying it up to rateLimitRetries times if Slack rate
+// limits it, after waiting as long as its Retry-After header tells us to or backing off if it doesn't. Rate limited
+// attempts are passed to the passed in func so that they can be logged, and if we run out of retries we return the
+// last of them.
+func makeRequest(ctx context.Context, newRequest func() (*http.Request, context.CancelFunc, error), rateLimited func(*utils.RequestResponse, error)) (*utils.RequestResponse, error) {
+	backoff := &utils.Backoff{Base: time.Second, Max: maxRetryAfter, Multiplier: 2, Jitter: 0.2}
+
+	for retries := 0; ; retries++ {
+		req, cancel, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		rr, err := utils.MakeHTTPRequest(req)
+		cancel()
+
+		if rr == nil || rr.StatusCode != http.StatusTooManyRequests || retries == rateLimitRetries {
+			return rr, err
+		}
+		rateLimited(rr, err)
+
+		select {
+		case <-ctx.Done():
+			return rr, err
+		case <-time.After(retryAfter(rr, backoff)):
+		}
+	}
+}
+
+// retryAfter returns how long the passed in rate limited response tells us to wait before retrying, the next delay of
+// the passed in backoff if it doesn't say
+func retryAfter(rr *utils.RequestResponse, backoff *utils.Backoff) time.Duration {
+	if rr.RateLimit == nil || rr.RateLimit.Reset.IsZero() {
+		return backoff.Next()
+	}
+
+	wait := time.Until(rr.RateLimit.Reset)
+	if wait < 0 {
+		wait = 0
+	} else if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait
+}
+
+// resolveFile makes the passed in file public, returning its public URL and that of its thumbnail, the latter being
+// empty if the file isn't an image with a thumbnail
+func (h *handler) resolveFile(ctx context.Context, channel courier.Channel, file File) (string, string, error) {
+	userToken := channel.StringConfigForKey(configUserToken, "")
+
+	fileApiURL := channelAPIURL(channel) + "/files.sharedPublicURL"
+
+	newRequest := func() (*http.Request, context.CancelFunc, error) {
+		data := strings.NewReader(fmt.Sprintf(`{"file":"%s"}`, file.ID))
+		req, cancel, err := handlers.NewRequestWithTimeout(ctx, channel, "share", lookupTimeout, http.MethodPost, fileApiURL, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Add("Content-Type", "application/json; charset=utf-8")
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", userToken))
+		return req, cancel, nil
+	}
+
+	rr, err := makeRequest(ctx, newRequest, func(rr *utils.RequestResponse, err error) {
+		log := courier.NewChannelLogFromRR("File Resolving", channel, courier.NilMsgID, rr).WithError("File Resolving Rate Limited", err)
+		h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+	})
+	if rr == nil {
+		return "", "", err
+	}
+	if err != nil {
+		log := courier.NewChannelLogFromRR("File Resolving", channel, courier.NilMsgID, rr).WithError("File Resolving Error", err)
+		h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+		return "", "", err
+	}
+
+	var fResponse FileResponse
+	if err := json.Unmarshal([]byte(rr.Body), &fResponse); err != nil {
+		return "", "", errors.Errorf("couldn't unmarshal file response: %v", err)
+	}
+
+	currentFile := fResponse.File
+
+	if !fResponse.OK {
+		if fResponse.Error != ErrAlreadyPublic {
+			if fResponse.Error == ErrPublicVideoNotAllowed {
+				return "", "", errors.Errorf("public sharing of videos is not available for a free instance of Slack. file id: %s. error: %s", file.ID, fResponse.Error)
+			}
+			return "", "", errors.Errorf("couldn't resolve file for file id: %s. error: %s", file.ID, fResponse.Error)
+		}
+		currentFile = file
+	}
+
+	// without a public permalink we can't give a public URL, so we give the private one, which needs to be downloaded
+	// with the bot token in an Authorization header, and no thumbnail as those are private too
+	pubSecret := publicSecret(currentFile.PermalinkPublic)
+	if pubSecret == "" {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("file_id", currentFile.ID).Warn("file has no public permalink, using its private download URL")
+		if err := h.checkFileSize(ctx, channel, currentFile, currentFile.URLPrivateDownload); err != nil {
+			return "", "", err
+		}
+		return currentFile.URLPrivateDownload, "", nil
+	}
+	filePath := currentFile.URLPrivateDownload + "?pub_secret=" + pubSecret
+	if err := h.checkFileSize(ctx, channel, currentFile, filePath); err != nil {
+		return "", "", err
+	}
+
+	// thumbnails are shared along with their file so are public with the same secret
+	thumbPath := ""
+	if strings.HasPrefix(currentFile.Mimetype, "image/") {
+		if thumb := largestThumb(currentFile); thumb != "" {
+			thumbPath = thumb + "?pub_secret=" + pubSecret
+		}
+	}
+
+	return filePath, thumbPath, nil
+}
+
+// checkFileSize checks that the passed in file, to be downloaded from the passed in URL, is within the channel's file size
+// limit so that files too large to re-host aren't given to the backend to download in full. Files Slack tells us are
+// too large aren't downloaded at all, and others are downloaded in chunks, giving up as soon as they go over the limit.
+func (h *handler) checkFileSize(ctx context.Context, channel courier.Channel, file File, fileURL string) error {
+	maxSize := channel.IntConfigForKey(configMaxFileSize, defaultMaxFileSize)
+	if file.Size > maxSize {
+		return &handlers.FileTooLargeError{MaxSize: maxSize}
+	}
+
+	// private download URLs need the bot token, like when the backend downloads them
+	var header http.Header
+	if !strings.Contains(fileURL, "pub_secret=") {
+		header = http.Header{"Authorization": {fmt.Sprintf("Bearer %s", channel.StringConfigForKey(configBotToken, ""))}}
+	}
+
+	_, log, err := handlers.DownloadWithLimit(ctx, channel, courier.NilMsgID, fileURL, header, maxSize, downloadTimeout)
+	if err != nil {
+		h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+	}
+	return err
+}
+
+// fileInfo looks up the file with the passed in id, see https://api.slack.com/methods/files.info
+func (h *handler) fileInfo(ctx context.Context, channel courier.Channel, fileID string) (File, error) {
+	botToken := channel.StringConfigForKey(configBotToken, "")
+
+	newRequest := func() (*http.Request, context.CancelFunc, error) {
+		req, cancel, err := handlers.NewRequestWithTimeout(ctx, channel, "lookup", lookupTimeout, http.MethodGet, channelAPIURL(channel)+"/files.info?file="+url.QueryEscape(fileID), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", botToken))
+		return req, cancel, nil
+	}
+
+	rr, err := makeRequest(ctx, newRequest, func(rr *utils.RequestResponse, err error) {
+		log := courier.NewChannelLogFromRR("File Info", channel, courier.NilMsgID, rr).WithError("File Info Rate Limited", err)
+		h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+	})
+	if rr == nil {
+		return File{}, err
+	}
+	if err != nil {
+		log := courier.NewChannelLogFromRR("File Info", channel, courier.NilMsgID, rr).WithError("File Info Error", err)
+		h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
+		return File{}, err
+	}
+
+	var fResponse FileResponse
+	if err := json.Unmarshal(rr.Body, &fResponse); err != nil {
+		return File{}, errors.Errorf("couldn't unmarshal file info response: %v", err)
+	}
+	if !fResponse.OK {
+		return File{}, errors.Errorf("couldn't get info for file id: %s. error: %s", fileID, fResponse.Error)
+	}
+	return fResponse.File, nil
+}
+
+// BuildDownloadMediaRequest builds the request to download the passed in attachment, which for files we could only give
+// the private download URL of needs the bot token as its authorization
+func (h *handler) BuildDownloadMediaRequest(ctx context.Context, b courier.Backend, channel courier.Channel, attachmentURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, attachmentURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", utils.HTTPUserAgent)
+
+	if req.URL.Query().Get("pub_secret") == "" {
+		token := channel.StringConfigForKey(configBotToken, "")
+		if token == "" {
+			return nil, fmt.Errorf("missing bot token for SL/slack channel")
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	}
+	return req, nil
+}
+
+// publicSecret returns the secret which makes the private URLs of a file public, which is the last part of its public
+// permalink of the form https://slack-files.com/<team>-<file>-<secret>, or an empty string if it doesn't have one
+func publicSecret(permalink string) string {
+	parts := strings.Split(permalink[strings.LastIndex(permalink, "/")+1:], "-")
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[len(parts)-1]
+}
+
+// largestThumb returns the URL of the largest thumbnail we use of the passed in file, if it has one
+func largestThumb(file File) string {
+	if file.Thumb360 != "" {
+		return file.Thumb360
+	}
+	return file.Thumb160
+}
+
+// fileAttachments returns the attachments of an incoming message for the passed in file. If the channel is configured
+// for thumbnails, images with one get it attached after the full image, or in place of it if the image is larger than
+// the channel's thumbnail only size.
+func fileAttachments(channel courier.Channel, file File, fileURL string, thumbURL string) []handlers.SizedAttachment {
+	full := handlers.SizedAttachment{URL: fileURL, Size: file.Size}
+	if thumbURL == "" || !channel.BoolConfigForKey(configThumbnails, false) {
+		return []handlers.SizedAttachment{full}
+	}
+
+	// we don't know the size of thumbnails but they are small enough to not count towards the channel's size limit
+	thumb := handlers.SizedAttachment{URL: thumbURL}
+
+	thumbOnlySize := channel.IntConfigForKey(configThumbnailOnly, 0)
+	if thumbOnlySize > 0 && file.Size > thumbOnlySize {
+		return []handlers.SizedAttachment{thumb}
+	}
+	return []handlers.SizedAttachment{full, thumb}
+}
+
+// Slack ids of users and conversations are a letter for their type followed by uppercase letters and digits, Enterprise
+// Grid ones being prefixed by the id of their team
+var slackIDRegex = regexp.MustCompile(`^(T[A-Z0-9]{8,}/)?([UWD][A-Z0-9]{8,}|[CG][A-Z0-9]{8,}(/[UW][A-Z0-9]{8,})?)$`)
+
+// ValidateURN checks that the passed in URN is the id of a Slack user or conversation we can post to
+func (h *handler) ValidateURN(urn urns.URN) error {
+	if urn.Scheme() != urns.SlackScheme {
+		return errors.Errorf("unsupported URN scheme for Slack: %s", urn.Scheme())
+	}
+	if !slackIDRegex.MatchString(urn.Path()) {
+		return errors.Errorf("invalid Slack user or conversation id: %s", urn.Path())
+	}
+	return nil
+}
+
+func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+	botToken := msg.Channel().StringConfigForKey(configBotToken, "")
+	if botToken == "" {
+		return nil, fmt.Errorf("missing bot token for SL/slack channel")
+	}
+	if msg.Channel().BoolConfigForKey(configSendAsUser, false) && msg.Channel().StringConfigForKey(configUserToken, "") == "" {
+		return nil, fmt.Errorf("missing user token for SL/slack channel configured to send as user")
+	}
+
+	// Slack rejects messages with buttons whose text is longer than it can show, so we don't try to send them
+	for _, reply := range msg.QuickReplies() {
+		if utf8.RuneCountInString(reply) > maxButtonTextLength {
+			return nil, errors.Errorf("quick replies can be at most %d characters for channel: %s, got: %s", maxButtonTextLength, msg.Channel().UUID(), reply)
+		}
+	}
+
+	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+
+	// messages targeting the app home tab are published as the user's home view instead of sent to a conversation
+	if target, _ := jsonparser.GetString(msg.Metadata(), "target"); target == targetHome {
+		view, err := homeView(msg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid home view for channel: %s", msg.Channel().UUID())
+		}
+
+		log, err := publishHomeView(ctx, msg, botToken, view)
+		status.AddLog(log)
+		if err == nil {
+			status.SetStatus(courier.MsgWired)
+		}
+		return status, nil
+	}
+
+	// messages targeting the bot's presence set it rather than being sent
+	if target, _ := jsonparser.GetString(msg.Metadata(), "target"); target == targetPresence {
+		presence, _ := jsonparser.GetString(msg.Metadata(), "presence")
+		if presence != presenceAuto && presence != presenceAway {
+			return nil, errors.Errorf("invalid presence for channel: %s: must be %s or %s, got: %s", msg.Channel().UUID(), presenceAuto, presenceAway, presence)
+		}
+
+		log, err := setPresence(ctx, msg, status, botToken, presence)
+		status.AddLog(log)
+		if err == nil {
+			status.SetStatus(courier.MsgWired)
+		}
+		return status, nil
+	}
+
+	// messages carrying the ts of a message we sent update that message in place rather than being posted as new ones,
+	// which Slack only lets us do for its text and blocks
+	if updateTs, _ := jsonparser.GetString(msg.Metadata(), "update_ts"); updateTs != "" {
+		if !tsRegex.MatchString(updateTs) {
+			return nil, errors.Errorf("invalid update ts for channel: %s: %s", msg.Channel().UUID(), updateTs)
+		}
+		if len(msg.Attachments()) > 0 {
+			return nil, errors.Errorf("can't update message with attachments for channel: %s", msg.Channel().UUID())
+		}
+		if len(msg.QuickReplies()) > 0 && len(msg.Text()) > maxSectionLength {
+			return nil, errors.Errorf("can't update message with quick replies to text longer than %d for channel: %s", maxSectionLength, msg.Channel().UUID())
+		}
+
+		log, ts, err := updateTextMsg(ctx, msg, status, botToken, updateTs)
+		status.AddLog(log)
+		if err == nil {
+			handlers.SetSendResult(status, ts, time.Time{})
+			status.SetStatus(courier.MsgWired)
+		}
+		return status, nil
+	}
+
+	// messages targeting a workflow step report its outcome rather than being sent
+	if target, _ := jsonparser.GetString(msg.Metadata(), "target"); target == targetWorkflowStep {
+		executeID, _ := jsonparser.GetString(msg.Metadata(), "workflow_step_execute_id")
+		if executeID == "" {
+			executeID = msg.ResponseToExternalID()
+		}
+		if executeID == "" {
+			return nil, errors.Errorf("missing workflow step execute id for channel: %s", msg.Channel().UUID())
+		}
+
+		log, err := reportWorkflowStep(ctx, msg, status, botToken, executeID)
+		status.AddLog(log)
+		if err == nil {
+			status.SetStatus(courier.MsgWired)
+		}
+		return status, nil
+	}
+
+	// bots can only post to conversations they are members of, so optionally check that first rather than have Slack
+	// reject each part of the message as not_in_channel
+	if msg.Channel().BoolConfigForKey(configCheckMembership, false) {
+		log, err := h.checkMembership(ctx, msg, botToken)
+		if log != nil {
+			status.AddLog(log)
+		}
+		if err != nil {
+			return status, nil
+		}
+	}
+
+	hasError := true
+
+	// replies to slash commands are sent to their response URL, unless it has expired or been used up, and if we
+	// weren't given a thread, replies to messages in threads go to the same thread
+	responseURL, _ := jsonparser.GetString(msg.Metadata(), "response_url")
+	threadTs, _ := jsonparser.GetString(msg.Metadata(), "thread_ts")
+	if threadTs == "" && tsRegex.MatchString(msg.ResponseToExternalID()) {
+		threadTs = h.threadOf(msg.Channel(), msg.ResponseToExternalID())
+	}
+
+	// text too long for one message is posted in several parts, and with quick replies, the last part goes in a section
+	// so text too long for one is posted in several parts too
+	textParts := handlers.SplitMsgByChannel(msg.Channel(), msg.Text(), maxMsgLength)
+	if len(msg.QuickReplies()) > 0 {
+		last := textParts[len(textParts)-1]
+		textParts = append(textParts[:len(textParts)-1], handlers.SplitMsg(last, maxSectionLength)...)
+	}
+
+	// text that would be posted to the conversation itself in one part without quick replies is sent as the comment of
+	// the first file instead, so that the file doesn't lose its caption
+	caption := ""
+	if responseURL == "" && threadTs == "" && !msg.Channel().BoolConfigForKey(configThreadOnLatest, false) && len(msg.QuickReplies()) == 0 && len(textParts) == 1 {
+		caption = msg.Text()
+	}
+	captioned := false
+
+	// code is uploaded as a snippet, which keeps its formatting and isn't limited in length like text, when it can be
+	// shared in the conversation itself without anything else the message has
+	if responseURL == "" && threadTs == "" && !msg.Channel().BoolConfigForKey(configThreadOnLatest, false) && len(msg.QuickReplies()) == 0 && len(msg.Attachments()) == 0 {
+		if snippet := snippetParams(msg); snippet != nil {
+			h.waitToPost(ctx, msg)
+			log, err := sendFilePart(ctx, msg, status, botToken, snippet)
+			status.AddLog(log)
+			if err == nil {
+				status.SetStatus(courier.MsgWired)
+			}
+			return status, nil
+		}
+	}
+
+	// attachments larger than we'll upload, and which we can't upload a placeholder for instead, leave the message
+	// errored even if its text can still be sent without them
+	tooLarge := false
+
+	for i, attachment := range msg.Attachments() {
+		fileAttachment, log, err := parseAttachmentToFileParams(ctx, msg, attachment)
+		status.AddLog(log)
+		fileTooLarge := errors.As(err, new(*handlers.FileTooLargeError))
+
+		// if we can't fetch the attachment, we can optionally upload a placeholder in its place
+		if err != nil {
+			if placeholder := msg.Channel().StringConfigForKey(configPlaceholder, ""); placeholder != "" {
+				fileAttachment, log, err = parseAttachmentToFileParams(ctx, msg, placeholder)
+				status.AddLog(log)
+			}
+		}
+		tooLarge = tooLarge || (fileTooLarge && fileAttachment == nil)
+		hasError = err != nil
+
+		if fileAttachment != nil {
+			if i == 0 {
+				fileAttachment.InitialComment = caption
+			}
+			h.waitToPost(ctx, msg)
+			log, err = sendFilePart(ctx, msg, status, botToken, fileAttachment)
+			hasError = err != nil
+			captioned = captioned || (fileAttachment.InitialComment != "" && err == nil)
+			status.AddLog(log)
+		}
+	}
+
+	if msg.Text() != "" && !captioned {
+		responded := false
+		if responseURL != "" {
+			log, expired, err := sendResponseURLMsgPart(ctx, msg, responseURL)
+			status.AddLog(log)
+			if !expired {
+				hasError = err != nil
+				responded = true
+			}
+		}
+
+		if !responded {
+			// if we weren't given a thread and aren't replying in one, we can optionally reply to the latest message in the conversation
+			if threadTs == "" && msg.Channel().BoolConfigForKey(configThreadOnLatest, false) {
+				latestTs, log, err := getLatestMessageTs(ctx, msg, botToken)
+				status.AddLog(log)
+				if err == nil {
+					threadTs = latestTs
+				}
+			}
+
+			// parts are posted in order, stopping at the first which fails, and any quick replies go with the last
+			for i, part := range textParts {
+				h.waitToPost(ctx, msg)
+				log, ts, err := sendTextMsgPart(ctx, msg, status, botToken, threadTs, part, i, i == len(textParts)-1)
+				hasError = err != nil
+				status.AddLog(log)
+				if err != nil {
+					if sendErr, known := sendErrors[err.Error()]; known && sendErr.status == courier.MsgFailed {
+						status.SetStatus(courier.MsgFailed)
+					}
+					break
+				}
+
+				// the ts of the first posted part is both the message's id and when Slack received it
+				if i == 0 {
+					sentOn, _ := parseTs(ts)
+					handlers.SetSendResult(status, ts, sentOn)
+				}
+			}
+		}
+	}
+
+	if !hasError && !tooLarge {
+		status.SetStatus(courier.MsgWired)
+	}
+
+	return status, nil
+}
+
+// waitToPost blocks until we can post to the conversation of the passed in message without exceeding the rate of the
+// channel, so that bursts of sends to a conversation are smoothed out rather than throttled by Slack
+func (h *handler) waitToPost(ctx context.Context, msg courier.Msg) {
+	rate := msg.Channel().IntConfigForKey(configMessagesPerSecond, defaultMessagesPerSecond)
+	if rate <= 0 {
+		rate = defaultMessagesPerSecond
+	}
+
+	delay := h.postLimiter.Reserve(conversationID(msg.URN()), float64(rate))
+	if delay <= 0 {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+}
+
+// sendTextMsgPart posts the passed in part of the text of the passed in message to its conversation, with the message's
+// quick replies if it's the last part, returning the ts of the posted message
+func sendTextMsgPart(ctx context.Context, msg courier.Msg, status courier.MsgStatus, token string, threadTs string, text string, part int, last bool) (*courier.ChannelLog, string, error) {
+	sendURL := channelAPIURL(msg.Channel()) + "/chat.postMessage"
+
+	msgPayload := &mtPayload{
+		Channel:     conversationID(msg.URN()),
+		Text:        text,
+		ThreadTs:    threadTs,
+		ClientMsgID: clientMsgID(msg, part),
+	}
+	if last {
+		msgPayload.Blocks = quickReplyBlocks(msg, text)
+	}
+
+	// channels can post text as the user who installed the app rather than the bot, or give the bot a name and icon
+	// other than the app's, which needs the chat:write.customize scope. Icon emojis take precedence over icon URLs.
+	if msg.Channel().BoolConfigForKey(configSendAsUser, false) {
+		token = msg.Channel().StringConfigForKey(configUserToken, "")
+		msgPayload.AsUser = true
+	} else {
+		msgPayload.Username = msg.Channel().StringConfigForKey(configBotUsername, "")
+		msgPayload.IconEmoji = msg.Channel().StringConfigForKey(configBotIconEmoji, "")
+		if msgPayload.IconEmoji == "" {
+			msgPayload.IconURL = msg.Channel().StringConfigForKey(configBotIconURL, "")
+		}
+	}
+
+	// channels can control unfurling of links and media separately, unless a link display overrides both
+	msgPayload.UnfurlLinks = unfurlConfig(msg.Channel(), configUnfurlLinks)
+	msgPayload.UnfurlMedia = unfurlConfig(msg.Channel(), configUnfurlMedia)
+
+	if display := linkDisplay(msg); display != "" {
+		unfurl := display == linkDisplayExpanded
+		msgPayload.UnfurlLinks, msgPayload.UnfurlMedia = &unfurl, &unfurl
+	}
+
+	body, err := json.Marshal(msgPayload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	newRequest := func() (*http.Request, context.CancelFunc, error) {
+		req, cancel, err := handlers.NewRequestWithTimeout(ctx, msg.Channel(), "send", sendTimeout, http.MethodPost, sendURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		return req, cancel, nil
+	}
+
+	rr, err := makeRequest(ctx, newRequest, func(rr *utils.RequestResponse, err error) {
+		status.AddLog(courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Rate Limited", err))
+	})
+	if rr == nil {
+		return nil, "", err
+	}
+
+	log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
+
+	ok, err := jsonparser.GetBoolean([]byte(rr.Body), "ok")
+	if err != nil {
+		return log, "", err
+	}
+
+	if !ok {
+		errDescription, err := jsonparser.GetString([]byte(rr.Body), "error")
+		if err != nil {
+			return log, "", err
+		}
+
+		// the error Slack gave us is logged, well-known ones with a description of what went wrong
+		err = errors.New(errDescription)
+		if sendErr, known := sendErrors[errDescription]; known {
+			log.WithError(sendErr.description, err)
+		} else {
+			log.WithError("Message Send Error", err)
+		}
+		return log, "", err
+	}
+
+	ts, _ := jsonparser.GetString([]byte(rr.Body), "ts")
+	return log, ts, nil
+}
+
+// sendError is how we treat a well-known error Slack gives us when we post a message
+type sendError struct {
+	status      courier.MsgStatusValue
+	description string
+}
+
+// sendErrors are the well-known errors of chat.postMessage. Those which retrying the message won't fix fail it, while
+// those which go away with time or once the channel is fixed error it so that it's retried.
+var sendErrors = map[string]sendError{
+	"channel_not_found":     {courier.MsgFailed, "Conversation Not Found"},
+	"not_in_channel":        {courier.MsgFailed, "Bot Not In Conversation"},
+	"is_archived":           {courier.MsgFailed, "Conversation Archived"},
+	"cannot_dm_bot":         {courier.MsgFailed, "Can't Message Bot"},
+	"messages_tab_disabled": {courier.MsgFailed, "Messages Tab Disabled"},
+	"restricted_action":     {courier.MsgFailed, "Posting Restricted"},
+	"msg_too_long":          {courier.MsgFailed, "Message Too Long"},
+	"no_text":               {courier.MsgFailed, "Message Has No Text"},
+	"invalid_blocks":        {courier.MsgFailed, "Invalid Blocks"},
+	"not_authed":            {courier.MsgErrored, "Token Missing"},
+	"invalid_auth":          {courier.MsgErrored, "Token Invalid"},
+	"token_revoked":         {courier.MsgErrored, "Token Revoked"},
+	"account_inactive":      {courier.MsgErrored, "Account Inactive"},
+	"missing_scope":         {courier.MsgErrored, "Token Missing Scope"},
+	"internal_error":        {courier.MsgErrored, "Slack Unavailable"},
+	"fatal_error":           {courier.MsgErrored, "Slack Unavailable"},
+	"service_unavailable":   {courier.MsgErrored, "Slack Unavailable"},
+	"request_timeout":       {courier.MsgErrored, "Slack Unavailable"},
+}
+
+// updateTextMsg updates the text of the previously sent message with the passed in ts to that of the passed in message,
+// returning the ts of the updated message which stays its external id
+func updateTextMsg(ctx context.Context, msg courier.Msg, status courier.MsgStatus, token string, ts string) (*courier.ChannelLog, string, error) {
+	payload := &mtUpdatePayload{
+		Channel: conversationID(msg.URN()),
+		Ts:      ts,
+		Text:    msg.Text(),
+		Blocks:  quickReplyBlocks(msg, msg.Text()),
+	}
+
+	// messages posted as the user who installed the app can only be updated by them
+	if msg.Channel().BoolConfigForKey(configSendAsUser, false) {
+		token = msg.Channel().StringConfigForKey(configUserToken, "")
+		payload.AsUser = true
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	response := &UpdateResponse{}
+	log, err := callAPI(ctx, msg, status, "Updating message", func() (*http.Request, context.CancelFunc, error) {
+		return newAPIRequest(ctx, msg, token, "/chat.update", "application/json; charset=utf-8", body)
+	}, response)
+
+	if err != nil && (response.Error == "message_not_found" || response.Error == "cant_update_message") {
+		err = errors.Errorf("message %s can't be updated as it no longer exists or wasn't sent by us: %s", ts, response.Error)
+		log.WithError("Updating message Error", err)
+	}
+	if err != nil {
+		return log, "", err
+	}
+	return log, response.Ts, nil
+}
+
+// clientMsgIDNamespace is the namespace of the UUIDs we derive from our message ids to use as client message ids
+var clientMsgIDNamespace = uuid.Must(uuid.FromString("f28a4762-1c1f-484d-bd8d-ee405ff33031"))
+
+// clientMsgID returns the client_msg_id for the passed in part of the passed in message, which is derived from its id so
+// that it's the same every time we try to send it, letting us and any tooling which respects it spot duplicate posts
+func clientMsgID(msg courier.Msg, part int) string {
+	if msg.ID() == courier.NilMsgID {
+		return ""
+	}
+	if part > 0 {
+		return uuid.NewV5(clientMsgIDNamespace, fmt.Sprintf("%s-%d", msg.ID(), part)).String()
+	}
+	return uuid.NewV5(clientMsgIDNamespace, msg.ID().String()).String()
+}
+
+// maxButtonsPerBlock is how many quick reply buttons we put in each actions block
+const maxButtonsPerBlock = 5
+
+// maxButtonTextLength is the most characters Slack allows in the text of a button, which is the whole quick reply
+const maxButtonTextLength = 75
+
+// quickReplyBlocks returns the blocks to send the passed in text of the passed in message as if it has quick replies,
+// which are a section with the text followed by buttons for its quick replies, or nil if it doesn't. Action ids must be
+// unique within a message, so buttons are identified by their position, the quick reply being their value.
+func quickReplyBlocks(msg courier.Msg, text string) []mtBlock {
+	if len(msg.QuickReplies()) == 0 {
+		return nil
+	}
+
+	blocks := []mtBlock{{Type: "section", Text: &mtText{Type: "mrkdwn", Text: text}}}
+
+	for i, reply := range msg.QuickReplies() {
+		if i%maxButtonsPerBlock == 0 {
+			blocks = append(blocks, mtBlock{Type: "actions", Elements: []mtButton{}})
+		}
+		actions := &blocks[len(blocks)-1]
+		actions.Elements = append(actions.Elements, mtButton{Type: "button", Text: mtText{Type: "plain_text", Text: reply}, ActionID: fmt.Sprintf("quick_reply_%d", i), Value: reply})
+	}
+	return blocks
+}
+
+// tsRegex matches Slack message ts, which unlike event ids are used as the external ids of messages in threads
+var tsRegex = regexp.MustCompile(`^\d+\.\d+$`)
+
+// parseTs parses a Slack message ts, which is the epoch seconds with microseconds, e.g. 1503435956.000247
+func parseTs(ts string) (time.Time, error) {
+	parts := strings.SplitN(ts, ".", 2)
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid ts: %s", ts)
+	}
+
+	var micros int64
+	if len(parts) == 2 {
+		fraction := (parts[1] + "000000")[:6]
+		if micros, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return time.Time{}, errors.Errorf("invalid ts: %s", ts)
+		}
+	}
+	return time.Unix(secs, micros*int64(time.Microsecond)).UTC(), nil
+}
+
+// sendResponseURLMsgPart sends the text of the passed in message to the response URL of the slash command it replies
+// to, returning whether the response URL can no longer be used, which Slack allows for 30 minutes and 5 responses
+func sendResponseURLMsgPart(ctx context.Context, msg courier.Msg, responseURL string) (*courier.ChannelLog, bool, error) {
+	if !strings.HasPrefix(responseURL, responseURLPrefix) {
+		err := errors.Errorf("invalid response URL: %s", responseURL)
+		return courier.NewChannelLogFromError("Response URL Error", msg.Channel(), msg.ID(), 0, err), true, err
+	}
+
+	responseType, _ := jsonparser.GetString(msg.Metadata(), "response_type")
+	if responseType != responseTypeInChannel {
+		responseType = responseTypeEphemeral
+	}
+
+	body, err := json.Marshal(&responseURLPayload{Text: msg.Text(), ResponseType: responseType})
+	if err != nil {
+		return nil, false, err
+	}
+
+	req, cancel, err := handlers.NewRequestWithTimeout(ctx, msg.Channel(), "send", sendTimeout, http.MethodPost, responseURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	defer cancel()
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	rr, err := utils.MakeHTTPRequest(req)
+	log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
 
-		text := payload.Event.Text
-		msg := h.Backend().NewIncomingMsg(channel, urn, text).WithReceivedOn(date).WithExternalID(payload.EventID).WithContactName(userName)
+	// Slack tells us when a response URL has expired or been used too many times
+	response := strings.TrimSpace(string(rr.Body))
+	if rr.StatusCode == http.StatusNotFound || rr.StatusCode == http.StatusGone || strings.Contains(response, "expired_url") || strings.Contains(response, "used_url") {
+		err := errors.Errorf("response URL can no longer be used: %s", response)
+		log.WithError("Message Send Error", err)
+		return log, true, err
+	}
+	return log, false, err
+}
 
-		for _, attURL := range attachmentURLs {
-			msg.WithAttachment(attURL)
+// homeView returns the view to publish to the app home tab for the passed in message, which is either given in its
+// metadata or otherwise built as a single section with the message text
+func homeView(msg courier.Msg) (json.RawMessage, error) {
+	raw, dataType, _, err := jsonparser.Get(msg.Metadata(), "view")
+	if err == jsonparser.KeyPathNotFoundError {
+		if msg.Text() == "" {
+			return nil, errors.New("no view or text to publish")
+		}
+		section, err := json.Marshal(map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": msg.Text()},
+		})
+		if err != nil {
+			return nil, err
 		}
+		return json.Marshal(&HomeView{Type: targetHome, Blocks: []json.RawMessage{section}})
+	}
+	if err != nil || dataType != jsonparser.Object {
+		return nil, errors.New("view must be an object")
+	}
 
-		return handlers.WriteMsgsAndResponse(ctx, h, []courier.Msg{msg}, w, r)
+	view := &HomeView{}
+	if err := json.Unmarshal(raw, view); err != nil {
+		return nil, errors.Wrap(err, "unable to parse view")
 	}
-	return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no message")
+	if view.Type != targetHome {
+		return nil, errors.Errorf("view type must be %s, got: %s", targetHome, view.Type)
+	}
+	if len(view.Blocks) == 0 || len(view.Blocks) > maxHomeViewBlocks {
+		return nil, errors.Errorf("view must have between 1 and %d blocks, got: %d", maxHomeViewBlocks, len(view.Blocks))
+	}
+	for i, b := range view.Blocks {
+		if blockType, _ := jsonparser.GetString(b, "type"); blockType == "" {
+			return nil, errors.Errorf("view block %d has no type", i)
+		}
+	}
+	return raw, nil
 }
 
-func (h *handler) resolveFile(ctx context.Context, channel courier.Channel, file File) (string, error) {
-	userToken := channel.StringConfigForKey(configUserToken, "")
+// publishHomeView publishes the passed in view as the app home tab of the user the message is being sent to
+func publishHomeView(ctx context.Context, msg courier.Msg, token string, view json.RawMessage) (*courier.ChannelLog, error) {
+	publishURL := channelAPIURL(msg.Channel()) + "/views.publish"
 
-	fileApiURL := apiURL + "/files.sharedPublicURL"
+	_, userID := urnIDs(msg.URN())
+	if userID == "" {
+		return nil, errors.Errorf("no user to publish home view for in URN: %s", msg.URN())
+	}
 
-	data := strings.NewReader(fmt.Sprintf(`{"file":"%s"}`, file.ID))
-	req, err := http.NewRequest(http.MethodPost, fileApiURL, data)
+	body, err := json.Marshal(&viewsPublishPayload{UserID: userID, View: view})
 	if err != nil {
-		courier.LogRequestError(req, channel, err)
-		return "", err
+		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/json; charset=utf-8")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", userToken))
 
-	rr, err := utils.MakeHTTPRequest(req)
+	req, cancel, err := handlers.NewRequestWithTimeout(ctx, msg.Channel(), "send", sendTimeout, http.MethodPost, publishURL, bytes.NewReader(body))
 	if err != nil {
-		log := courier.NewChannelLogFromRR("File Resolving", channel, courier.NilMsgID, rr).WithError("File Resolving Error", err)
-		h.Backend().WriteChannelLogs(ctx, []*courier.ChannelLog{log})
-		return "", err
+		return nil, err
 	}
+	defer cancel()
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	var fResponse FileResponse
-	if err := json.Unmarshal([]byte(rr.Body), &fResponse); err != nil {
-		return "", errors.Errorf("couldn't unmarshal file response: %v", err)
+	rr, err := utils.MakeHTTPRequest(req)
+	log := courier.NewChannelLogFromRR("Home View Published", msg.Channel(), msg.ID(), rr).WithError("Home View Publish Error", err)
+	if err != nil {
+		return log, err
 	}
 
-	currentFile := fResponse.File
-
-	if !fResponse.OK {
-		if fResponse.Error != ErrAlreadyPublic {
-			if fResponse.Error == ErrPublicVideoNotAllowed {
-				return "", errors.Errorf("public sharing of videos is not available for a free instance of Slack. file id: %s. error: %s", file.ID, fResponse.Error)
-			}
-			return "", errors.Errorf("couldn't resolve file for file id: %s. error: %s", file.ID, fResponse.Error)
-		}
-		currentFile = file
+	ok, err := jsonparser.GetBoolean(rr.Body, "ok")
+	if err != nil {
+		log.WithError("Home View Publish Error", err)
+		return log, err
 	}
-
-	pubLnkSplited := strings.Split(currentFile.PermalinkPublic, "-")
-	pubSecret := pubLnkSplited[len(pubLnkSplited)-1]
-	filePath := currentFile.URLPrivateDownload + "?pub_secret=" + pubSecret
-
-	return filePath, nil
+	if !ok {
+		errDescription, _ := jsonparser.GetString(rr.Body, "error")
+		err := errors.Errorf("couldn't publish home view: %s", errDescription)
+		log.WithError("Home View Publish Error", err)
+		return log, err
+	}
+	return log, nil
 }
 
-func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
-	botToken := msg.Channel().StringConfigForKey(configBotToken, "")
-	if botToken == "" {
-		return nil, fmt.Errorf("missing bot token for SL/slack channel")
+// setPresence sets the presence of the bot user, which needs the users:write scope
+func setPresence(ctx context.Context, msg courier.Msg, status courier.MsgStatus, token string, presence string) (*courier.ChannelLog, error) {
+	form := url.Values{"presence": []string{presence}}
+	response := &PresenceResponse{}
+	log, err := callAPI(ctx, msg, status, "Setting presence", func() (*http.Request, context.CancelFunc, error) {
+		return newAPIRequest(ctx, msg, token, "/users.setPresence", "application/x-www-form-urlencoded", []byte(form.Encode()))
+	}, response)
+
+	if err != nil && response.Error == "missing_scope" {
+		err = errors.Errorf("bot token is missing the %s scope needed to set presence", response.Needed)
+		log.WithError("Setting presence Error", err)
 	}
+	return log, err
+}
 
-	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+// reportWorkflowStep completes the workflow step with the passed in execute id with the outputs in the metadata of the
+// passed in message, or fails it if the metadata has an error
+func reportWorkflowStep(ctx context.Context, msg courier.Msg, status courier.MsgStatus, token string, executeID string) (*courier.ChannelLog, error) {
+	method, description := "/workflows.stepCompleted", "Completing workflow step"
+	payload := &mtWorkflowStepPayload{WorkflowStepExecuteID: executeID}
+
+	if stepError, _ := jsonparser.GetString(msg.Metadata(), "error"); stepError != "" {
+		method, description = "/workflows.stepFailed", "Failing workflow step"
+		payload.Error = &mtWorkflowStepError{Message: stepError}
+	} else if outputs, dataType, _, _ := jsonparser.Get(msg.Metadata(), "outputs"); dataType == jsonparser.Object {
+		payload.Outputs = outputs
+	}
 
-	hasError := true
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, attachment := range msg.Attachments() {
-		fileAttachment, log, err := parseAttachmentToFileParams(msg, attachment)
-		hasError = err != nil
-		status.AddLog(log)
+	return callAPI(ctx, msg, status, description, func() (*http.Request, context.CancelFunc, error) {
+		return newAPIRequest(ctx, msg, token, method, "application/json; charset=utf-8", body)
+	}, &WorkflowStepResponse{})
+}
 
-		if fileAttachment != nil {
-			log, err = sendFilePart(msg, botToken, fileAttachment)
-			hasError = err != nil
-			status.AddLog(log)
-		}
+// linkDisplay returns how links in the passed in message should be displayed, which can be set per message in its
+// metadata, or otherwise per channel in its config. An empty value means we leave it to Slack's default.
+func linkDisplay(msg courier.Msg) string {
+	display, _ := jsonparser.GetString(msg.Metadata(), configLinkDisplay)
+	if display == "" {
+		display = msg.Channel().StringConfigForKey(configLinkDisplay, "")
 	}
-
-	if msg.Text() != "" {
-		log, err := sendTextMsgPart(msg, botToken)
-		hasError = err != nil
-		status.AddLog(log)
+	display = strings.ToLower(display)
+	if display != linkDisplayCompact && display != linkDisplayExpanded {
+		return ""
 	}
+	return display
+}
 
-	if !hasError {
-		status.SetStatus(courier.MsgWired)
+// unfurlConfig returns the value of the passed in unfurl config of the channel, or nil if it isn't set so that we leave
+// it to Slack's default
+func unfurlConfig(channel courier.Channel, key string) *bool {
+	if channel.ConfigForKey(key, nil) == nil {
+		return nil
 	}
-
-	return status, nil
+	unfurl := channel.BoolConfigForKey(key, true)
+	return &unfurl
 }
 
-func sendTextMsgPart(msg courier.Msg, token string) (*courier.ChannelLog, error) {
-	sendURL := apiURL + "/chat.postMessage"
-
-	msgPayload := &mtPayload{
-		Channel: msg.URN().Path(),
-		Text:    msg.Text(),
+// checkMembership checks the bot is a member of the conversation the passed in message is being sent to, returning an
+// error saying how to fix it if not. Messages to users aren't checked as they are sent as direct messages.
+func (h *handler) checkMembership(ctx context.Context, msg courier.Msg, token string) (*courier.ChannelLog, error) {
+	conversation := conversationID(msg.URN())
+	if !strings.HasPrefix(conversation, "C") && !strings.HasPrefix(conversation, "G") {
+		return nil, nil
 	}
 
-	body, err := json.Marshal(msgPayload)
-	if err != nil {
-		return nil, err
+	cacheKey := fmt.Sprintf("%s:%s", msg.Channel().UUID(), conversation)
+	if _, found := h.memberships.Get(cacheKey); found {
+		return nil, nil
 	}
 
-	req, err := http.NewRequest(http.MethodPost, sendURL, bytes.NewReader(body))
+	req, cancel, err := handlers.NewRequestWithTimeout(ctx, msg.Channel(), "lookup", lookupTimeout, http.MethodGet, channelAPIURL(msg.Channel())+"/conversations.info", nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	defer cancel()
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	rr, err := utils.MakeHTTPRequest(req)
-
-	log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
+	q := req.URL.Query()
+	q.Add("channel", conversation)
+	req.URL.RawQuery = q.Encode()
 
-	ok, err := jsonparser.GetBoolean([]byte(rr.Body), "ok")
+	rr, err := utils.MakeHTTPRequest(req)
+	log := courier.NewChannelLogFromRR("Checking membership", msg.Channel(), msg.ID(), rr).WithError("Checking membership error", err)
 	if err != nil {
 		return log, err
 	}
 
-	if !ok {
-		errDescription, err := jsonparser.GetString([]byte(rr.Body), "error")
-		if err != nil {
-			return log, err
-		}
-		return log, errors.New(errDescription)
+	info := &ConversationInfoResponse{}
+	if err := json.Unmarshal(rr.Body, info); err != nil {
+		log.WithError("Checking membership error", err)
+		return log, err
+	}
+	if !info.OK {
+		err := errors.Errorf("couldn't check membership: %s", info.Error)
+		log.WithError("Checking membership error", err)
+		return log, err
+	}
+	if !info.Channel.IsMember {
+		err := errors.Errorf("bot is not a member of conversation %s, invite it with /invite in the conversation so that it can send there", conversation)
+		log.WithError("Bot not in conversation", err)
+		return log, err
 	}
+
+	h.memberships.Set(cacheKey, true, cache.DefaultExpiration)
 	return log, nil
 }
 
-func parseAttachmentToFileParams(msg courier.Msg, attachment string) (*FileParams, *courier.ChannelLog, error) {
-	_, attURL := handlers.SplitAttachment(attachment)
+// getLatestMessageTs returns the ts of the latest message in the conversation the passed in message is being sent to,
+// or an empty string if the conversation has no messages
+func getLatestMessageTs(ctx context.Context, msg courier.Msg, token string) (string, *courier.ChannelLog, error) {
+	historyURL := channelAPIURL(msg.Channel()) + "/conversations.history"
 
-	req, err := http.NewRequest(http.MethodGet, attURL, nil)
+	req, cancel, err := handlers.NewRequestWithTimeout(ctx, msg.Channel(), "lookup", lookupTimeout, http.MethodGet, historyURL, nil)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "error building file request")
+		return "", nil, err
+	}
+	defer cancel()
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	q := req.URL.Query()
+	q.Add("channel", conversationID(msg.URN()))
+	q.Add("limit", "1")
+	req.URL.RawQuery = q.Encode()
+
+	rr, err := utils.MakeHTTPRequest(req)
+	log := courier.NewChannelLogFromRR("Fetching latest message", msg.Channel(), msg.ID(), rr).WithError("Fetching latest message error", err)
+	if err != nil {
+		return "", log, err
+	}
+
+	history := &HistoryResponse{}
+	if err := json.Unmarshal(rr.Body, history); err != nil {
+		log.WithError("Fetching latest message error", err)
+		return "", log, err
+	}
+	if !history.OK {
+		err := errors.Errorf("couldn't fetch latest message: %s", history.Error)
+		log.WithError("Fetching latest message error", err)
+		return "", log, err
+	}
+	if len(history.Messages) == 0 {
+		return "", log, nil
+	}
+	return history.Messages[0].Ts, log, nil
+}
+
+func parseAttachmentToFileParams(ctx context.Context, msg courier.Msg, attachment string) (*FileParams, *courier.ChannelLog, error) {
+	attType, attURL := handlers.SplitAttachment(attachment)
+
+	// download in chunks so that we can give up on files over our limit without holding all of them in memory
+	maxSize := msg.Channel().IntConfigForKey(configMaxFileSize, defaultMaxFileSize)
+	file, log, err := handlers.DownloadWithLimit(ctx, msg.Channel(), msg.ID(), attURL, nil, maxSize, downloadTimeout)
+	if err != nil {
+		return nil, log, err
 	}
-	resp, err := utils.MakeHTTPRequest(req)
-	log := courier.NewChannelLogFromRR("Fetching attachment", msg.Channel(), msg.ID(), resp).WithError("error fetching media", err)
 
 	filename, err := utils.BasePathForURL(attURL)
 	if err != nil {
 		return nil, log, err
 	}
 	return &FileParams{
-		File:     resp.Body,
-		FileName: filename,
-		Channels: msg.URN().Path(),
+		File:        file,
+		FileName:    utils.FilenameForMimeType(filename, attType),
+		ContentType: handlers.UploadContentType(msg.Channel(), attType, ""),
+		Channels:    conversationID(msg.URN()),
 	}, log, nil
 }
 
-func sendFilePart(msg courier.Msg, token string, fileParams *FileParams) (*courier.ChannelLog, error) {
-	uploadURL := apiURL + "/files.upload"
+// codeBlockRegex matches text ending in a code block, capturing any text before it and the code in it
+var codeBlockRegex = regexp.MustCompile("(?s)^(.*?)```\n?(.*?)\n?```\\s*$")
+
+// snippetParams returns the params to upload the text of the passed in message as a snippet, or nil if it shouldn't be.
+// Messages are snippets if their metadata says so, or if the channel sends code as snippets and their text ends in a
+// code block, any text before which is the comment of the snippet.
+func snippetParams(msg courier.Msg) *FileParams {
+	flagged, _ := jsonparser.GetBoolean(msg.Metadata(), "snippet")
+	if !flagged && !msg.Channel().BoolConfigForKey(configCodeSnippets, false) {
+		return nil
+	}
+
+	comment, code := "", msg.Text()
+	if match := codeBlockRegex.FindStringSubmatch(msg.Text()); match != nil && !strings.Contains(match[1]+match[2], "```") {
+		comment, code = strings.TrimSpace(match[1]), match[2]
+	} else if !flagged {
+		return nil
+	}
+	if strings.TrimSpace(code) == "" {
+		return nil
+	}
+
+	return &FileParams{
+		File:           []byte(code),
+		FileName:       "snippet.txt",
+		ContentType:    "text/plain",
+		SnippetType:    "text",
+		Channels:       conversationID(msg.URN()),
+		InitialComment: comment,
+	}
+}
+
+// sendFilePart uploads the passed in file and shares it in the conversation of the message using Slack's external upload
+// flow, or the legacy files.upload endpoint if the channel is configured to use it while that's still supported
+func sendFilePart(ctx context.Context, msg courier.Msg, status courier.MsgStatus, token string, fileParams *FileParams) (*courier.ChannelLog, error) {
+	if msg.Channel().BoolConfigForKey(configLegacyFileUpload, false) {
+		return sendLegacyFilePart(ctx, msg, status, token, fileParams)
+	}
 
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	mediaPart, err := writer.CreateFormFile("file", fileParams.FileName)
+	// first we get a URL to upload the file to
+	form := url.Values{"filename": []string{fileParams.FileName}, "length": []string{strconv.Itoa(len(fileParams.File))}}
+	if fileParams.SnippetType != "" {
+		form.Set("snippet_type", fileParams.SnippetType)
+	}
+	uploadURLResponse := &UploadURLResponse{}
+	log, err := callAPI(ctx, msg, status, "Getting upload URL", func() (*http.Request, context.CancelFunc, error) {
+		return newAPIRequest(ctx, msg, token, "/files.getUploadURLExternal", "application/x-www-form-urlencoded", []byte(form.Encode()))
+	}, uploadURLResponse)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create file form field")
+		return log, err
 	}
-	io.Copy(mediaPart, bytes.NewReader(fileParams.File))
+	status.AddLog(log)
 
-	filenamePart, err := writer.CreateFormField("filename")
+	// then upload it there
+	log, err = callAPI(ctx, msg, status, "Uploading file", func() (*http.Request, context.CancelFunc, error) {
+		req, cancel, err := handlers.NewRequestWithTimeout(ctx, msg.Channel(), "upload", uploadTimeout, http.MethodPost, uploadURLResponse.UploadURL, bytes.NewReader(fileParams.File))
+		if err != nil {
+			return nil, nil, err
+		}
+		contentType := fileParams.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		req.Header.Set("Content-Type", contentType)
+		return req, cancel, nil
+	}, nil)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create filename form field")
+		return log, err
+	}
+	status.AddLog(log)
+
+	// files can only be shared in conversations, so for direct messages we need the id of the conversation with the user
+	channelID := fileParams.Channels
+	if strings.HasPrefix(channelID, "U") || strings.HasPrefix(channelID, "W") {
+		openResponse := &ConversationInfoResponse{}
+		body, _ := json.Marshal(map[string]string{"users": channelID})
+		log, err = callAPI(ctx, msg, status, "Opening conversation", func() (*http.Request, context.CancelFunc, error) {
+			return newAPIRequest(ctx, msg, token, "/conversations.open", "application/json; charset=utf-8", body)
+		}, openResponse)
+		if err != nil {
+			return log, err
+		}
+		status.AddLog(log)
+		channelID = openResponse.Channel.ID
 	}
-	io.Copy(filenamePart, strings.NewReader(fileParams.FileName))
 
-	channelsPart, err := writer.CreateFormField("channels")
+	// and finally complete the upload, which shares the file in the conversation
+	body, err := json.Marshal(&completeUploadPayload{
+		Files:          []completeUploadFile{{ID: uploadURLResponse.FileID, Title: fileParams.FileName}},
+		ChannelID:      channelID,
+		InitialComment: fileParams.InitialComment,
+	})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to create channels form field")
+		return nil, err
 	}
-	io.Copy(channelsPart, strings.NewReader(fileParams.Channels))
+	return callAPI(ctx, msg, status, "Completing upload", func() (*http.Request, context.CancelFunc, error) {
+		return newAPIRequest(ctx, msg, token, "/files.completeUploadExternal", "application/json; charset=utf-8", body)
+	}, &CompleteUploadResponse{})
+}
 
-	writer.Close()
+// channelAPIURL returns the base URL of the Slack API for the passed in channel, which deployments on other Slack hosts
+// such as GovSlack can configure
+func channelAPIURL(channel courier.Channel) string {
+	return strings.TrimSuffix(channel.StringConfigForKey(configAPIBaseURL, apiURL), "/")
+}
 
-	req, err := http.NewRequest(http.MethodPost, uploadURL, bytes.NewReader(body.Bytes()))
+// newAPIRequest builds a POST request to the passed in Slack API method with the passed in body
+func newAPIRequest(ctx context.Context, msg courier.Msg, token string, method string, contentType string, body []byte) (*http.Request, context.CancelFunc, error) {
+	req, cancel, err := handlers.NewRequestWithTimeout(ctx, msg.Channel(), "send", sendTimeout, http.MethodPost, channelAPIURL(msg.Channel())+method, bytes.NewReader(body))
 	if err != nil {
-		return nil, errors.Wrapf(err, "error building request to file upload endpoint")
+		return nil, nil, err
 	}
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Add("Content-Type", writer.FormDataContentType())
-	resp, err := utils.MakeHTTPRequest(req)
+	return req, cancel, nil
+}
+
+// callAPI makes the request built by the passed in func, returning its log and an error if it fails. If a response is
+// passed in, the request is to the Slack API whose JSON response is unmarshalled into it, and which has failed if it
+// isn't ok, in which case the error Slack gives us is what we return.
+func callAPI(ctx context.Context, msg courier.Msg, status courier.MsgStatus, description string, newRequest func() (*http.Request, context.CancelFunc, error), response interface{}) (*courier.ChannelLog, error) {
+	rr, err := makeRequest(ctx, newRequest, func(rr *utils.RequestResponse, err error) {
+		status.AddLog(courier.NewChannelLogFromRR(description, msg.Channel(), msg.ID(), rr).WithError(description+" Rate Limited", err))
+	})
+	if rr == nil {
+		return courier.NewChannelLogFromError(description+" Error", msg.Channel(), msg.ID(), 0, err), err
+	}
+
+	log := courier.NewChannelLogFromRR(description, msg.Channel(), msg.ID(), rr).WithError(description+" Error", err)
+	if err != nil || response == nil {
+		return log, err
+	}
+
+	if err := json.Unmarshal(rr.Body, response); err != nil {
+		log.WithError(description+" Error", err)
+		return log, err
+	}
+	if ok, _ := jsonparser.GetBoolean(rr.Body, "ok"); !ok {
+		errDescription, _ := jsonparser.GetString(rr.Body, "error")
+		err := errors.Errorf("%s failed: %s", strings.ToLower(description), errDescription)
+		log.WithError(description+" Error", err)
+		return log, err
+	}
+	return log, nil
+}
+
+// sendLegacyFilePart uploads the passed in file and shares it in the conversation of the message using the files.upload
+// endpoint which Slack is retiring
+func sendLegacyFilePart(ctx context.Context, msg courier.Msg, status courier.MsgStatus, token string, fileParams *FileParams) (*courier.ChannelLog, error) {
+	uploadURL := channelAPIURL(msg.Channel()) + "/files.upload"
+
+	newRequest := func() (*http.Request, context.CancelFunc, error) {
+		fields := map[string]string{"filename": fileParams.FileName, "channels": fileParams.Channels}
+		if fileParams.InitialComment != "" {
+			fields["initial_comment"] = fileParams.InitialComment
+		}
+		if fileParams.SnippetType != "" {
+			fields["filetype"] = fileParams.SnippetType
+		}
+		req, err := utils.BuildMultipartRequest(uploadURL, fields, bytes.NewReader(fileParams.File), "file", fileParams.FileName, fileParams.ContentType)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error building request to file upload endpoint")
+		}
+		ctx, cancel := context.WithTimeout(ctx, handlers.RequestTimeout(msg.Channel(), "upload", uploadTimeout))
+		req = req.WithContext(ctx)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		return req, cancel, nil
+	}
+
+	resp, err := makeRequest(ctx, newRequest, func(rr *utils.RequestResponse, err error) {
+		status.AddLog(courier.NewChannelLogFromRR("uploading file to Slack", msg.Channel(), msg.ID(), rr).WithError("File Upload Rate Limited", err))
+	})
+	if resp == nil {
+		return courier.NewChannelLogFromError("Error uploading file to Slack", msg.Channel(), msg.ID(), 0, err), err
+	}
+	log := courier.NewChannelLogFromRR("uploading file to Slack", msg.Channel(), msg.ID(), resp)
 	if err != nil {
-		return nil, errors.Wrapf(err, "error uploading file to slack")
+		err = errors.Wrapf(err, "error uploading file to slack")
+		return log.WithError("Error uploading file to Slack", err), err
 	}
 
 	var fr FileResponse
 	if err := json.Unmarshal([]byte(resp.Body), &fr); err != nil {
-		return nil, errors.Errorf("couldn't unmarshal file response: %v", err)
+		err = errors.Errorf("couldn't unmarshal file response: %v", err)
+		return log.WithError("Error uploading file to Slack", err), err
 	}
 
 	if !fr.OK {
-		return nil, errors.Errorf("error uploading file to slack: %s.", fr.Error)
+		err = errors.Errorf("error uploading file to slack: %s.", fr.Error)
+		return log.WithError("Error uploading file to Slack", err), err
 	}
 
-	return courier.NewChannelLogFromRR("uploading file to Slack", msg.Channel(), msg.ID(), resp).WithError("Error uploading file to Slack", err), nil
+	return log, nil
 }
 
-func getUserInfo(userSlackID string, channel courier.Channel) (*UserInfo, *courier.ChannelLog, error) {
+func getUserInfo(ctx context.Context, userSlackID string, channel courier.Channel) (*UserInfo, *courier.ChannelLog, error) {
 	resource := "/users.info"
-	urlStr := apiURL + resource
+	urlStr := channelAPIURL(channel) + resource
 
-	req, err := http.NewRequest(http.MethodGet, urlStr, nil)
+	req, cancel, err := handlers.NewRequestWithTimeout(ctx, channel, "lookup", lookupTimeout, http.MethodGet, urlStr, nil)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer cancel()
 
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Add("Authorization", "Bearer "+channel.StringConfigForKey(configBotToken, ""))
@@ -334,14 +2413,157 @@ func getUserInfo(userSlackID string, channel courier.Channel) (*UserInfo, *couri
 		log := courier.NewChannelLogFromRR("Get User info", channel, courier.NilMsgID, rr).WithError("Unmarshal User Info Error", err)
 		return nil, log, err
 	}
+	if !uInfo.Ok {
+		err := errors.Errorf("couldn't get user info: %s", uInfo.Error)
+		log := courier.NewChannelLogFromRR("Get User info", channel, courier.NilMsgID, rr).WithError("Request User Info Error", err)
+		return nil, log, err
+	}
 
 	return uInfo, nil, nil
 }
 
+func getConversationInfo(ctx context.Context, conversationID string, channel courier.Channel) (*ConversationInfoResponse, *courier.ChannelLog, error) {
+	req, cancel, err := handlers.NewRequestWithTimeout(ctx, channel, "lookup", lookupTimeout, http.MethodGet, channelAPIURL(channel)+"/conversations.info", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer cancel()
+	req.Header.Add("Authorization", "Bearer "+channel.StringConfigForKey(configBotToken, ""))
+
+	q := req.URL.Query()
+	q.Add("channel", conversationID)
+	req.URL.RawQuery = q.Encode()
+
+	rr, err := utils.MakeHTTPRequest(req)
+	if err != nil {
+		log := courier.NewChannelLogFromRR("Get Conversation info", channel, courier.NilMsgID, rr).WithError("Request Conversation Info Error", err)
+		return nil, log, err
+	}
+
+	info := &ConversationInfoResponse{}
+	if err := json.Unmarshal(rr.Body, info); err != nil {
+		log := courier.NewChannelLogFromRR("Get Conversation info", channel, courier.NilMsgID, rr).WithError("Unmarshal Conversation Info Error", err)
+		return nil, log, err
+	}
+	if !info.OK {
+		err := errors.Errorf("couldn't get conversation info: %s", info.Error)
+		log := courier.NewChannelLogFromRR("Get Conversation info", channel, courier.NilMsgID, rr).WithError("Request Conversation Info Error", err)
+		return nil, log, err
+	}
+
+	return info, nil, nil
+}
+
+func getThreadParent(ctx context.Context, channel courier.Channel, conversationID string, threadTs string) (*threadParent, *courier.ChannelLog, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, channelAPIURL(channel)+"/conversations.replies", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Add("Authorization", "Bearer "+channel.StringConfigForKey(configBotToken, ""))
+
+	q := req.URL.Query()
+	q.Add("channel", conversationID)
+	q.Add("ts", threadTs)
+	q.Add("limit", "1")
+	req.URL.RawQuery = q.Encode()
+
+	rr, err := utils.MakeHTTPRequest(req)
+	if err != nil {
+		log := courier.NewChannelLogFromRR("Get Thread Parent", channel, courier.NilMsgID, rr).WithError("Request Thread Parent Error", err)
+		return nil, log, err
+	}
+
+	// the first message of the replies to a thread is always its parent
+	replies := &HistoryResponse{}
+	if err := json.Unmarshal(rr.Body, replies); err != nil {
+		log := courier.NewChannelLogFromRR("Get Thread Parent", channel, courier.NilMsgID, rr).WithError("Unmarshal Thread Parent Error", err)
+		return nil, log, err
+	}
+	if !replies.OK || len(replies.Messages) == 0 {
+		err := errors.Errorf("couldn't get thread parent: %s", replies.Error)
+		log := courier.NewChannelLogFromRR("Get Thread Parent", channel, courier.NilMsgID, rr).WithError("Request Thread Parent Error", err)
+		return nil, log, err
+	}
+
+	parent := replies.Messages[0]
+	return &threadParent{User: parent.User, Text: parent.Text, Ts: parent.Ts}, nil, nil
+}
+
 // mtPayload is a struct that represents the body of a SendMmsg text part
 type mtPayload struct {
-	Channel string `json:"channel"`
-	Text    string `json:"text"`
+	Channel     string `json:"channel"`
+	Text        string `json:"text"`
+	ThreadTs    string `json:"thread_ts,omitempty"`
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	AsUser      bool   `json:"as_user,omitempty"`
+
+	Username  string `json:"username,omitempty"`
+	IconEmoji string `json:"icon_emoji,omitempty"`
+	IconURL   string `json:"icon_url,omitempty"`
+
+	UnfurlLinks *bool `json:"unfurl_links,omitempty"`
+	UnfurlMedia *bool `json:"unfurl_media,omitempty"`
+
+	// Blocks are only sent for messages with quick replies, the text then being the fallback for notifications
+	Blocks []mtBlock `json:"blocks,omitempty"`
+}
+
+// mtUpdatePayload is the body of a chat.update request, which replaces the text and blocks of a sent message
+type mtUpdatePayload struct {
+	Channel string    `json:"channel"`
+	Ts      string    `json:"ts"`
+	Text    string    `json:"text"`
+	AsUser  bool      `json:"as_user,omitempty"`
+	Blocks  []mtBlock `json:"blocks,omitempty"`
+}
+
+// mtWorkflowStepPayload is the body of a workflows.stepCompleted or workflows.stepFailed request
+type mtWorkflowStepPayload struct {
+	WorkflowStepExecuteID string               `json:"workflow_step_execute_id"`
+	Outputs               json.RawMessage      `json:"outputs,omitempty"`
+	Error                 *mtWorkflowStepError `json:"error,omitempty"`
+}
+
+type mtWorkflowStepError struct {
+	Message string `json:"message"`
+}
+
+// mtBlock is a Block Kit block of a sent message, either a section with its text or actions with its buttons, see
+// https://api.slack.com/reference/block-kit/blocks
+type mtBlock struct {
+	Type     string     `json:"type"`
+	Text     *mtText    `json:"text,omitempty"`
+	Elements []mtButton `json:"elements,omitempty"`
+}
+
+type mtText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type mtButton struct {
+	Type     string `json:"type"`
+	Text     mtText `json:"text"`
+	ActionID string `json:"action_id"`
+	Value    string `json:"value,omitempty"`
+}
+
+// responseURLPayload is a struct that represents the body of a response to a slash command sent to its response_url, more information see https://api.slack.com/interactivity/handling#message_responses.
+type responseURLPayload struct {
+	Text         string `json:"text"`
+	ResponseType string `json:"response_type"`
+}
+
+// viewsPublishPayload is a struct that represents the body of a request to the views.publish slack api method, more information see https://api.slack.com/methods/views.publish.
+type viewsPublishPayload struct {
+	UserID string          `json:"user_id"`
+	View   json.RawMessage `json:"view"`
+}
+
+// HomeView is a struct that represents an app home tab view, more information see https://api.slack.com/reference/surfaces/views.
+type HomeView struct {
+	Type   string            `json:"type"`
+	Blocks []json.RawMessage `json:"blocks"`
 }
 
 // moPayload is a struct that represents message payload from message type event
@@ -350,15 +2572,62 @@ type moPayload struct {
 	TeamID   string `json:"team_id,omitempty"`
 	APIAppID string `json:"api_app_id,omitempty"`
 	Event    struct {
-		Type        string `json:"type,omitempty"`
-		Channel     string `json:"channel,omitempty"`
-		User        string `json:"user,omitempty"`
-		Text        string `json:"text,omitempty"`
-		Ts          string `json:"ts,omitempty"`
-		EventTs     string `json:"event_ts,omitempty"`
-		ChannelType string `json:"channel_type,omitempty"`
-		Files       []File `json:"files"`
-		BotID       string `json:"bot_id,omitempty"`
+		Type        string          `json:"type,omitempty"`
+		Channel     string          `json:"channel,omitempty"`
+		User        string          `json:"user,omitempty"`
+		Text        string          `json:"text,omitempty"`
+		Ts          string          `json:"ts,omitempty"`
+		ThreadTs    string          `json:"thread_ts,omitempty"`
+		EventTs     string          `json:"event_ts,omitempty"`
+		ChannelType string          `json:"channel_type,omitempty"`
+		Files       []File          `json:"files"`
+		BotID       string          `json:"bot_id,omitempty"`
+		AppID       string          `json:"app_id,omitempty"`
+		Subtype     string          `json:"subtype,omitempty"`
+		Blocks      json.RawMessage `json:"blocks,omitempty"`
+		Reaction    string          `json:"reaction,omitempty"`
+		ItemUser    string          `json:"item_user,omitempty"`
+		Item        struct {
+			Type    string `json:"type,omitempty"`
+			Channel string `json:"channel,omitempty"`
+			Ts      string `json:"ts,omitempty"`
+		} `json:"item,omitempty"`
+		Message *struct {
+			User     string          `json:"user,omitempty"`
+			Text     string          `json:"text,omitempty"`
+			Ts       string          `json:"ts,omitempty"`
+			ThreadTs string          `json:"thread_ts,omitempty"`
+			BotID    string          `json:"bot_id,omitempty"`
+			AppID    string          `json:"app_id,omitempty"`
+			Blocks   json.RawMessage `json:"blocks,omitempty"`
+		} `json:"message,omitempty"`
+		Attachments []struct {
+			IsShare    bool   `json:"is_share,omitempty"`
+			AuthorID   string `json:"author_id,omitempty"`
+			AuthorName string `json:"author_name,omitempty"`
+			ChannelID  string `json:"channel_id,omitempty"`
+			Text       string `json:"text,omitempty"`
+			Ts         string `json:"ts,omitempty"`
+		} `json:"attachments,omitempty"`
+		PreviousMessage *struct {
+			Text string `json:"text,omitempty"`
+		} `json:"previous_message,omitempty"`
+		WorkflowStep *struct {
+			WorkflowStepExecuteID string `json:"workflow_step_execute_id"`
+			WorkflowID            string `json:"workflow_id"`
+			StepID                string `json:"step_id"`
+			Inputs                map[string]struct {
+				Value interface{} `json:"value"`
+			} `json:"inputs"`
+		} `json:"workflow_step,omitempty"`
+		File      *File  `json:"file,omitempty"`
+		FileID    string `json:"file_id,omitempty"`
+		UserID    string `json:"user_id,omitempty"`
+		ChannelID string `json:"channel_id,omitempty"`
+		Comment   *struct {
+			User    string `json:"user,omitempty"`
+			Comment string `json:"comment,omitempty"`
+		} `json:"comment,omitempty"`
 	} `json:"event,omitempty"`
 	Type           string   `json:"type,omitempty"`
 	AuthedUsers    []string `json:"authed_users,omitempty"`
@@ -419,18 +2688,96 @@ type FileResponse struct {
 	Error string `json:"error"`
 }
 
+// UploadURLResponse is a struct that represents the response from request in files.getUploadURLExternal slack api method, more information see https://api.slack.com/methods/files.getUploadURLExternal.
+type UploadURLResponse struct {
+	OK        bool   `json:"ok"`
+	Error     string `json:"error"`
+	UploadURL string `json:"upload_url"`
+	FileID    string `json:"file_id"`
+}
+
+// CompleteUploadResponse is a struct that represents the response from request in files.completeUploadExternal slack api method, more information see https://api.slack.com/methods/files.completeUploadExternal.
+type CompleteUploadResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+	Files []File `json:"files"`
+}
+
+type completeUploadFile struct {
+	ID    string `json:"id"`
+	Title string `json:"title,omitempty"`
+}
+
+type completeUploadPayload struct {
+	Files          []completeUploadFile `json:"files"`
+	ChannelID      string               `json:"channel_id"`
+	InitialComment string               `json:"initial_comment,omitempty"`
+}
+
+// WorkflowStepResponse is a struct that represents the response from request in workflows.stepCompleted and workflows.stepFailed slack api methods, more information see https://api.slack.com/methods/workflows.stepCompleted.
+type WorkflowStepResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// UpdateResponse is a struct that represents the response from request in chat.update slack api method, more information see https://api.slack.com/methods/chat.update.
+type UpdateResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	Ts      string `json:"ts"`
+}
+
+// PresenceResponse is a struct that represents the response from request in users.setPresence slack api method, more information see https://api.slack.com/methods/users.setPresence.
+type PresenceResponse struct {
+	OK     bool   `json:"ok"`
+	Error  string `json:"error"`
+	Needed string `json:"needed"`
+}
+
+// ConversationInfoResponse is a struct that represents the response from request in conversations.info slack api method, more information see https://api.slack.com/methods/conversations.info.
+type ConversationInfoResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		IsMember bool   `json:"is_member"`
+	} `json:"channel"`
+}
+
+// HistoryResponse is a struct that represents the response from request in conversations.history slack api method, more information see https://api.slack.com/methods/conversations.history.
+type HistoryResponse struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error"`
+	Messages []struct {
+		Type string `json:"type"`
+		User string `json:"user"`
+		Text string `json:"text"`
+		Ts   string `json:"ts"`
+	} `json:"messages"`
+}
+
 // FileParams is a struct that represents the request params send to slack api files.upload method to send a file to a channel conversation or a direct message conversation with a user, more
 // information see https://api.slack.com/methods/files.upload.
 type FileParams struct {
-	File     []byte `json:"file,omitempty"`
-	FileName string `json:"filename,omitempty"`
-	Channels string `json:"channels,omitempty"`
+	File           []byte `json:"file,omitempty"`
+	FileName       string `json:"filename,omitempty"`
+	Channels       string `json:"channels,omitempty"`
+	InitialComment string `json:"initial_comment,omitempty"`
+
+	// ContentType is the type the file is uploaded as, Slack sniffing it if this is empty
+	ContentType string `json:"-"`
+
+	// SnippetType is the type of snippet the file is shared as, if it's text to be shown as a snippet
+	SnippetType string `json:"-"`
 }
 
 // UserInfo is a struct that represents the response from request in users.info slack api method, more information see https://api.slack.com/methods/users.info.
 type UserInfo struct {
-	Ok   bool `json:"ok"`
-	User struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error"`
+	User  struct {
 		ID       string `json:"id"`
 		TeamID   string `json:"team_id"`
 		Name     string `json:"name"`
@@ -1,26 +1,76 @@
 package slack
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/nyaruka/courier"
 	. "github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/utils"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
-	channelUUID = "8eb23e93-5ecb-45ba-b726-3b064e0c568c"
-	receiveURL  = "/c/sl/" + channelUUID + "/receive/"
+	channelUUID    = "8eb23e93-5ecb-45ba-b726-3b064e0c568c"
+	receiveURL     = "/c/sl/" + channelUUID + "/receive/"
+	commandURL     = "/c/sl/" + channelUUID + "/command/"
+	interactionURL = "/c/sl/" + channelUUID + "/interaction/"
 )
 
+// filesRequests records the requests made for Slack files, which are served by the test files server
+var filesRequests []string
+
+// filesTransport sends requests for Slack files to the test files server, and all other requests where they're for
+type filesTransport struct {
+	http.RoundTripper
+	serverURL *url.URL
+}
+
+func (t *filesTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host == "files.slack.com" {
+		filesRequests = append(filesRequests, r.URL.Path)
+		r = r.Clone(r.Context())
+		r.URL.Scheme, r.URL.Host = t.serverURL.Scheme, t.serverURL.Host
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
+
+func TestMain(m *testing.M) {
+	// files are small, apart from those whose names say otherwise
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "too_large") {
+			http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(strings.Repeat("0123456789", 1<<20)))
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	client := utils.GetHTTPClient()
+	client.Transport = &filesTransport{RoundTripper: client.Transport, serverURL: serverURL}
+
+	m.Run()
+}
+
+// our test channel can post as fast as our test cases send, as they are all to the same few conversations
 var testChannels = []courier.Channel{
-	courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token"}),
+	courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "messages_per_second": 1000, "channel_user_urns": true}),
 }
 
 const helloMsg = `{
@@ -44,413 +94,3716 @@ const helloMsg = `{
 	"event_time": 1355517523
 }`
 
-const imageFileMsg = `{
-	"token": "Bwf82iq5kCEkHOzRQ7p4FqkQ",
-	"team_id": "T03CN5KTA6S",
-	"api_app_id": "A03FTC8MZ63",
+const enterpriseMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"enterprise_id": "E0123ABCDEF",
+	"api_app_id": "A0PNCHHK2",
 	"event": {
 			"type": "message",
-			"text": "",
-			"files": [
-					{
-							"id": "F03GTH43SSF",
-							"created": 1653417049,
-							"timestamp": 1653417049,
-							"name": "batata.jpg",
-							"title": "batata.jpg",
-							"mimetype": "image/jpeg",
-							"filetype": "jpg",
-							"pretty_type": "JPEG",
-							"user": "U0123ABCDEF",
-							"editable": false,
-							"size": 7130,
-							"mode": "hosted",
-							"is_external": false,
-							"external_type": "",
-							"is_public": true,
-							"public_url_shared": false,
-							"display_as_bot": false,
-							"username": "",
-							"url_private": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSF/batata.jpg",
-							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSF/download/batata.jpg",
-							"media_display_type": "unknown",
-							"thumb_64": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSF-75138e6784/batata_64.jpg",
-							"thumb_80": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSF-75138e6784/batata_80.jpg",
-							"thumb_360": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSF-75138e6784/batata_360.jpg",
-							"thumb_360_w": 360,
-							"thumb_360_h": 360,
-							"thumb_160": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSF-75138e6784/batata_160.jpg",
-							"original_w": 400,
-							"original_h": 400,
-							"thumb_tiny": "AwAwADDTooooAKKY7Y4HWmjnqalysOxLRTUJJxTqadxBTS4HvRIcLURIFTKVhpDZJhu6UAse1IuCSR16U/NZPXUvYWNyOq81MDkZFQk9xT4+5rSL6EseRkYNRtCD0JFSUVbSZJWW3dGzvz7YpTuB5VvwFWKKTgh3IQpYdxUoGBS0U0rA2f/Z",
-							"permalink": "https://teste-apigrupo.slack.com/files/U0123ABCDEF/F03GTH43SSF/batata.jpg",
-							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GTH43SSF-39fcf577f2",
-							"has_rich_preview": false
-					}
-			],
-			"upload": false,
+			"channel": "D0123ABCDEF",
 			"user": "U0123ABCDEF",
-			"display_as_bot": false,
-			"ts": "1653417052.881009",
-			"client_msg_id": "0e400b8f-07c4-452f-a13e-2744fcae2558",
-			"channel": "C0123ABCDEF",
-			"subtype": "file_share",
-			"event_ts": "1653417052.881009",
-			"channel_type": "channel"
+			"text": "Hello from the grid!",
+			"ts": "1355517523.000005",
+			"event_ts": "1355517523.000005",
+			"channel_type": "im"
 	},
 	"type": "event_callback",
-	"event_id": "Ev0PV52K21",
-	"event_time": 1653417052,
 	"authorizations": [
 			{
-					"enterprise_id": null,
-					"team_id": "T03CN5KTA6S",
+					"enterprise_id": "E0123ABCDEF",
+					"team_id": "T061EG9R6",
 					"user_id": "U03G81FQM98",
 					"is_bot": true,
 					"is_enterprise_install": false
 			}
 	],
-	"is_ext_shared_channel": false,
-	"event_context": "4-eyJldCI6Im1lc3NhZ2UiLCJ0aWQiOiJUMDNDTjVLVEE2UyIsImFpZCI6IkEwM0ZUQzhNWjYzIiwiY2lkIjoiQzAzQ1VRUUJIRUYifQ"
-}
-`
+	"event_id": "Ev0PV52K30",
+	"event_time": 1355517523
+}`
 
-const audioFileMsg = `{
-	"token": "Bwf82iq5kCEkHOzRQ7p4FqkQ",
-	"team_id": "T03CN5KTA6S",
-	"api_app_id": "A03FTC8MZ63",
+const threadBroadcastMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
 	"event": {
 			"type": "message",
-			"text": "",
-			"files": [
-					{
-							"id": "F03GWURCZL4",
-							"created": 1653428828,
-							"timestamp": 1653428828,
-							"name": "here we go again.mp3",
-							"title": "here we go again.mp3",
-							"mimetype": "audio/mpeg",
-							"filetype": "mp3",
-							"pretty_type": "MP3",
-							"user": "U0123ABCDEF",
-							"editable": false,
-							"size": 102122,
-							"mode": "hosted",
-							"is_external": false,
-							"external_type": "",
-							"is_public": true,
-							"public_url_shared": false,
-							"display_as_bot": false,
-							"username": "",
-							"transcription": {
-									"status": "none"
-							},
-							"url_private": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GWURCZL4-9aaa1171c6/here_we_go_again_audio.mp4",
-							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GWURCZL4/download/here_we_go_again.mp3",
-							"duration_ms": 3187,
-							"aac": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GWURCZL4-9aaa1171c6/here_we_go_again_audio.mp4",
-							"audio_wave_samples": [0,0,0,3,5,2,3,6,9,10,9,8,5,3,9,19,22,23,24,25,25,30,28,13,10,10,8,7,4,1,5,7,9,10,9,12,56,35,59,15,10,10,8,6,3,3,6,8,10,10,8,5,2,3,6,8,10,10,22,50,42,20,59,73,30,14,26,67,65,72,72,86,94,36,12,42,100,91,91,86,54,40,23,15,7,5,8,9,10,8,6,3,2,5,8,10,9,8,5,2],
-							"media_display_type": "audio",
-							"permalink": "https://teste-apigrupo.slack.com/files/U0123ABCDEF/F03GWURCZL4/here_we_go_again.mp3",
-							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GWURCZL4-471020b300",
-							"has_rich_preview": false
-					}
-			],
-			"upload": false,
+			"subtype": "thread_broadcast",
+			"channel": "C0123ABCDEF",
 			"user": "U0123ABCDEF",
-			"display_as_bot": false,
-			"ts": "1653428835.192419",
-			"client_msg_id": "c827a681-2641-44ed-8cd5-854339499a1e",
+			"text": "Hello to the thread and the channel!",
+			"ts": "1355517531.000009",
+			"thread_ts": "1355517523.000005",
+			"event_ts": "1355517531.000009",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K31",
+	"event_time": 1355517531
+}`
+
+const fileCommentMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"subtype": "file_comment",
 			"channel": "C0123ABCDEF",
-			"subtype": "file_share",
-			"event_ts": "1653428835.192419",
+			"text": "<@U0123ABCDEF> commented on <@U0123ABCDEF>'s file <https://example.slack.com/files/U0123ABCDEF/F0123ABCDEF/report.pdf|Quarterly Report>: Looks good to me",
+			"file": {
+				"id": "F0123ABCDEF",
+				"name": "report.pdf",
+				"title": "Quarterly Report",
+				"mimetype": "application/pdf"
+			},
+			"comment": {
+				"id": "Fc0123ABCDEF",
+				"user": "U0123ABCDEF",
+				"comment": "Looks good to me"
+			},
+			"ts": "1355517532.000010",
+			"event_ts": "1355517532.000010",
 			"channel_type": "channel"
 	},
 	"type": "event_callback",
-	"event_id": "Ev0PV52K21",
-	"event_time": 1653428835,
-	"authorizations": [
-			{
-					"enterprise_id": null,
-					"team_id": "T03CN5KTA6S",
-					"user_id": "U03G81FQM98",
-					"is_bot": true,
-					"is_enterprise_install": false
-			}
+	"authed_teams": [
+			"T061EG9R6"
 	],
-	"is_ext_shared_channel": false,
-	"event_context": "4-eyJldCI6Im1lc3NhZ2UiLCJ0aWQiOiJUMDNDTjVLVEE2UyIsImFpZCI6IkEwM0ZUQzhNWjYzIiwiY2lkIjoiQzAzQ1VRUUJIRUYifQ"
-}
-`
+	"event_id": "Ev0PV52K32",
+	"event_time": 1355517532
+}`
 
-const videoFileMsg = `{
-	"token": "Bwf82iq5kCEkHOzRQ7p4FqkQ",
-	"team_id": "T03CN5KTA6S",
-	"api_app_id": "A03FTC8MZ63",
+const channelJoinMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
 	"event": {
 			"type": "message",
-			"text": "",
-			"files": [
-					{
-							"id": "F03GDSSMC79",
-							"created": 1653427226,
-							"timestamp": 1653427226,
-							"name": "Walk Cycle Animation sample.mp4",
-							"title": "Walk Cycle Animation sample.mp4",
-							"mimetype": "video/mp4",
-							"filetype": "mp4",
-							"pretty_type": "MPEG 4 Video",
-							"user": "U0123ABCDEF",
-							"editable": false,
-							"size": 767148,
-							"mode": "hosted",
-							"is_external": false,
-							"external_type": "",
-							"is_public": true,
-							"public_url_shared": false,
-							"display_as_bot": false,
-							"username": "",
-							"transcription": {
-									"status": "none"
-							},
-							"mp4": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GDSSMC79-0af57254d8/walk_cycle_animation_sample.mp4",
-							"url_private": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GDSSMC79-0af57254d8/walk_cycle_animation_sample.mp4",
-							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GDSSMC79/download/walk_cycle_animation_sample.mp4",
-							"hls": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GDSSMC79-0af57254d8/file.m3u8",
-							"duration_ms": 19953,
-							"media_display_type": "video",
-							"thumb_video": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GDSSMC79-0af57254d8/walk_cycle_animation_sample_thumb_video.jpeg",
-							"thumb_video_w": 640,
-							"thumb_video_h": 360,
-							"permalink": "https://teste-apigrupo.slack.com/files/U0123ABCDEF/F03GDSSMC79/walk_cycle_animation_sample.mp4",
-							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GDSSMC79-805aa1d85f",
-							"has_rich_preview": false
-					}
-			],
-			"upload": false,
-			"user": "U0123ABCDEF",
-			"display_as_bot": false,
-			"ts": "1653427243.620839",
-			"client_msg_id": "72df394d-bfbb-4d90-8db4-cbe5caa76b28",
+			"subtype": "channel_join",
 			"channel": "C0123ABCDEF",
+			"user": "U0123ABCDEF",
+			"text": "<@U0123ABCDEF> has joined the channel",
+			"ts": "1355517533.000011",
+			"event_ts": "1355517533.000011",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K33",
+	"event_time": 1355517533
+}`
+
+const emptyFileShareMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
 			"subtype": "file_share",
-			"event_ts": "1653427243.620839",
+			"channel": "C0123ABCDEF",
+			"user": "U0123ABCDEF",
+			"text": "",
+			"files": [],
+			"ts": "1355517534.000012",
+			"event_ts": "1355517534.000012",
 			"channel_type": "channel"
 	},
 	"type": "event_callback",
-	"event_id": "Ev0PV52K21",
-	"event_time": 1653427243,
-	"authorizations": [
-			{
-					"enterprise_id": null,
-					"team_id": "T03CN5KTA6S",
-					"user_id": "U03G81FQM98",
-					"is_bot": true,
-					"is_enterprise_install": false
-			}
+	"authed_teams": [
+			"T061EG9R6"
 	],
-	"is_ext_shared_channel": false,
-	"event_context": "4-eyJldCI6Im1lc3NhZ2UiLCJ0aWQiOiJUMDNDTjVLVEE2UyIsImFpZCI6IkEwM0ZUQzhNWjYzIiwiY2lkIjoiQzAzQ1VRUUJIRUYifQ"
+	"event_id": "Ev0PV52K34",
+	"event_time": 1355517534
 }`
 
-func setSendUrl(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
-	apiURL = s.URL
-}
+const workflowStepExecute = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "workflow_step_execute",
+			"callback_id": "register_visitor",
+			"workflow_step": {
+				"workflow_step_execute_id": "1a2b3c4d5e.123456",
+				"workflow_id": "Wf0123ABCDEF",
+				"workflow_instance_id": "Wi0123ABCDEF",
+				"step_id": "St0123ABCDEF",
+				"inputs": {
+					"user": {"value": "U0123ABCDEF"},
+					"visitor": {"value": "Ann Smith"},
+					"guests": {"value": 2}
+				},
+				"outputs": [{"name": "badge", "type": "text", "label": "Badge number"}]
+			},
+			"event_ts": "1355517535.000013"
+	},
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K35",
+	"event_time": 1355517535
+}`
 
-var handleTestCases = []ChannelHandleTestCase{
-	{
-		Label:      "Receive Hello Msg",
-		URL:        receiveURL,
-		Headers:    map[string]string{},
-		Data:       helloMsg,
-		URN:        Sp("slack:C0123ABCDEF"),
-		Text:       Sp("Hello World!"),
-		Status:     200,
-		Response:   "Accepted",
-		ExternalID: Sp("Ev0PV52K21"),
-	},
-	{
-		Label:      "Receive image file",
-		URL:        receiveURL,
-		Headers:    map[string]string{},
-		Data:       imageFileMsg,
-		Attachment: Sp("https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSF/download/batata.jpg?pub_secret=39fcf577f2"),
-		URN:        Sp("slack:C0123ABCDEF"),
-		Text:       Sp(""),
-		Status:     200,
-		Response:   "Accepted",
-		ExternalID: Sp("Ev0PV52K21"),
+const threadMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"channel": "C0123ABCDEF",
+			"user": "U0123ABCDEF",
+			"text": "Hello in a thread!",
+			"ts": "1355517530.000008",
+			"thread_ts": "1355517523.000005",
+			"event_ts": "1355517530.000008",
+			"channel_type": "channel"
 	},
-	{
-		Label:      "Receive audio file",
-		URL:        receiveURL,
-		Headers:    map[string]string{},
-		Data:       audioFileMsg,
-		Attachment: Sp("https://files.slack.com/files-pri/T03CN5KTA6S-F03GWURCZL4/download/here_we_go_again.mp3?pub_secret=471020b300"),
-		URN:        Sp("slack:C0123ABCDEF"),
-		Text:       Sp(""),
-		Status:     200,
-		Response:   "Accepted",
-		ExternalID: Sp("Ev0PV52K21"),
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K25",
+	"event_time": 1355517530
+}`
+
+const editedMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"subtype": "message_changed",
+			"channel": "C0123ABCDEF",
+			"message": {
+					"type": "message",
+					"user": "U0123ABCDEF",
+					"text": "Hello World, edited!",
+					"ts": "1355517523.000005"
+			},
+			"previous_message": {
+					"type": "message",
+					"user": "U0123ABCDEF",
+					"text": "Hello World!",
+					"ts": "1355517523.000005"
+			},
+			"ts": "1355517536.000001",
+			"event_ts": "1355517536.000001",
+			"channel_type": "channel"
 	},
-	{
-		Label:      "Receive video file (not allowed)",
-		URL:        receiveURL,
-		Headers:    map[string]string{},
-		Data:       videoFileMsg,
-		Attachment: nil,
-		URN:        Sp("slack:C0123ABCDEF"),
-		Text:       Sp(""),
-		Status:     200,
-		Response:   "Accepted",
-		ExternalID: Sp("Ev0PV52K21"),
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K22",
+	"event_time": 1355517536
+}`
+
+const editedMsgNoPrevious = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"subtype": "message_changed",
+			"channel": "C0123ABCDEF",
+			"message": {
+					"type": "message",
+					"user": "U0123ABCDEF",
+					"text": "Hello World, edited!",
+					"ts": "1355517523.000005"
+			},
+			"ts": "1355517536.000001",
+			"event_ts": "1355517536.000001",
+			"channel_type": "channel"
 	},
-}
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K23",
+	"event_time": 1355517536
+}`
 
-var defaultSendTestCases = []ChannelSendTestCase{
-	{
-		Label: "Plain Send",
-		Text:  "Simple Message", URN: "slack:C0123ABCDEF",
-		Status:         "W",
-		ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
-		ResponseStatus: 200,
-		RequestBody:    `{"channel":"C0123ABCDEF","text":"Simple Message"}`,
-		SendPrep:       setSendUrl,
+const forwardedMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"channel": "C0123ABCDEF",
+			"user": "U0123ABCDEF",
+			"text": "Look at this",
+			"attachments": [
+				{
+					"fallback": "[December 14th, 2012 8:38 PM] Jane Doe: The meeting has moved to 3pm",
+					"ts": "1355517500.000001",
+					"author_id": "U0456GHIJKL",
+					"author_name": "Jane Doe",
+					"channel_id": "C0456GHIJKL",
+					"channel_name": "general",
+					"is_msg_unfurl": true,
+					"is_share": true,
+					"text": "The meeting has moved to 3pm",
+					"from_url": "https://example.slack.com/archives/C0456GHIJKL/p1355517500000001",
+					"footer": "Posted in #general"
+				}
+			],
+			"ts": "1355517523.000008",
+			"event_ts": "1355517523.000008",
+			"channel_type": "channel"
 	},
-	{
-		Label: "Unicode Send",
-		Text:  "☺", URN: "slack:U0123ABCDEF",
-		Status:         "W",
-		ResponseBody:   `{"ok":true,"channel":"U0123ABCDEF"}`,
-		ResponseStatus: 200,
-		RequestBody:    `{"channel":"U0123ABCDEF","text":"☺"}`,
-		SendPrep:       setSendUrl,
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K26",
+	"event_time": 1355517523
+}`
+
+const editedBotMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"subtype": "message_changed",
+			"channel": "C0123ABCDEF",
+			"message": {
+					"type": "message",
+					"bot_id": "B0123ABCDEF",
+					"text": "Hello from the bot, edited!",
+					"ts": "1355517523.000007"
+			},
+			"previous_message": {
+					"type": "message",
+					"bot_id": "B0123ABCDEF",
+					"text": "Hello from the bot!",
+					"ts": "1355517523.000007"
+			},
+			"ts": "1355517536.000002",
+			"event_ts": "1355517536.000002",
+			"channel_type": "channel"
 	},
-	{
-		Label: "Send Text Auth Error",
-		Text:  "Hello", URN: "slack:U0123ABCDEF",
-		Status:         "E",
-		ResponseBody:   `{"ok":false,"error":"invalid_auth"}`,
-		ResponseStatus: 200,
-		RequestBody:    `{"channel":"U0123ABCDEF","text":"Hello"}`,
-		SendPrep:       setSendUrl,
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K25",
+	"event_time": 1355517536
+}`
+
+// a message our own app posted as the user who installed it, which has our app id but no bot id
+const ownAppMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"channel": "C0123ABCDEF",
+			"user": "U0456GHIJKL",
+			"app_id": "A0PNCHHK2",
+			"text": "Hello from us!",
+			"ts": "1355517523.000011",
+			"event_ts": "1355517523.000011",
+			"channel_type": "channel"
 	},
-}
+	"type": "event_callback",
+	"authorizations": [
+			{
+					"team_id": "T061EG9R6",
+					"user_id": "U03G81FQM98",
+					"is_bot": true
+			}
+	],
+	"event_id": "Ev0PV52K40",
+	"event_time": 1355517523
+}`
 
-var fileSendTestCases = []ChannelSendTestCase{
-	{
-		Label: "Send Image",
-		Text:  "", URN: "slack:U0123ABCDEF",
-		Status:      "W",
-		Attachments: []string{"image/jpeg:https://foo.bar/image.png"},
-		Responses: map[MockedRequest]MockedResponse{
+// a message from our own bot user, without a bot id
+const ownBotUserMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"channel": "C0123ABCDEF",
+			"user": "U03G81FQM98",
+			"text": "Hello from our bot!",
+			"ts": "1355517523.000012",
+			"event_ts": "1355517523.000012",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"authorizations": [
 			{
-				Method:       "POST",
-				Path:         "/files.upload",
-				BodyContains: "image.png",
-			}: {
-				Status: 200,
-				Body:   `{"ok":true,"file":{"id":"F1L3SL4CK1D"}}`,
-			},
+					"team_id": "T061EG9R6",
+					"user_id": "U03G81FQM98",
+					"is_bot": true
+			}
+	],
+	"event_id": "Ev0PV52K41",
+	"event_time": 1355517523
+}`
+
+// a message from another app's bot
+const thirdPartyBotMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"channel": "C0123ABCDEF",
+			"user": "U0456GHIJKL",
+			"bot_id": "B0456GHIJKL",
+			"app_id": "A0456GHIJKL",
+			"text": "Hello from another bot!",
+			"ts": "1355517523.000013",
+			"event_ts": "1355517523.000013",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"event_id": "Ev0PV52K42",
+	"event_time": 1355517523
+}`
+
+// a message from an integration which posts as a user, so has another app's id but no bot id
+const integrationMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"channel": "C0123ABCDEF",
+			"user": "U0789MNOPQR",
+			"app_id": "A0789MNOPQR",
+			"text": "Hello from an integration!",
+			"ts": "1355517523.000014",
+			"event_ts": "1355517523.000014",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"event_id": "Ev0PV52K43",
+	"event_time": 1355517523
+}`
+
+const blocksMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"channel": "C0123ABCDEF",
+			"user": "U0123ABCDEF",
+			"text": "Hello *World*!",
+			"blocks": [
+				{
+					"type": "rich_text",
+					"block_id": "Xx1",
+					"elements": [
+						{
+							"type": "rich_text_section",
+							"elements": [
+								{"type": "text", "text": "Hello "},
+								{"type": "text", "text": "World", "style": {"bold": true}},
+								{"type": "text", "text": "!"}
+							]
+						}
+					]
+				}
+			],
+			"ts": "1355517523.000006",
+			"event_ts": "1355517523.000006",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K24",
+	"event_time": 1355517523
+}`
+
+const imageFileMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T03CN5KTA6S",
+	"api_app_id": "A03FTC8MZ63",
+	"event": {
+			"type": "message",
+			"text": "",
+			"files": [
+					{
+							"id": "F03GTH43SSF",
+							"created": 1653417049,
+							"timestamp": 1653417049,
+							"name": "batata.jpg",
+							"title": "batata.jpg",
+							"mimetype": "image/jpeg",
+							"filetype": "jpg",
+							"pretty_type": "JPEG",
+							"user": "U0123ABCDEF",
+							"editable": false,
+							"size": 7130,
+							"mode": "hosted",
+							"is_external": false,
+							"external_type": "",
+							"is_public": true,
+							"public_url_shared": false,
+							"display_as_bot": false,
+							"username": "",
+							"url_private": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSF/batata.jpg",
+							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSF/download/batata.jpg",
+							"media_display_type": "unknown",
+							"thumb_64": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSF-75138e6784/batata_64.jpg",
+							"thumb_80": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSF-75138e6784/batata_80.jpg",
+							"thumb_360": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSF-75138e6784/batata_360.jpg",
+							"thumb_360_w": 360,
+							"thumb_360_h": 360,
+							"thumb_160": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSF-75138e6784/batata_160.jpg",
+							"original_w": 400,
+							"original_h": 400,
+							"thumb_tiny": "AwAwADDTooooAKKY7Y4HWmjnqalysOxLRTUJJxTqadxBTS4HvRIcLURIFTKVhpDZJhu6UAse1IuCSR16U/NZPXUvYWNyOq81MDkZFQk9xT4+5rSL6EseRkYNRtCD0JFSUVbSZJWW3dGzvz7YpTuB5VvwFWKKTgh3IQpYdxUoGBS0U0rA2f/Z",
+							"permalink": "https://teste-apigrupo.slack.com/files/U0123ABCDEF/F03GTH43SSF/batata.jpg",
+							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GTH43SSF-39fcf577f2",
+							"has_rich_preview": false
+					}
+			],
+			"upload": false,
+			"user": "U0123ABCDEF",
+			"display_as_bot": false,
+			"ts": "1653417052.881009",
+			"client_msg_id": "0e400b8f-07c4-452f-a13e-2744fcae2558",
+			"channel": "C0123ABCDEF",
+			"subtype": "file_share",
+			"event_ts": "1653417052.881009",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"event_id": "Ev0PV52K21",
+	"event_time": 1653417052,
+	"authorizations": [
+			{
+					"enterprise_id": null,
+					"team_id": "T03CN5KTA6S",
+					"user_id": "U03G81FQM98",
+					"is_bot": true,
+					"is_enterprise_install": false
+			}
+	],
+	"is_ext_shared_channel": false,
+	"event_context": "4-eyJldCI6Im1lc3NhZ2UiLCJ0aWQiOiJUMDNDTjVLVEE2UyIsImFpZCI6IkEwM0ZUQzhNWjYzIiwiY2lkIjoiQzAzQ1VRUUJIRUYifQ"
+}
+`
+
+const audioFileMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T03CN5KTA6S",
+	"api_app_id": "A03FTC8MZ63",
+	"event": {
+			"type": "message",
+			"text": "",
+			"files": [
+					{
+							"id": "F03GWURCZL4",
+							"created": 1653428828,
+							"timestamp": 1653428828,
+							"name": "here we go again.mp3",
+							"title": "here we go again.mp3",
+							"mimetype": "audio/mpeg",
+							"filetype": "mp3",
+							"pretty_type": "MP3",
+							"user": "U0123ABCDEF",
+							"editable": false,
+							"size": 102122,
+							"mode": "hosted",
+							"is_external": false,
+							"external_type": "",
+							"is_public": true,
+							"public_url_shared": false,
+							"display_as_bot": false,
+							"username": "",
+							"transcription": {
+									"status": "none"
+							},
+							"url_private": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GWURCZL4-9aaa1171c6/here_we_go_again_audio.mp4",
+							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GWURCZL4/download/here_we_go_again.mp3",
+							"duration_ms": 3187,
+							"aac": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GWURCZL4-9aaa1171c6/here_we_go_again_audio.mp4",
+							"audio_wave_samples": [0,0,0,3,5,2,3,6,9,10,9,8,5,3,9,19,22,23,24,25,25,30,28,13,10,10,8,7,4,1,5,7,9,10,9,12,56,35,59,15,10,10,8,6,3,3,6,8,10,10,8,5,2,3,6,8,10,10,22,50,42,20,59,73,30,14,26,67,65,72,72,86,94,36,12,42,100,91,91,86,54,40,23,15,7,5,8,9,10,8,6,3,2,5,8,10,9,8,5,2],
+							"media_display_type": "audio",
+							"permalink": "https://teste-apigrupo.slack.com/files/U0123ABCDEF/F03GWURCZL4/here_we_go_again.mp3",
+							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GWURCZL4-471020b300",
+							"has_rich_preview": false
+					}
+			],
+			"upload": false,
+			"user": "U0123ABCDEF",
+			"display_as_bot": false,
+			"ts": "1653428835.192419",
+			"client_msg_id": "c827a681-2641-44ed-8cd5-854339499a1e",
+			"channel": "C0123ABCDEF",
+			"subtype": "file_share",
+			"event_ts": "1653428835.192419",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"event_id": "Ev0PV52K21",
+	"event_time": 1653428835,
+	"authorizations": [
+			{
+					"enterprise_id": null,
+					"team_id": "T03CN5KTA6S",
+					"user_id": "U03G81FQM98",
+					"is_bot": true,
+					"is_enterprise_install": false
+			}
+	],
+	"is_ext_shared_channel": false,
+	"event_context": "4-eyJldCI6Im1lc3NhZ2UiLCJ0aWQiOiJUMDNDTjVLVEE2UyIsImFpZCI6IkEwM0ZUQzhNWjYzIiwiY2lkIjoiQzAzQ1VRUUJIRUYifQ"
+}
+`
+
+const videoFileMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T03CN5KTA6S",
+	"api_app_id": "A03FTC8MZ63",
+	"event": {
+			"type": "message",
+			"text": "",
+			"files": [
+					{
+							"id": "F03GDSSMC79",
+							"created": 1653427226,
+							"timestamp": 1653427226,
+							"name": "Walk Cycle Animation sample.mp4",
+							"title": "Walk Cycle Animation sample.mp4",
+							"mimetype": "video/mp4",
+							"filetype": "mp4",
+							"pretty_type": "MPEG 4 Video",
+							"user": "U0123ABCDEF",
+							"editable": false,
+							"size": 767148,
+							"mode": "hosted",
+							"is_external": false,
+							"external_type": "",
+							"is_public": true,
+							"public_url_shared": false,
+							"display_as_bot": false,
+							"username": "",
+							"transcription": {
+									"status": "none"
+							},
+							"mp4": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GDSSMC79-0af57254d8/walk_cycle_animation_sample.mp4",
+							"url_private": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GDSSMC79-0af57254d8/walk_cycle_animation_sample.mp4",
+							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GDSSMC79/download/walk_cycle_animation_sample.mp4",
+							"hls": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GDSSMC79-0af57254d8/file.m3u8",
+							"duration_ms": 19953,
+							"media_display_type": "video",
+							"thumb_video": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GDSSMC79-0af57254d8/walk_cycle_animation_sample_thumb_video.jpeg",
+							"thumb_video_w": 640,
+							"thumb_video_h": 360,
+							"permalink": "https://teste-apigrupo.slack.com/files/U0123ABCDEF/F03GDSSMC79/walk_cycle_animation_sample.mp4",
+							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GDSSMC79-805aa1d85f",
+							"has_rich_preview": false
+					}
+			],
+			"upload": false,
+			"user": "U0123ABCDEF",
+			"display_as_bot": false,
+			"ts": "1653427243.620839",
+			"client_msg_id": "72df394d-bfbb-4d90-8db4-cbe5caa76b28",
+			"channel": "C0123ABCDEF",
+			"subtype": "file_share",
+			"event_ts": "1653427243.620839",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"event_id": "Ev0PV52K21",
+	"event_time": 1653427243,
+	"authorizations": [
+			{
+					"enterprise_id": null,
+					"team_id": "T03CN5KTA6S",
+					"user_id": "U03G81FQM98",
+					"is_bot": true,
+					"is_enterprise_install": false
+			}
+	],
+	"is_ext_shared_channel": false,
+	"event_context": "4-eyJldCI6Im1lc3NhZ2UiLCJ0aWQiOiJUMDNDTjVLVEE2UyIsImFpZCI6IkEwM0ZUQzhNWjYzIiwiY2lkIjoiQzAzQ1VRUUJIRUYifQ"
+}`
+
+func setSendUrl(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+	apiURL = s.URL
+}
+
+const twoFilesMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T03CN5KTA6S",
+	"api_app_id": "A03FTC8MZ63",
+	"event": {
+			"type": "message",
+			"text": "Photos",
+			"files": [
+					{
+							"id": "F03GTH43SSA",
+							"name": "first.jpg",
+							"mimetype": "image/jpeg",
+							"size": 6000,
+							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSA/download/first.jpg",
+							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GTH43SSA-11aa22bb33"
+					},
+					{
+							"id": "F03GTH43SSB",
+							"name": "second.jpg",
+							"mimetype": "image/jpeg",
+							"size": 5000,
+							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSB/download/second.jpg",
+							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GTH43SSB-44cc55dd66"
+					}
+			],
+			"user": "U0123ABCDEF",
+			"ts": "1653417052.881009",
+			"channel": "C0123ABCDEF",
+			"subtype": "file_share",
+			"event_ts": "1653417052.881009",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"event_id": "Ev0PV52K30",
+	"event_time": 1653417052
+}`
+
+const largeImageMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T03CN5KTA6S",
+	"api_app_id": "A03FTC8MZ63",
+	"event": {
+			"type": "message",
+			"text": "Big photo",
+			"files": [
+					{
+							"id": "F03GTH43SSC",
+							"name": "large.jpg",
+							"mimetype": "image/jpeg",
+							"size": 8000000,
+							"url_private_download": "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSC/download/large.jpg",
+							"thumb_160": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSC-77ee88ff99/large_160.jpg",
+							"thumb_360": "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSC-77ee88ff99/large_360.jpg",
+							"permalink_public": "https://slack-files.com/T03CN5KTA6S-F03GTH43SSC-77ee88ff99"
+					}
+			],
+			"user": "U0123ABCDEF",
+			"ts": "1653417052.881009",
+			"channel": "C0123ABCDEF",
+			"subtype": "file_share",
+			"event_ts": "1653417052.881009",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"event_id": "Ev0PV52K31",
+	"event_time": 1653417052
+}`
+
+// the file_shared event for the image shared in largeImageMsg
+const fileSharedMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T03CN5KTA6S",
+	"api_app_id": "A03FTC8MZ63",
+	"event": {
+			"type": "file_shared",
+			"channel_id": "C0123ABCDEF",
+			"file_id": "F03GTH43SSC",
+			"user_id": "U0123ABCDEF",
+			"file": {
+					"id": "F03GTH43SSC"
+			},
+			"event_ts": "1653417053.000100"
+	},
+	"type": "event_callback",
+	"event_id": "Ev0PV52K99",
+	"event_time": 1653417053
+}`
+
+var handleTestCases = []ChannelHandleTestCase{
+	{
+		Label:      "Receive Hello Msg",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       helloMsg,
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp("Hello World!"),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K21"),
+	},
+	{
+		Label:      "Receive Enterprise Grid Msg",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       enterpriseMsg,
+		URN:        Sp("slack:T061EG9R6/U0123ABCDEF#Ann Smith"),
+		Text:       Sp("Hello from the grid!"),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K30"),
+	},
+	{
+		Label:      "Receive Msg In Thread",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       threadMsg,
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp("Hello in a thread!"),
+		Metadata:   json.RawMessage(`{"thread_ts": "1355517523.000005"}`),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("1355517530.000008"),
+	},
+	{
+		Label:      "Receive Edited Msg",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       editedMsg,
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp("Hello World, edited!"),
+		Metadata:   json.RawMessage(`{"edited_ts": "1355517523.000005", "previous_text": "Hello World!"}`),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K22"),
+	},
+	{
+		Label:      "Receive Edited Msg Without Previous",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       editedMsgNoPrevious,
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp("Hello World, edited!"),
+		Metadata:   json.RawMessage(`{"edited_ts": "1355517523.000005"}`),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K23"),
+	},
+	{
+		Label:      "Receive Forwarded Msg",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       forwardedMsg,
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp("Look at this\n\nThe meeting has moved to 3pm"),
+		Metadata:   json.RawMessage(`{"forwarded": {"author": "U0456GHIJKL", "author_name": "Jane Doe", "ts": "1355517500.000001", "channel": "C0456GHIJKL"}}`),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K26"),
+	},
+	{
+		Label:    "Ignore Edited Bot Msg",
+		URL:      receiveURL,
+		Headers:  map[string]string{},
+		Data:     editedBotMsg,
+		Status:   200,
+		Response: "Ignoring request, no message",
+	},
+	{
+		Label:      "Receive Msg With Blocks",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       blocksMsg,
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp("Hello *World*!"),
+		Metadata:   json.RawMessage(`{"blocks": [{"type": "rich_text", "block_id": "Xx1", "elements": [{"type": "rich_text_section", "elements": [{"type": "text", "text": "Hello "}, {"type": "text", "text": "World", "style": {"bold": true}}, {"type": "text", "text": "!"}]}]}]}`),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K24"),
+	},
+	{
+		Label:      "Receive image file",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       imageFileMsg,
+		Attachment: Sp("https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSF/download/batata.jpg?pub_secret=39fcf577f2"),
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp(""),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K21"),
+	},
+	{
+		Label:      "Receive audio file",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       audioFileMsg,
+		Attachment: Sp("https://files.slack.com/files-pri/T03CN5KTA6S-F03GWURCZL4/download/here_we_go_again.mp3?pub_secret=471020b300"),
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp(""),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K21"),
+	},
+	{
+		Label:    "Receive video file (not allowed)",
+		URL:      receiveURL,
+		Headers:  map[string]string{},
+		Data:     videoFileMsg,
+		Status:   200,
+		Response: "Ignoring request, no text or attachments",
+	},
+	{
+		Label:      "Receive thread broadcast",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       threadBroadcastMsg,
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp("Hello to the thread and the channel!"),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("1355517531.000009"),
+		Metadata:   json.RawMessage(`{"thread_ts": "1355517523.000005"}`),
+	},
+	{
+		Label:      "Receive file comment",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       fileCommentMsg,
+		URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		Text:       Sp("Comment on Quarterly Report: Looks good to me"),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("Ev0PV52K32"),
+	},
+	{
+		Label:      "Receive workflow step",
+		URL:        receiveURL,
+		Headers:    map[string]string{},
+		Data:       workflowStepExecute,
+		URN:        Sp("slack:U0123ABCDEF"),
+		Text:       Sp("guests: 2\nuser: U0123ABCDEF\nvisitor: Ann Smith"),
+		Status:     200,
+		Response:   "Accepted",
+		ExternalID: Sp("1a2b3c4d5e.123456"),
+		Metadata:   json.RawMessage(`{"workflow_step": {"execute_id": "1a2b3c4d5e.123456", "workflow_id": "Wf0123ABCDEF", "step_id": "St0123ABCDEF", "inputs": {"user": "U0123ABCDEF", "visitor": "Ann Smith", "guests": 2}}}`),
+	},
+	{
+		Label:    "Receive workflow step without user or channel",
+		URL:      receiveURL,
+		Headers:  map[string]string{},
+		Data:     strings.Replace(workflowStepExecute, `"user": {"value": "U0123ABCDEF"},`, "", 1),
+		Status:   200,
+		Response: "Ignoring request, workflow step has no user or channel input",
+	},
+	{
+		Label:    "Receive channel join",
+		URL:      receiveURL,
+		Headers:  map[string]string{},
+		Data:     channelJoinMsg,
+		Status:   200,
+		Response: "Ignoring request, unsupported message subtype: channel_join",
+	},
+	{
+		Label:    "Receive file share without files",
+		URL:      receiveURL,
+		Headers:  map[string]string{},
+		Data:     emptyFileShareMsg,
+		Status:   200,
+		Response: "Ignoring request, no text or attachments",
+	},
+}
+
+var defaultSendTestCases = []ChannelSendTestCase{
+	{
+		Label: "Plain Send",
+		Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+		Status:         "W",
+		ExternalID:     "1503435956.000247",
+		SentOn:         "2017-08-22T21:05:56.000247Z",
+		ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF","ts":"1503435956.000247"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Enterprise Grid Send",
+		Text:  "Simple Message", URN: "slack:T061EG9R6/U0123ABCDEF",
+		Status:         "W",
+		ExternalID:     "1503435956.000247",
+		SentOn:         "2017-08-22T21:05:56.000247Z",
+		ResponseBody:   `{"ok":true,"channel":"D0123ABCDEF","ts":"1503435956.000247"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"U0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Reply In Thread",
+		Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+		ResponseToExternalID: "1355517523.000005",
+		Status:               "W",
+		ResponseBody:         `{"ok":true,"channel":"C0123ABCDEF"}`,
+		ResponseStatus:       200,
+		RequestBody:          `{"channel":"C0123ABCDEF","text":"Simple Message","thread_ts":"1355517523.000005","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+		SendPrep:             setSendUrl,
+	},
+	{
+		Label: "Reply To Msg Not In Thread",
+		Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+		ResponseToExternalID: "Ev0PV52K21",
+		Status:               "W",
+		ResponseBody:         `{"ok":true,"channel":"C0123ABCDEF"}`,
+		ResponseStatus:       200,
+		RequestBody:          `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+		SendPrep:             setSendUrl,
+	},
+	{
+		Label: "Quick Replies Send",
+		Text:  "Are you happy?", URN: "slack:C0123ABCDEF",
+		QuickReplies:   []string{"Yes", "No"},
+		Status:         "W",
+		ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"C0123ABCDEF","text":"Are you happy?","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","blocks":[{"type":"section","text":{"type":"mrkdwn","text":"Are you happy?"}},{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Yes"},"action_id":"quick_reply_0","value":"Yes"},{"type":"button","text":{"type":"plain_text","text":"No"},"action_id":"quick_reply_1","value":"No"}]}]}`,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Many Quick Replies Send",
+		Text:  "Pick a day", URN: "slack:C0123ABCDEF",
+		QuickReplies:   []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"},
+		Status:         "W",
+		ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"C0123ABCDEF","text":"Pick a day","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","blocks":[{"type":"section","text":{"type":"mrkdwn","text":"Pick a day"}},{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Mon"},"action_id":"quick_reply_0","value":"Mon"},{"type":"button","text":{"type":"plain_text","text":"Tue"},"action_id":"quick_reply_1","value":"Tue"},{"type":"button","text":{"type":"plain_text","text":"Wed"},"action_id":"quick_reply_2","value":"Wed"},{"type":"button","text":{"type":"plain_text","text":"Thu"},"action_id":"quick_reply_3","value":"Thu"},{"type":"button","text":{"type":"plain_text","text":"Fri"},"action_id":"quick_reply_4","value":"Fri"}]},{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Sat"},"action_id":"quick_reply_5","value":"Sat"},{"type":"button","text":{"type":"plain_text","text":"Sun"},"action_id":"quick_reply_6","value":"Sun"}]}]}`,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Repeated Quick Replies Send",
+		Text:  "Are you sure?", URN: "slack:C0123ABCDEF",
+		QuickReplies:   []string{"Yes", "Yes"},
+		Status:         "W",
+		ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"C0123ABCDEF","text":"Are you sure?","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","blocks":[{"type":"section","text":{"type":"mrkdwn","text":"Are you sure?"}},{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Yes"},"action_id":"quick_reply_0","value":"Yes"},{"type":"button","text":{"type":"plain_text","text":"Yes"},"action_id":"quick_reply_1","value":"Yes"}]}]}`,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Long Quick Reply Send",
+		Text:  "Are you happy?", URN: "slack:C0123ABCDEF",
+		QuickReplies: []string{"Yes", strings.Repeat("no ", 26)},
+		Error:        "quick replies can be at most 75 characters for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c, got: " + strings.Repeat("no ", 26),
+		SendPrep:     setSendUrl,
+	},
+	{
+		Label: "Unicode Send",
+		Text:  "☺", URN: "slack:U0123ABCDEF",
+		Status:         "W",
+		ResponseBody:   `{"ok":true,"channel":"U0123ABCDEF"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"U0123ABCDEF","text":"☺","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Send Text Auth Error",
+		Text:  "Hello", URN: "slack:U0123ABCDEF",
+		Status:         "E",
+		ResponseBody:   `{"ok":false,"error":"invalid_auth"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"U0123ABCDEF","text":"Hello","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+		SendPrep:       setSendUrl,
+	},
+}
+
+var threadSendTestCases = []ChannelSendTestCase{
+	{
+		Label: "Send On Latest Message",
+		Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+		Status: "W",
+		Responses: map[MockedRequest]MockedResponse{
+			{
+				Method:   "GET",
+				Path:     "/conversations.history",
+				RawQuery: "channel=C0123ABCDEF&limit=1",
+			}: {
+				Status: 200,
+				Body:   `{"ok":true,"messages":[{"type":"message","user":"U0123ABCDEF","text":"Hello","ts":"1512085950.000216"}],"has_more":true}`,
+			},
+			{
+				Method: "POST",
+				Path:   "/chat.postMessage",
+				Body:   `{"channel":"C0123ABCDEF","text":"Simple Message","thread_ts":"1512085950.000216","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+			}: {
+				Status: 200,
+				Body:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			},
+		},
+		Timeout:  time.Second,
+		SendPrep: setSendUrl,
+	},
+	{
+		Label: "Send On Empty Channel",
+		Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+		Status: "W",
+		Responses: map[MockedRequest]MockedResponse{
+			{
+				Method:   "GET",
+				Path:     "/conversations.history",
+				RawQuery: "channel=C0123ABCDEF&limit=1",
+			}: {
+				Status: 200,
+				Body:   `{"ok":true,"messages":[],"has_more":false}`,
+			},
+			{
+				Method: "POST",
+				Path:   "/chat.postMessage",
+				Body:   `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+			}: {
+				Status: 200,
+				Body:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			},
+		},
+		Timeout:  time.Second,
+		SendPrep: setSendUrl,
+	},
+	{
+		Label: "Send With Explicit Thread",
+		Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+		Metadata: json.RawMessage(`{"thread_ts":"1512085950.000100"}`),
+		Status:   "W",
+		Responses: map[MockedRequest]MockedResponse{
+			{
+				Method: "POST",
+				Path:   "/chat.postMessage",
+				Body:   `{"channel":"C0123ABCDEF","text":"Simple Message","thread_ts":"1512085950.000100","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+			}: {
+				Status: 200,
+				Body:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			},
+		},
+		Timeout:  time.Second,
+		SendPrep: setSendUrl,
+	},
+}
+
+var linkDisplaySendTestCases = []ChannelSendTestCase{
+	{
+		Label: "Channel Link Display",
+		Text:  "Check https://nyaruka.com", URN: "slack:C0123ABCDEF",
+		Status:         "W",
+		ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"C0123ABCDEF","text":"Check https://nyaruka.com","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","unfurl_links":false,"unfurl_media":false}`,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Message Link Display Overrides Channel",
+		Text:  "Check https://nyaruka.com", URN: "slack:C0123ABCDEF",
+		Metadata:       json.RawMessage(`{"link_display":"expanded"}`),
+		Status:         "W",
+		ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"C0123ABCDEF","text":"Check https://nyaruka.com","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","unfurl_links":true,"unfurl_media":true}`,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Invalid Message Link Display Ignored",
+		Text:  "Check https://nyaruka.com", URN: "slack:C0123ABCDEF",
+		Metadata:       json.RawMessage(`{"link_display":"huge"}`),
+		Status:         "W",
+		ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"channel":"C0123ABCDEF","text":"Check https://nyaruka.com","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+		SendPrep:       setSendUrl,
+	},
+}
+
+var homeSendTestCases = []ChannelSendTestCase{
+	{
+		Label: "Publish Home View",
+		Text:  "Welcome", URN: "slack:U0123ABCDEF",
+		Metadata: json.RawMessage(`{"target":"home","view":{"type":"home","blocks":[{"type":"header","text":{"type":"plain_text","text":"Welcome"}}]}}`),
+		Status:   "W",
+		Responses: map[MockedRequest]MockedResponse{
+			{
+				Method: "POST",
+				Path:   "/views.publish",
+				Body:   `{"user_id":"U0123ABCDEF","view":{"type":"home","blocks":[{"type":"header","text":{"type":"plain_text","text":"Welcome"}}]}}`,
+			}: {
+				Status: 200,
+				Body:   `{"ok":true,"view":{"id":"V0123ABCDEF"}}`,
+			},
+		},
+		SendPrep: setSendUrl,
+	},
+	{
+		Label: "Publish Home View From Text",
+		Text:  "Hello *there*", URN: "slack:U0123ABCDEF",
+		Metadata: json.RawMessage(`{"target":"home"}`),
+		Status:   "W",
+		Responses: map[MockedRequest]MockedResponse{
+			{
+				Method: "POST",
+				Path:   "/views.publish",
+				Body:   `{"user_id":"U0123ABCDEF","view":{"type":"home","blocks":[{"text":{"text":"Hello *there*","type":"mrkdwn"},"type":"section"}]}}`,
+			}: {
+				Status: 200,
+				Body:   `{"ok":true,"view":{"id":"V0123ABCDEF"}}`,
+			},
+		},
+		SendPrep: setSendUrl,
+	},
+	{
+		Label: "Publish Home View Error",
+		Text:  "Welcome", URN: "slack:U0123ABCDEF",
+		Metadata:       json.RawMessage(`{"target":"home"}`),
+		Status:         "E",
+		ResponseBody:   `{"ok":false,"error":"not_enabled"}`,
+		ResponseStatus: 200,
+		SendPrep:       setSendUrl,
+	},
+	{
+		Label: "Invalid Home View Type",
+		Text:  "Welcome", URN: "slack:U0123ABCDEF",
+		Metadata: json.RawMessage(`{"target":"home","view":{"type":"modal","blocks":[{"type":"divider"}]}}`),
+		Error:    "invalid home view for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c: view type must be home, got: modal",
+		SendPrep: setSendUrl,
+	},
+	{
+		Label: "Invalid Home View Without Blocks",
+		Text:  "Welcome", URN: "slack:U0123ABCDEF",
+		Metadata: json.RawMessage(`{"target":"home","view":{"type":"home","blocks":[]}}`),
+		Error:    "invalid home view for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c: view must have between 1 and 100 blocks, got: 0",
+		SendPrep: setSendUrl,
+	},
+	{
+		Label: "Invalid Home View Block",
+		Text:  "Welcome", URN: "slack:U0123ABCDEF",
+		Metadata: json.RawMessage(`{"target":"home","view":{"type":"home","blocks":[{"text":"hi"}]}}`),
+		Error:    "invalid home view for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c: view block 0 has no type",
+		SendPrep: setSendUrl,
+	},
+	{
+		Label: "Invalid Home View JSON",
+		Text:  "Welcome", URN: "slack:U0123ABCDEF",
+		Metadata: json.RawMessage(`{"target":"home","view":"home"}`),
+		Error:    "invalid home view for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c: view must be an object",
+		SendPrep: setSendUrl,
+	},
+}
+
+func TestHandler(t *testing.T) {
+	slackServiceMock := buildMockSlackService(handleTestCases)
+	defer slackServiceMock.Close()
+
+	RunChannelTestCases(t, testChannels, newHandler(), handleTestCases)
+}
+
+func TestSending(t *testing.T) {
+	RunChannelSendTestCases(t, testChannels[0], newHandler(), defaultSendTestCases, nil)
+}
+
+func TestSendingOnLatestMessage(t *testing.T) {
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "thread_on_latest": true, "messages_per_second": 1000})
+	RunChannelSendTestCases(t, channel, newHandler(), threadSendTestCases, nil)
+}
+
+func TestSendingLinkDisplay(t *testing.T) {
+	// without any config or metadata we leave it to Slack
+	RunChannelSendTestCases(t, testChannels[0], newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Default Link Display",
+			Text:  "Check https://nyaruka.com", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Check https://nyaruka.com","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+			SendPrep:       setSendUrl,
+		},
+		{
+			Label: "Message Link Display",
+			Text:  "Check https://nyaruka.com", URN: "slack:C0123ABCDEF",
+			Metadata:       json.RawMessage(`{"link_display":"compact"}`),
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Check https://nyaruka.com","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","unfurl_links":false,"unfurl_media":false}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "link_display": "compact", "messages_per_second": 1000})
+	RunChannelSendTestCases(t, channel, newHandler(), linkDisplaySendTestCases, nil)
+}
+
+func TestSendingAsUser(t *testing.T) {
+	// by default text is posted with the bot token, even if the channel has a user token
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "user_token": "xoxp-abc123", "verification_token": "one-long-verification-token"})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Send As Bot",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			Headers:        map[string]string{"Authorization": "Bearer xoxb-abc123"},
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+
+	// but channels can post it as the user instead
+	channel = courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "user_token": "xoxp-abc123", "verification_token": "one-long-verification-token", "send_as_user": true})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Send As User",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			Headers:        map[string]string{"Authorization": "Bearer xoxp-abc123"},
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","as_user":true}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+
+	// which needs a user token
+	channel = courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "send_as_user": true})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Send As User Without Token",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			Error:    "missing user token for SL/slack channel configured to send as user",
+			SendPrep: setSendUrl,
+		},
+	}, nil)
+}
+
+func TestSendingBotIdentity(t *testing.T) {
+	// by default the bot posts with the name and icon of the app
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token"})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Send As App",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+
+	// but channels can give it a name and icon of its own
+	channel = courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "bot_username": "Support", "bot_icon_url": "https://example.com/support.png"})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Send With Name And Icon URL",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","username":"Support","icon_url":"https://example.com/support.png"}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+
+	// an icon emoji being used instead of an icon URL if it has both
+	channel = courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "bot_icon_emoji": ":robot_face:", "bot_icon_url": "https://example.com/support.png"})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Send With Icon Emoji",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","icon_emoji":":robot_face:"}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+
+	// none of which applies to channels posting as the user
+	channel = courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "user_token": "xoxp-abc123", "verification_token": "one-long-verification-token", "send_as_user": true, "bot_username": "Support", "bot_icon_emoji": ":robot_face:"})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Send As User With Bot Identity",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","as_user":true}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+}
+
+func TestSendingUnfurlConfig(t *testing.T) {
+	// links and media can be unfurled or not separately
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "unfurl_links": false, "messages_per_second": 1000})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Links Not Unfurled",
+			Text:  "Check https://nyaruka.com", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Check https://nyaruka.com","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","unfurl_links":false}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+
+	channel = courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "unfurl_links": false, "unfurl_media": false, "messages_per_second": 1000})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Links And Media Not Unfurled",
+			Text:  "Check https://nyaruka.com", URN: "slack:C0123ABCDEF",
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Check https://nyaruka.com","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","unfurl_links":false,"unfurl_media":false}`,
+			SendPrep:       setSendUrl,
+		},
+		{
+			Label: "Link Display Overrides",
+			Text:  "Check https://nyaruka.com", URN: "slack:C0123ABCDEF",
+			Metadata:       json.RawMessage(`{"link_display":"expanded"}`),
+			Status:         "W",
+			ResponseBody:   `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"channel":"C0123ABCDEF","text":"Check https://nyaruka.com","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa","unfurl_links":true,"unfurl_media":true}`,
+			SendPrep:       setSendUrl,
+		},
+	}, nil)
+}
+
+func TestSendingHomeView(t *testing.T) {
+	RunChannelSendTestCases(t, testChannels[0], newHandler(), homeSendTestCases, nil)
+}
+
+func TestSendingPresence(t *testing.T) {
+	var requests []string
+	var forms []string
+	response := `{"ok":true}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path)
+		forms = append(forms, string(body))
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	send := func(metadata string) (courier.MsgStatus, error) {
+		requests, forms = nil, nil
+		msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:U0123ABCDEF", "", false, nil, "", 0, "").WithMetadata(json.RawMessage(metadata))
+		return h.SendMsg(context.Background(), msg)
+	}
+
+	// messages targeting presence set the presence of the bot rather than being sent
+	status, err := send(`{"target":"presence","presence":"away"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/users.setPresence"}, requests)
+	assert.Equal(t, []string{"presence=away"}, forms)
+
+	// tokens without the scope needed get a clear error
+	response = `{"ok":false,"error":"missing_scope","needed":"users:write","provided":"chat:write"}`
+	status, err = send(`{"target":"presence","presence":"auto"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, []string{"presence=auto"}, forms)
+	assert.Equal(t, "bot token is missing the users:write scope needed to set presence", status.Logs()[len(status.Logs())-1].Error)
+
+	// and presence values Slack doesn't support are rejected without a request
+	_, err = send(`{"target":"presence","presence":"busy"}`)
+	assert.EqualError(t, err, "invalid presence for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c: must be auto or away, got: busy")
+	assert.Nil(t, requests)
+}
+
+func TestSendingToResponseURL(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path+" "+string(body))
+
+		switch r.URL.Path {
+		case "/commands/T0001/1234/valid":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"ok":true}`))
+		case "/commands/T0001/1234/expired":
+			w.WriteHeader(404)
+			w.Write([]byte(`expired_url`))
+		case "/commands/T0001/1234/broken":
+			w.WriteHeader(500)
+			w.Write([]byte(`internal error`))
+		case "/chat.postMessage":
+			w.WriteHeader(200)
+			w.Write([]byte(`{"ok":true,"channel":"U0123ABCDEF"}`))
+		}
+	}))
+	defer server.Close()
+
+	defer func(api, prefix string) { apiURL, responseURLPrefix = api, prefix }(apiURL, responseURLPrefix)
+	apiURL = server.URL
+	responseURLPrefix = server.URL + "/commands/"
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	send := func(metadata string) courier.MsgStatus {
+		requests = nil
+		msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:U0123ABCDEF", "Command result", false, nil, "", 0, "")
+		msg.WithMetadata(json.RawMessage(metadata))
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status
+	}
+
+	// response URLs are used instead of posting to the conversation, ephemeral by default
+	status := send(fmt.Sprintf(`{"response_url":"%s/commands/T0001/1234/valid"}`, server.URL))
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{`/commands/T0001/1234/valid {"text":"Command result","response_type":"ephemeral"}`}, requests)
+
+	status = send(fmt.Sprintf(`{"response_url":"%s/commands/T0001/1234/valid","response_type":"in_channel"}`, server.URL))
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{`/commands/T0001/1234/valid {"text":"Command result","response_type":"in_channel"}`}, requests)
+
+	// expired response URLs fall back to posting to the conversation
+	status = send(fmt.Sprintf(`{"response_url":"%s/commands/T0001/1234/expired"}`, server.URL))
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{
+		`/commands/T0001/1234/expired {"text":"Command result","response_type":"ephemeral"}`,
+		`/chat.postMessage {"channel":"U0123ABCDEF","text":"Command result","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+	}, requests)
+	assert.Equal(t, "response URL can no longer be used: expired_url", status.Logs()[0].Error)
+
+	// as do response URLs which aren't Slack's
+	status = send(`{"response_url":"http://example.com/commands/T0001/1234/valid"}`)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{`/chat.postMessage {"channel":"U0123ABCDEF","text":"Command result","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`}, requests)
+
+	// but other errors don't, to avoid sending twice
+	status = send(fmt.Sprintf(`{"response_url":"%s/commands/T0001/1234/broken"}`, server.URL))
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, []string{`/commands/T0001/1234/broken {"text":"Command result","response_type":"ephemeral"}`}, requests)
+}
+
+func TestSendingWithMembershipCheck(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+
+		switch r.URL.Path + "?" + r.URL.RawQuery {
+		case "/conversations.info?channel=C0123ABCDEF":
+			w.Write([]byte(`{"ok":true,"channel":{"id":"C0123ABCDEF","is_member":true}}`))
+		case "/conversations.info?channel=C0456GHIJKL":
+			w.Write([]byte(`{"ok":true,"channel":{"id":"C0456GHIJKL","is_member":false}}`))
+		case "/chat.postMessage?":
+			w.Write([]byte(`{"ok":true,"channel":"C0123ABCDEF","ts":"1653417052.881009"}`))
+		}
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "check_membership": true, "messages_per_second": 1000})
+
+	send := func(urn urns.URN) courier.MsgStatus {
+		requests = nil
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), urn, "Simple Message", false, nil, "", 0, "")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status
+	}
+
+	// we check membership before sending to conversations
+	status := send("slack:C0123ABCDEF")
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/conversations.info?channel=C0123ABCDEF", "/chat.postMessage?"}, requests)
+
+	// and remember it for next time
+	status = send("slack:C0123ABCDEF")
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/chat.postMessage?"}, requests)
+
+	// messages to conversations the bot isn't in aren't sent
+	status = send("slack:C0456GHIJKL")
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, []string{"/conversations.info?channel=C0456GHIJKL"}, requests)
+	assert.Equal(t, "bot is not a member of conversation C0456GHIJKL, invite it with /invite in the conversation so that it can send there", status.Logs()[0].Error)
+
+	// and we keep checking until it is
+	send("slack:C0456GHIJKL")
+	assert.Equal(t, []string{"/conversations.info?channel=C0456GHIJKL"}, requests)
+
+	// direct messages to users aren't checked
+	status = send("slack:U0123ABCDEF")
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/chat.postMessage?"}, requests)
+}
+
+func TestSendingRateLimited(t *testing.T) {
+	rateLimited := 0
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= rateLimited {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"ok":false,"error":"ratelimited"}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"channel":"C0123ABCDEF","ts":"1503435956.000247"}`))
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	send := func(limited int) courier.MsgStatus {
+		rateLimited, requests = limited, 0
+		msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:C0123ABCDEF", "Simple Message", false, nil, "", 0, "")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status
+	}
+
+	// rate limited requests are retried, with each attempt logged
+	status := send(2)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, 3, requests)
+	assert.Equal(t, []string{"Message Send Rate Limited", "Message Send Rate Limited", "Message Sent"}, LogDescriptions(status.Logs()))
+	for _, log := range LogsWithDescription(status.Logs(), "Message Send Rate Limited") {
+		assert.Equal(t, 429, log.StatusCode)
+	}
+	if sent := LogsWithDescription(status.Logs(), "Message Sent"); assert.Len(t, sent, 1) {
+		assert.Equal(t, 200, sent[0].StatusCode)
+	}
+	assert.Equal(t, "1503435956.000247", status.ExternalID())
+
+	// until we run out of retries
+	RunChannelSendTestCases(t, testChannels[0], newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Rate Limited Send",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			Status:          "E",
+			ResponseStatus:  429,
+			ResponseHeaders: map[string]string{"Retry-After": "0"},
+			ResponseBody:    `{"ok":false,"error":"ratelimited"}`,
+			Retries:         3,
+			LogContains:     []string{"Message Send Rate Limited", "Message Send Error", `"error":"ratelimited"`},
+			SendPrep:        setSendUrl,
+		},
+	}, nil)
+}
+
+func TestRetryAfter(t *testing.T) {
+	defer func(max time.Duration) { maxRetryAfter = max }(maxRetryAfter)
+	maxRetryAfter = 30 * time.Second
+
+	rateLimited := func(header http.Header) *utils.RequestResponse {
+		return &utils.RequestResponse{StatusCode: 429, RateLimit: utils.ParseRateLimitHeaders(header, time.Now())}
+	}
+
+	backoff := &utils.Backoff{Base: time.Second, Max: maxRetryAfter, Multiplier: 2}
+	assert.InDelta(t, 5*time.Second, retryAfter(rateLimited(http.Header{"Retry-After": []string{"5"}}), backoff), float64(100*time.Millisecond))
+	assert.Equal(t, 30*time.Second, retryAfter(rateLimited(http.Header{"Retry-After": []string{"120"}}), backoff))
+
+	// if Slack doesn't tell us how long to wait, we back off
+	assert.Equal(t, time.Second, retryAfter(rateLimited(http.Header{}), backoff))
+	assert.Equal(t, 2*time.Second, retryAfter(rateLimited(http.Header{}), backoff))
+	assert.Equal(t, 4*time.Second, retryAfter(rateLimited(http.Header{}), backoff))
+}
+
+func TestSendFiles(t *testing.T) {
+	fileServer := buildMockAttachmentFileServer()
+	defer fileServer.Close()
+
+	var uploaded string
+	failUpload := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failUpload {
+			w.Write([]byte(`{"ok":false,"error":"invalid_channel"}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		uploaded = string(body)
+		w.Write([]byte(`{"ok":true,"file":{"id":"F1L3SL4CK1D"}}`))
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	// channels can still use the legacy files.upload endpoint while Slack supports it
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "legacy_file_upload": true})
+
+	send := func() courier.MsgStatus {
+		uploaded = ""
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "slack:U0123ABCDEF", "", false, nil, "", 0, "").WithAttachment("image/jpeg:" + fileServer.URL + "/image.png")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status
+	}
+
+	status := send()
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Contains(t, uploaded, `filename="image.jpg"`)
+	assert.Contains(t, uploaded, "filetype... ...file bytes... ...end")
+
+	// failed uploads are logged like any other failed request
+	failUpload = true
+	status = send()
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	for _, log := range status.Logs() {
+		require.NotNil(t, log)
+	}
+	assert.Equal(t, []string{"error uploading file to slack: invalid_channel."}, LogErrors(ErroredLogs(status.Logs())))
+}
+
+func TestSendFilesExternalUpload(t *testing.T) {
+	fileServer := buildMockAttachmentFileServer()
+	defer fileServer.Close()
+
+	var requests []string
+	var uploaded, completed string
+	failUpload := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path)
+
+		switch r.URL.Path {
+		case "/files.getUploadURLExternal":
+			if failUpload {
+				w.Write([]byte(`{"ok":false,"error":"invalid_arguments"}`))
+				return
+			}
+			w.Write([]byte(fmt.Sprintf(`{"ok":true,"upload_url":"http://%s/upload/v1/abc","file_id":"F1L3SL4CK1D"}`, r.Host)))
+		case "/upload/v1/abc":
+			uploaded = string(body)
+			w.Write([]byte(`OK - 35`))
+		case "/conversations.open":
+			w.Write([]byte(`{"ok":true,"channel":{"id":"D0123ABCDEF"}}`))
+		case "/files.completeUploadExternal":
+			completed = string(body)
+			w.Write([]byte(`{"ok":true,"files":[{"id":"F1L3SL4CK1D","title":"image.jpg"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	send := func(urn urns.URN) courier.MsgStatus {
+		requests, uploaded, completed = nil, "", ""
+		msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), urn, "", false, nil, "", 0, "").WithAttachment("image/jpeg:" + fileServer.URL + "/image.png")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status
+	}
+
+	// files are uploaded to the URL Slack gives us and then shared in the conversation
+	status := send("slack:C0123ABCDEF")
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/files.getUploadURLExternal", "/upload/v1/abc", "/files.completeUploadExternal"}, requests)
+	assert.Equal(t, "filetype... ...file bytes... ...end", uploaded)
+	assert.JSONEq(t, `{"files":[{"id":"F1L3SL4CK1D","title":"image.jpg"}],"channel_id":"C0123ABCDEF"}`, completed)
+
+	// for direct messages, we share them in the conversation with the user
+	status = send("slack:U0123ABCDEF")
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/files.getUploadURLExternal", "/upload/v1/abc", "/conversations.open", "/files.completeUploadExternal"}, requests)
+	assert.JSONEq(t, `{"files":[{"id":"F1L3SL4CK1D","title":"image.jpg"}],"channel_id":"D0123ABCDEF"}`, completed)
+
+	// and errors from Slack are logged
+	failUpload = true
+	status = send("slack:C0123ABCDEF")
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, []string{"/files.getUploadURLExternal"}, requests)
+	assert.Equal(t, "getting upload url failed: invalid_arguments", status.Logs()[len(status.Logs())-1].Error)
+}
+
+func TestSendFilesContentType(t *testing.T) {
+	fileServer := buildMockAttachmentFileServer()
+	defer fileServer.Close()
+
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files.getUploadURLExternal":
+			w.Write([]byte(fmt.Sprintf(`{"ok":true,"upload_url":"http://%s/upload/v1/abc","file_id":"F1L3SL4CK1D"}`, r.Host)))
+		case "/upload/v1/abc":
+			contentType = r.Header.Get("Content-Type")
+			w.Write([]byte(`OK - 35`))
+		case "/files.completeUploadExternal":
+			w.Write([]byte(`{"ok":true,"files":[{"id":"F1L3SL4CK1D","title":"image.jpg"}]}`))
+		case "/files.upload":
+			r.ParseMultipartForm(1024)
+			contentType = r.MultipartForm.File["file"][0].Header.Get("Content-Type")
+			w.Write([]byte(`{"ok":true,"file":{"id":"F1L3SL4CK1D"}}`))
+		}
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	send := func(config map[string]interface{}) string {
+		contentType = ""
+		config["bot_token"] = "xoxb-abc123"
+		config["messages_per_second"] = 1000
+		channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", config)
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "slack:C0123ABCDEF", "", false, nil, "", 0, "").WithAttachment("image/jpeg:" + fileServer.URL + "/image.png")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		require.Equal(t, courier.MsgWired, status.Status())
+		return contentType
+	}
+
+	// by default we leave working out the type of files to Slack
+	assert.Equal(t, "application/octet-stream", send(map[string]interface{}{}))
+	assert.Equal(t, "application/octet-stream", send(map[string]interface{}{"legacy_file_upload": true}))
+
+	// but channels can force the type attachments were declared with
+	assert.Equal(t, "image/jpeg", send(map[string]interface{}{"upload_content_type": "attachment"}))
+	assert.Equal(t, "image/jpeg", send(map[string]interface{}{"upload_content_type": "attachment", "legacy_file_upload": true}))
+
+	// or a fixed type
+	assert.Equal(t, "image/png", send(map[string]interface{}{"upload_content_type": "image/png"}))
+	assert.Equal(t, "image/png", send(map[string]interface{}{"upload_content_type": "image/png", "legacy_file_upload": true}))
+}
+
+func TestSendFileCaptions(t *testing.T) {
+	fileServer := buildMockAttachmentFileServer()
+	defer fileServer.Close()
+
+	var requests []string
+	var comments []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+
+		switch r.URL.Path {
+		case "/files.upload":
+			r.ParseMultipartForm(1024)
+			comments = append(comments, r.FormValue("initial_comment"))
+			w.Write([]byte(`{"ok":true,"file":{"id":"F1L3SL4CK1D"}}`))
+		case "/chat.postMessage":
+			w.Write([]byte(`{"ok":true,"channel":"C0123ABCDEF","ts":"1355517523.000005"}`))
+		}
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "legacy_file_upload": true, "messages_per_second": 1000})
+
+	send := func(quickReplies []string, attachments ...string) courier.MsgStatus {
+		requests, comments = nil, nil
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "slack:C0123ABCDEF", "Look at this", false, quickReplies, "", 0, "")
+		for _, attachment := range attachments {
+			msg.WithAttachment("image/jpeg:" + fileServer.URL + "/" + attachment)
+		}
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status
+	}
+
+	// the text of a message is sent as the comment of its file rather than posted separately
+	status := send(nil, "image.png")
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/files.upload"}, requests)
+	assert.Equal(t, []string{"Look at this"}, comments)
+
+	// and only on the first of its files
+	status = send(nil, "image.png", "other.png")
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/files.upload", "/files.upload"}, requests)
+	assert.Equal(t, []string{"Look at this", ""}, comments)
+
+	// unless it has quick replies which need posting with it
+	status = send([]string{"Yes", "No"}, "image.png")
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/files.upload", "/chat.postMessage"}, requests)
+	assert.Equal(t, []string{""}, comments)
+}
+
+func TestSendFileTooLarge(t *testing.T) {
+	fileServer := buildMockAttachmentFileServer()
+	defer fileServer.Close()
+
+	// attachments over the channel's file size limit are never uploaded
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "max_file_size": 10})
+	testCases := mockAttachmentURLs(fileServer, []ChannelSendTestCase{
+		{
+			Label: "Send Image Too Large",
+			Text:  "", URN: "slack:U0123ABCDEF",
+			Status:         "E",
+			Attachments:    []string{"image/jpeg:https://foo.bar/image.png"},
+			ResponseBody:   `{"ok":true,"file":{"id":"F1L3SL4CK1D"}}`,
+			ResponseStatus: 200,
+			SendPrep:       setSendUrl,
+		},
+	})
+
+	RunChannelSendTestCases(t, channel, newHandler(), testCases, nil)
+}
+
+func TestSendFileTooLargeWithText(t *testing.T) {
+	// files served without support for range requests, but whose size we're told, aren't downloaded at all
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(defaultMaxFileSize+1))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer fileServer.Close()
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		w.Write([]byte(`{"ok":true,"channel":"C0123ABCDEF","ts":"1503435956.000247"}`))
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	// the text of messages with attachments too large to upload is still sent, but the message is errored
+	msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:C0123ABCDEF", "Look at this", false, nil, "", 0, "")
+	msg.WithAttachment("image/jpeg:" + fileServer.URL + "/huge.jpg")
+	status, err := h.SendMsg(context.Background(), msg)
+	require.NoError(t, err)
+
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, []string{"/chat.postMessage"}, requests)
+	require.Len(t, status.Logs(), 2)
+	assert.Equal(t, "Attachment too large", status.Logs()[0].Description)
+	assert.Equal(t, "file is larger than the limit of 52428800 bytes", status.Logs()[0].Error)
+}
+
+func TestSendFilePlaceholder(t *testing.T) {
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.png" {
+			w.WriteHeader(404)
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte("filetype... ...file bytes... ...end"))
+	}))
+	defer fileServer.Close()
+
+	// attachments which can't be fetched are replaced by the placeholder if the channel has one
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "placeholder_attachment": "image/png:" + fileServer.URL + "/placeholder.png", "legacy_file_upload": true})
+	testCases := mockAttachmentURLs(fileServer, []ChannelSendTestCase{
+		{
+			Label: "Send Missing Image With Placeholder",
+			Text:  "", URN: "slack:U0123ABCDEF",
+			Status:      "W",
+			Attachments: []string{"image/jpeg:https://foo.bar/missing.png"},
+			Responses: map[MockedRequest]MockedResponse{
+				{
+					Method:       "POST",
+					Path:         "/files.upload",
+					BodyContains: `filename="placeholder.png"`,
+				}: {
+					Status: 200,
+					Body:   `{"ok":true,"file":{"id":"F1L3SL4CK1D"}}`,
+				},
+			},
+			SendPrep: setSendUrl,
+		},
+	})
+	RunChannelSendTestCases(t, channel, newHandler(), testCases, nil)
+
+	// and otherwise aren't sent
+	testCases = mockAttachmentURLs(fileServer, []ChannelSendTestCase{
+		{
+			Label: "Send Missing Image",
+			Text:  "", URN: "slack:U0123ABCDEF",
+			Status:         "E",
+			Attachments:    []string{"image/jpeg:https://foo.bar/missing.png"},
+			ResponseBody:   `{"ok":true,"file":{"id":"F1L3SL4CK1D"}}`,
+			ResponseStatus: 200,
+			SendPrep:       setSendUrl,
+		},
+	})
+	RunChannelSendTestCases(t, testChannels[0], newHandler(), testCases, nil)
+}
+
+func TestAttachmentLimits(t *testing.T) {
+	attachmentLimitTestCases := []ChannelHandleTestCase{
+		{
+			Label:       "Receive Files Within Limit",
+			URL:         receiveURL,
+			Data:        twoFilesMsg,
+			Attachments: []string{"https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSA/download/first.jpg?pub_secret=11aa22bb33", "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSB/download/second.jpg?pub_secret=44cc55dd66"},
+			Text:        Sp("Photos"),
+			Status:      200,
+			Response:    "Accepted",
+		},
+	}
+	slackServiceMock := buildMockSlackService(attachmentLimitTestCases)
+	defer slackServiceMock.Close()
+
+	newChannel := func(config map[string]interface{}) []courier.Channel {
+		config["bot_token"] = "xoxb-abc123"
+		config["verification_token"] = "one-long-verification-token"
+		return []courier.Channel{courier.NewMockChannel(channelUUID, "SL", "2022", "US", config)}
+	}
+
+	RunChannelTestCases(t, newChannel(map[string]interface{}{"max_attachments_size": 11000}), newHandler(), attachmentLimitTestCases)
+
+	// by default attachments that would take us over the total size are dropped
+	RunChannelTestCases(t, newChannel(map[string]interface{}{"max_attachments_size": 10000}), newHandler(), []ChannelHandleTestCase{
+		{
+			Label:       "Receive Files Over Size Limit Truncated",
+			URL:         receiveURL,
+			Data:        twoFilesMsg,
+			Attachments: []string{"https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSA/download/first.jpg?pub_secret=11aa22bb33"},
+			Text:        Sp("Photos"),
+			Status:      200,
+			Response:    "Accepted",
+		},
+	})
+
+	// channels can also limit the number of attachments
+	RunChannelTestCases(t, newChannel(map[string]interface{}{"max_attachments": 1}), newHandler(), []ChannelHandleTestCase{
+		{
+			Label:       "Receive Files Over Count Limit Truncated",
+			URL:         receiveURL,
+			Data:        twoFilesMsg,
+			Attachments: []string{"https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSA/download/first.jpg?pub_secret=11aa22bb33"},
+			Text:        Sp("Photos"),
+			Status:      200,
+			Response:    "Accepted",
+		},
+	})
+
+	// or reject all of them
+	RunChannelTestCases(t, newChannel(map[string]interface{}{"max_attachments_size": 10000, "attachment_limit_action": "reject"}), newHandler(), []ChannelHandleTestCase{
+		{
+			Label:       "Receive Files Over Size Limit Rejected",
+			URL:         receiveURL,
+			Data:        twoFilesMsg,
+			Attachments: []string{},
+			Text:        Sp("Photos"),
+			Status:      200,
+			Response:    "Accepted",
+		},
+	})
+}
+
+func TestThumbnails(t *testing.T) {
+	fullURL := "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSC/download/large.jpg?pub_secret=77ee88ff99"
+	thumbURL := "https://files.slack.com/files-tmb/T03CN5KTA6S-F03GTH43SSC-77ee88ff99/large_360.jpg?pub_secret=77ee88ff99"
+
+	thumbnailTestCases := []ChannelHandleTestCase{
+		{
+			Label:       "Receive Image Without Thumbnail",
+			URL:         receiveURL,
+			Data:        largeImageMsg,
+			Attachments: []string{fullURL},
+			Text:        Sp("Big photo"),
+			Status:      200,
+			Response:    "Accepted",
+		},
+	}
+	slackServiceMock := buildMockSlackService(thumbnailTestCases)
+	defer slackServiceMock.Close()
+
+	newChannel := func(config map[string]interface{}) []courier.Channel {
+		config["bot_token"] = "xoxb-abc123"
+		config["verification_token"] = "one-long-verification-token"
+		return []courier.Channel{courier.NewMockChannel(channelUUID, "SL", "2022", "US", config)}
+	}
+
+	// by default we only attach the full image
+	RunChannelTestCases(t, newChannel(map[string]interface{}{}), newHandler(), thumbnailTestCases)
+
+	// channels can have the thumbnail attached alongside it
+	RunChannelTestCases(t, newChannel(map[string]interface{}{"thumbnails": true}), newHandler(), []ChannelHandleTestCase{
+		{
+			Label:       "Receive Image With Thumbnail",
+			URL:         receiveURL,
+			Data:        largeImageMsg,
+			Attachments: []string{fullURL, thumbURL},
+			Text:        Sp("Big photo"),
+			Status:      200,
+			Response:    "Accepted",
+		},
+	})
+
+	// or in place of images over a size
+	RunChannelTestCases(t, newChannel(map[string]interface{}{"thumbnails": true, "thumbnail_only_size": 5000000}), newHandler(), []ChannelHandleTestCase{
+		{
+			Label:       "Receive Large Image As Thumbnail",
+			URL:         receiveURL,
+			Data:        largeImageMsg,
+			Attachments: []string{thumbURL},
+			Text:        Sp("Big photo"),
+			Status:      200,
+			Response:    "Accepted",
+		},
+	})
+
+	// smaller images still get both
+	RunChannelTestCases(t, newChannel(map[string]interface{}{"thumbnails": true, "thumbnail_only_size": 10000000}), newHandler(), []ChannelHandleTestCase{
+		{
+			Label:       "Receive Image Under Thumbnail Only Size",
+			URL:         receiveURL,
+			Data:        largeImageMsg,
+			Attachments: []string{fullURL, thumbURL},
+			Text:        Sp("Big photo"),
+			Status:      200,
+			Response:    "Accepted",
+		},
+	})
+}
+
+func TestVerification(t *testing.T) {
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{Label: "Valid token", URL: receiveURL, Status: 200,
+			Data:     `{"token":"one-long-verification-token","challenge":"challenge123","type":"url_verification"}`,
+			Headers:  map[string]string{"content-type": "text/plain"},
+			Response: "challenge123", NoQueueErrorCheck: true, NoInvalidChannelCheck: true,
+		},
+		{Label: "Invalid token", URL: receiveURL, Status: 403,
+			Data:    `{"token":"abc321","challenge":"challenge123","type":"url_verification"}`,
+			Headers: map[string]string{"content-type": "text/plain"},
+		},
+	})
+}
+
+func TestVerificationMismatch(t *testing.T) {
+	h := newHandler().(*handler)
+
+	// mismatched tokens, including ones which only differ at the end, get a 403 which doesn't say why
+	for _, token := range []string{"abc321", "one-long-verification-toke", "one-long-verification-token2", ""} {
+		body := fmt.Sprintf(`{"token":"%s","challenge":"challenge123","type":"url_verification"}`, token)
+		r := httptest.NewRequest(http.MethodPost, receiveURL, strings.NewReader(body))
+		w := httptest.NewRecorder()
+
+		events, err := h.receiveEvent(context.Background(), testChannels[0], w, r)
+		assert.NoError(t, err)
+		assert.Nil(t, events)
+		assert.Equal(t, http.StatusForbidden, w.Code, "status mismatch for token %s", token)
+		assert.Equal(t, "", w.Body.String(), "body mismatch for token %s", token)
+	}
+}
+
+func TestSigningSecret(t *testing.T) {
+	signedChannels := []courier.Channel{
+		courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "channel_user_urns": true, "signing_secret": "8f742231b10e8888abcd99yyyzzz85a5"}),
+	}
+
+	signedHeaders := func(body string, timestamp time.Time) map[string]string {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		return map[string]string{
+			"Content-Type":              "application/json",
+			"X-Slack-Request-Timestamp": ts,
+			"X-Slack-Signature":         calculateSignature("8f742231b10e8888abcd99yyyzzz85a5", ts, []byte(body)),
+		}
+	}
+	challenge := `{"challenge":"challenge123","type":"url_verification"}`
+	signedInteraction := "payload=" + url.QueryEscape(blockActionsPayload)
+
+	RunChannelTestCases(t, signedChannels, newHandler(), []ChannelHandleTestCase{
+		{
+			Label:    "Receive Signed Msg",
+			URL:      receiveURL,
+			Data:     helloMsg,
+			Headers:  signedHeaders(helloMsg, time.Now()),
+			Status:   200,
+			Response: "Accepted",
+			Text:     Sp("Hello World!"),
+			URN:      Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+		},
+		{
+			Label:    "Receive Signed Challenge",
+			URL:      receiveURL,
+			Data:     challenge,
+			Headers:  signedHeaders(challenge, time.Now()),
+			Status:   200,
+			Response: "challenge123",
+		},
+		{
+			Label:   "Receive Signed Command",
+			URL:     commandURL,
+			Data:    commandData,
+			Headers: signedHeaders(commandData, time.Now()),
+			Status:  200,
+			Text:    Sp("/weather London"),
+			URN:     Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+			PrepRequest: func(r *http.Request) {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			},
+		},
+		{
+			Label:   "Receive Signed Interaction",
+			URL:     interactionURL,
+			Data:    signedInteraction,
+			Headers: signedHeaders(signedInteraction, time.Now()),
+			Status:  200,
+			Text:    Sp("Yes"),
+			URN:     Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+			PrepRequest: func(r *http.Request) {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			},
+		},
+		{
+			Label:    "Receive Msg Signed With Wrong Secret",
+			URL:      receiveURL,
+			Data:     helloMsg,
+			Headers:  map[string]string{"X-Slack-Request-Timestamp": strconv.FormatInt(time.Now().Unix(), 10), "X-Slack-Signature": "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503"},
+			Status:   400,
+			Response: "invalid request signature",
+		},
+		{
+			Label:    "Receive Msg With Old Signature",
+			URL:      receiveURL,
+			Data:     helloMsg,
+			Headers:  signedHeaders(helloMsg, time.Now().Add(-10*time.Minute)),
+			Status:   403,
+			Response: "request timestamp too far from now",
+		},
+		{
+			Label:    "Receive Command With Old Signature",
+			URL:      commandURL,
+			Data:     commandData,
+			Headers:  signedHeaders(commandData, time.Now().Add(-10*time.Minute)),
+			Status:   403,
+			Response: "request timestamp too far from now",
+			PrepRequest: func(r *http.Request) {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			},
+		},
+		{
+			Label:    "Receive Msg With Future Signature",
+			URL:      receiveURL,
+			Data:     helloMsg,
+			Headers:  signedHeaders(helloMsg, time.Now().Add(10*time.Minute)),
+			Status:   403,
+			Response: "request timestamp too far from now",
+		},
+		{
+			Label:    "Receive Unsigned Msg",
+			URL:      receiveURL,
+			Data:     helloMsg,
+			Status:   400,
+			Response: "missing request signature",
+		},
+	})
+
+	// channels can allow older requests, e.g. for when our clocks differ from Slack's
+	RunChannelTestCases(t, []courier.Channel{
+		courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "channel_user_urns": true, "signing_secret": "8f742231b10e8888abcd99yyyzzz85a5", "max_request_age": 900}),
+	}, newHandler(), []ChannelHandleTestCase{
+		{
+			Label:    "Receive Msg With Signature Within Max Age",
+			URL:      receiveURL,
+			Data:     helloMsg,
+			Headers:  signedHeaders(helloMsg, time.Now().Add(-10*time.Minute)),
+			Status:   200,
+			Response: "Accepted",
+			Text:     Sp("Hello World!"),
+		},
+		{
+			Label:    "Receive Msg With Signature Over Max Age",
+			URL:      receiveURL,
+			Data:     helloMsg,
+			Headers:  signedHeaders(helloMsg, time.Now().Add(-20*time.Minute)),
+			Status:   403,
+			Response: "request timestamp too far from now",
+		},
+	})
+
+	// without a signing secret, events must have the verification token
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{
+			Label:    "Receive Msg With Wrong Token",
+			URL:      receiveURL,
+			Data:     strings.Replace(helloMsg, "one-long-verification-token", "abc321", 1),
+			Status:   400,
+			Response: "wrong verification token",
+
+			NoQueueErrorCheck:     true,
+			NoInvalidChannelCheck: true,
+		},
+	})
+}
+
+const commandData = "token=one-long-verification-token&team_id=T061EG9R6&channel_id=C0123ABCDEF&user_id=U0123ABCDEF&user_name=ann&command=%2Fweather&text=London&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT061EG9R6%2F1234%2Fabcd&trigger_id=13345224609.738474920"
+
+func TestReceiveCommands(t *testing.T) {
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{
+			Label:      "Receive Command",
+			URL:        commandURL,
+			Data:       commandData,
+			Status:     200,
+			Text:       Sp("/weather London"),
+			URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+			Metadata:   json.RawMessage(`{"command": "/weather", "response_url": "https://hooks.slack.com/commands/T061EG9R6/1234/abcd"}`),
+			ExternalID: Sp("13345224609.738474920"),
+		},
+		{
+			Label:      "Receive Command In Direct Message",
+			URL:        commandURL,
+			Data:       strings.Replace(strings.Replace(commandData, "channel_id=C0123ABCDEF", "channel_id=D0123ABCDEF", 1), "text=London", "text=", 1),
+			Status:     200,
+			Text:       Sp("/weather"),
+			URN:        Sp("slack:U0123ABCDEF"),
+			ExternalID: Sp("13345224609.738474920"),
+		},
+		{
+			Label:    "Receive Command Without User",
+			URL:      commandURL,
+			Data:     strings.Replace(commandData, "user_id=U0123ABCDEF", "", 1),
+			Status:   400,
+			Response: "Field validation for 'UserID' failed on the 'required' tag",
+		},
+		{
+			Label:    "Receive Command With Wrong Token",
+			URL:      commandURL,
+			Data:     strings.Replace(commandData, "one-long-verification-token", "abc321", 1),
+			Status:   400,
+			Response: "wrong verification token",
+		},
+	})
+}
+
+const blockActionsPayload = `{
+	"type": "block_actions",
+	"token": "one-long-verification-token",
+	"user": {"id": "U0123ABCDEF", "username": "ann.smith", "name": "Ann Smith", "team_id": "T061EG9R6"},
+	"api_app_id": "A0PNCHHK2",
+	"container": {"type": "message", "message_ts": "1355517523.000005", "channel_id": "C0123ABCDEF", "is_ephemeral": false},
+	"trigger_id": "13345224609.738474920.8088930838d88f008e0",
+	"team": {"id": "T061EG9R6", "domain": "example"},
+	"channel": {"id": "C0123ABCDEF", "name": "general"},
+	"response_url": "https://hooks.slack.com/actions/T061EG9R6/1234/abcd",
+	"actions": [
+		{
+			"action_id": "Yes",
+			"block_id": "Xx2",
+			"text": {"type": "plain_text", "text": "Yes"},
+			"type": "button",
+			"action_ts": "1355517530.000001"
+		}
+	]
+}`
+
+func TestReceiveInteractions(t *testing.T) {
+	interactionData := func(payload string) string {
+		return "payload=" + url.QueryEscape(payload)
+	}
+
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{
+			Label:      "Receive Button Click",
+			URL:        interactionURL,
+			Data:       interactionData(blockActionsPayload),
+			Status:     200,
+			Text:       Sp("Yes"),
+			URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+			Metadata:   json.RawMessage(`{"action_id": "Yes", "message_ts": "1355517523.000005", "response_url": "https://hooks.slack.com/actions/T061EG9R6/1234/abcd"}`),
+			ExternalID: Sp("13345224609.738474920.8088930838d88f008e0"),
+		},
+		{
+			Label:  "Receive Button With Value In Direct Message",
+			URL:    interactionURL,
+			Data:   interactionData(strings.Replace(strings.Replace(blockActionsPayload, `"action_id": "Yes",`, `"action_id": "confirm", "value": "yes please",`, 1), `"id": "C0123ABCDEF"`, `"id": "D0123ABCDEF"`, 1)),
+			Status: 200,
+			Text:   Sp("yes please"),
+			URN:    Sp("slack:U0123ABCDEF"),
+		},
+		{
+			Label:    "Ignore Interaction Without Actions",
+			URL:      interactionURL,
+			Data:     interactionData(`{"type": "view_closed", "token": "one-long-verification-token", "user": {"id": "U0123ABCDEF"}}`),
+			Status:   200,
+			Response: "Ignoring request, no actions in view_closed interaction",
+		},
+		{
+			Label:    "Receive Invalid Payload",
+			URL:      interactionURL,
+			Data:     "payload=foo",
+			Status:   400,
+			Response: "unable to parse interaction payload",
+		},
+		{
+			Label:    "Receive Interaction With Wrong Token",
+			URL:      interactionURL,
+			Data:     interactionData(strings.Replace(blockActionsPayload, "one-long-verification-token", "abc321", 1)),
+			Status:   400,
+			Response: "wrong verification token",
+		},
+	})
+}
+
+func buildMockAttachmentFileServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		w.WriteHeader(200)
+		w.Write([]byte("filetype... ...file bytes... ...end"))
+	}))
+}
+
+func buildMockSlackService(testCases []ChannelHandleTestCase) *httptest.Server {
+
+	files := make(map[string]File)
+
+	for _, tc := range testCases {
+		var mp moPayload
+		if err := json.Unmarshal([]byte(tc.Data), &mp); err != nil {
+			continue
+		}
+
+		for _, f := range mp.Event.Files {
+			if _, ok := files[f.ID]; ok == false {
+				files[f.ID] = f
+			}
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// conversation names can't be looked up without the channels:read scope
+		if r.URL.Path == "/conversations.info" {
+			w.Write([]byte(`{"ok":false,"error":"missing_scope"}`))
+			return
+		}
+		if r.URL.Path == "/users.info" {
+			w.Write([]byte(`{"ok":true,"user":{"id":"U0123ABCDEF","real_name":"Ann Smith"}}`))
+			return
+		}
+		if r.URL.Path == "/files.info" {
+			file, ok := files[r.URL.Query().Get("file")]
+			if !ok {
+				w.Write([]byte(`{"ok":false,"error":"file_not_found"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(FileResponse{OK: true, File: file})
+			return
+		}
+
+		byteBody, err := io.ReadAll(r.Body)
+		f, err := jsonparser.GetString(byteBody, "file")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer r.Body.Close()
+
+		file, ok := files[f]
+
+		if file.Mimetype == "video/mp4" {
+			w.Write([]byte(`{"ok":"false","error":"public_video_not_allowed"}`))
+			return
+		}
+
+		if !ok {
+			w.Write([]byte(`{"ok": "false", "error": "file not found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(FileResponse{OK: true, Error: "", File: file})
+	}))
+
+	apiURL = server.URL
+
+	return server
+}
+
+func mockAttachmentURLs(fileServer *httptest.Server, testCases []ChannelSendTestCase) []ChannelSendTestCase {
+	casesWithMockedUrls := make([]ChannelSendTestCase, len(testCases))
+
+	for i, testCase := range testCases {
+		mockedCase := testCase
+		mockedCase.Attachments = make([]string, len(testCase.Attachments))
+		for j, attachment := range testCase.Attachments {
+			mockedCase.Attachments[j] = strings.Replace(attachment, "https://foo.bar", fileServer.URL, 1)
+		}
+		casesWithMockedUrls[i] = mockedCase
+	}
+	return casesWithMockedUrls
+}
+
+func TestValidateURN(t *testing.T) {
+	h := newHandler().(courier.URNValidator)
+
+	tcs := []struct {
+		urn         urns.URN
+		expectedErr string
+	}{
+		{"slack:U0123ABCDEF", ""},
+		{"slack:C0123ABCDEF", ""},
+		{"slack:W0123ABCDEF", ""},
+		{"slack:T061EG9R6/U0123ABCDEF", ""},
+		{"slack:T061EG9R6/u0123abcdef", "invalid Slack user or conversation id: T061EG9R6/u0123abcdef"},
+		{"slack:C0123ABCDEF/U0123ABCDEF", ""},
+		{"slack:T061EG9R6/C0123ABCDEF/U0123ABCDEF", ""},
+		{"slack:U0123ABCDEF/C0123ABCDEF", "invalid Slack user or conversation id: U0123ABCDEF/C0123ABCDEF"},
+		{"slack:C0123ABCDEF/C0456GHIJKL", "invalid Slack user or conversation id: C0123ABCDEF/C0456GHIJKL"},
+		{"slack:u0123abcdef", "invalid Slack user or conversation id: u0123abcdef"},
+		{"slack:X0123ABCDEF", "invalid Slack user or conversation id: X0123ABCDEF"},
+		{"slack:U01", "invalid Slack user or conversation id: U01"},
+		{"tel:+250788383383", "unsupported URN scheme for Slack: tel"},
+	}
+
+	for _, tc := range tcs {
+		err := h.ValidateURN(tc.urn)
+		if tc.expectedErr == "" {
+			assert.NoError(t, err, "unexpected error for %s", tc.urn)
+		} else {
+			assert.EqualError(t, err, tc.expectedErr, "error mismatch for %s", tc.urn)
+		}
+	}
+}
+
+func TestURNIDs(t *testing.T) {
+	tcs := []struct {
+		urn                  urns.URN
+		expectedConversation string
+		expectedUser         string
+	}{
+		{"slack:U0123ABCDEF", "U0123ABCDEF", "U0123ABCDEF"},
+		{"slack:W0123ABCDEF", "W0123ABCDEF", "W0123ABCDEF"},
+		{"slack:C0123ABCDEF", "C0123ABCDEF", ""},
+		{"slack:C0123ABCDEF/U0123ABCDEF", "C0123ABCDEF", "U0123ABCDEF"},
+		{"slack:T061EG9R6/U0123ABCDEF", "U0123ABCDEF", "U0123ABCDEF"},
+		{"slack:T061EG9R6/C0123ABCDEF/U0123ABCDEF", "C0123ABCDEF", "U0123ABCDEF"},
+	}
+
+	for _, tc := range tcs {
+		conversation, user := urnIDs(tc.urn)
+		assert.Equal(t, tc.expectedConversation, conversation, "conversation mismatch for %s", tc.urn)
+		assert.Equal(t, tc.expectedUser, user, "user mismatch for %s", tc.urn)
+	}
+}
+
+func TestChannelUserURNRoundTrip(t *testing.T) {
+	var paths, bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/conversations.info":
+			w.Write([]byte(`{"ok":true,"channel":{"id":"C0123ABCDEF","name":"general","is_member":true}}`))
+		default:
+			paths, bodies = append(paths, r.URL.Path), append(bodies, string(body))
+			w.Write([]byte(`{"ok":true,"channel":"C0123ABCDEF","ts":"1503435956.000247"}`))
+		}
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	// people in channels are identified by both the channel and themselves
+	r := httptest.NewRequest(http.MethodPost, receiveURL, strings.NewReader(helloMsg))
+	_, err := h.receiveEvent(context.Background(), testChannels[0], httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	received, err := mb.GetLastQueueMsg()
+	require.NoError(t, err)
+	assert.Equal(t, urns.URN("slack:C0123ABCDEF/U0123ABCDEF#general"), received.URN())
+
+	// and replies to them are posted in the channel
+	reply := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), received.URN(), "Hi there!", false, nil, "", 0, "")
+	status, err := h.SendMsg(context.Background(), reply)
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/chat.postMessage"}, paths)
+	channelID, _ := jsonparser.GetString([]byte(bodies[0]), "channel")
+	assert.Equal(t, "C0123ABCDEF", channelID)
+
+	// while their home views are published for them
+	paths, bodies = nil, nil
+	home := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(11), received.URN(), "Welcome", false, nil, "", 0, "")
+	home.WithMetadata(json.RawMessage(`{"target":"home","view":{"type":"home","blocks":[{"type":"divider"}]}}`))
+	status, err = h.SendMsg(context.Background(), home)
+	require.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/views.publish"}, paths)
+	userID, _ := jsonparser.GetString([]byte(bodies[0]), "user_id")
+	assert.Equal(t, "U0123ABCDEF", userID)
+
+	// channels not configured to do so keep identifying people in channels by the channel alone
+	legacy := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token"})
+	r = httptest.NewRequest(http.MethodPost, receiveURL, strings.NewReader(helloMsg))
+	_, err = h.receiveEvent(context.Background(), legacy, httptest.NewRecorder(), r)
+	require.NoError(t, err)
+	received, err = mb.GetLastQueueMsg()
+	require.NoError(t, err)
+	assert.Equal(t, urns.URN("slack:C0123ABCDEF#general"), received.URN())
+}
+
+func TestClientMsgID(t *testing.T) {
+	mb := courier.NewMockBackend()
+	newMsg := func(id int64) courier.Msg {
+		return mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(id), "slack:U0123ABCDEF", "Hello", false, nil, "", 0, "")
+	}
+
+	// the same message always gets the same id, so retries of it can be spotted
+	assert.Equal(t, "9758bc62-1c95-5ab3-8c66-0370f24d0eaa", clientMsgID(newMsg(10), 0))
+	assert.Equal(t, clientMsgID(newMsg(10), 0), clientMsgID(newMsg(10), 0))
+	assert.NotEqual(t, clientMsgID(newMsg(10), 0), clientMsgID(newMsg(11), 0))
+
+	// each part of a message gets its own id
+	assert.NotEqual(t, clientMsgID(newMsg(10), 0), clientMsgID(newMsg(10), 1))
+	assert.Equal(t, clientMsgID(newMsg(10), 1), clientMsgID(newMsg(10), 1))
+
+	// messages without an id don't get one
+	assert.Equal(t, "", clientMsgID(newMsg(0), 0))
+}
+
+const mentionsMsg = `{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+			"type": "message",
+			"channel": "C0123ABCDEF",
+			"user": "U0123ABCDEF",
+			"text": " Hey <@U0AAAAAAAA>, <@U0BBBBBBBB|bob> and <@U0CCCCCCCC> :tada: see <#C0123ABCDEF|general> <!here> ",
+			"ts": "1355517523.000007",
+			"event_ts": "1355517523.000007",
+			"channel_type": "channel"
+	},
+	"type": "event_callback",
+	"authed_teams": [
+			"T061EG9R6"
+	],
+	"event_id": "Ev0PV52K25",
+	"event_time": 1355517523
+}`
+
+func TestReceiveMentions(t *testing.T) {
+	var lookups []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		lookups = append(lookups, user)
+
+		if user == "U0AAAAAAAA" {
+			w.Write([]byte(`{"ok":true,"user":{"id":"U0AAAAAAAA","name":"ann.smith","real_name":"Ann Smith","profile":{"display_name":"ann"}}}`))
+		} else {
+			w.Write([]byte(`{"ok":false,"error":"user_not_found"}`))
+		}
+	}))
+	defer server.Close()
+	apiURL = server.URL
+
+	// mentions are resolved to names, falling back to ids, before emoji are handled and whitespace trimmed
+	channels := []courier.Channel{
+		courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "channel_user_urns": true, "verification_token": "one-long-verification-token", "emoji_handling": "replace"}),
+	}
+	RunChannelTestCases(t, channels, newHandler(), []ChannelHandleTestCase{
+		{
+			Label:             "Receive Msg With Mentions",
+			URL:               receiveURL,
+			Headers:           map[string]string{},
+			Data:              mentionsMsg,
+			URN:               Sp("slack:C0123ABCDEF/U0123ABCDEF"),
+			Text:              Sp("Hey @ann, @bob and @U0CCCCCCCC [emoji] see #general @here"),
+			Status:            200,
+			Response:          "Accepted",
+			ExternalID:        Sp("Ev0PV52K25"),
+			NoQueueErrorCheck: true,
+		},
+	})
+
+	assert.Contains(t, lookups, "U0AAAAAAAA")
+	assert.NotContains(t, lookups, "U0BBBBBBBB")
+}
+
+func reactionEvent(eventType, user, itemUser string) string {
+	return reactionEventIn(eventType, user, itemUser, "C0123ABCDEF")
+}
+
+func reactionEventIn(eventType, user, itemUser, itemChannel string) string {
+	return fmt.Sprintf(`{
+	"token": "one-long-verification-token",
+	"team_id": "T061EG9R6",
+	"api_app_id": "A0PNCHHK2",
+	"event": {
+		"type": "%s",
+		"user": "%s",
+		"reaction": "thumbsup",
+		"item_user": "%s",
+		"item": {
+			"type": "message",
+			"channel": "%s",
+			"ts": "1355517523.000005"
+		},
+		"event_ts": "1355517530.000001"
+	},
+	"type": "event_callback",
+	"authorizations": [
+		{"team_id": "T061EG9R6", "user_id": "U0B0TB0TB0T", "is_bot": true}
+	],
+	"event_id": "Ev0PV52K27",
+	"event_time": 1355517530
+}`, eventType, user, itemUser, itemChannel)
+}
+
+func TestReceiveReactions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/conversations.info" {
+			w.Write([]byte(`{"ok":true,"channel":{"id":"C0123ABCDEF","name":"general","is_member":true}}`))
+			return
+		}
+		w.Write([]byte(`{"ok":true,"user":{"id":"U0123ABCDEF","name":"ann.smith","real_name":"Ann Smith"}}`))
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	// by default only reactions to the bot's own messages are delivered
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{
+			Label:      "Receive Reaction To Bot Msg",
+			URL:        receiveURL,
+			Headers:    map[string]string{},
+			Data:       reactionEvent("reaction_added", "U0123ABCDEF", "U0B0TB0TB0T"),
+			URN:        Sp("slack:C0123ABCDEF/U0123ABCDEF#general"),
+			Text:       Sp(":thumbsup:"),
+			Metadata:   json.RawMessage(`{"reaction_to": "1355517523.000005"}`),
+			Status:     200,
+			Response:   "Accepted",
+			ExternalID: Sp("Ev0PV52K27"),
+		},
+		{
+			Label:      "Receive Reaction In Direct Message",
+			URL:        receiveURL,
+			Headers:    map[string]string{},
+			Data:       reactionEventIn("reaction_added", "U0123ABCDEF", "U0B0TB0TB0T", "D0123ABCDEF"),
+			URN:        Sp("slack:U0123ABCDEF#Ann Smith"),
+			Text:       Sp(":thumbsup:"),
+			Metadata:   json.RawMessage(`{"reaction_to": "1355517523.000005"}`),
+			Status:     200,
+			Response:   "Accepted",
+			ExternalID: Sp("Ev0PV52K27"),
+		},
+		{
+			Label:    "Ignore Reaction To Other Msg",
+			URL:      receiveURL,
+			Headers:  map[string]string{},
+			Data:     reactionEvent("reaction_added", "U0123ABCDEF", "U0456GHIJKL"),
+			Status:   200,
+			Response: "Ignoring request, reaction to message not sent by bot",
+		},
+		{
+			Label:    "Ignore Reaction From Bot",
+			URL:      receiveURL,
+			Headers:  map[string]string{},
+			Data:     reactionEvent("reaction_added", "U0B0TB0TB0T", "U0123ABCDEF"),
+			Status:   200,
+			Response: "Ignoring request, reaction from bot",
+		},
+		{
+			Label:    "Ignore Removed Reaction",
+			URL:      receiveURL,
+			Headers:  map[string]string{},
+			Data:     reactionEvent("reaction_removed", "U0123ABCDEF", "U0B0TB0TB0T"),
+			Status:   200,
+			Response: "Ignoring request, reaction removed",
+		},
+	})
+
+	// but channels can be configured to forward all reactions
+	channels := []courier.Channel{
+		courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "forward_reactions": true}),
+	}
+	RunChannelTestCases(t, channels, newHandler(), []ChannelHandleTestCase{
+		{
+			Label:      "Receive Reaction To Other Msg",
+			URL:        receiveURL,
+			Headers:    map[string]string{},
+			Data:       reactionEvent("reaction_added", "U0123ABCDEF", "U0456GHIJKL"),
+			URN:        Sp("slack:C0123ABCDEF#general"),
+			Text:       Sp(":thumbsup:"),
+			Status:     200,
+			Response:   "Accepted",
+			ExternalID: Sp("Ev0PV52K27"),
+		},
+	})
+}
+
+func TestNormalizeMrkdwn(t *testing.T) {
+	var lookups []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups = append(lookups, r.URL.Query().Get("user"))
+		w.Write([]byte(`{"ok":true,"user":{"id":"U0AAAAAAAA","name":"ann.smith","real_name":"Ann Smith","profile":{"display_name":"ann"}}}`))
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	tcs := []struct {
+		text       string
+		normalized string
+	}{
+		{"Hello World", "Hello World"},
+		{"see <https://example.com/a?b=1&amp;c=2|the docs> or <https://example.com>", "see the docs or https://example.com"},
+		{"mail <mailto:ann@example.com|ann@example.com>", "mail ann@example.com"},
+		{"ask <@U0AAAAAAAA> &amp; <#C0123ABCDEF|general>", "ask @ann & #general"},
+		{"1 &lt; 2 &gt; 0", "1 < 2 > 0"},
+		{"run `a &amp;&amp; <@U0AAAAAAAA>` then ```\n<https://example.com|x> &lt;\n``` <@U0AAAAAAAA>", "run `a &amp;&amp; <@U0AAAAAAAA>` then ```\n<https://example.com|x> &lt;\n``` @ann"},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.normalized, h.normalizeMrkdwn(context.Background(), testChannels[0], tc.text), "normalized mismatch for: %s", tc.text)
+	}
+
+	// user names are only looked up once
+	assert.Equal(t, []string{"U0AAAAAAAA"}, lookups)
+}
+
+func TestReplyInThread(t *testing.T) {
+	threadingChannel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "channel_user_urns": true, "verification_token": "one-long-verification-token", "reply_in_thread": true})
+
+	// by default messages outside of threads are identified by their event, so replies to them aren't threaded
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{Label: "Receive Msg", URL: receiveURL, Headers: map[string]string{}, Data: helloMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello World!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF"), ExternalID: Sp("Ev0PV52K21")},
+	})
+	RunChannelSendTestCases(t, testChannels[0], newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Reply To Msg",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			ResponseToExternalID: "Ev0PV52K21",
+			Status:               "W",
+			ResponseBody:         `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus:       200,
+			RequestBody:          `{"channel":"C0123ABCDEF","text":"Simple Message","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+			SendPrep:             setSendUrl,
+		},
+	}, nil)
+
+	// but channels which reply in threads identify them by their ts, so replies to them start threads under them
+	RunChannelTestCases(t, []courier.Channel{threadingChannel}, newHandler(), []ChannelHandleTestCase{
+		{Label: "Receive Msg", URL: receiveURL, Headers: map[string]string{}, Data: helloMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello World!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF"), ExternalID: Sp("1355517523.000005")},
+	})
+	RunChannelSendTestCases(t, threadingChannel, newHandler(), []ChannelSendTestCase{
+		{
+			Label: "Reply To Msg",
+			Text:  "Simple Message", URN: "slack:C0123ABCDEF",
+			ResponseToExternalID: "1355517523.000005",
+			Status:               "W",
+			ResponseBody:         `{"ok":true,"channel":"C0123ABCDEF"}`,
+			ResponseStatus:       200,
+			RequestBody:          `{"channel":"C0123ABCDEF","text":"Simple Message","thread_ts":"1355517523.000005","client_msg_id":"9758bc62-1c95-5ab3-8c66-0370f24d0eaa"}`,
+			SendPrep:             setSendUrl,
 		},
-		SendPrep: setSendUrl,
-	},
+	}, nil)
 }
 
-func TestHandler(t *testing.T) {
-	slackServiceMock := buildMockSlackService(handleTestCases)
-	defer slackServiceMock.Close()
+func TestRepeatedEdits(t *testing.T) {
+	mb := courier.NewMockBackend()
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
 
-	RunChannelTestCases(t, testChannels, newHandler(), handleTestCases)
-}
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "dedup_external_ids": true})
+	receive := func(body string) {
+		w := httptest.NewRecorder()
+		_, err := h.receiveEvent(context.Background(), channel, w, httptest.NewRequest(http.MethodPost, receiveURL, strings.NewReader(body)))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
 
-func TestSending(t *testing.T) {
-	RunChannelSendTestCases(t, testChannels[0], newHandler(), defaultSendTestCases, nil)
+	// each edit of a message is a message of its own, even on channels which dedup by external id
+	receive(editedMsg)
+	receive(strings.Replace(strings.Replace(editedMsg, "Ev0PV52K22", "Ev0PV52K29", 1), "Hello World, edited!", "Hello World, edited again!", 1))
+	assert.Equal(t, 2, mb.LenQueuedMsgs())
 }
 
-func TestSendFiles(t *testing.T) {
-	fileServer := buildMockAttachmentFileServer()
-	defer fileServer.Close()
-	fileSendTestCases := mockAttachmentURLs(fileServer, fileSendTestCases)
+func TestRepliesInThreads(t *testing.T) {
+	var threads []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		threadTs, _ := jsonparser.GetString(body, "thread_ts")
+		threads = append(threads, threadTs)
+		w.Write([]byte(`{"ok":true,"channel":"C0123ABCDEF"}`))
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
 
-	RunChannelSendTestCases(t, testChannels[0], newHandler(), fileSendTestCases, nil)
+	// replies in threads are identified by their own ts, so that several replies in one thread don't look the same
+	h := newHandler().(*handler)
+	RunChannelTestCases(t, testChannels, h, []ChannelHandleTestCase{
+		{Label: "Receive Reply", URL: receiveURL, Headers: map[string]string{}, Data: threadMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello in a thread!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF"), ExternalID: Sp("1355517530.000008"),
+			Metadata: json.RawMessage(`{"thread_ts": "1355517523.000005"}`)},
+	})
+
+	// but replies to them are still sent to their thread
+	send := func(responseTo string) string {
+		threads = nil
+		msg := h.Backend().NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:C0123ABCDEF", "Simple Message", false, nil, "", 0, responseTo)
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		require.Equal(t, courier.MsgWired, status.Status())
+		return threads[0]
+	}
+	assert.Equal(t, "1355517523.000005", send("1355517530.000008"))
+
+	// and replies to messages which aren't in threads start threads under them
+	assert.Equal(t, "1355517540.000001", send("1355517540.000001"))
 }
 
-func TestVerification(t *testing.T) {
+func TestReceiveBotMsgs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"channel":{"id":"C0123ABCDEF","name":"general","is_member":true}}`))
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	// messages from our own app or bot user, even without a bot id, and from other bots are ignored so we don't loop,
+	// while integrations which post as users are received by default
 	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
-		{Label: "Valid token", URL: receiveURL, Status: 200,
-			Data:     `{"token":"one-long-verification-token","challenge":"challenge123","type":"url_verification"}`,
-			Headers:  map[string]string{"content-type": "text/plain"},
-			Response: "challenge123", NoQueueErrorCheck: true, NoInvalidChannelCheck: true,
-		},
-		{Label: "Invalid token", URL: receiveURL, Status: 403,
-			Data:    `{"token":"abc321","challenge":"challenge123","type":"url_verification"}`,
-			Headers: map[string]string{"content-type": "text/plain"},
-		},
+		{Label: "Receive Integration Msg", URL: receiveURL, Headers: map[string]string{}, Data: integrationMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello from an integration!"), URN: Sp("slack:C0123ABCDEF/U0789MNOPQR#general"), ExternalID: Sp("Ev0PV52K43")},
+		{Label: "Ignore Own App Msg", URL: receiveURL, Headers: map[string]string{}, Data: ownAppMsg, Status: 200, Response: "Ignoring request, no message"},
+		{Label: "Ignore Own Bot User Msg", URL: receiveURL, Headers: map[string]string{}, Data: ownBotUserMsg, Status: 200, Response: "Ignoring request, no message"},
+		{Label: "Ignore Third Party Bot Msg", URL: receiveURL, Headers: map[string]string{}, Data: thirdPartyBotMsg, Status: 200, Response: "Ignoring request, no message"},
 	})
+
+	// unless the channel ignores their app or user
+	for _, ignored := range []string{"A0789MNOPQR", "U0789MNOPQR"} {
+		channels := []courier.Channel{
+			courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token", "ignored_bot_ids": []interface{}{"A0123ABCDEF", ignored}}),
+		}
+		RunChannelTestCases(t, channels, newHandler(), []ChannelHandleTestCase{
+			{Label: "Ignore Integration Msg " + ignored, URL: receiveURL, Headers: map[string]string{}, Data: integrationMsg, Status: 200, Response: "Ignoring request, no message", NoQueueErrorCheck: true},
+		})
+	}
 }
 
-func buildMockAttachmentFileServer() *httptest.Server {
-	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer r.Body.Close()
-		w.WriteHeader(200)
-		w.Write([]byte("filetype... ...file bytes... ...end"))
+func TestReceiveChannelNames(t *testing.T) {
+	var lookups []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conversation := r.URL.Query().Get("channel")
+		lookups = append(lookups, conversation)
+
+		if conversation == "C0123ABCDEF" {
+			w.Write([]byte(`{"ok":true,"channel":{"id":"C0123ABCDEF","name":"general","is_member":true}}`))
+		} else {
+			w.Write([]byte(`{"ok":false,"error":"channel_not_found"}`))
+		}
 	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	channels := []courier.Channel{
+		courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "channel_user_urns": true, "verification_token": "one-long-verification-token", "channel_name_expiration": 300}),
+	}
+	h := newHandler()
+
+	// messages in channels are named after their channel, which is only looked up once
+	RunChannelTestCases(t, channels, h, []ChannelHandleTestCase{
+		{Label: "Receive Msg", URL: receiveURL, Headers: map[string]string{}, Data: helloMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello World!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF#general"), ExternalID: Sp("Ev0PV52K21")},
+		{Label: "Receive Msg Again", URL: receiveURL, Headers: map[string]string{}, Data: helloMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello World!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF#general"), ExternalID: Sp("Ev0PV52K21")},
+	})
+	assert.Equal(t, []string{"C0123ABCDEF"}, lookups)
+
+	// and remembered for as long as the channel configures
+	item := h.(*handler).channelNames.Items()["T061EG9R6:C0123ABCDEF"]
+	assert.Equal(t, "general", item.Object)
+	assert.WithinDuration(t, time.Now().Add(300*time.Second), time.Unix(0, item.Expiration), 5*time.Second)
+
+	// if a channel can't be looked up, its messages are received without a name
+	RunChannelTestCases(t, channels, h, []ChannelHandleTestCase{
+		{Label: "Receive Msg Unknown Channel", URL: receiveURL, Headers: map[string]string{}, Data: strings.Replace(helloMsg, "C0123ABCDEF", "C0456GHIJKL", 1), Status: 200, Response: "Accepted",
+			Text: Sp("Hello World!"), URN: Sp("slack:C0456GHIJKL/U0123ABCDEF"), ExternalID: Sp("Ev0PV52K21")},
+	})
+	assert.Contains(t, lookups, "C0456GHIJKL")
 }
 
-func buildMockSlackService(testCases []ChannelHandleTestCase) *httptest.Server {
+func TestReceiveRetriedEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"channel":{"id":"C0123ABCDEF","name":"general","is_member":true}}`))
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
 
-	files := make(map[string]File)
+	mb := courier.NewMockBackend()
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
 
-	for _, tc := range testCases {
-		var mp moPayload
-		if err := json.Unmarshal([]byte(tc.Data), &mp); err != nil {
-			continue
+	receive := func(retryNum string) (*httptest.ResponseRecorder, error) {
+		r := httptest.NewRequest(http.MethodPost, receiveURL, strings.NewReader(helloMsg))
+		if retryNum != "" {
+			r.Header.Set(retryNumHeader, retryNum)
 		}
+		w := httptest.NewRecorder()
+		_, err := h.receiveEvent(context.Background(), testChannels[0], w, r)
+		return w, err
+	}
 
-		for _, f := range mp.Event.Files {
-			if _, ok := files[f.ID]; ok == false {
-				files[f.ID] = f
-			}
+	// Slack retrying an event we've already received only gets it acknowledged
+	_, err := receive("")
+	assert.NoError(t, err)
+	w, err := receive("1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Ignoring request, event already processed")
+	assert.Equal(t, 1, mb.LenQueuedMsgs())
+
+	// but retries of events we failed to handle are handled again
+	mb.ClearQueueMsgs()
+	mb.ClearSeenExternalIDs()
+	h.receivedEvents.Flush()
+	mb.SetErrorOnQueue(true)
+	_, err = receive("")
+	assert.EqualError(t, err, "unable to queue message")
+	mb.SetErrorOnQueue(false)
+	w, err = receive("1")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Accepted")
+	assert.Equal(t, 1, mb.LenQueuedMsgs())
+
+	// events are remembered per channel
+	r := httptest.NewRequest(http.MethodPost, receiveURL, strings.NewReader(helloMsg))
+	r.Header.Set(retryNumHeader, "2")
+	w = httptest.NewRecorder()
+	otherChannel := courier.NewMockChannel("1c2b0d8a-5ad7-4f6c-8e8a-6e4c2b2d1f00", "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "verification_token": "one-long-verification-token"})
+	h.receiveEvent(context.Background(), otherChannel, w, r)
+	assert.Contains(t, w.Body.String(), "Accepted")
+	assert.Equal(t, 2, mb.LenQueuedMsgs())
+}
+
+func TestResolveFileWithoutPermalink(t *testing.T) {
+	file := File{
+		ID:                 "F0123ABCDEF",
+		Mimetype:           "image/jpeg",
+		URLPrivateDownload: "https://files.slack.com/files-pri/T03CN5KTA6S-F0123ABCDEF/download/image.jpg",
+		Thumb360:           "https://files.slack.com/files-tmb/T03CN5KTA6S-F0123ABCDEF-a1b2c3/image_360.jpg",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(FileResponse{OK: true, File: file})
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	// files without a public permalink fall back to their private download URL, without a thumbnail
+	fileURL, thumbURL, err := h.resolveFile(context.Background(), testChannels[0], file)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://files.slack.com/files-pri/T03CN5KTA6S-F0123ABCDEF/download/image.jpg", fileURL)
+	assert.Equal(t, "", thumbURL)
+
+	// which is downloaded with the bot token, unlike public URLs
+	req, err := h.BuildDownloadMediaRequest(context.Background(), mb, testChannels[0], fileURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer xoxb-abc123", req.Header.Get("Authorization"))
+
+	req, err = h.BuildDownloadMediaRequest(context.Background(), mb, testChannels[0], fileURL+"?pub_secret=39fcf577f2")
+	assert.NoError(t, err)
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+
+	assert.Equal(t, "39fcf577f2", publicSecret("https://slack-files.com/T03CN5KTA6S-F03GTH43SSF-39fcf577f2"))
+	assert.Equal(t, "", publicSecret(""))
+	assert.Equal(t, "", publicSecret("https://slack-files.com/"))
+}
+
+func TestResolveFileSizeLimit(t *testing.T) {
+	defer func(chunkSize int) { DownloadChunkSize = chunkSize }(DownloadChunkSize)
+	DownloadChunkSize = 1 << 20
+
+	var file File
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(FileResponse{OK: true, File: file})
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "max_file_size": 2 << 20})
+
+	resolve := func(name string, size int) (string, error) {
+		filesRequests = nil
+		file = File{
+			ID:                 "F0123ABCDEF",
+			Mimetype:           "application/pdf",
+			Size:               size,
+			URLPrivateDownload: "https://files.slack.com/files-pri/T03CN5KTA6S-F0123ABCDEF/download/" + name,
+			PermalinkPublic:    "https://slack-files.com/T03CN5KTA6S-F0123ABCDEF-39fcf577f2",
 		}
+		fileURL, _, err := h.resolveFile(context.Background(), channel, file)
+		return fileURL, err
 	}
 
+	// files within the channel's limit are resolved
+	fileURL, err := resolve("small.pdf", 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://files.slack.com/files-pri/T03CN5KTA6S-F0123ABCDEF/download/small.pdf?pub_secret=39fcf577f2", fileURL)
+	assert.Equal(t, []string{"/files-pri/T03CN5KTA6S-F0123ABCDEF/download/small.pdf"}, filesRequests)
+
+	// while those over it are given up on after their first chunk
+	_, err = resolve("too_large.pdf", 0)
+	assert.EqualError(t, err, "file is larger than the limit of 2097152 bytes")
+	assert.Equal(t, []string{"/files-pri/T03CN5KTA6S-F0123ABCDEF/download/too_large.pdf"}, filesRequests)
+	channelLog, err := mb.GetLastChannelLog()
+	require.NoError(t, err)
+	assert.Equal(t, "Attachment too large", channelLog.Description)
+
+	// or not downloaded at all if Slack tells us they're too large
+	_, err = resolve("too_large.pdf", 10<<20)
+	assert.EqualError(t, err, "file is larger than the limit of 2097152 bytes")
+	assert.Nil(t, filesRequests)
+}
+
+func TestLookupTimeouts(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		byteBody, err := io.ReadAll(r.Body)
-		f, err := jsonparser.GetString(byteBody, "file")
-		if err != nil {
-			log.Fatal(err)
+		time.Sleep(1100 * time.Millisecond)
+		w.Write([]byte(`{"ok":true,"user":{"id":"U0123ABCDEF","name":"ann.smith","real_name":"Ann Smith"}}`))
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	// looking up users isn't sending, so isn't cut short by the send timeout
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "request_timeout_send": 1})
+	info, _, err := getUserInfo(context.Background(), "U0123ABCDEF", channel)
+	require.NoError(t, err)
+	assert.Equal(t, "Ann Smith", info.User.RealName)
+
+	// but by the lookup one
+	channel = courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "request_timeout_lookup": 1})
+	_, _, err = getUserInfo(context.Background(), "U0123ABCDEF", channel)
+	assert.Error(t, err)
+}
+
+func TestUserProfileCache(t *testing.T) {
+	defer func(expiration time.Duration) { userInfoExpiration = expiration }(userInfoExpiration)
+	userInfoExpiration = 50 * time.Millisecond
+
+	var lookups []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.URL.Query().Get("user")
+		lookups = append(lookups, user)
+
+		if user == "U0123ABCDEF" {
+			w.Write([]byte(`{"ok":true,"user":{"id":"U0123ABCDEF","name":"ann.smith","real_name":"Ann Smith","profile":{"email":"ann@example.com"}}}`))
+		} else if user == "U0789MNOPQR" {
+			w.Write([]byte(`{"ok":false,"error":"user_not_found"}`))
+		} else {
+			w.WriteHeader(500)
 		}
-		defer r.Body.Close()
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
 
-		file, ok := files[f]
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123"})
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), courier.NewMockBackend()))
 
-		if file.Mimetype == "video/mp4" {
-			w.Write([]byte(`{"ok":"false","error":"public_video_not_allowed"}`))
-			return
+	// profiles are only looked up once, even by concurrent requests after the first
+	profile, err := h.userProfile(context.Background(), channel, "U0123ABCDEF")
+	assert.NoError(t, err)
+	assert.Equal(t, &userProfile{RealName: "Ann Smith", Email: "ann@example.com"}, profile)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			profile, err := h.userProfile(context.Background(), channel, "U0123ABCDEF")
+			assert.NoError(t, err)
+			assert.Equal(t, "Ann Smith", profile.RealName)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []string{"U0123ABCDEF"}, lookups)
+
+	// until they expire
+	time.Sleep(60 * time.Millisecond)
+	profile, err = h.userProfile(context.Background(), channel, "U0123ABCDEF")
+	assert.NoError(t, err)
+	assert.Equal(t, "Ann Smith", profile.RealName)
+	assert.Equal(t, []string{"U0123ABCDEF", "U0123ABCDEF"}, lookups)
+
+	// failed lookups aren't remembered
+	_, err = h.userProfile(context.Background(), channel, "U0456GHIJKL")
+	assert.Error(t, err)
+	_, err = h.userProfile(context.Background(), channel, "U0456GHIJKL")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"U0123ABCDEF", "U0123ABCDEF", "U0456GHIJKL", "U0456GHIJKL"}, lookups)
+
+	// including those Slack answers but isn't ok with, which are logged
+	mb := h.Backend().(*courier.MockBackend)
+	_, err = h.userProfile(context.Background(), channel, "U0789MNOPQR")
+	assert.EqualError(t, err, "couldn't get user info: user_not_found")
+	_, err = h.userProfile(context.Background(), channel, "U0789MNOPQR")
+	assert.EqualError(t, err, "couldn't get user info: user_not_found")
+	assert.Equal(t, []string{"U0123ABCDEF", "U0123ABCDEF", "U0456GHIJKL", "U0456GHIJKL", "U0789MNOPQR", "U0789MNOPQR"}, lookups)
+	log, err := mb.GetLastChannelLog()
+	require.NoError(t, err)
+	assert.Equal(t, "couldn't get user info: user_not_found", log.Error)
+}
+
+func TestReceiveUserEmail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// users only have an email if the app has the users:read.email scope
+		if r.URL.Query().Get("user") == "U0123ABCDEF" {
+			w.Write([]byte(`{"ok":true,"user":{"id":"U0123ABCDEF","real_name":"Ann Smith","profile":{"real_name":"Ann Smith","email":"ann@example.com"}}}`))
+		} else {
+			w.Write([]byte(`{"ok":true,"user":{"id":"U0456GHIJKL","real_name":"Bob Jones","profile":{"real_name":"Bob Jones"}}}`))
 		}
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
 
-		if !ok {
-			w.Write([]byte(`{"ok": "false", "error": "file not found"}`))
+	mb := courier.NewMockBackend()
+	h := newHandler().(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	receive := func(body string) courier.Msg {
+		r := httptest.NewRequest(http.MethodPost, receiveURL, strings.NewReader(body))
+		_, err := h.receiveEvent(context.Background(), testChannels[0], httptest.NewRecorder(), r)
+		require.NoError(t, err)
+		msg, err := mb.GetLastQueueMsg()
+		require.NoError(t, err)
+		return msg
+	}
+
+	// direct messages carry the email of their user
+	msg := receive(enterpriseMsg)
+	assert.Equal(t, "slack:T061EG9R6/U0123ABCDEF#Ann Smith", string(msg.URN()))
+	assert.JSONEq(t, `{"email": "ann@example.com"}`, string(msg.Metadata()))
+
+	// unless we can't see it
+	msg = receive(strings.NewReplacer("U0123ABCDEF", "U0456GHIJKL", "Ev0PV52K30", "Ev0PV52K31").Replace(enterpriseMsg))
+	assert.Equal(t, "slack:T061EG9R6/U0456GHIJKL#Bob Jones", string(msg.URN()))
+	assert.Nil(t, msg.Metadata())
+}
+
+func TestReceiveThreadContext(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path+"?"+r.URL.RawQuery)
+
+		switch r.URL.Path {
+		case "/conversations.info":
+			w.Write([]byte(`{"ok":false,"error":"missing_scope"}`))
+		case "/conversations.replies":
+			w.Write([]byte(`{"ok":true,"messages":[{"type":"message","user":"U0456GHIJKL","text":"Who wants lunch?","ts":"1355517523.000005","thread_ts":"1355517523.000005"}],"has_more":true}`))
+		}
+	}))
+	defer server.Close()
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	// replies get the message which started their thread, which is only looked up once
+	channels := []courier.Channel{
+		courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "channel_user_urns": true, "verification_token": "one-long-verification-token", "thread_context": true}),
+	}
+	RunChannelTestCases(t, channels, newHandler(), []ChannelHandleTestCase{
+		{Label: "Receive Reply", URL: receiveURL, Headers: map[string]string{}, Data: threadMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello in a thread!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF"), ExternalID: Sp("1355517530.000008"),
+			Metadata: json.RawMessage(`{"thread_ts": "1355517523.000005", "thread_parent": {"user": "U0456GHIJKL", "text": "Who wants lunch?", "ts": "1355517523.000005"}}`)},
+		{Label: "Receive Reply Again", URL: receiveURL, Headers: map[string]string{}, Data: threadMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello in a thread!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF"), ExternalID: Sp("1355517530.000008"),
+			Metadata: json.RawMessage(`{"thread_ts": "1355517523.000005", "thread_parent": {"user": "U0456GHIJKL", "text": "Who wants lunch?", "ts": "1355517523.000005"}}`)},
+		{Label: "Receive Not In Thread", URL: receiveURL, Headers: map[string]string{}, Data: helloMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello World!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF"), ExternalID: Sp("Ev0PV52K21")},
+	})
+
+	var lookups []string
+	for _, request := range requests {
+		if strings.HasPrefix(request, "/conversations.replies") {
+			lookups = append(lookups, request)
+		}
+	}
+	assert.Equal(t, []string{"/conversations.replies?channel=C0123ABCDEF&limit=1&ts=1355517523.000005"}, lookups)
+
+	// channels which don't want thread context don't look it up
+	requests = nil
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{Label: "Receive Reply Without Context", URL: receiveURL, Headers: map[string]string{}, Data: threadMsg, Status: 200, Response: "Accepted",
+			Text: Sp("Hello in a thread!"), URN: Sp("slack:C0123ABCDEF/U0123ABCDEF"), ExternalID: Sp("1355517530.000008"),
+			Metadata: json.RawMessage(`{"thread_ts": "1355517523.000005"}`)},
+	})
+	for _, request := range requests {
+		assert.False(t, strings.HasPrefix(request, "/conversations.replies"))
+	}
+}
+
+func TestSendingUpdates(t *testing.T) {
+	var requests []string
+	response := `{"ok":true,"channel":"C0123ABCDEF","ts":"1503435956.000247","text":"Updated"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path+" "+string(body))
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	send := func(text string, attachments []string, metadata string) (courier.MsgStatus, error) {
+		requests = nil
+		msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:C0123ABCDEF", text, false, nil, "", 0, "").WithMetadata(json.RawMessage(metadata))
+		for _, a := range attachments {
+			msg.WithAttachment(a)
+		}
+		return h.SendMsg(context.Background(), msg)
+	}
+
+	// messages with the ts of a sent message update it, keeping its ts as their external id
+	status, err := send("Updated", nil, `{"update_ts":"1503435956.000247"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "1503435956.000247", status.ExternalID())
+	assert.Equal(t, []string{`/chat.update {"channel":"C0123ABCDEF","ts":"1503435956.000247","text":"Updated"}`}, requests)
+
+	// messages which no longer exist or can't be updated by us are errored
+	for _, slackErr := range []string{"message_not_found", "cant_update_message"} {
+		response = fmt.Sprintf(`{"ok":false,"error":"%s"}`, slackErr)
+		status, err = send("Updated", nil, `{"update_ts":"1503435956.000247"}`)
+		assert.NoError(t, err)
+		assert.Equal(t, courier.MsgErrored, status.Status())
+		assert.Equal(t, fmt.Sprintf("message 1503435956.000247 can't be updated as it no longer exists or wasn't sent by us: %s", slackErr), status.Logs()[len(status.Logs())-1].Error)
+	}
+
+	// and updates which Slack can't make are rejected without a request
+	_, err = send("Updated", nil, `{"update_ts":"Ev0PV52K21"}`)
+	assert.EqualError(t, err, "invalid update ts for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c: Ev0PV52K21")
+	_, err = send("Updated", []string{"image/jpeg:https://foo.bar/image.jpg"}, `{"update_ts":"1503435956.000247"}`)
+	assert.EqualError(t, err, "can't update message with attachments for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c")
+	long := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:C0123ABCDEF", strings.Repeat("0123456789", 301), false, []string{"Yes", "No"}, "", 0, "").WithMetadata(json.RawMessage(`{"update_ts":"1503435956.000247"}`))
+	_, err = h.SendMsg(context.Background(), long)
+	assert.EqualError(t, err, "can't update message with quick replies to text longer than 3000 for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c")
+	assert.Nil(t, requests)
+}
+
+func TestSendingPostRate(t *testing.T) {
+	var posted []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = append(posted, time.Now())
+		w.Write([]byte(`{"ok":true,"channel":"C0123ABCDEF","ts":"1503435956.000247"}`))
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "messages_per_second": 10})
+	send := func(urn urns.URN) {
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), urn, "Hello", false, nil, "", 0, "")
+		status, err := h.SendMsg(context.Background(), msg)
+		assert.NoError(t, err)
+		assert.Equal(t, courier.MsgWired, status.Status())
+	}
+
+	// rapid sends to the same conversation are spaced out at the channel's rate
+	send("slack:C0123ABCDEF")
+	send("slack:C0123ABCDEF")
+	assert.GreaterOrEqual(t, posted[1].Sub(posted[0]), 90*time.Millisecond)
+
+	// but sends to other conversations aren't held up by them
+	start := time.Now()
+	send("slack:C0456GHIJKL")
+	assert.Less(t, time.Since(start), 90*time.Millisecond)
+
+	// and without a configured rate, we post once per second
+	assert.Equal(t, time.Duration(0), h.(*handler).postLimiter.Reserve("C0789MNOPQR", defaultMessagesPerSecond))
+	assert.InDelta(t, time.Second, h.(*handler).postLimiter.Reserve("C0789MNOPQR", defaultMessagesPerSecond), float64(10*time.Millisecond))
+}
+
+func TestSendingWorkflowStepOutcomes(t *testing.T) {
+	var requests []string
+	response := `{"ok":true}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path+" "+string(body))
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	send := func(responseTo string, metadata string) (courier.MsgStatus, error) {
+		requests = nil
+		msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:U0123ABCDEF", "", false, nil, "", 0, responseTo).WithMetadata(json.RawMessage(metadata))
+		return h.SendMsg(context.Background(), msg)
+	}
+
+	// replies to workflow steps complete them with their outputs
+	status, err := send("1a2b3c4d5e.123456", `{"target":"workflow_step","outputs":{"badge":"42"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{`/workflows.stepCompleted {"workflow_step_execute_id":"1a2b3c4d5e.123456","outputs":{"badge":"42"}}`}, requests)
+
+	// or fail them with their error, the step being given explicitly
+	status, err = send("", `{"target":"workflow_step","workflow_step_execute_id":"9z8y7x.654321","error":"No badges left"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{`/workflows.stepFailed {"workflow_step_execute_id":"9z8y7x.654321","error":{"message":"No badges left"}}`}, requests)
+
+	// errors from Slack error the message
+	response = `{"ok":false,"error":"invalid_workflow_step_execute_id"}`
+	status, err = send("1a2b3c4d5e.123456", `{"target":"workflow_step"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, "completing workflow step failed: invalid_workflow_step_execute_id", status.Logs()[len(status.Logs())-1].Error)
+
+	// and we can't report on steps we don't know
+	_, err = send("", `{"target":"workflow_step"}`)
+	assert.EqualError(t, err, "missing workflow step execute id for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c568c")
+	assert.Nil(t, requests)
+}
+
+func TestSendingLongMessages(t *testing.T) {
+	var posted []mtPayload
+	failAfter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload mtPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		posted = append(posted, payload)
+
+		if failAfter > 0 && len(posted) > failAfter {
+			w.Write([]byte(`{"ok":false,"error":"fatal_error"}`))
 			return
 		}
-		json.NewEncoder(w).Encode(FileResponse{OK: true, Error: "", File: file})
+		w.Write([]byte(fmt.Sprintf(`{"ok":true,"channel":"C0123ABCDEF","ts":"1503435956.00024%d"}`, len(posted))))
 	}))
+	defer server.Close()
 
+	defer func(api string) { apiURL = api }(apiURL)
 	apiURL = server.URL
 
-	return server
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	text := strings.Repeat("0123456789", 5000)
+
+	send := func(quickReplies []string) courier.MsgStatus {
+		posted = nil
+		msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:C0123ABCDEF", text, false, quickReplies, "", 0, "")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status
+	}
+
+	// a 50k character message is posted in two parts, in order, each logged separately
+	status := send(nil)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	require.Len(t, posted, 2)
+	assert.Equal(t, text[:40000], posted[0].Text)
+	assert.Equal(t, text[40000:], posted[1].Text)
+	assert.NotEqual(t, posted[0].ClientMsgID, posted[1].ClientMsgID)
+	assert.Len(t, status.Logs(), 2)
+
+	// the first part being the message's external id
+	assert.Equal(t, "1503435956.000241", status.ExternalID())
+
+	// quick replies go with the last part, which is short enough for the section it's posted in
+	status = send([]string{"Yes", "No"})
+	assert.Equal(t, courier.MsgWired, status.Status())
+	require.Len(t, posted, 5)
+	assert.Equal(t, text[:40000], posted[0].Text)
+	assert.Equal(t, text[40000:43000], posted[1].Text)
+	assert.Equal(t, text[49000:], posted[4].Text)
+	for _, payload := range posted[:4] {
+		assert.Nil(t, payload.Blocks)
+	}
+	require.Len(t, posted[4].Blocks, 2)
+	assert.Equal(t, text[49000:], posted[4].Blocks[0].Text.Text)
+
+	// even when the whole message would fit in one part without them
+	text = strings.Repeat("0123456789", 400)
+	status = send([]string{"Yes", "No"})
+	assert.Equal(t, courier.MsgWired, status.Status())
+	require.Len(t, posted, 2)
+	assert.Equal(t, text[:3000], posted[0].Text)
+	assert.Nil(t, posted[0].Blocks)
+	require.Len(t, posted[1].Blocks, 2)
+	assert.Equal(t, text[3000:], posted[1].Blocks[0].Text.Text)
+	text = strings.Repeat("0123456789", 5000)
+
+	// and the message is only wired if every part is posted
+	failAfter = 1
+	status = send(nil)
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Len(t, posted, 2)
+	assert.Len(t, status.Logs(), 2)
 }
 
-func mockAttachmentURLs(fileServer *httptest.Server, testCases []ChannelSendTestCase) []ChannelSendTestCase {
-	casesWithMockedUrls := make([]ChannelSendTestCase, len(testCases))
+func TestSendingErrors(t *testing.T) {
+	var response string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
 
-	for i, testCase := range testCases {
-		mockedCase := testCase
-		for j, attachment := range testCase.Attachments {
-			mockedCase.Attachments[j] = strings.Replace(attachment, "https://foo.bar", fileServer.URL, 1)
+	defer func(api string) { apiURL = api }(apiURL)
+	apiURL = server.URL
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	tcs := []struct {
+		slackError          string
+		expectedStatus      courier.MsgStatusValue
+		expectedDescription string
+	}{
+		// errors which retrying won't fix fail the message
+		{"channel_not_found", courier.MsgFailed, "Conversation Not Found"},
+		{"not_in_channel", courier.MsgFailed, "Bot Not In Conversation"},
+		{"is_archived", courier.MsgFailed, "Conversation Archived"},
+
+		// others error it so it's retried
+		{"token_revoked", courier.MsgErrored, "Token Revoked"},
+		{"internal_error", courier.MsgErrored, "Slack Unavailable"},
+		{"something_new", courier.MsgErrored, "Message Send Error"},
+	}
+
+	for _, tc := range tcs {
+		response = fmt.Sprintf(`{"ok":false,"error":"%s"}`, tc.slackError)
+		msg := mb.NewOutgoingMsg(testChannels[0], courier.NewMsgID(10), "slack:C0123ABCDEF", "Hello", false, nil, "", 0, "")
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+
+		assert.Equal(t, tc.expectedStatus, status.Status(), "status mismatch for %s", tc.slackError)
+		require.Len(t, status.Logs(), 1)
+		assert.Equal(t, tc.expectedDescription, status.Logs()[0].Description, "log description mismatch for %s", tc.slackError)
+		assert.Equal(t, tc.slackError, status.Logs()[0].Error, "log error mismatch for %s", tc.slackError)
+	}
+}
+
+func TestReceiveFileShared(t *testing.T) {
+	fullURL := "https://files.slack.com/files-pri/T03CN5KTA6S-F03GTH43SSC/download/large.jpg?pub_secret=77ee88ff99"
+	dmFileSharedMsg := strings.Replace(fileSharedMsg, `"channel_id": "C0123ABCDEF"`, `"channel_id": "D0123ABCDEF"`, 1)
+	unknownFileSharedMsg := strings.Replace(fileSharedMsg, `"file_id": "F03GTH43SSC"`, `"file_id": "F0000000000"`, 1)
+	botFileSharedMsg := strings.Replace(strings.Replace(fileSharedMsg, `"user_id": "U0123ABCDEF"`, `"user_id": "U03G81FQM98"`, 1), `"type": "event_callback",`, `"type": "event_callback", "authorizations": [{"user_id": "U03G81FQM98", "is_bot": true}],`, 1)
+
+	// files shared on their own become messages with just them as attachments, and aren't given again by their message
+	sharedFirstCases := []ChannelHandleTestCase{
+		{Label: "Receive File Shared", URL: receiveURL, Data: fileSharedMsg, URN: Sp("slack:C0123ABCDEF/U0123ABCDEF"), Text: Sp(""), Attachments: []string{fullURL}, Status: 200, Response: "Accepted", NoQueueErrorCheck: true},
+		{Label: "Receive Message After File Shared", URL: receiveURL, Data: largeImageMsg, Text: Sp("Big photo"), Attachments: []string{}, Status: 200, Response: "Accepted", NoQueueErrorCheck: true},
+		{Label: "Ignore File Shared Again", URL: receiveURL, Data: fileSharedMsg, Status: 200, Response: "Ignoring request, file already received"},
+	}
+	slackServiceMock := buildMockSlackService(sharedFirstCases)
+	defer slackServiceMock.Close()
+
+	RunChannelTestCases(t, testChannels, newHandler(), sharedFirstCases)
+
+	// files shared with messages are given by them and their file_shared events are ignored
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{Label: "Receive Message Before File Shared", URL: receiveURL, Data: largeImageMsg, Text: Sp("Big photo"), Attachments: []string{fullURL}, Status: 200, Response: "Accepted", NoQueueErrorCheck: true},
+		{Label: "Ignore File Shared After Message", URL: receiveURL, Data: fileSharedMsg, Status: 200, Response: "Ignoring request, file already received"},
+	})
+
+	RunChannelTestCases(t, testChannels, newHandler(), []ChannelHandleTestCase{
+		{Label: "Receive File Shared In DM", URL: receiveURL, Data: dmFileSharedMsg, URN: Sp("slack:U0123ABCDEF#Ann Smith"), Attachments: []string{fullURL}, Status: 200, Response: "Accepted", NoQueueErrorCheck: true},
+		{Label: "Ignore File Shared By Bot", URL: receiveURL, Data: botFileSharedMsg, Status: 200, Response: "Ignoring request, file shared by bot"},
+	})
+
+	// files we can't look up are errors, which we forget so that Slack's retries can try again
+	h := newHandler()
+	RunChannelTestCases(t, testChannels, h, []ChannelHandleTestCase{
+		{Label: "Unknown File Shared", URL: receiveURL, Data: unknownFileSharedMsg, Status: 400, Response: "couldn't get info for file id: F0000000000. error: file_not_found", NoQueueErrorCheck: true},
+	})
+	_, remembered := h.(*handler).receivedFiles.Get(channelUUID + ":F0000000000")
+	assert.False(t, remembered)
+}
+
+func TestAPIBaseURL(t *testing.T) {
+	newAPI := func(requests *[]string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*requests = append(*requests, r.URL.Path)
+			switch r.URL.Path {
+			case "/users.info":
+				w.Write([]byte(`{"ok":true,"user":{"id":"U0123ABCDEF","real_name":"Ann Smith"}}`))
+			default:
+				w.Write([]byte(`{"ok":true,"channel":"U0123ABCDEF","ts":"1503435956.000247"}`))
+			}
+		}))
+	}
+
+	var govRequests, enterpriseRequests []string
+	gov, enterprise := newAPI(&govRequests), newAPI(&enterpriseRequests)
+	defer gov.Close()
+	defer enterprise.Close()
+
+	// channels on different Slack hosts can be used side by side, the trailing slash of a base URL being optional
+	govChannel := courier.NewMockChannel(channelUUID, "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-abc123", "api_base_url": gov.URL + "/"})
+	enterpriseChannel := courier.NewMockChannel("3b5cbd34-5c46-4d70-8e1a-f3d6a2c6f84e", "SL", "2022", "US", map[string]interface{}{"bot_token": "xoxb-def456", "api_base_url": enterprise.URL})
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	for _, channel := range []courier.Channel{govChannel, enterpriseChannel} {
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "slack:U0123ABCDEF", "Hello", false, nil, "", 0, "")
+		status, err := h.SendMsg(context.Background(), msg)
+		assert.NoError(t, err)
+		assert.Equal(t, courier.MsgWired, status.Status())
+
+		profile, err := h.(*handler).userProfile(context.Background(), channel, "U0123ABCDEF")
+		assert.NoError(t, err)
+		assert.Equal(t, "Ann Smith", profile.RealName)
+	}
+
+	assert.Equal(t, []string{"/chat.postMessage", "/users.info"}, govRequests)
+	assert.Equal(t, []string{"/chat.postMessage", "/users.info"}, enterpriseRequests)
+
+	// channels without a base URL use Slack's
+	assert.Equal(t, apiURL, channelAPIURL(testChannels[0]))
+}
+
+func TestSendingSnippets(t *testing.T) {
+	var requests []string
+	var form url.Values
+	var uploaded, completed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/files.getUploadURLExternal":
+			r.ParseForm()
+			form = r.PostForm
+			w.Write([]byte(fmt.Sprintf(`{"ok":true,"upload_url":"http://%s/upload/v1/abc","file_id":"F1L3SL4CK1D"}`, r.Host)))
+		case "/upload/v1/abc":
+			body, _ := io.ReadAll(r.Body)
+			uploaded = string(body)
+			w.Write([]byte(`OK - 35`))
+		case "/files.completeUploadExternal":
+			body, _ := io.ReadAll(r.Body)
+			completed = string(body)
+			w.Write([]byte(`{"ok":true,"files":[{"id":"F1L3SL4CK1D","title":"snippet.txt"}]}`))
+		case "/files.upload":
+			r.ParseMultipartForm(1024)
+			form = url.Values(r.MultipartForm.Value)
+			w.Write([]byte(`{"ok":true,"file":{"id":"F1L3SL4CK1D"}}`))
+		default:
+			w.Write([]byte(`{"ok":true,"channel":"C0123ABCDEF","ts":"1503435956.000247"}`))
 		}
-		casesWithMockedUrls[i] = mockedCase
+	}))
+	defer server.Close()
+
+	mb := courier.NewMockBackend()
+	h := newHandler()
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	newChannel := func(config map[string]interface{}) courier.Channel {
+		config["bot_token"] = "xoxb-abc123"
+		config["api_base_url"] = server.URL
+		config["messages_per_second"] = 1000
+		return courier.NewMockChannel(channelUUID, "SL", "2022", "US", config)
 	}
-	return casesWithMockedUrls
+	send := func(channel courier.Channel, text string, metadata string) courier.MsgStatus {
+		requests, form, uploaded, completed = nil, nil, "", ""
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "slack:C0123ABCDEF", text, false, nil, "", 0, "").WithMetadata(json.RawMessage(metadata))
+		status, err := h.SendMsg(context.Background(), msg)
+		require.NoError(t, err)
+		return status
+	}
+	logDump := "Here's the log:\n```panic: runtime error\n\tat main.go:12\n```"
+
+	// channels can send code blocks as text snippets, with any text before them as their comment
+	snippets := newChannel(map[string]interface{}{"code_snippets": true})
+	status := send(snippets, logDump, `{}`)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/files.getUploadURLExternal", "/upload/v1/abc", "/files.completeUploadExternal"}, requests)
+	assert.Equal(t, "text", form.Get("snippet_type"))
+	assert.Equal(t, "snippet.txt", form.Get("filename"))
+	assert.Equal(t, "panic: runtime error\n\tat main.go:12", uploaded)
+	assert.JSONEq(t, `{"files":[{"id":"F1L3SL4CK1D","title":"snippet.txt"}],"channel_id":"C0123ABCDEF","initial_comment":"Here's the log:"}`, completed)
+
+	// other text is posted as usual, as is text with code which isn't one block at its end
+	for _, text := range []string{"Hello", "```one``` and ```two```", "Run `ls` to see files", "```\n```"} {
+		send(snippets, text, `{}`)
+		assert.Equal(t, []string{"/chat.postMessage"}, requests, "requests mismatch for %s", text)
+	}
+
+	// channels which don't send code as snippets post code blocks as text
+	plain := newChannel(map[string]interface{}{})
+	send(plain, logDump, `{}`)
+	assert.Equal(t, []string{"/chat.postMessage"}, requests)
+
+	// unless messages say they're snippets, in which case all their text is the snippet if it isn't a code block
+	status = send(plain, "line 1\nline 2", `{"snippet":true}`)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "line 1\nline 2", uploaded)
+	assert.JSONEq(t, `{"files":[{"id":"F1L3SL4CK1D","title":"snippet.txt"}],"channel_id":"C0123ABCDEF"}`, completed)
+
+	// legacy uploads give the snippet's type as its filetype
+	status = send(newChannel(map[string]interface{}{"code_snippets": true, "legacy_file_upload": true}), logDump, `{}`)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"/files.upload"}, requests)
+	assert.Equal(t, "text", form.Get("filetype"))
+	assert.Equal(t, "Here's the log:", form.Get("initial_comment"))
 }
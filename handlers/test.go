@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -43,8 +44,10 @@ type ChannelHandleTestCase struct {
 	Attachment  *string
 	Attachments []string
 	Date        *time.Time
+	Metadata    json.RawMessage
 
-	MsgStatus *string
+	MsgStatus      *string
+	MsgStatusExtra map[string]interface{}
 
 	ChannelEvent      *string
 	ChannelEventExtra map[string]interface{}
@@ -91,9 +94,10 @@ type ChannelSendTestCase struct {
 	ResponseToExternalID string
 	Metadata             json.RawMessage
 
-	ResponseStatus int
-	ResponseBody   string
-	Responses      map[MockedRequest]MockedResponse
+	ResponseStatus  int
+	ResponseBody    string
+	ResponseHeaders map[string]string
+	Responses       map[MockedRequest]MockedResponse
 
 	Path        string
 	URLParams   map[string]string
@@ -104,9 +108,22 @@ type ChannelSendTestCase struct {
 	Error      string
 	Status     string
 	ExternalID string
+	SentOn     string
+
+	// ErrorCategory is the reason a permanent send error is dead lettered for
+	ErrorCategory courier.DeadLetterReason
+
+	// Retries is how many times the request was retried, which is only checked if non-zero
+	Retries int
+
+	// LogContains are substrings which should each be found in at least one of the channel logs of the send
+	LogContains []string
 
 	Stopped bool
 
+	// Timeout is how long the send is given, which is 10ms unless set
+	Timeout time.Duration
+
 	ContactURNs map[string]bool
 
 	SendPrep SendPrepFunc
@@ -222,6 +239,8 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 
 	for _, testCase := range testCases {
 		mockRRCount := 0
+		requestCount := 0
+		requestMutex := &sync.Mutex{}
 		t.Run(testCase.Label, func(t *testing.T) {
 			require := require.New(t)
 
@@ -239,9 +258,16 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 
 			var testRequest *http.Request
 			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestMutex.Lock()
+				defer requestMutex.Unlock()
+
 				body, _ := ioutil.ReadAll(r.Body)
 				testRequest = httptest.NewRequest(r.Method, r.URL.String(), bytes.NewBuffer(body))
 				testRequest.Header = r.Header
+				requestCount++
+				for k, v := range testCase.ResponseHeaders {
+					w.Header().Set(k, v)
+				}
 				if (len(testCase.Responses)) == 0 {
 					w.WriteHeader(testCase.ResponseStatus)
 					w.Write([]byte(testCase.ResponseBody))
@@ -251,9 +277,9 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 					for mockRequest, mockResponse := range testCase.Responses {
 						bodyStr := string(body)[:]
 						if mockRequest.Method == r.Method && mockRequest.Path == r.URL.Path && mockRequest.RawQuery == r.URL.RawQuery && (mockRequest.Body == bodyStr || (mockRequest.BodyContains != "" && strings.Contains(bodyStr, mockRequest.BodyContains))) {
+							mockRRCount++
 							w.WriteHeader(mockResponse.Status)
 							w.Write([]byte(mockResponse.Body))
-							mockRRCount++
 							break
 						}
 					}
@@ -266,10 +292,24 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 				testCase.SendPrep(server, handler, channel, msg)
 			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
-			status, err := handler.SendMsg(ctx, msg)
+			// send like the server does, through any middleware of the handler
+			send := courier.SendFunc(handler.SendMsg)
+			if wrapper, isWrapper := handler.(courier.SendWrapper); isWrapper {
+				send = wrapper.WrapSend(send)
+			}
+
+			timeout := testCase.Timeout
+			if timeout == 0 {
+				timeout = time.Millisecond * 10
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			status, err := send(ctx, msg)
 			cancel()
 
+			// the server may still be finishing up the last request after we've read its response
+			requestMutex.Lock()
+			defer requestMutex.Unlock()
+
 			if testCase.Error != "" {
 				if err == nil {
 					t.Errorf("expected error: %s", testCase.Error)
@@ -280,6 +320,23 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 				t.Errorf("unexpected error: %s", err.Error())
 			}
 
+			if testCase.ErrorCategory != "" {
+				reason, isPermanent := courier.ClassifySendError(err)
+				require.True(isPermanent, "error should be permanent")
+				require.Equal(testCase.ErrorCategory, reason)
+			}
+
+			if testCase.Retries != 0 {
+				require.Equal(testCase.Retries, requestCount-1, "retries mismatch")
+			}
+
+			if len(testCase.LogContains) > 0 {
+				require.NotNil(status, "status should not be nil")
+				for _, expected := range testCase.LogContains {
+					require.True(logsContain(status.Logs(), expected), "no channel log contains: %s", expected)
+				}
+			}
+
 			if testCase.Path != "" {
 				require.NotNil(testRequest, "path should not be nil")
 				require.Equal(testCase.Path, testRequest.URL.Path)
@@ -323,6 +380,10 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 				require.Equal(testCase.ExternalID, status.ExternalID())
 			}
 
+			if testCase.SentOn != "" {
+				require.Equal(testCase.SentOn, status.Extra()[courier.MsgStatusExtraSentOn])
+			}
+
 			if testCase.Status != "" {
 				require.NotNil(status, "status should not be nil")
 				require.Equal(testCase.Status, string(status.Status()))
@@ -360,6 +421,66 @@ func RunChannelSendTestCases(t *testing.T, channel courier.Channel, handler cour
 
 }
 
+// logsContain returns whether any of the passed in channel logs contains the passed in substring in its description,
+// error, request or response
+func logsContain(logs []*courier.ChannelLog, substring string) bool {
+	for _, l := range logs {
+		if l == nil {
+			continue
+		}
+		for _, s := range []string{l.Description, l.Error, l.Request, l.Response} {
+			if strings.Contains(s, substring) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LogsWithDescription returns the passed in channel logs which have the passed in description, e.g. to pick out the rate
+// limited attempts of a send
+func LogsWithDescription(logs []*courier.ChannelLog, description string) []*courier.ChannelLog {
+	matching := make([]*courier.ChannelLog, 0)
+	for _, l := range logs {
+		if l != nil && l.Description == description {
+			matching = append(matching, l)
+		}
+	}
+	return matching
+}
+
+// ErroredLogs returns the passed in channel logs which have errors
+func ErroredLogs(logs []*courier.ChannelLog) []*courier.ChannelLog {
+	errored := make([]*courier.ChannelLog, 0)
+	for _, l := range logs {
+		if l != nil && l.Error != "" {
+			errored = append(errored, l)
+		}
+	}
+	return errored
+}
+
+// LogDescriptions returns the descriptions of the passed in channel logs in order, so that tests can assert on what was
+// logged in one go
+func LogDescriptions(logs []*courier.ChannelLog) []string {
+	descriptions := make([]string, 0, len(logs))
+	for _, l := range logs {
+		if l != nil {
+			descriptions = append(descriptions, l.Description)
+		}
+	}
+	return descriptions
+}
+
+// LogErrors returns the errors of the passed in channel logs which have them, in order
+func LogErrors(logs []*courier.ChannelLog) []string {
+	errs := make([]string, 0)
+	for _, l := range ErroredLogs(logs) {
+		errs = append(errs, l.Error)
+	}
+	return errs
+}
+
 // RunChannelTestCases runs all the passed in tests cases for the passed in channel configurations
 func RunChannelTestCases(t *testing.T, channels []courier.Channel, handler courier.ChannelHandler, testCases []ChannelHandleTestCase) {
 	mb := courier.NewMockBackend()
@@ -427,6 +548,10 @@ func RunChannelTestCases(t *testing.T, channels []courier.Channel, handler couri
 					require.NotNil(status)
 					require.Equal(*testCase.MsgStatus, string(status.Status()))
 				}
+				if testCase.MsgStatusExtra != nil {
+					require.NotNil(status)
+					require.Equal(testCase.MsgStatusExtra, status.Extra())
+				}
 				if testCase.ID != 0 {
 					if status != nil {
 						require.Equal(testCase.ID, int64(status.ID()))
@@ -439,6 +564,8 @@ func RunChannelTestCases(t *testing.T, channels []courier.Channel, handler couri
 				}
 				if len(testCase.Attachments) > 0 {
 					require.Equal(testCase.Attachments, msg.Attachments())
+				} else if testCase.Attachments != nil {
+					require.Empty(msg.Attachments())
 				}
 				if testCase.Date != nil {
 					if msg != nil {
@@ -449,6 +576,10 @@ func RunChannelTestCases(t *testing.T, channels []courier.Channel, handler couri
 						require.Equal(*testCase.Date, nil)
 					}
 				}
+				if testCase.Metadata != nil {
+					require.NotNil(msg)
+					require.JSONEq(string(testCase.Metadata), string(msg.Metadata()))
+				}
 			}
 		})
 	}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/utils"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+)
+
+// retryingHandler is a handler which retries failed sends and can only send to tel URNs, used to test our send test
+// cases themselves
+type retryingHandler struct {
+	BaseHandler
+	sendURL string
+}
+
+func (h *retryingHandler) Initialize(s courier.Server) error {
+	h.SetServer(s)
+	return nil
+}
+
+func (h *retryingHandler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
+	if msg.URN().Scheme() != urns.TelScheme {
+		return nil, courier.NewPermanentSendError(courier.DeadLetterInvalidDestination, fmt.Errorf("can't send to %s URNs", msg.URN().Scheme()))
+	}
+
+	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), courier.MsgErrored)
+	err := SendWithRetries(ctx, msg.Channel(), status, h.RetryBackoff(), func() (*courier.ChannelLog, bool, error) {
+		req, cancel, err := NewRequestWithTimeout(ctx, msg.Channel(), "send", time.Second, http.MethodPost, h.sendURL, nil)
+		if err != nil {
+			return nil, false, err
+		}
+		defer cancel()
+
+		rr, err := utils.MakeHTTPRequest(req)
+		return courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err), IsRetryableResponse(rr), err
+	})
+	if err == nil {
+		status.SetStatus(courier.MsgWired)
+	}
+	return status, nil
+}
+
+func setRetryingSendURL(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
+	h.(*retryingHandler).sendURL = s.URL
+}
+
+func TestSendTestCases(t *testing.T) {
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "RT", "2020", "US", map[string]interface{}{"max_retries": 2})
+	handler := &retryingHandler{BaseHandler: NewBaseHandler(courier.ChannelType("RT"), "Retrying")}
+	handler.SetRetryBackoff(time.Microsecond)
+
+	RunChannelSendTestCases(t, channel, handler, []ChannelSendTestCase{
+		{
+			Label: "Send",
+			Text:  "Simple Message", URN: "tel:+250788383383",
+			Status:          "W",
+			ResponseStatus:  200,
+			ResponseHeaders: map[string]string{"X-Request-Id": "req-1234"},
+			LogContains:     []string{"Message Sent", "X-Request-Id: req-1234"},
+			SendPrep:        setRetryingSendURL,
+		},
+		{
+			Label: "Retried Send",
+			Text:  "Simple Message", URN: "tel:+250788383383",
+			Status:         "E",
+			ResponseStatus: 503,
+			Retries:        2,
+			LogContains:    []string{"Message Send Error", "received non 200 status: 503"},
+			SendPrep:       setRetryingSendURL,
+		},
+		{
+			Label: "Permanent Error",
+			Text:  "Simple Message", URN: "telegram:12345",
+			Error:         "can't send to telegram URNs",
+			ErrorCategory: courier.DeadLetterInvalidDestination,
+			SendPrep:      setRetryingSendURL,
+		},
+	}, nil)
+}
+
+func TestLogsContain(t *testing.T) {
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "RT", "2020", "US", nil)
+	logs := []*courier.ChannelLog{
+		nil,
+		courier.NewChannelLog("Message Sent", channel, courier.NilMsgID, "POST", "http://example.com", 503, "POST / HTTP/1.1", "HTTP/1.1 503 Service Unavailable", 0, nil),
+		courier.NewChannelLogFromError("Message Send Error", channel, courier.NilMsgID, 0, errors.New("connection reset")),
+	}
+
+	assert.True(t, logsContain(logs, "Message Sent"))
+	assert.True(t, logsContain(logs, "POST / HTTP/1.1"))
+	assert.True(t, logsContain(logs, "503 Service Unavailable"))
+	assert.True(t, logsContain(logs, "connection reset"))
+	assert.False(t, logsContain(logs, "rate limited"))
+	assert.False(t, logsContain(nil, "Message Sent"))
+}
+
+func TestLogFilters(t *testing.T) {
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "RT", "2020", "US", nil)
+	logs := []*courier.ChannelLog{
+		courier.NewChannelLog("Message Send Rate Limited", channel, courier.NilMsgID, "POST", "http://example.com", 429, "", "", 0, errors.New("rate limited")),
+		nil,
+		courier.NewChannelLog("Message Send Rate Limited", channel, courier.NilMsgID, "POST", "http://example.com", 429, "", "", 0, nil),
+		courier.NewChannelLogFromError("Message Send Error", channel, courier.NilMsgID, 0, errors.New("connection reset")),
+		courier.NewChannelLog("Message Sent", channel, courier.NilMsgID, "POST", "http://example.com", 200, "", "", 0, nil),
+	}
+
+	limited := LogsWithDescription(logs, "Message Send Rate Limited")
+	assert.Len(t, limited, 2)
+	assert.Equal(t, []int{429, 429}, []int{limited[0].StatusCode, limited[1].StatusCode})
+	assert.Equal(t, []*courier.ChannelLog{logs[4]}, LogsWithDescription(logs, "Message Sent"))
+	assert.Empty(t, LogsWithDescription(logs, "Message Delivered"))
+
+	assert.Equal(t, []*courier.ChannelLog{logs[0], logs[3]}, ErroredLogs(logs))
+	assert.Equal(t, []string{"rate limited", "connection reset"}, LogErrors(logs))
+	assert.Equal(t, []string{"Message Send Rate Limited", "Message Send Rate Limited", "Message Send Error", "Message Sent"}, LogDescriptions(logs))
+
+	// no logs give empty rather than nil lists, so they can be compared to empty literals
+	assert.Equal(t, []string{}, LogDescriptions(nil))
+	assert.Equal(t, []string{}, LogErrors(nil))
+	assert.Equal(t, []*courier.ChannelLog{}, ErroredLogs(nil))
+	assert.Equal(t, []*courier.ChannelLog{}, LogsWithDescription(nil, "Message Sent"))
+}
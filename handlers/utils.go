@@ -2,15 +2,24 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/gocommon/urns"
+	"github.com/sirupsen/logrus"
 )
 
 // GetTextAndAttachments returns both the text of our message as well as any attachments, newline delimited
@@ -118,6 +127,72 @@ func SplitMsg(text string, max int) []string {
 	return parts
 }
 
+// SplitMsgByChannelAtBoundaries splits the passed in string into segments that are at most channel config max length or
+// type max length, breaking at sentence or word boundaries where possible
+func SplitMsgByChannelAtBoundaries(channel courier.Channel, text string, maxLength int) []string {
+	max := channel.IntConfigForKey(courier.ConfigMaxLength, maxLength)
+
+	return SplitMsgAtBoundaries(text, max)
+}
+
+// SplitMsgAtBoundaries splits the passed in string into segments that are at most max length. Each segment ends at the
+// last sentence boundary in its final quarter if there is one, otherwise at its last word boundary, so words are only
+// split when a single word is longer than max.
+func SplitMsgAtBoundaries(text string, max int) []string {
+	// smaller than our max, just return it
+	if len(text) <= max {
+		return []string{text}
+	}
+
+	parts := make([]string, 0, 2)
+	for len(text) > max {
+		cut := boundaryCut(text, max)
+		if part := strings.TrimSpace(text[:cut]); part != "" {
+			parts = append(parts, part)
+		}
+		text = strings.TrimSpace(text[cut:])
+	}
+	if text != "" {
+		parts = append(parts, text)
+	}
+
+	return parts
+}
+
+// boundaryCut returns where to end the next segment of the passed in text which is longer than max
+func boundaryCut(text string, max int) int {
+	// the end of the longest segment which doesn't split a character
+	limit := max
+	for limit > 0 && !utf8.RuneStart(text[limit]) {
+		limit--
+	}
+	if limit == 0 {
+		_, size := utf8.DecodeRuneInString(text)
+		return size
+	}
+
+	isSpace := func(b byte) bool { return b == ' ' || b == '\n' || b == '\t' || b == '\r' }
+
+	// sentence boundaries are only worth the shorter segment if they are in its final quarter
+	for i := limit; i > 0 && i >= limit-max/4; i-- {
+		if text[i] == '\n' || (isSpace(text[i]) && strings.IndexByte(".!?", text[i-1]) >= 0) {
+			return i
+		}
+	}
+	for i := limit; i > 0; i-- {
+		if isSpace(text[i]) {
+			return i
+		}
+	}
+	return limit
+}
+
+// UnsupportedContent returns the placeholder text and metadata of an incoming message for content of a type we don't
+// support, e.g. [unsupported: sticker], so that it can still be delivered to flows rather than dropped
+func UnsupportedContent(contentType string) (string, map[string]interface{}) {
+	return fmt.Sprintf("[unsupported: %s]", contentType), map[string]interface{}{"unsupported_type": contentType}
+}
+
 // StrictTelForCountry wraps urns.NewURNTelForCountry but is stricter in
 // what it accepts. Incoming tels must be numeric or we will return an
 // error. (IE, alphanumeric shortcodes are not ok)
@@ -143,3 +218,263 @@ func StrictTelForCountry(number string, country string) (urns.URN, error) {
 
 	return urn, nil
 }
+
+// RewriteAttachmentURL rewrites the passed in incoming attachment URL using the channel's attachment URL rewrite
+// template if it has one. The template can reference the original URL with {{url}} (query escaped), {{host}}
+// and {{path}} (path and query). Attachments which aren't http(s) URLs, like geo locations, are left unchanged.
+func RewriteAttachmentURL(channel courier.Channel, attURL string) (string, error) {
+	template := channel.StringConfigForKey(courier.ConfigAttachmentURLRewrite, "")
+	if template == "" || !strings.HasPrefix(attURL, "http") {
+		return attURL, nil
+	}
+
+	original, err := url.Parse(attURL)
+	if err != nil {
+		return attURL, fmt.Errorf("unable to parse attachment URL: %s", attURL)
+	}
+
+	rewritten := strings.NewReplacer(
+		"{{url}}", url.QueryEscape(attURL),
+		"{{host}}", original.Host,
+		"{{path}}", strings.TrimPrefix(original.RequestURI(), "/"),
+	).Replace(template)
+
+	parsed, err := url.Parse(rewritten)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return attURL, fmt.Errorf("attachment URL rewrite produced an invalid URL: %s", rewritten)
+	}
+
+	return rewritten, nil
+}
+
+// UploadContentTypeAttachment is the upload content type config value which uploads attachments as the type they were
+// declared with
+const UploadContentTypeAttachment = "attachment"
+
+// UploadContentType returns the content type to upload an attachment declared as the passed in type with on the passed
+// in channel. Unless the channel forces the declared type or a fixed type, this is the passed in detected type.
+func UploadContentType(channel courier.Channel, declared string, detected string) string {
+	forced := channel.StringConfigForKey(courier.ConfigUploadContentType, "")
+	if forced == UploadContentTypeAttachment {
+		if declared != "" {
+			return declared
+		}
+		return detected
+	}
+	if forced != "" {
+		return forced
+	}
+	return detected
+}
+
+// RequestTimeout returns the timeout to use for outgoing requests of the passed in operation on the passed in channel. An
+// operation specific config value takes precedence over the channel wide one, and if neither is set we use the default.
+// Sends are cut short after courier.SendTimeout whatever their requests' timeouts, so configured values longer than that
+// are logged and clamped to it.
+func RequestTimeout(channel courier.Channel, operation string, defaultTimeout time.Duration) time.Duration {
+	seconds := channel.IntConfigForKey(fmt.Sprintf("%s_%s", courier.ConfigRequestTimeout, operation), 0)
+	if seconds <= 0 {
+		seconds = channel.IntConfigForKey(courier.ConfigRequestTimeout, 0)
+	}
+	if seconds <= 0 {
+		return defaultTimeout
+	}
+
+	timeout := time.Duration(seconds) * time.Second
+	if timeout > courier.SendTimeout {
+		logrus.WithField("channel_uuid", channel.UUID()).WithField("operation", operation).Warnf("request timeout of %s is longer than sends are given, using %s", timeout, courier.SendTimeout)
+		return courier.SendTimeout
+	}
+	return timeout
+}
+
+// NewRequestWithTimeout creates a new outgoing request which is cancelled if it takes longer than the timeout for the passed
+// in operation on the channel. Callers must call the returned cancel func once they are done with the response.
+func NewRequestWithTimeout(ctx context.Context, channel courier.Channel, operation string, defaultTimeout time.Duration, method string, url string, body io.Reader) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout(channel, operation, defaultTimeout))
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return req, cancel, nil
+}
+
+// defaultMaxRetries is how many times a failed send request is retried if the channel doesn't configure it
+const defaultMaxRetries = 2
+
+// DefaultRetryBackoff is how long handlers wait before retrying a failed send request unless set otherwise
+const DefaultRetryBackoff = time.Second
+
+// SendAttempt makes a single attempt at a send request, returning the log of the attempt, any error and whether
+// that error is worth retrying
+type SendAttempt func() (*courier.ChannelLog, bool, error)
+
+// SendWithRetries makes the passed in send attempt until it succeeds, fails with an error that isn't worth retrying
+// or the channel's maximum number of retries is exhausted, waiting the passed in backoff before the first retry and
+// doubling it with each one after. The logs of all attempts are added to the status, and if the send ultimately fails,
+// the number of attempts made and the last error are recorded on it.
+func SendWithRetries(ctx context.Context, channel courier.Channel, status courier.MsgStatus, retryBackoff time.Duration, attempt SendAttempt) error {
+	maxRetries := channel.IntConfigForKey(courier.ConfigMaxRetries, defaultMaxRetries)
+	backoff := &utils.Backoff{Base: retryBackoff, Multiplier: 2}
+
+	for attempts := 1; ; attempts++ {
+		log, retryable, err := attempt()
+		if log != nil {
+			status.AddLog(log)
+		}
+		if err == nil {
+			return nil
+		}
+
+		exhausted := !retryable || attempts > maxRetries
+		if !exhausted {
+			select {
+			case <-ctx.Done():
+				exhausted = true
+			case <-time.After(backoff.Next()):
+			}
+		}
+
+		if exhausted {
+			status.SetExtra("send_attempts", attempts)
+			status.SetExtra("last_error", err.Error())
+			return err
+		}
+	}
+}
+
+// IsRetryableResponse returns whether a failed request is worth retrying, which is the case for connection errors,
+// rate limiting and server errors
+func IsRetryableResponse(rr *utils.RequestResponse) bool {
+	return rr == nil || rr.StatusCode == 0 || rr.StatusCode == http.StatusTooManyRequests || rr.StatusCode >= 500
+}
+
+// SetSendResult records the id and timestamp the provider assigned to a message it accepted on the passed in status,
+// either of which can be empty if the provider didn't return it
+func SetSendResult(status courier.MsgStatus, externalID string, sentOn time.Time) {
+	if externalID != "" {
+		status.SetExternalID(externalID)
+	}
+	if !sentOn.IsZero() {
+		status.SetExtra(courier.MsgStatusExtraSentOn, sentOn.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+// values for what to do with the attachments of incoming messages over the channel's attachment limits
+const (
+	AttachmentLimitTruncate = "truncate"
+	AttachmentLimitReject   = "reject"
+)
+
+// SizedAttachment is an attachment URL of an incoming message along with its size in bytes, zero if unknown
+type SizedAttachment struct {
+	URL  string
+	Size int
+}
+
+// LimitAttachments applies the channel's limits on the number and total size of the attachments of an incoming
+// message, returning the URLs of the attachments to keep and whether any were dropped. If the channel is configured
+// to reject attachments over its limits, all attachments are dropped, otherwise we keep those within the limits.
+func LimitAttachments(channel courier.Channel, attachments []SizedAttachment) ([]string, bool) {
+	maxCount := channel.IntConfigForKey(courier.ConfigMaxAttachments, 0)
+	maxSize := channel.IntConfigForKey(courier.ConfigMaxAttachmentsSize, 0)
+
+	kept := make([]string, 0, len(attachments))
+	totalSize := 0
+	for _, a := range attachments {
+		if (maxCount > 0 && len(kept) >= maxCount) || (maxSize > 0 && totalSize+a.Size > maxSize) {
+			if channel.StringConfigForKey(courier.ConfigAttachmentLimitAction, AttachmentLimitTruncate) == AttachmentLimitReject {
+				return []string{}, true
+			}
+			continue
+		}
+		kept = append(kept, a.URL)
+		totalSize += a.Size
+	}
+	return kept, len(kept) < len(attachments)
+}
+
+// StringListConfigForKey returns the list of strings in the channel config for the passed in key, which can be set
+// either as a list or as a comma separated string, with surrounding whitespace trimmed from each value
+func StringListConfigForKey(channel courier.Channel, key string) []string {
+	var values []string
+	switch value := channel.ConfigForKey(key, nil).(type) {
+	case []string:
+		values = value
+	case []interface{}:
+		for _, v := range value {
+			values = append(values, fmt.Sprint(v))
+		}
+	case string:
+		if value != "" {
+			values = strings.Split(value, ",")
+		}
+	}
+
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// IsSenderAllowed returns whether messages from the passed in URN should be accepted by the channel. If the channel has
+// an allowlist of senders configured, either as a list or comma separated string, the URN path or identity must be on it.
+func IsSenderAllowed(channel courier.Channel, urn urns.URN) bool {
+	allowed := StringListConfigForKey(channel, courier.ConfigAllowedSenders)
+
+	// no allowlist means everyone is allowed
+	if len(allowed) == 0 {
+		return true
+	}
+
+	path := strings.TrimPrefix(urn.Path(), "+")
+	for _, a := range allowed {
+		if strings.TrimPrefix(a, "+") == path || a == string(urn.Identity()) {
+			return true
+		}
+	}
+	return false
+}
+
+// inboundFilter is a compiled inbound filter pattern
+type inboundFilter struct {
+	regex *regexp.Regexp
+	err   error
+}
+
+// inboundFilters are the compiled inbound filter patterns of channels, keyed by pattern, so that each pattern is only
+// compiled once however many channels use it
+var inboundFilters sync.Map
+
+// MatchesInboundFilter returns whether incoming messages with the passed in text should be accepted by the channel. If
+// the channel has an inbound filter prefix or pattern configured, the text must start with or match it. An invalid
+// pattern is returned as an error, with the text accepted so that messages aren't lost to a bad config.
+func MatchesInboundFilter(channel courier.Channel, text string) (bool, error) {
+	if prefix := channel.StringConfigForKey(courier.ConfigInboundFilterPrefix, ""); prefix != "" {
+		trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+		if len(trimmed) < len(prefix) || !strings.EqualFold(trimmed[:len(prefix)], prefix) {
+			return false, nil
+		}
+	}
+
+	pattern := channel.StringConfigForKey(courier.ConfigInboundFilterPattern, "")
+	if pattern == "" {
+		return true, nil
+	}
+
+	cached, found := inboundFilters.Load(pattern)
+	if !found {
+		filter := &inboundFilter{}
+		filter.regex, filter.err = regexp.Compile(pattern)
+		cached, _ = inboundFilters.LoadOrStore(pattern, filter)
+	}
+	filter := cached.(*inboundFilter)
+	if filter.err != nil {
+		return true, fmt.Errorf("invalid inbound filter pattern: %w", filter.err)
+	}
+	return filter.regex.MatchString(text), nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -293,7 +294,18 @@ func (h *handler) receiveEvent(ctx context.Context, channel courier.Channel, w h
 		}
 
 		if mediaURL != "" {
-			event.WithAttachment(mediaURL)
+			size := 0
+			if channel.IntConfigForKey(courier.ConfigMaxAttachmentsSize, 0) > 0 && !strings.HasPrefix(mediaURL, "geo:") {
+				size = resolveMediaSize(ctx, channel, mediaURL)
+			}
+
+			attachmentURLs, dropped := handlers.LimitAttachments(channel, []handlers.SizedAttachment{{URL: mediaURL, Size: size}})
+			if dropped {
+				courier.LogRequestError(r, channel, errors.New("dropped attachments over the channel's limits"))
+			}
+			for _, attURL := range attachmentURLs {
+				event.WithAttachment(attURL)
+			}
 		}
 
 		err = h.Backend().WriteMsg(ctx, event)
@@ -354,6 +366,21 @@ func resolveMediaURL(channel courier.Channel, mediaID string) (string, error) {
 	return fileURL, nil
 }
 
+// resolveMediaSize returns the size in bytes of the media at the passed in URL, or zero if it can't be determined
+func resolveMediaSize(ctx context.Context, channel courier.Channel, mediaURL string) int {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, mediaURL, nil)
+	if err != nil {
+		return 0
+	}
+	setWhatsAppAuthHeader(&req.Header, channel)
+
+	rr, err := utils.MakeHTTPRequest(req)
+	if err != nil || rr.ContentLength < 0 {
+		return 0
+	}
+	return rr.ContentLength
+}
+
 // BuildDownloadMediaRequest to download media for message attachment with Bearer token set
 func (h *handler) BuildDownloadMediaRequest(ctx context.Context, b courier.Backend, channel courier.Channel, attachmentURL string) (*http.Request, error) {
 	token := channel.StringConfigForKey(courier.ConfigAuthToken, "")
@@ -557,6 +584,20 @@ type mtErrorPayload struct {
 // whatsapp only allows messages up to 4096 chars
 const maxMsgLength = 4096
 
+// WhatsApp ids are the international numbers of contacts without the leading +
+var whatsappIDRegex = regexp.MustCompile(`^[1-9][0-9]{4,14}$`)
+
+// ValidateURN checks that the passed in URN is a WhatsApp number we can send to
+func (h *handler) ValidateURN(urn urns.URN) error {
+	if urn.Scheme() != urns.WhatsAppScheme {
+		return errors.Errorf("unsupported URN scheme for WhatsApp: %s", urn.Scheme())
+	}
+	if !whatsappIDRegex.MatchString(urn.Path()) {
+		return errors.Errorf("invalid WhatsApp number: %s", urn.Path())
+	}
+	return nil
+}
+
 // SendMsg sends the passed in message, returning any error
 func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
 	start := time.Now()
@@ -711,7 +752,7 @@ func buildPayloads(msg courier.Msg, h *handler) ([]interface{}, []*courier.Chann
 
 							document := &mmtDocument{
 								Link:     mediaURL,
-								Filename: filename,
+								Filename: utils.FilenameForMimeType(filename, mimeType),
 							}
 							header.Parameters = append(header.Parameters, Param{Type: "document", Document: document})
 							payload.Template.Components = append(payload.Template.Components, *header)
@@ -850,6 +891,7 @@ func buildPayloads(msg courier.Msg, h *handler) ([]interface{}, []*courier.Chann
 					if err != nil {
 						logrus.WithField("channel_uuid", msg.Channel().UUID().String()).WithError(err).Error("Error while parsing the media URL")
 					}
+					mediaPayload.Filename = utils.FilenameForMimeType(mediaPayload.Filename, mimeType)
 					payload.Document = mediaPayload
 					payloads = append(payloads, payload)
 				} else if strings.HasPrefix(mimeType, "image") {
@@ -939,11 +981,9 @@ func (h *handler) fetchMediaID(msg courier.Msg, mimeType, mediaURL string) (stri
 	mtype := http.DetectContentType(rr.Body)
 
 	if mtype != mimeType || mtype == "application/octet-stream" || mtype == "application/zip" {
-		mimeT := mimetype.Detect(rr.Body)
-		req.Header.Add("Content-Type", mimeT.String())
-	} else {
-		req.Header.Add("Content-Type", mtype)
+		mtype = mimetype.Detect(rr.Body).String()
 	}
+	req.Header.Add("Content-Type", handlers.UploadContentType(msg.Channel(), mimeType, mtype))
 	rr, err = utils.MakeHTTPRequest(req)
 	log = courier.NewChannelLogFromRR("Uploading media to WhatsApp", msg.Channel(), msg.ID(), rr).WithError("Error uploading media to WhatsApp", err)
 	logs = append(logs, log)
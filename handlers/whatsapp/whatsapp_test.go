@@ -12,6 +12,7 @@ import (
 
 	"github.com/nyaruka/courier"
 	. "github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/gocommon/urns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -412,6 +413,40 @@ func TestHandler(t *testing.T) {
 	RunChannelTestCases(t, testChannels, newWAHandler(courier.ChannelType("TXW"), "TextIt"), replaceTestcaseURLs(waTestCases, txReceiveURL))
 }
 
+func TestAttachmentLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		assert.Equal(t, "Bearer the-auth-token", r.Header.Get("Authorization"))
+		w.Header().Set("Content-Length", "5000")
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	newChannel := func(maxSize int) courier.Channel {
+		return courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c568c", "WA", "250788383383", "RW", map[string]interface{}{
+			"auth_token":           "the-auth-token",
+			"base_url":             server.URL,
+			"max_attachments_size": maxSize,
+		})
+	}
+
+	// media within the limit is kept
+	RunChannelTestCases(t, []courier.Channel{newChannel(10000)}, newWAHandler(courier.ChannelType("WA"), "WhatsApp"), []ChannelHandleTestCase{
+		{Label: "Receive Image Within Limit", URL: waReceiveURL, Data: imageMsg, Status: 200, Response: `"type":"msg"`,
+			NoQueueErrorCheck: true, NoInvalidChannelCheck: true,
+			Text: Sp("the caption"), Attachment: Sp(server.URL + "/v1/media/41"), URN: Sp("whatsapp:250788123123"), ExternalID: Sp("41")},
+	})
+
+	// media over the limit is dropped but we keep the rest of the message
+	RunChannelTestCases(t, []courier.Channel{newChannel(1000)}, newWAHandler(courier.ChannelType("WA"), "WhatsApp"), []ChannelHandleTestCase{
+		{Label: "Receive Image Over Limit", URL: waReceiveURL, Data: imageMsg, Status: 200, Response: `"type":"msg"`,
+			NoQueueErrorCheck: true, NoInvalidChannelCheck: true,
+			Text: Sp("the caption"), Attachments: []string{}, URN: Sp("whatsapp:250788123123"), ExternalID: Sp("41")},
+		{Label: "Receive Location Over Limit", URL: waReceiveURL, Data: locationMsg, Status: 200, Response: `"type":"msg"`,
+			Text: Sp(""), Attachment: Sp("geo:0.000000,1.000000"), URN: Sp("whatsapp:250788123123"), ExternalID: Sp("41")},
+	})
+}
+
 func BenchmarkHandler(b *testing.B) {
 	RunChannelBenchmarks(b, testChannels, newWAHandler(courier.ChannelType("WA"), "WhatsApp"), waTestCases)
 	RunChannelBenchmarks(b, testChannels, newWAHandler(courier.ChannelType("D3"), "360Dialog"), replaceTestcaseURLs(waTestCases, d3ReceiveURL))
@@ -495,6 +530,23 @@ var defaultSendTestCases = []ChannelSendTestCase{
 		},
 		SendPrep: setSendURL,
 	},
+	{Label: "Document Send Without Extension",
+		Text:   "document caption",
+		URN:    "whatsapp:250788123123",
+		Status: "W", ExternalID: "157b5e14568e8",
+		Attachments: []string{"application/pdf:https://foo.bar/document"},
+		Responses: map[MockedRequest]MockedResponse{
+			MockedRequest{
+				Method: "POST",
+				Path:   "/v1/messages",
+				Body:   `{"to":"250788123123","type":"document","document":{"link":"https://foo.bar/document","caption":"document caption","filename":"document.pdf"}}`,
+			}: MockedResponse{
+				Status: 201,
+				Body:   `{ "messages": [{"id": "157b5e14568e8"}] }`,
+			},
+		},
+		SendPrep: setSendURL,
+	},
 	{Label: "Image Send",
 		Text:   "document caption",
 		URN:    "whatsapp:250788123123",
@@ -898,3 +950,71 @@ func TestSending(t *testing.T) {
 
 	RunChannelSendTestCases(t, defaultChannel, newWAHandler(courier.ChannelType("WA"), "WhatsApp"), mediaCacheSendTestCases, nil)
 }
+
+func TestValidateURN(t *testing.T) {
+	h := newWAHandler(courier.ChannelType("WA"), "WhatsApp").(courier.URNValidator)
+
+	tcs := []struct {
+		urn         urns.URN
+		expectedErr string
+	}{
+		{"whatsapp:250788123123", ""},
+		{"whatsapp:5511987654321", ""},
+		{"whatsapp:+250788123123", "invalid WhatsApp number: +250788123123"},
+		{"whatsapp:0788123123", "invalid WhatsApp number: 0788123123"},
+		{"whatsapp:1234", "invalid WhatsApp number: 1234"},
+		{"whatsapp:2507881231231231", "invalid WhatsApp number: 2507881231231231"},
+		{"tel:+250788123123", "unsupported URN scheme for WhatsApp: tel"},
+	}
+
+	for _, tc := range tcs {
+		err := h.ValidateURN(tc.urn)
+		if tc.expectedErr == "" {
+			assert.NoError(t, err, "unexpected error for %s", tc.urn)
+		} else {
+			assert.EqualError(t, err, tc.expectedErr, "error mismatch for %s", tc.urn)
+		}
+	}
+}
+
+func TestSendingMediaContentType(t *testing.T) {
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/media":
+			contentType = r.Header.Get("Content-Type")
+			w.Write([]byte(`{ "media" : [{"id": "25c484d1-1283-4b94-988d-7276bdec4ef3"}] }`))
+		case "/v1/messages":
+			w.WriteHeader(201)
+			w.Write([]byte(`{ "messages": [{"id": "157b5e14568e8"}] }`))
+		default:
+			w.Write([]byte("media bytes"))
+		}
+	}))
+	defer server.Close()
+
+	mb := courier.NewMockBackend()
+	h := newWAHandler(courier.ChannelType("WA"), "WhatsApp")
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	send := func(config map[string]interface{}, document string) string {
+		contentType = ""
+		config["auth_token"] = "token123"
+		config["base_url"] = server.URL
+		channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "WA", "250788383383", "US", config)
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "whatsapp:250788123123", "", false, nil, "", 0, "").WithAttachment("application/pdf:" + server.URL + "/" + document)
+		status, err := h.SendMsg(context.Background(), msg)
+		assert.NoError(t, err)
+		assert.Equal(t, courier.MsgWired, status.Status())
+		return contentType
+	}
+
+	// by default media is uploaded as the type we detect it as
+	assert.Equal(t, "text/plain; charset=utf-8", send(map[string]interface{}{}, "detected.pdf"))
+
+	// but channels can force the type attachments were declared with
+	assert.Equal(t, "application/pdf", send(map[string]interface{}{"upload_content_type": "attachment"}, "declared.pdf"))
+
+	// or a fixed type
+	assert.Equal(t, "application/octet-stream", send(map[string]interface{}{"upload_content_type": "application/octet-stream"}, "fixed.pdf"))
+}
@@ -5,22 +5,48 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/buger/jsonparser"
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/courier"
 	"github.com/nyaruka/courier/handlers"
 	"github.com/nyaruka/courier/utils"
+	"github.com/nyaruka/gocommon/gsm7"
 	"github.com/nyaruka/gocommon/urns"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
-var (
-	maxMsgLength    = 1152
+const (
+	configFromNumbers = "from_numbers"
+	configUploadMedia = "upload_media"
+	configAckResponse = "ack_response"
+)
+
+const (
 	whatsappSendURL = "https://api.zenvia.com/v2/channels/whatsapp/messages"
 	smsSendURL      = "https://api.zenvia.com/v2/channels/sms/messages"
+	mediaUploadURL  = "https://api.zenvia.com/v2/channels/whatsapp/media"
+)
+
+var (
+	maxMsgLength = 1152
+	selfTestText = "courier self test"
+	sendTimeout  = 15 * time.Second
+
+	// media we upload is limited to what WhatsApp accepts for documents
+	maxUploadSize   = 100 * 1024 * 1024
+	downloadTimeout = 30 * time.Second
+	uploadTimeout   = 60 * time.Second
 )
 
 func init() {
@@ -30,10 +56,26 @@ func init() {
 
 type handler struct {
 	handlers.BaseHandler
+
+	// the URLs we send messages and upload media to
+	whatsappSendURL string
+	smsSendURL      string
+	mediaUploadURL  string
+
+	// returns the shortener for the links in outgoing SMS, if the channel has one
+	linkShortener func(courier.Channel) handlers.LinkShortener
 }
 
 func newHandler(channelType courier.ChannelType, name string) courier.ChannelHandler {
-	return &handler{handlers.NewBaseHandler(channelType, name)}
+	h := &handler{
+		BaseHandler:     handlers.NewBaseHandler(channelType, name),
+		whatsappSendURL: whatsappSendURL,
+		smsSendURL:      smsSendURL,
+		mediaUploadURL:  mediaUploadURL,
+		linkShortener:   handlers.LinkShortenerForChannel,
+	}
+	h.UseSendMiddleware(handlers.RequireConfig(courier.ConfigAPIKey))
+	return h
 }
 
 // Initialize is called by the engine once everything is loaded
@@ -57,6 +99,47 @@ type moContent struct {
 	Name         string  `json:"name"`
 	Address      string  `json:"address"`
 	URL          string  `json:"url"`
+	Index        *int    `json:"index"`
+
+	CatalogID         string        `json:"catalogId"`
+	ProductRetailerID string        `json:"productRetailerId"`
+	Items             []moOrderItem `json:"items"`
+
+	SystemType string `json:"systemType"`
+}
+
+type moOrderItem struct {
+	ProductRetailerID string  `json:"productRetailerId"`
+	Quantity          int     `json:"quantity"`
+	ItemPrice         float64 `json:"itemPrice"`
+	Currency          string  `json:"currency"`
+}
+
+// orderMetadata is the structured form of order and product messages we save as inbound metadata
+type orderMetadata struct {
+	CatalogID string              `json:"catalog_id"`
+	Text      string              `json:"text,omitempty"`
+	Items     []orderItemMetadata `json:"items"`
+}
+
+type orderItemMetadata struct {
+	ProductID string  `json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	ItemPrice float64 `json:"item_price,omitempty"`
+	Currency  string  `json:"currency,omitempty"`
+}
+
+// systemMetadata flags a system notification, e.g. a user joining a group or changing their profile name, that we save
+// as a message so that flows can tell it apart from chat messages and react to or ignore it
+type systemMetadata struct {
+	Type string `json:"type"`
+}
+
+// buttonMetadata is the structured form of a reply to a template button we save as inbound metadata, the payload
+// being what the button was sent with and the index its position in the template
+type buttonMetadata struct {
+	Payload string `json:"payload"`
+	Index   *int   `json:"index,omitempty"`
 }
 
 type moPayload struct {
@@ -70,6 +153,8 @@ type moPayload struct {
 		Direction string      `json:"direction"   validate:"required" `
 		Channel   string      `json:"channel"`
 		Contents  []moContent `json:"contents"    validate:"required" `
+		Forwarded bool        `json:"forwarded"`
+		Ephemeral bool        `json:"ephemeral"`
 	} `json:"message"`
 	Visitor struct {
 		Name string `json:"name"`
@@ -78,6 +163,8 @@ type moPayload struct {
 
 // receiveMessage is our HTTP handler function for incoming messages
 func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	rw := h.responder(channel)
+
 	// get our params
 	payload := &moPayload{}
 	err := handlers.DecodeAndValidateJSON(payload, r)
@@ -90,14 +177,13 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 	}
 
 	// create our date from the timestamp
-	// 2017-05-03T06:04:45Z
-	date, err := time.Parse("2006-01-02T15:04:05Z", payload.Timestamp)
+	date, err := parseTimestamp(payload.Timestamp, h.Clock())
 	if err != nil {
 		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("invalid date format: %s", payload.Timestamp))
 	}
 
 	if strings.ToUpper(payload.Message.Direction) != "IN" {
-		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "ignoring request, not incoming messages")
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, rw, channel, w, r, "ignoring request, not incoming messages")
 	}
 
 	// create our URN
@@ -114,6 +200,7 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 
 		text := ""
 		mediaURL := ""
+		metadata := make(map[string]interface{})
 
 		if content.Type == "text" {
 			text = content.Text
@@ -121,9 +208,36 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 			mediaURL = fmt.Sprintf("geo:%f,%f", content.Latitude, content.Longitude)
 		} else if content.Type == "file" {
 			mediaURL = content.FileURL
+		} else if content.Type == "button" {
+			// the label of the tapped button is the text, falling back to its payload if there isn't one
+			text = content.Text
+			if text == "" {
+				text = content.Payload
+			}
+			metadata["button"] = &buttonMetadata{Payload: content.Payload, Index: content.Index}
+		} else if content.Type == "order" || content.Type == "product" {
+			order := newOrderMetadata(content)
+			text = order.summary()
+			metadata[content.Type] = order
+		} else if content.Type == "system" {
+			// the text of a system notification describes what happened, falling back to its type if there isn't one
+			text = content.Text
+			if text == "" {
+				text = fmt.Sprintf("[system: %s]", content.SystemType)
+			}
+			metadata["system"] = &systemMetadata{Type: content.SystemType}
 		} else {
-			// we received a message type we do not support.
+			// we received a message type we do not support, so deliver a placeholder that flows can still respond to
 			courier.LogRequestError(r, channel, fmt.Errorf("unsupported message type %s", content.Type))
+			text, metadata = handlers.UnsupportedContent(content.Type)
+		}
+
+		// flag forwarded and view once messages so flows handling sensitive content can treat them differently
+		if payload.Message.Forwarded {
+			metadata["forwarded"] = true
+		}
+		if payload.Message.Ephemeral {
+			metadata["ephemeral"] = true
 		}
 
 		// build our msg
@@ -131,25 +245,113 @@ func (h *handler) receiveMessage(ctx context.Context, channel courier.Channel, w
 		if mediaURL != "" {
 			msg.WithAttachment(mediaURL)
 		}
+		if len(metadata) > 0 {
+			metadataJSON, err := json.Marshal(metadata)
+			if err != nil {
+				return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+			}
+			msg.WithMetadata(metadataJSON)
+		}
 		msgs = append(msgs, msg)
 	}
 
 	// and finally write our messages
-	return handlers.WriteMsgsAndResponse(ctx, h, msgs, w, r)
+	return handlers.WriteMsgsAndResponse(ctx, rw, msgs, w, r)
+}
+
+// parseTimestamp parses a Zenvia timestamp, e.g. 2017-05-03T06:04:45Z. As Zenvia's clock can be ahead of ours, a
+// timestamp in the future is replaced by the current time so that messages are never received after now.
+func parseTimestamp(timestamp string, clock utils.Clock) (time.Time, error) {
+	date, err := time.Parse("2006-01-02T15:04:05Z", timestamp)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if now := clock.Now(); date.After(now) {
+		return now, nil
+	}
+	return date, nil
+}
+
+// newOrderMetadata extracts the catalog and line items of an order or product content, products being a single item
+func newOrderMetadata(content moContent) *orderMetadata {
+	order := &orderMetadata{CatalogID: content.CatalogID, Text: content.Text, Items: []orderItemMetadata{}}
+	if content.Type == "product" {
+		order.Items = append(order.Items, orderItemMetadata{ProductID: content.ProductRetailerID, Quantity: 1})
+	}
+	for _, item := range content.Items {
+		order.Items = append(order.Items, orderItemMetadata{
+			ProductID: item.ProductRetailerID,
+			Quantity:  item.Quantity,
+			ItemPrice: item.ItemPrice,
+			Currency:  item.Currency,
+		})
+	}
+	return order
+}
+
+// summary returns a readable text version of the order, one line per item
+func (o *orderMetadata) summary() string {
+	lines := make([]string, 0, len(o.Items)+1)
+	if o.Text != "" {
+		lines = append(lines, o.Text)
+	}
+	for _, item := range o.Items {
+		line := fmt.Sprintf("%d x %s", item.Quantity, item.ProductID)
+		if item.ItemPrice != 0 {
+			line += fmt.Sprintf(" (%.2f %s)", item.ItemPrice, item.Currency)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
 }
 
 var statusMapping = map[string]courier.MsgStatusValue{
-	"REJECTED":      courier.MsgFailed,
-	"NOT_DELIVERED": courier.MsgFailed,
-	"SENT":          courier.MsgSent,
-	"DELIVERED":     courier.MsgDelivered,
-	"READ":          courier.MsgDelivered,
+	"REJECTED":        courier.MsgFailed,
+	"NOT_DELIVERED":   courier.MsgFailed,
+	"SENT":            courier.MsgSent,
+	"DELIVERED":       courier.MsgDelivered,
+	"READ":            courier.MsgDelivered,
+	"SENT_TO_CARRIER": courier.MsgSent,
+	"QUEUED":          courier.MsgWired,
+	"ACCEPTED":        courier.MsgWired,
+}
+
+// statusProgress orders statuses by how far along a message is, so that the status of a message sent in parts is that
+// of its least advanced part
+var statusProgress = map[courier.MsgStatusValue]int{
+	courier.MsgErrored:   0,
+	courier.MsgWired:     1,
+	courier.MsgSent:      2,
+	courier.MsgDelivered: 3,
 }
 
+// how long we keep the statuses of the parts of a message sent in parts
+const aggregateExpiration = 24 * 60 * 60
+
+// how long we keep the latest status of a message for ordering status updates
+const latestStatusExpiration = 24 * 60 * 60
+
+// latestStatusScript records the progress and timestamp in milliseconds of a status update if it isn't older and less
+// advanced than the latest one we have, returning whether it was recorded
+var latestStatusScript = redis.NewScript(1, `
+local key, progress, ts = KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2])
+local last = redis.call("HMGET", key, "progress", "ts")
+if last[1] and last[2] then
+	if ts < tonumber(last[2]) and progress < tonumber(last[1]) then
+		return 0
+	end
+	ts = math.max(ts, tonumber(last[2]))
+end
+redis.call("HMSET", key, "progress", progress, "ts", ts)
+redis.call("EXPIRE", key, ARGV[3])
+return 1
+`)
+
 type statusPayload struct {
 	ID            string `json:"id"`
 	Type          string `json:"type"       validate:"required" `
 	MessageID     string `json:"messageId"`
+	AggregateID   string `json:"aggregateId"`
 	MessageStatus struct {
 		Timestamp string `json:"timestamp"`
 		Code      string `json:"code"`
@@ -158,6 +360,8 @@ type statusPayload struct {
 
 // receiveStatus is our HTTP handler function for status updates
 func (h *handler) receiveStatus(ctx context.Context, channel courier.Channel, w http.ResponseWriter, r *http.Request) ([]courier.Event, error) {
+	rw := h.responder(channel)
+
 	// get our params
 	payload := &statusPayload{}
 	err := handlers.DecodeAndValidateJSON(payload, r)
@@ -174,10 +378,141 @@ func (h *handler) receiveStatus(ctx context.Context, channel courier.Channel, w
 		msgStatus = courier.MsgErrored
 	}
 
-	// write our status
-	status := h.Backend().NewMsgStatusForExternalID(channel, payload.MessageID, msgStatus)
-	return handlers.WriteMsgStatusAndResponse(ctx, h, channel, status, w, r)
+	// long messages sent in parts get a status for each part, which share the aggregate id that is the id of our message
+	externalID := payload.MessageID
+	if payload.AggregateID != "" && payload.AggregateID != payload.MessageID {
+		externalID = payload.AggregateID
+		msgStatus, err = h.aggregateStatus(channel, payload.AggregateID, payload.MessageID, msgStatus)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// status updates can arrive out of order, so ignore those which would take the message back to an earlier status
+	if timestamp, err := time.Parse(time.RFC3339, payload.MessageStatus.Timestamp); err == nil && msgStatus != courier.MsgFailed {
+		isLatest, err := h.recordLatestStatus(channel, externalID, msgStatus, timestamp)
+		if err != nil {
+			return nil, err
+		}
+		if !isLatest {
+			return nil, handlers.WriteAndLogRequestIgnored(ctx, rw, channel, w, r, "ignoring status update older than the latest one")
+		}
+	}
+
+	// write our status, keeping the raw Zenvia code as it's more granular than our own statuses
+	status := h.Backend().NewMsgStatusForExternalID(channel, externalID, msgStatus)
+	status.SetExtra("provider_status", payload.MessageStatus.Code)
+	return handlers.WriteMsgStatusAndResponse(ctx, rw, channel, status, w, r)
+
+}
+
+// responder returns what we answer the webhooks of the passed in channel with, which is our standard responses unless
+// the channel is configured to acknowledge them with a particular body
+func (h *handler) responder(channel courier.Channel) handlers.ResponseWriter {
+	body, configured := channel.ConfigForKey(configAckResponse, nil).(string)
+	if !configured {
+		return h
+	}
+	return &ackResponder{handler: h, body: body}
+}
+
+// ackResponder acknowledges accepted and ignored webhooks with a 200 and a fixed body, as some Zenvia deployments keep
+// retrying deliveries whose responses don't look as they expect. Errors still get our standard responses.
+type ackResponder struct {
+	*handler
+	body string
+}
+
+func (a *ackResponder) WriteMsgSuccessResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, msgs []courier.Msg) error {
+	return a.writeAck(w)
+}
+
+func (a *ackResponder) WriteStatusSuccessResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, statuses []courier.MsgStatus) error {
+	return a.writeAck(w)
+}
+
+func (a *ackResponder) WriteRequestIgnored(ctx context.Context, w http.ResponseWriter, r *http.Request, details string) error {
+	return a.writeAck(w)
+}
+
+func (a *ackResponder) writeAck(w http.ResponseWriter) error {
+	if a.body != "" {
+		contentType := "text/plain; charset=utf-8"
+		if json.Valid([]byte(a.body)) {
+			contentType = "application/json"
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write([]byte(a.body))
+	return err
+}
+
+// aggregateStatus records the status of a part of a message sent in parts, returning the status of the whole message,
+// which has failed if any part has failed and is otherwise that of its least advanced part. That way we only consider
+// the message delivered once all its parts are, which for messages we know the number of parts of includes those yet
+// to report a status.
+func (h *handler) aggregateStatus(channel courier.Channel, aggregateID string, partID string, partStatus courier.MsgStatusValue) (courier.MsgStatusValue, error) {
+	rc := h.Backend().RedisPool().Get()
+	defer rc.Close()
+
+	mapKey := fmt.Sprintf("zenvia-aggregate:%s:%s", channel.UUID().String(), aggregateID)
+	rc.Send("MULTI")
+	rc.Send("HSET", mapKey, partID, string(partStatus))
+	rc.Send("EXPIRE", mapKey, aggregateExpiration)
+	rc.Send("HVALS", mapKey)
+	rc.Send("GET", partsKey(channel, aggregateID))
+	replies, err := redis.Values(rc.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+	parts, err := redis.Strings(replies[2], nil)
+	if err != nil {
+		return "", err
+	}
+
+	combined := partStatus
+	for _, part := range parts {
+		value := courier.MsgStatusValue(part)
+		if value == courier.MsgFailed {
+			return courier.MsgFailed, nil
+		}
+		if statusProgress[value] < statusProgress[combined] {
+			combined = value
+		}
+	}
+
+	// parts which haven't reported yet are at most sent
+	if numParts, _ := redis.Int(replies[3], nil); len(parts) < numParts && statusProgress[combined] > statusProgress[courier.MsgSent] {
+		combined = courier.MsgSent
+	}
+	return combined, nil
+}
 
+// partsKey is the key we record the number of parts of a message sent in parts under
+func partsKey(channel courier.Channel, aggregateID string) string {
+	return fmt.Sprintf("zenvia-parts:%s:%s", channel.UUID().String(), aggregateID)
+}
+
+// recordParts records the number of parts the message with the passed in aggregate id was sent in, so that we know
+// how many part statuses to expect
+func (h *handler) recordParts(channel courier.Channel, aggregateID string, numParts int) error {
+	rc := h.Backend().RedisPool().Get()
+	defer rc.Close()
+
+	_, err := rc.Do("SET", partsKey(channel, aggregateID), numParts, "EX", aggregateExpiration)
+	return err
+}
+
+// recordLatestStatus records the passed in status of the message with the passed in external id as its latest, unless
+// we already have a less advanced status which is newer, returning whether it was recorded
+func (h *handler) recordLatestStatus(channel courier.Channel, externalID string, msgStatus courier.MsgStatusValue, timestamp time.Time) (bool, error) {
+	rc := h.Backend().RedisPool().Get()
+	defer rc.Close()
+
+	key := fmt.Sprintf("zenvia-status:%s:%s", channel.UUID().String(), externalID)
+	millis := timestamp.UnixNano() / int64(time.Millisecond)
+	return redis.Bool(latestStatusScript.Do(rc, key, statusProgress[msgStatus], millis, latestStatusExpiration))
 }
 
 //
@@ -185,9 +520,60 @@ type mtContent struct {
 	Type         string `json:"type"`
 	Text         string `json:"text,omitempty"`
 	FileURL      string `json:"fileUrl,omitempty"`
+	FileID       string `json:"fileId,omitempty"`
 	FileMimeType string `json:"fileMimeType,omitempty"`
 	FileCaption  string `json:"fileCaption,omitempty"`
 	FileName     string `json:"fileName,omitempty"`
+
+	TemplateID string            `json:"templateId,omitempty"`
+	Category   string            `json:"category,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	Buttons    []mtButton        `json:"buttons,omitempty"`
+
+	MessageID string  `json:"messageId,omitempty"`
+	Emoji     *string `json:"emoji,omitempty"`
+
+	Contacts []mtContact `json:"contacts,omitempty"`
+
+	Body   string `json:"body,omitempty"`
+	Footer string `json:"footer,omitempty"`
+}
+
+type mtContact struct {
+	Name   mtContactName    `json:"name"`
+	Phones []mtContactPhone `json:"phones"`
+	Emails []mtContactEmail `json:"emails,omitempty"`
+	Org    *mtContactOrg    `json:"org,omitempty"`
+}
+
+type mtContactName struct {
+	FormattedName string `json:"formattedName"`
+	FirstName     string `json:"firstName,omitempty"`
+	LastName      string `json:"lastName,omitempty"`
+}
+
+type mtContactPhone struct {
+	Phone string `json:"phone"`
+	Type  string `json:"type,omitempty"`
+}
+
+type mtContactEmail struct {
+	Email string `json:"email"`
+	Type  string `json:"type,omitempty"`
+}
+
+type mtContactOrg struct {
+	Company string `json:"company"`
+	Title   string `json:"title,omitempty"`
+}
+
+type mtButton struct {
+	Type    string `json:"type,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	URL     string `json:"url,omitempty"`
 }
 
 type mtPayload struct {
@@ -196,42 +582,126 @@ type mtPayload struct {
 	Contents []mtContent `json:"contents"`
 }
 
-// SendMsg sends the passed in message, returning any error
+// numbers we send to can be in international format, with or without the leading +, or national format
+var numberRegex = regexp.MustCompile(`^\+?[0-9]{3,15}$`)
+
+// ValidateURN checks that the passed in URN is a number we can send to, which for WhatsApp can also be a WhatsApp URN
+func (h *handler) ValidateURN(urn urns.URN) error {
+	if urn.Scheme() != urns.TelScheme && (urn.Scheme() != urns.WhatsAppScheme || h.ChannelType() != "ZVW") {
+		return errors.Errorf("unsupported URN scheme for %s: %s", h.ChannelName(), urn.Scheme())
+	}
+	if !numberRegex.MatchString(urn.Path()) {
+		return errors.Errorf("invalid number: %s", urn.Path())
+	}
+	return nil
+}
+
+// SendMsg sends the passed in message, returning any error, once our middleware has checked the channel has a token
 func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStatus, error) {
 	channel := msg.Channel()
-
 	token := channel.StringConfigForKey(courier.ConfigAPIKey, "")
-	if token == "" {
-		return nil, fmt.Errorf("no token set for ZVW channel")
+
+	// whatsapp URNs are international numbers without the leading +
+	number := msg.URN().Path()
+	if msg.URN().Scheme() == urns.WhatsAppScheme && !strings.HasPrefix(number, "+") {
+		number = "+" + number
+	}
+	to, err := utils.NormalizeE164(number, channel.Country())
+	if err != nil {
+		return nil, courier.NewPermanentSendError(courier.DeadLetterInvalidDestination, errors.Wrapf(err, "invalid destination for message"))
 	}
 
+	from, err := fromNumber(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Zenvia expects E.164 numbers without the leading +
 	payload := mtPayload{
-		From: strings.TrimLeft(channel.Address(), "+"),
-		To:   strings.TrimLeft(msg.URN().Path(), "+"),
+		From: from,
+		To:   strings.TrimPrefix(to, "+"),
 	}
 
 	status := h.Backend().NewMsgStatusForID(channel, msg.ID(), courier.MsgErrored)
 
 	text := ""
 	if channel.ChannelType() == "ZVW" {
-		for _, attachment := range msg.Attachments() {
-			attType, attURL := handlers.SplitAttachment(attachment)
-			payload.Contents = append(payload.Contents, mtContent{
-				Type:         "file",
-				FileURL:      attURL,
-				FileMimeType: attType,
-			})
+		templating, err := getTemplating(msg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decode template: %s for channel: %s", string(msg.Metadata()), channel.UUID())
+		}
+
+		reaction, err := getReaction(msg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid reaction for channel: %s", channel.UUID())
+		}
+
+		contacts, err := getContacts(msg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid contacts for channel: %s", channel.UUID())
+		}
+
+		interactive, err := getInteractive(msg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid interactive message for channel: %s", channel.UUID())
+		}
 
+		if reaction != nil {
+			// reactions are sent on their own, in place of any text or attachments
+			payload.Contents = append(payload.Contents, reactionContent(reaction))
+		} else {
+			for _, attachment := range msg.Attachments() {
+				attType, attURL := handlers.SplitAttachment(attachment)
+				content := mtContent{Type: "file", FileURL: attURL, FileMimeType: attType}
+
+				// Zenvia can't fetch media which isn't public so we upload it ourselves, as channels can ask us to for all media
+				if channel.BoolConfigForKey(configUploadMedia, false) || !isPublicURL(attURL) {
+					fileID, err := h.uploadMedia(ctx, msg, status, token, attType, attURL)
+					if err != nil {
+						return status, nil
+					}
+					content.FileURL, content.FileID = "", fileID
+				}
+
+				payload.Contents = append(payload.Contents, content)
+			}
+
+			// contact cards are sent after any attachments
+			if len(contacts) > 0 {
+				payload.Contents = append(payload.Contents, contactsContent(contacts))
+			}
+
+			// templates are sent in place of our text, as is interactive content for messages which ask to be sent as it
+			if templating != nil {
+				payload.Contents = append(payload.Contents, templateContent(templating))
+			} else {
+				buttons, isInteractive, err := buttonContent(msg, interactive)
+				if err != nil {
+					return nil, errors.Wrapf(err, "invalid interactive message for channel: %s", channel.UUID())
+				}
+				if isInteractive {
+					payload.Contents = append(payload.Contents, buttons)
+				} else {
+					text = msg.Text()
+				}
+			}
 		}
-		text = msg.Text()
 
 	} else if channel.ChannelType() == "ZVS" {
 		text = handlers.GetTextAndAttachments(msg)
+
+		// SMS are billed per segment so shorten any links if the channel has a shortener, sending them as they are if we can't
+		if shortener := h.linkShortener(channel); shortener != nil {
+			text, err = handlers.ShortenLinks(ctx, shortener, text)
+			if err != nil {
+				logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Warn("unable to shorten links in message")
+			}
+		}
 	}
 
 	msgParts := make([]string, 0)
 	if text != "" {
-		msgParts = handlers.SplitMsgByChannel(channel, text, maxMsgLength)
+		msgParts = handlers.SplitMsgByChannelAtBoundaries(channel, text, maxMsgLength)
 	}
 
 	for _, msgPart := range msgParts {
@@ -246,25 +716,29 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		return status, err
 	}
 
-	sendURL := whatsappSendURL
+	sendURL := h.whatsappSendURL
 	if channel.ChannelType() == "ZVS" {
-		sendURL = smsSendURL
+		sendURL = h.smsSendURL
 	}
 
-	req, err := http.NewRequest(http.MethodPost, sendURL, bytes.NewReader(jsonBody))
-
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("X-API-TOKEN", token)
+	var rr *utils.RequestResponse
+	var log *courier.ChannelLog
+	err = handlers.SendWithRetries(ctx, channel, status, h.RetryBackoff(), func() (*courier.ChannelLog, bool, error) {
+		req, cancel, err := handlers.NewRequestWithTimeout(ctx, channel, "send", sendTimeout, http.MethodPost, sendURL, bytes.NewReader(jsonBody))
+		if err != nil {
+			return nil, false, err
+		}
+		defer cancel()
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-API-TOKEN", token)
 
-	rr, err := utils.MakeHTTPRequest(req)
+		rr, err = utils.MakeHTTPRequest(req)
 
-	// record our status and log
-	log := courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
-	status.AddLog(log)
+		// record our log
+		log = courier.NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
+		return log, handlers.IsRetryableResponse(rr), err
+	})
 	if err != nil {
 		return status, nil
 	}
@@ -275,8 +749,457 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		return status, nil
 	}
 
-	status.SetExternalID(externalID)
+	// Zenvia also tells us when it accepted the message
+	var sentOn time.Time
+	if timestamp, _ := jsonparser.GetString(rr.Body, "timestamp"); timestamp != "" {
+		sentOn, _ = time.Parse(time.RFC3339, timestamp)
+	}
+
+	handlers.SetSendResult(status, externalID, sentOn)
+
+	// each content is a part that gets its own statuses, so we need to know how many there are to aggregate them
+	if len(payload.Contents) > 1 {
+		if err := h.recordParts(channel, externalID, len(payload.Contents)); err != nil {
+			logrus.WithError(err).WithField("channel_uuid", channel.UUID()).Warn("unable to record parts of message")
+		}
+	}
+
+	// SMS are billed per segment, each part being sent as its own concatenated SMS
+	if channel.ChannelType() == "ZVS" {
+		segments := 0
+		for _, msgPart := range msgParts {
+			segments += gsm7.Segments(msgPart)
+		}
+		status.SetExtra(courier.MsgStatusExtraUnits, segments)
+	}
+
 	// this was wired successfully
 	status.SetStatus(courier.MsgWired)
 	return status, nil
 }
+
+// isPublicURL returns whether the passed in URL is one Zenvia can fetch, i.e. isn't on a local or private network
+func isPublicURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified())
+	}
+	return host != "localhost" && strings.Contains(host, ".") && !strings.HasSuffix(host, ".local") && !strings.HasSuffix(host, ".internal")
+}
+
+// uploadMedia downloads the media at the passed in URL and uploads it to Zenvia, returning the id of the uploaded file
+// to send in its place. The logs of both requests are added to the passed in status.
+func (h *handler) uploadMedia(ctx context.Context, msg courier.Msg, status courier.MsgStatus, token string, mimeType string, mediaURL string) (string, error) {
+	media, log, err := handlers.DownloadWithLimit(ctx, msg.Channel(), msg.ID(), mediaURL, nil, maxUploadSize, downloadTimeout)
+	status.AddLog(log)
+	if err != nil {
+		return "", err
+	}
+
+	fileName := path.Base(strings.SplitN(mediaURL, "?", 2)[0])
+
+	req, err := utils.BuildMultipartRequest(h.mediaUploadURL, map[string]string{"fileMimeType": mimeType}, bytes.NewReader(media), "file", fileName, "")
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, handlers.RequestTimeout(msg.Channel(), "upload", uploadTimeout))
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-API-TOKEN", token)
+
+	rr, err := utils.MakeHTTPRequest(req)
+	log = courier.NewChannelLogFromRR("Media Uploaded", msg.Channel(), msg.ID(), rr).WithError("Media Upload Error", err)
+	status.AddLog(log)
+	if err != nil {
+		return "", err
+	}
+
+	fileID, err := jsonparser.GetString(rr.Body, "id")
+	if err != nil {
+		err = errors.Errorf("unable to get id from media upload response")
+		log.WithError("Media Upload Error", err)
+		return "", err
+	}
+	return fileID, nil
+}
+
+// fromNumber returns the number to send the passed in message from, which defaults to the channel address but for
+// WhatsApp accounts with multiple numbers can be overridden in the message metadata with one of the channel's numbers
+func fromNumber(msg courier.Msg) (string, error) {
+	channel := msg.Channel()
+	from := strings.TrimLeft(channel.Address(), "+")
+
+	override, _ := jsonparser.GetString(msg.Metadata(), "from")
+	override = strings.TrimLeft(strings.TrimSpace(override), "+")
+	if override == "" || override == from || channel.ChannelType() != "ZVW" {
+		return from, nil
+	}
+
+	for _, number := range handlers.StringListConfigForKey(channel, configFromNumbers) {
+		if strings.TrimLeft(number, "+") == override {
+			return override, nil
+		}
+	}
+	return "", errors.Errorf("from number %s is not one of the numbers of channel: %s", override, channel.UUID())
+}
+
+// NotifyProcessing marks the passed in incoming message as read and shows the contact a typing indicator while we
+// process it, which is only supported for WhatsApp
+func (h *handler) NotifyProcessing(ctx context.Context, msg courier.Msg) ([]*courier.ChannelLog, error) {
+	channel := msg.Channel()
+	if channel.ChannelType() != "ZVW" || msg.ExternalID() == "" {
+		logrus.WithField("channel_uuid", channel.UUID()).Debug("read receipts and typing indicators not supported, ignoring")
+		return nil, nil
+	}
+
+	token := channel.StringConfigForKey(courier.ConfigAPIKey, "")
+	if token == "" {
+		return nil, fmt.Errorf("no token set for ZVW channel")
+	}
+
+	logs := make([]*courier.ChannelLog, 0, 2)
+
+	readURL := fmt.Sprintf("%s/%s/read", h.whatsappSendURL, msg.ExternalID())
+	log, supported, err := h.notify(ctx, msg, token, "Read Receipt", readURL, nil)
+	logs = append(logs, log)
+	if err != nil || !supported {
+		return logs, err
+	}
+
+	typingBody, err := json.Marshal(map[string]string{
+		"from": strings.TrimLeft(channel.Address(), "+"),
+		"to":   strings.TrimLeft(msg.URN().Path(), "+"),
+	})
+	if err != nil {
+		return logs, err
+	}
+
+	log, _, err = h.notify(ctx, msg, token, "Typing Indicator", h.whatsappSendURL+"/typing", typingBody)
+	logs = append(logs, log)
+	return logs, err
+}
+
+// notify makes a read receipt or typing indicator request, returning whether the account supports it
+func (h *handler) notify(ctx context.Context, msg courier.Msg, token string, description string, url string, body []byte) (*courier.ChannelLog, bool, error) {
+	req, cancel, err := handlers.NewRequestWithTimeout(ctx, msg.Channel(), "notify", sendTimeout, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	defer cancel()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-API-TOKEN", token)
+
+	rr, err := utils.MakeHTTPRequest(req)
+	log := courier.NewChannelLogFromRR(description, msg.Channel(), msg.ID(), rr)
+
+	// accounts without support for these respond as if the endpoint doesn't exist, which isn't an error for us
+	if rr.StatusCode == http.StatusNotFound || rr.StatusCode == http.StatusMethodNotAllowed || rr.StatusCode == http.StatusNotImplemented {
+		logrus.WithField("channel_uuid", msg.Channel().UUID()).WithField("status_code", rr.StatusCode).Debug("read receipts and typing indicators not supported, ignoring")
+		return log, false, nil
+	}
+
+	log.WithError(description+" Error", err)
+	return log, true, err
+}
+
+// msgReaction is a reaction to send to a previous message, which is removed rather than set if remove is true
+type msgReaction struct {
+	MessageID string `json:"message_id" validate:"required"`
+	Emoji     string `json:"emoji"`
+	Remove    bool   `json:"remove"`
+}
+
+// getReaction returns the reaction the passed in message should be sent as, if any
+func getReaction(msg courier.Msg) (*msgReaction, error) {
+	if len(msg.Metadata()) == 0 {
+		return nil, nil
+	}
+
+	metadata := &struct {
+		Reaction *msgReaction `json:"reaction"`
+	}{}
+	if err := json.Unmarshal(msg.Metadata(), metadata); err != nil {
+		return nil, err
+	}
+
+	reaction := metadata.Reaction
+	if reaction == nil {
+		return nil, nil
+	}
+	if err := handlers.Validate(reaction); err != nil {
+		return nil, err
+	}
+	if !reaction.Remove && reaction.Emoji == "" {
+		return nil, errors.New("reactions require an emoji unless they are being removed")
+	}
+	return reaction, nil
+}
+
+// reactionContent returns the content to send for the passed in reaction, removing a reaction being done by reacting
+// to the same message with an empty emoji
+func reactionContent(reaction *msgReaction) mtContent {
+	emoji := reaction.Emoji
+	if reaction.Remove {
+		emoji = ""
+	}
+	return mtContent{Type: "reaction", MessageID: reaction.MessageID, Emoji: &emoji}
+}
+
+// msgContact is a contact card to send, which needs a name and at least one phone number
+type msgContact struct {
+	Name      string            `json:"name" validate:"required"`
+	FirstName string            `json:"first_name"`
+	LastName  string            `json:"last_name"`
+	Phones    []msgContactPhone `json:"phones" validate:"required,min=1,dive"`
+	Email     string            `json:"email" validate:"omitempty,email"`
+	Org       string            `json:"org"`
+	Title     string            `json:"title"`
+}
+
+// msgContactPhone is a phone number of a contact card, whose type is something like CELL, WORK or HOME
+type msgContactPhone struct {
+	Phone string `json:"phone" validate:"required"`
+	Type  string `json:"type"`
+}
+
+// getContacts returns the contact cards the passed in message should be sent with, if any
+func getContacts(msg courier.Msg) ([]*msgContact, error) {
+	if len(msg.Metadata()) == 0 {
+		return nil, nil
+	}
+
+	metadata := &struct {
+		Contacts []*msgContact `json:"contacts"`
+	}{}
+	if err := json.Unmarshal(msg.Metadata(), metadata); err != nil {
+		return nil, err
+	}
+
+	for _, contact := range metadata.Contacts {
+		if err := handlers.Validate(contact); err != nil {
+			return nil, err
+		}
+	}
+	return metadata.Contacts, nil
+}
+
+// contactsContent returns the content to send for the passed in contact cards
+func contactsContent(contacts []*msgContact) mtContent {
+	content := mtContent{Type: "contacts"}
+
+	for _, contact := range contacts {
+		card := mtContact{Name: mtContactName{FormattedName: contact.Name, FirstName: contact.FirstName, LastName: contact.LastName}}
+		for _, phone := range contact.Phones {
+			card.Phones = append(card.Phones, mtContactPhone{Phone: phone.Phone, Type: strings.ToUpper(phone.Type)})
+		}
+		if contact.Email != "" {
+			card.Emails = []mtContactEmail{{Email: contact.Email}}
+		}
+		if contact.Org != "" {
+			card.Org = &mtContactOrg{Company: contact.Org, Title: contact.Title}
+		}
+		content.Contacts = append(content.Contacts, card)
+	}
+	return content
+}
+
+// WhatsApp limits how many reply buttons an interactive message can have and the length of its parts
+const (
+	maxReplyButtons     = 3
+	maxReplyButtonTitle = 20
+	maxInteractiveBody  = 1024
+	maxFooterLength     = 60
+)
+
+// messages are sent as interactive content if their metadata asks for it, optionally with a footer
+type msgInteractive struct {
+	Interactive bool   `json:"interactive"`
+	Footer      string `json:"footer"`
+}
+
+// getInteractive returns how the passed in message should be sent as interactive content, which is nil if its
+// metadata doesn't ask for it to be
+func getInteractive(msg courier.Msg) (*msgInteractive, error) {
+	if len(msg.Metadata()) == 0 {
+		return nil, nil
+	}
+
+	interactive := &msgInteractive{}
+	if err := json.Unmarshal(msg.Metadata(), interactive); err != nil {
+		return nil, err
+	}
+	if !interactive.Interactive {
+		return nil, nil
+	}
+
+	if utf8.RuneCountInString(interactive.Footer) > maxFooterLength {
+		return nil, errors.Errorf("footers can be at most %d characters, got: %d", maxFooterLength, utf8.RuneCountInString(interactive.Footer))
+	}
+	return interactive, nil
+}
+
+// buttonContent returns the interactive content to send the text and quick replies of the passed in message as, and
+// whether it can be sent as one, which it can't if it isn't asked to be, without quick replies, with more than WhatsApp
+// allows, or if its text is too long for the body of an interactive message. Quick replies too long to be button titles
+// are an error.
+func buttonContent(msg courier.Msg, interactive *msgInteractive) (mtContent, bool, error) {
+	quickReplies := msg.QuickReplies()
+	if interactive == nil || len(quickReplies) == 0 || len(quickReplies) > maxReplyButtons {
+		return mtContent{}, false, nil
+	}
+	if msg.Text() == "" || utf8.RuneCountInString(msg.Text()) > maxInteractiveBody {
+		return mtContent{}, false, nil
+	}
+
+	content := mtContent{Type: "button", Body: msg.Text(), Footer: interactive.Footer}
+	for i, quickReply := range quickReplies {
+		if utf8.RuneCountInString(quickReply) > maxReplyButtonTitle {
+			return mtContent{}, false, errors.Errorf("button titles can be at most %d characters, got: %s", maxReplyButtonTitle, quickReply)
+		}
+		content.Buttons = append(content.Buttons, mtButton{ID: strconv.Itoa(i), Title: quickReply})
+	}
+	return content, true, nil
+}
+
+// templates are referenced by their Zenvia id, which we receive as the template name
+type msgTemplating struct {
+	Template struct {
+		Name string `json:"name" validate:"required"`
+		UUID string `json:"uuid" validate:"required"`
+	} `json:"template" validate:"required,dive"`
+	Category  string                `json:"category"`
+	Variables []string              `json:"variables"`
+	Buttons   []msgTemplatingButton `json:"buttons" validate:"dive"`
+}
+
+// msgTemplatingButton is a button of a template, whose parameter is the payload of a quick reply or the dynamic
+// suffix of a URL button
+type msgTemplatingButton struct {
+	Type      string `json:"type" validate:"required"`
+	Parameter string `json:"parameter"`
+}
+
+// WhatsApp limits how many buttons a template can have in total and how many of those can be URL buttons
+const (
+	maxTemplateButtons    = 10
+	maxTemplateURLButtons = 2
+)
+
+// the categories WhatsApp prices template conversations by, which we pass on so sends are billed as the right one
+var templateCategories = map[string]bool{
+	"marketing":      true,
+	"utility":        true,
+	"authentication": true,
+}
+
+// authentication codes are limited by WhatsApp to 15 alphanumeric characters
+var otpCodeRegex = regexp.MustCompile(`^[a-zA-Z0-9]{1,15}$`)
+
+// getTemplating returns the template the passed in message should be sent with, if any, which is the case for
+// authentication templates and templates with buttons
+func getTemplating(msg courier.Msg) (*msgTemplating, error) {
+	if len(msg.Metadata()) == 0 {
+		return nil, nil
+	}
+
+	metadata := &struct {
+		Templating *msgTemplating `json:"templating"`
+	}{}
+	if err := json.Unmarshal(msg.Metadata(), metadata); err != nil {
+		return nil, err
+	}
+
+	templating := metadata.Templating
+	if templating == nil {
+		return nil, nil
+	}
+
+	if templating.Category != "" && !templateCategories[strings.ToLower(templating.Category)] {
+		return nil, errors.Errorf("unsupported template category: %s", templating.Category)
+	}
+
+	isAuthentication := strings.EqualFold(templating.Category, "authentication")
+	if !isAuthentication && len(templating.Buttons) == 0 {
+		return nil, nil
+	}
+
+	if err := handlers.Validate(templating); err != nil {
+		return nil, errors.Wrapf(err, "invalid templating definition")
+	}
+
+	if isAuthentication {
+		if len(templating.Variables) != 1 {
+			return nil, errors.New("authentication templates require exactly one variable for the code")
+		}
+		if !otpCodeRegex.MatchString(templating.Variables[0]) {
+			return nil, errors.Errorf("invalid authentication code: %s", templating.Variables[0])
+		}
+		return templating, nil
+	}
+
+	if len(templating.Buttons) > maxTemplateButtons {
+		return nil, errors.Errorf("templates can have at most %d buttons, got: %d", maxTemplateButtons, len(templating.Buttons))
+	}
+	urlButtons := 0
+	for _, button := range templating.Buttons {
+		switch button.Type {
+		case "quick_reply":
+		case "url":
+			urlButtons++
+		default:
+			return nil, errors.Errorf("unsupported template button type: %s", button.Type)
+		}
+	}
+	if urlButtons > maxTemplateURLButtons {
+		return nil, errors.Errorf("templates can have at most %d URL buttons, got: %d", maxTemplateURLButtons, urlButtons)
+	}
+
+	return templating, nil
+}
+
+// templateContent returns the content to send for the passed in template, with its category if it has one.
+// Authentication templates have their code copyable by a button, while other templates have their variables as
+// numbered fields and their buttons in order.
+func templateContent(templating *msgTemplating) mtContent {
+	content := mtContent{Type: "template", TemplateID: templating.Template.Name, Category: strings.ToUpper(templating.Category)}
+
+	if strings.EqualFold(templating.Category, "authentication") {
+		code := templating.Variables[0]
+		content.Fields = map[string]string{"code": code}
+		content.Buttons = []mtButton{{Type: "COPY_CODE", Code: code}}
+		return content
+	}
+
+	if len(templating.Variables) > 0 {
+		content.Fields = make(map[string]string, len(templating.Variables))
+		for i, v := range templating.Variables {
+			content.Fields[strconv.Itoa(i+1)] = v
+		}
+	}
+
+	for _, button := range templating.Buttons {
+		if button.Type == "url" {
+			content.Buttons = append(content.Buttons, mtButton{Type: "URL", URL: button.Parameter})
+		} else {
+			content.Buttons = append(content.Buttons, mtButton{Type: "QUICK_REPLY", Payload: button.Parameter})
+		}
+	}
+	return content
+}
+
+// SelfTestMsg builds a minimal message to the URN configured as the channel's self test destination
+func (h *handler) SelfTestMsg(channel courier.Channel) (courier.Msg, error) {
+	urn, err := urns.Parse(channel.StringConfigForKey(courier.ConfigSelfTestURN, ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid self test URN")
+	}
+
+	return h.Backend().NewOutgoingMsg(channel, courier.NilMsgID, urn, selfTestText, false, nil, "", 0, ""), nil
+}
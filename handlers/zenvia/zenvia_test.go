@@ -1,12 +1,23 @@
 package zenvia
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/nyaruka/courier"
 	. "github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/courier/utils"
+	"github.com/nyaruka/gocommon/urns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var testWhatsappChannels = []courier.Channel{
@@ -41,6 +52,28 @@ var validStatus = `{
 	}
 }`
 
+var sentToCarrierStatus = `{
+	"id": "string",
+	"type": "MESSAGE_STATUS",
+	"channel": "string",
+	"messageId": "hs765939216",
+	"messageStatus": {
+	  "timestamp": "2021-03-12T12:15:31Z",
+	  "code": "SENT_TO_CARRIER"
+	}
+}`
+
+var queuedStatus = `{
+	"id": "string",
+	"type": "MESSAGE_STATUS",
+	"channel": "string",
+	"messageId": "hs765939216",
+	"messageStatus": {
+	  "timestamp": "2021-03-12T12:15:31Z",
+	  "code": "QUEUED"
+	}
+}`
+
 var unknownStatus = `{
 	"id": "string",
 	"type": "MESSAGE_STATUS",
@@ -85,6 +118,97 @@ var validReceive = `{
 	}
 }`
 
+var buttonReceive = `{
+	"id": "string",
+	"timestamp": "2017-05-03T03:04:45Z",
+	"type": "MESSAGE",
+	"message": {
+	  "id": "string",
+	  "from": "254791541111",
+	  "to": "2020",
+	  "direction": "IN",
+	  "contents": [
+		{
+		  "type": "button",
+		  "text": "Track my order",
+		  "payload": "track",
+		  "index": 0
+		}
+	  ],
+	  "visitor": {
+		"name": "Bob"
+	  }
+	}
+}`
+
+var forwardedReceive = `{
+	"id": "string",
+	"timestamp": "2017-05-03T03:04:45Z",
+	"type": "MESSAGE",
+	"message": {
+	  "id": "string",
+	  "from": "254791541111",
+	  "to": "2020",
+	  "direction": "IN",
+	  "forwarded": true,
+	  "ephemeral": true,
+	  "contents": [
+		{
+		  "type": "text",
+		  "text": "Look at this"
+		}
+	  ],
+	  "visitor": {
+		"name": "Bob"
+	  }
+	}
+}`
+
+var forwardedButtonReceive = `{
+	"id": "string",
+	"timestamp": "2017-05-03T03:04:45Z",
+	"type": "MESSAGE",
+	"message": {
+	  "id": "string",
+	  "from": "254791541111",
+	  "to": "2020",
+	  "direction": "IN",
+	  "forwarded": true,
+	  "ephemeral": false,
+	  "contents": [
+		{
+		  "type": "button",
+		  "text": "Track my order",
+		  "payload": "track"
+		}
+	  ],
+	  "visitor": {
+		"name": "Bob"
+	  }
+	}
+}`
+
+var buttonNoLabelReceive = `{
+	"id": "string",
+	"timestamp": "2017-05-03T03:04:45Z",
+	"type": "MESSAGE",
+	"message": {
+	  "id": "string",
+	  "from": "254791541111",
+	  "to": "2020",
+	  "direction": "IN",
+	  "contents": [
+		{
+		  "type": "button",
+		  "payload": "help"
+		}
+	  ],
+	  "visitor": {
+		"name": "Bob"
+	  }
+	}
+}`
+
 var fileReceive = `{
 	"id": "string",
 	"timestamp": "2017-05-03T03:04:45Z",
@@ -128,6 +252,86 @@ var locationReceive = `{
 	}
 }`
 
+var orderReceive = `{
+	"id": "string",
+	"timestamp": "2017-05-03T03:04:45Z",
+	"type": "MESSAGE",
+	"message": {
+	  "id": "string",
+	  "from": "254791541111",
+	  "to": "2020",
+	  "direction": "IN",
+	  "contents": [
+		{
+		  "type": "order",
+		  "catalogId": "catalog-123",
+		  "text": "Please deliver today",
+		  "items": [
+			{
+			  "productRetailerId": "sku-1",
+			  "quantity": 2,
+			  "itemPrice": 10.5,
+			  "currency": "BRL"
+			},
+			{
+			  "productRetailerId": "sku-2",
+			  "quantity": 1,
+			  "itemPrice": 3,
+			  "currency": "BRL"
+			}
+		  ]
+		}
+	  ],
+	  "visitor": {
+		"name": "Bob"
+	  }
+	}
+}`
+
+var systemReceive = `{
+	"id": "string",
+	"timestamp": "2017-05-03T03:04:45Z",
+	"type": "MESSAGE",
+	"message": {
+	  "id": "string",
+	  "from": "254791541111",
+	  "to": "2020",
+	  "direction": "IN",
+	  "contents": [
+		{
+		  "type": "system",
+		  "systemType": "user_changed_number",
+		  "text": "Bob changed from 254791541111 to 254791542222"
+		}
+	  ],
+	  "visitor": {
+		"name": "Bob"
+	  }
+	}
+}`
+
+var productReceive = `{
+	"id": "string",
+	"timestamp": "2017-05-03T03:04:45Z",
+	"type": "MESSAGE",
+	"message": {
+	  "id": "string",
+	  "from": "254791541111",
+	  "to": "2020",
+	  "direction": "IN",
+	  "contents": [
+		{
+		  "type": "product",
+		  "catalogId": "catalog-123",
+		  "productRetailerId": "sku-1"
+		}
+	  ],
+	  "visitor": {
+		"name": "Bob"
+	  }
+	}
+}`
+
 var invalidURN = `{
   "id": "string",
   "timestamp": "2017-05-03T03:04:45Z",
@@ -204,13 +408,51 @@ var testWhatappCases = []ChannelHandleTestCase{
 	{Label: "Receive location Valid", URL: receiveWhatsappURL, Data: locationReceive, Status: 200, Response: "Message Accepted",
 		Text: Sp(""), Attachment: Sp("geo:0.000000,1.000000"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC))},
 
+	{Label: "Receive order Valid", URL: receiveWhatsappURL, Data: orderReceive, Status: 200, Response: "Message Accepted",
+		Text: Sp("Please deliver today\n2 x sku-1 (10.50 BRL)\n1 x sku-2 (3.00 BRL)"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"order": {"catalog_id": "catalog-123", "text": "Please deliver today", "items": [{"product_id": "sku-1", "quantity": 2, "item_price": 10.5, "currency": "BRL"}, {"product_id": "sku-2", "quantity": 1, "item_price": 3, "currency": "BRL"}]}}`)},
+
+	{Label: "Receive product Valid", URL: receiveWhatsappURL, Data: productReceive, Status: 200, Response: "Message Accepted",
+		Text: Sp("1 x sku-1"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"product": {"catalog_id": "catalog-123", "items": [{"product_id": "sku-1", "quantity": 1}]}}`)},
+
+	{Label: "Receive system notification", URL: receiveWhatsappURL, Data: systemReceive, Status: 200, Response: "Message Accepted",
+		Text: Sp("Bob changed from 254791541111 to 254791542222"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"system": {"type": "user_changed_number"}}`)},
+
+	{Label: "Receive system notification without text", URL: receiveWhatsappURL, Data: strings.Replace(strings.Replace(systemReceive, `"user_changed_number"`, `"group_participant_added"`, 1), `"Bob changed from 254791541111 to 254791542222"`, `""`, 1), Status: 200, Response: "Message Accepted",
+		Text: Sp("[system: group_participant_added]"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"system": {"type": "group_participant_added"}}`)},
+
+	{Label: "Receive unsupported content", URL: receiveWhatsappURL, Data: strings.Replace(validReceive, `"type": "text"`, `"type": "sticker"`, 1), Status: 200, Response: "Message Accepted",
+		Text: Sp("[unsupported: sticker]"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"unsupported_type": "sticker"}`)},
+
+	{Label: "Receive button reply Valid", URL: receiveWhatsappURL, Data: buttonReceive, Status: 200, Response: "Message Accepted",
+		Text: Sp("Track my order"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"button": {"payload": "track", "index": 0}}`)},
+
+	{Label: "Receive button reply without label", URL: receiveWhatsappURL, Data: buttonNoLabelReceive, Status: 200, Response: "Message Accepted",
+		Text: Sp("help"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"button": {"payload": "help"}}`)},
+
+	{Label: "Receive forwarded ephemeral message", URL: receiveWhatsappURL, Data: forwardedReceive, Status: 200, Response: "Message Accepted",
+		Text: Sp("Look at this"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"ephemeral": true, "forwarded": true}`)},
+
+	{Label: "Receive forwarded button reply", URL: receiveWhatsappURL, Data: forwardedButtonReceive, Status: 200, Response: "Message Accepted",
+		Text: Sp("Track my order"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 03, 04, 45, 0, time.UTC)),
+		Metadata: json.RawMessage(`{"button": {"payload": "track"}, "forwarded": true}`)},
+
 	{Label: "Not JSON body", URL: receiveWhatsappURL, Data: notJSON, Status: 400, Response: "unable to parse request JSON"},
 	{Label: "Wrong JSON schema", URL: receiveWhatsappURL, Data: wrongJSONSchema, Status: 400, Response: "request JSON doesn't match required schema"},
 	{Label: "Missing field", URL: receiveWhatsappURL, Data: missingFieldsReceive, Status: 400, Response: "validation for 'ID' failed on the 'required'"},
 	{Label: "Bad Date", URL: receiveWhatsappURL, Data: invalidDateReceive, Status: 400, Response: "invalid date format"},
 
-	{Label: "Valid Status", URL: statusWhatsppURL, Data: validStatus, Status: 200, Response: `Accepted`, MsgStatus: Sp("S")},
-	{Label: "Unkown Status", URL: statusWhatsppURL, Data: unknownStatus, Status: 200, Response: "Accepted", MsgStatus: Sp("E")},
+	{Label: "Valid Status", URL: statusWhatsppURL, Data: validStatus, Status: 200, Response: `Accepted`, MsgStatus: Sp("S"), MsgStatusExtra: map[string]interface{}{"provider_status": "SENT"}},
+	{Label: "Sent To Carrier Status", URL: statusWhatsppURL, Data: sentToCarrierStatus, Status: 200, Response: `Accepted`, MsgStatus: Sp("S"), MsgStatusExtra: map[string]interface{}{"provider_status": "SENT_TO_CARRIER"}},
+	{Label: "Queued Status", URL: statusWhatsppURL, Data: queuedStatus, Status: 200, Response: `Accepted`, MsgStatus: Sp("W"), MsgStatusExtra: map[string]interface{}{"provider_status": "QUEUED"}},
+	{Label: "Unkown Status", URL: statusWhatsppURL, Data: unknownStatus, Status: 200, Response: "Accepted", MsgStatus: Sp("E"), MsgStatusExtra: map[string]interface{}{"provider_status": "FOO"}},
 	{Label: "Not JSON body", URL: statusWhatsppURL, Data: notJSON, Status: 400, Response: "unable to parse request JSON"},
 	{Label: "Wrong JSON schema", URL: statusWhatsppURL, Data: wrongJSONSchema, Status: 400, Response: "request JSON doesn't match required schema"},
 }
@@ -230,8 +472,10 @@ var testSMSCases = []ChannelHandleTestCase{
 	{Label: "Missing field", URL: receiveSMSURL, Data: missingFieldsReceive, Status: 400, Response: "validation for 'ID' failed on the 'required'"},
 	{Label: "Bad Date", URL: receiveSMSURL, Data: invalidDateReceive, Status: 400, Response: "invalid date format"},
 
-	{Label: "Valid Status", URL: statusSMSURL, Data: validStatus, Status: 200, Response: `Accepted`, MsgStatus: Sp("S")},
-	{Label: "Unkown Status", URL: statusSMSURL, Data: unknownStatus, Status: 200, Response: "Accepted", MsgStatus: Sp("E")},
+	{Label: "Valid Status", URL: statusSMSURL, Data: validStatus, Status: 200, Response: `Accepted`, MsgStatus: Sp("S"), MsgStatusExtra: map[string]interface{}{"provider_status": "SENT"}},
+	{Label: "Sent To Carrier Status", URL: statusSMSURL, Data: sentToCarrierStatus, Status: 200, Response: `Accepted`, MsgStatus: Sp("S"), MsgStatusExtra: map[string]interface{}{"provider_status": "SENT_TO_CARRIER"}},
+	{Label: "Queued Status", URL: statusSMSURL, Data: queuedStatus, Status: 200, Response: `Accepted`, MsgStatus: Sp("W"), MsgStatusExtra: map[string]interface{}{"provider_status": "QUEUED"}},
+	{Label: "Unkown Status", URL: statusSMSURL, Data: unknownStatus, Status: 200, Response: "Accepted", MsgStatus: Sp("E"), MsgStatusExtra: map[string]interface{}{"provider_status": "FOO"}},
 	{Label: "Not JSON body", URL: statusSMSURL, Data: notJSON, Status: 400, Response: "unable to parse request JSON"},
 	{Label: "Wrong JSON schema", URL: statusSMSURL, Data: wrongJSONSchema, Status: 400, Response: "request JSON doesn't match required schema"},
 }
@@ -248,8 +492,8 @@ func BenchmarkHandler(b *testing.B) {
 
 // setSendURL takes care of setting the sendURL to call
 func setSendURL(s *httptest.Server, h courier.ChannelHandler, c courier.Channel, m courier.Msg) {
-	whatsappSendURL = s.URL
-	smsSendURL = s.URL
+	h.(*handler).whatsappSendURL = s.URL
+	h.(*handler).smsSendURL = s.URL
 }
 
 var defaultWhatsappSendTestCases = []ChannelSendTestCase{
@@ -258,7 +502,8 @@ var defaultWhatsappSendTestCases = []ChannelSendTestCase{
 		URN:            "tel:+250788383383",
 		Status:         "W",
 		ExternalID:     "55555",
-		ResponseBody:   `{"id": "55555"}`,
+		SentOn:         "2021-03-12T12:15:31Z",
+		ResponseBody:   `{"id": "55555", "timestamp": "2021-03-12T12:15:31Z"}`,
 		ResponseStatus: 200,
 		Headers: map[string]string{
 			"Content-Type": "application/json",
@@ -267,19 +512,229 @@ var defaultWhatsappSendTestCases = []ChannelSendTestCase{
 		},
 		RequestBody: `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"Simple Message ☺"}]}`,
 		SendPrep:    setSendURL},
+	{Label: "Authentication Template Send",
+		Text:           "Your code is 123456",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		Metadata:       json.RawMessage(`{"templating": {"template": {"name": "zv-otp-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "authentication", "variables": ["123456"]}}`),
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"template","templateId":"zv-otp-template","category":"AUTHENTICATION","fields":{"code":"123456"},"buttons":[{"type":"COPY_CODE","code":"123456"}]}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Authentication Template Invalid Code",
+		Text:     "Your code is 123 456",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"templating": {"template": {"name": "zv-otp-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "authentication", "variables": ["123 456"]}}`),
+		Error:    `unable to decode template: {"templating": {"template": {"name": "zv-otp-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "authentication", "variables": ["123 456"]}} for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: invalid authentication code: 123 456`,
+		SendPrep: setSendURL},
+	{Label: "Authentication Template Missing Code",
+		Text:     "Your code is",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"templating": {"template": {"name": "zv-otp-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "authentication", "variables": []}}`),
+		Error:    `unable to decode template: {"templating": {"template": {"name": "zv-otp-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "authentication", "variables": []}} for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: authentication templates require exactly one variable for the code`,
+		SendPrep: setSendURL},
+	{Label: "Mixed Button Template Send",
+		Text:           "Your order has shipped",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		Metadata:       json.RawMessage(`{"templating": {"template": {"name": "zv-order-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "utility", "variables": ["Bob", "1234"], "buttons": [{"type": "quick_reply", "parameter": "track"}, {"type": "url", "parameter": "orders/1234"}, {"type": "quick_reply", "parameter": "help"}]}}`),
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"template","templateId":"zv-order-template","category":"UTILITY","fields":{"1":"Bob","2":"1234"},"buttons":[{"type":"QUICK_REPLY","payload":"track"},{"type":"URL","url":"orders/1234"},{"type":"QUICK_REPLY","payload":"help"}]}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Marketing Template Send",
+		Text:           "Our sale starts today",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		Metadata:       json.RawMessage(`{"templating": {"template": {"name": "zv-sale-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "MARKETING", "buttons": [{"type": "url", "parameter": "sale"}]}}`),
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"template","templateId":"zv-sale-template","category":"MARKETING","buttons":[{"type":"URL","url":"sale"}]}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Template Without Category Send",
+		Text:           "Our sale starts today",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		Metadata:       json.RawMessage(`{"templating": {"template": {"name": "zv-sale-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "buttons": [{"type": "url", "parameter": "sale"}]}}`),
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"template","templateId":"zv-sale-template","buttons":[{"type":"URL","url":"sale"}]}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Template Unknown Category",
+		Text:     "Our sale starts today",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"templating": {"template": {"name": "zv-sale-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "promotional", "buttons": [{"type": "url", "parameter": "sale"}]}}`),
+		Error:    `unable to decode template: {"templating": {"template": {"name": "zv-sale-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "promotional", "buttons": [{"type": "url", "parameter": "sale"}]}} for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: unsupported template category: promotional`,
+		SendPrep: setSendURL},
+	{Label: "Template Without Buttons Sent As Text",
+		Text:           "Your order has shipped",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		Metadata:       json.RawMessage(`{"templating": {"template": {"name": "zv-order-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "utility", "variables": ["Bob"]}}`),
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"Your order has shipped"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Template Too Many URL Buttons",
+		Text:     "Your order has shipped",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"templating": {"template": {"name": "zv-order-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "utility", "buttons": [{"type": "url", "parameter": "a"}, {"type": "url", "parameter": "b"}, {"type": "url", "parameter": "c"}]}}`),
+		Error:    `unable to decode template: {"templating": {"template": {"name": "zv-order-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "utility", "buttons": [{"type": "url", "parameter": "a"}, {"type": "url", "parameter": "b"}, {"type": "url", "parameter": "c"}]}} for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: templates can have at most 2 URL buttons, got: 3`,
+		SendPrep: setSendURL},
+	{Label: "Template Too Many Buttons",
+		Text:     "Your order has shipped",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"templating": {"template": {"name": "zv-order-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "utility", "buttons": [{"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "url"}]}}`),
+		Error:    `unable to decode template: {"templating": {"template": {"name": "zv-order-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "utility", "buttons": [{"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "quick_reply"}, {"type": "url"}]}} for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: templates can have at most 10 buttons, got: 11`,
+		SendPrep: setSendURL},
+	{Label: "Template Unsupported Button",
+		Text:     "Your order has shipped",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"templating": {"template": {"name": "zv-order-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "utility", "buttons": [{"type": "phone_number", "parameter": "+5511999990001"}]}}`),
+		Error:    `unable to decode template: {"templating": {"template": {"name": "zv-order-template", "uuid": "171f8a4d-f725-46d7-85a6-11aceff0bfe3"}, "category": "utility", "buttons": [{"type": "phone_number", "parameter": "+5511999990001"}]}} for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: unsupported template button type: phone_number`,
+		SendPrep: setSendURL},
+	{Label: "Reaction Send",
+		Text:           "Simple Message",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		Metadata:       json.RawMessage(`{"reaction": {"message_id": "f4a7d4b5-ae22-4ad2-9b10-8c1b1b3cf4c0", "emoji": "👍"}}`),
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"reaction","messageId":"f4a7d4b5-ae22-4ad2-9b10-8c1b1b3cf4c0","emoji":"👍"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Reaction Removal Send",
+		Text:           "Simple Message",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		Attachments:    []string{"image/jpeg:https://foo.bar/image.jpg"},
+		Metadata:       json.RawMessage(`{"reaction": {"message_id": "f4a7d4b5-ae22-4ad2-9b10-8c1b1b3cf4c0", "emoji": "👍", "remove": true}}`),
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"reaction","messageId":"f4a7d4b5-ae22-4ad2-9b10-8c1b1b3cf4c0","emoji":""}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Reaction Missing Emoji",
+		Text:     "Simple Message",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"reaction": {"message_id": "f4a7d4b5-ae22-4ad2-9b10-8c1b1b3cf4c0"}}`),
+		Error:    `invalid reaction for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: reactions require an emoji unless they are being removed`,
+		SendPrep: setSendURL},
+	{Label: "Reaction Missing Message ID",
+		Text:     "Simple Message",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"reaction": {"remove": true}}`),
+		Error:    `invalid reaction for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: Key: 'msgReaction.MessageID' Error:Field validation for 'MessageID' failed on the 'required' tag`,
+		SendPrep: setSendURL},
+	{Label: "Contacts Send",
+		Text:           "Our sales team",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		Metadata:       json.RawMessage(`{"contacts": [{"name": "Ann Smith", "first_name": "Ann", "last_name": "Smith", "phones": [{"phone": "+5511999990001", "type": "work"}, {"phone": "+5511999990002"}], "email": "ann@example.com", "org": "Nyaruka", "title": "Sales"}, {"name": "Bob", "phones": [{"phone": "+5511999990003"}]}]}`),
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"contacts","contacts":[{"name":{"formattedName":"Ann Smith","firstName":"Ann","lastName":"Smith"},"phones":[{"phone":"+5511999990001","type":"WORK"},{"phone":"+5511999990002"}],"emails":[{"email":"ann@example.com"}],"org":{"company":"Nyaruka","title":"Sales"}},{"name":{"formattedName":"Bob"},"phones":[{"phone":"+5511999990003"}]}]},{"type":"text","text":"Our sales team"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Contacts Missing Phones",
+		Text:     "Our sales team",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"contacts": [{"name": "Ann Smith", "phones": []}]}`),
+		Error:    `invalid contacts for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: Key: 'msgContact.Phones' Error:Field validation for 'Phones' failed on the 'min' tag`,
+		SendPrep: setSendURL},
+	{Label: "Contacts Invalid Email",
+		Text:     "Our sales team",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"contacts": [{"name": "Ann Smith", "phones": [{"phone": "+5511999990001"}], "email": "ann"}]}`),
+		Error:    `invalid contacts for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: Key: 'msgContact.Email' Error:Field validation for 'Email' failed on the 'email' tag`,
+		SendPrep: setSendURL},
+	{Label: "Quick Replies Send",
+		Text:           "Do you like it?",
+		URN:            "whatsapp:250788383383",
+		QuickReplies:   []string{"Yes", "No, it's not what I was looking for"},
+		Status:         "W",
+		ExternalID:     "55555",
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"Do you like it?"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Footer Without Interactive Send",
+		Text:           "Do you like it?",
+		URN:            "whatsapp:250788383383",
+		QuickReplies:   []string{"Yes", "No"},
+		Metadata:       json.RawMessage(`{"footer": "Replies are recorded"}`),
+		Status:         "W",
+		ExternalID:     "55555",
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"Do you like it?"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Interactive Send",
+		Text:           "Do you like it?",
+		URN:            "whatsapp:250788383383",
+		QuickReplies:   []string{"Yes", "No"},
+		Metadata:       json.RawMessage(`{"interactive": true}`),
+		Status:         "W",
+		ExternalID:     "55555",
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"button","buttons":[{"id":"0","title":"Yes"},{"id":"1","title":"No"}],"body":"Do you like it?"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Interactive With Footer Send",
+		Text:           "Do you like it?",
+		URN:            "whatsapp:250788383383",
+		QuickReplies:   []string{"Yes", "No"},
+		Metadata:       json.RawMessage(`{"interactive": true, "footer": "Replies are recorded"}`),
+		Status:         "W",
+		ExternalID:     "55555",
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"button","buttons":[{"id":"0","title":"Yes"},{"id":"1","title":"No"}],"body":"Do you like it?","footer":"Replies are recorded"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Interactive With Too Many Quick Replies Send",
+		Text:           "Pick a color",
+		URN:            "whatsapp:250788383383",
+		QuickReplies:   []string{"Red", "Green", "Blue", "Yellow"},
+		Metadata:       json.RawMessage(`{"interactive": true, "footer": "Replies are recorded"}`),
+		Status:         "W",
+		ExternalID:     "55555",
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"Pick a color"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Interactive With Long Quick Reply",
+		Text:         "Do you like it?",
+		URN:          "whatsapp:250788383383",
+		QuickReplies: []string{"Yes", "No, it's not what I was looking for"},
+		Metadata:     json.RawMessage(`{"interactive": true}`),
+		Error:        `invalid interactive message for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: button titles can be at most 20 characters, got: No, it's not what I was looking for`,
+		SendPrep:     setSendURL},
+	{Label: "Interactive With Footer Too Long",
+		Text:         "Do you like it?",
+		URN:          "whatsapp:250788383383",
+		QuickReplies: []string{"Yes", "No"},
+		Metadata:     json.RawMessage(`{"interactive": true, "footer": "Replies are recorded and may be used to improve our products and services"}`),
+		Error:        `invalid interactive message for channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab: footers can be at most 60 characters, got: 73`,
+		SendPrep:     setSendURL},
 	{Label: "Long Send",
 		Text:           "This is a longer message than 160 characters and will cause us to split it into two separate parts, isn't that right but it is even longer than before I say, I need to keep adding more things to make it work",
 		URN:            "tel:+250788383383",
 		Status:         "W",
 		ExternalID:     "55555",
-		ResponseBody:   `{"id": "55555"}`,
+		SentOn:         "2021-03-12T12:15:31Z",
+		ResponseBody:   `{"id": "55555", "timestamp": "2021-03-12T12:15:31Z"}`,
 		ResponseStatus: 200,
 		Headers: map[string]string{
 			"Content-Type": "application/json",
 			"Accept":       "application/json",
 			"X-API-TOKEN":  "zv-api-token",
 		},
-		RequestBody: `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"This is a longer message than 160 characters and will cause us to split it into two separate parts, isn't that right but it is even longer than before I say,"},{"type":"text","text":"I need to keep adding more things to make it work"}]}`,
+		RequestBody: `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"This is a longer message than 160 characters and will cause us to split it into two separate parts, isn't that right but it is even longer than before I say, I"},{"type":"text","text":"need to keep adding more things to make it work"}]}`,
 		SendPrep:    setSendURL},
 	{Label: "Send Attachment",
 		Text:           "My pic!",
@@ -287,7 +742,8 @@ var defaultWhatsappSendTestCases = []ChannelSendTestCase{
 		Attachments:    []string{"image/jpeg:https://foo.bar/image.jpg"},
 		Status:         "W",
 		ExternalID:     "55555",
-		ResponseBody:   `{"id": "55555"}`,
+		SentOn:         "2021-03-12T12:15:31Z",
+		ResponseBody:   `{"id": "55555", "timestamp": "2021-03-12T12:15:31Z"}`,
 		ResponseStatus: 200,
 		Headers: map[string]string{
 			"Content-Type": "application/json",
@@ -320,12 +776,28 @@ var defaultWhatsappSendTestCases = []ChannelSendTestCase{
 }
 
 var defaultSMSSendTestCases = []ChannelSendTestCase{
+	{Label: "National Number Send",
+		Text:           "Simple Message",
+		URN:            "tel:11912345678",
+		Status:         "W",
+		ExternalID:     "55555",
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"5511912345678","contents":[{"type":"text","text":"Simple Message"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Invalid Number Send",
+		Text:          "Simple Message",
+		URN:           "tel:1234",
+		Error:         "invalid destination for message: phone number '1234' is not a possible number",
+		ErrorCategory: courier.DeadLetterInvalidDestination,
+		SendPrep:      setSendURL},
 	{Label: "Plain Send",
 		Text:           "Simple Message ☺",
 		URN:            "tel:+250788383383",
 		Status:         "W",
 		ExternalID:     "55555",
-		ResponseBody:   `{"id": "55555"}`,
+		SentOn:         "2021-03-12T12:15:31Z",
+		ResponseBody:   `{"id": "55555", "timestamp": "2021-03-12T12:15:31Z"}`,
 		ResponseStatus: 200,
 		Headers: map[string]string{
 			"Content-Type": "application/json",
@@ -339,14 +811,15 @@ var defaultSMSSendTestCases = []ChannelSendTestCase{
 		URN:            "tel:+250788383383",
 		Status:         "W",
 		ExternalID:     "55555",
-		ResponseBody:   `{"id": "55555"}`,
+		SentOn:         "2021-03-12T12:15:31Z",
+		ResponseBody:   `{"id": "55555", "timestamp": "2021-03-12T12:15:31Z"}`,
 		ResponseStatus: 200,
 		Headers: map[string]string{
 			"Content-Type": "application/json",
 			"Accept":       "application/json",
 			"X-API-TOKEN":  "zv-api-token",
 		},
-		RequestBody: `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"This is a longer message than 160 characters and will cause us to split it into two separate parts, isn't that right but it is even longer than before I say,"},{"type":"text","text":"I need to keep adding more things to make it work"}]}`,
+		RequestBody: `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"This is a longer message than 160 characters and will cause us to split it into two separate parts, isn't that right but it is even longer than before I say, I"},{"type":"text","text":"need to keep adding more things to make it work"}]}`,
 		SendPrep:    setSendURL},
 	{Label: "Send Attachment",
 		Text:           "My pic!",
@@ -354,7 +827,8 @@ var defaultSMSSendTestCases = []ChannelSendTestCase{
 		Attachments:    []string{"image/jpeg:https://foo.bar/image.jpg"},
 		Status:         "W",
 		ExternalID:     "55555",
-		ResponseBody:   `{"id": "55555"}`,
+		SentOn:         "2021-03-12T12:15:31Z",
+		ResponseBody:   `{"id": "55555", "timestamp": "2021-03-12T12:15:31Z"}`,
 		ResponseStatus: 200,
 		Headers: map[string]string{
 			"Content-Type": "application/json",
@@ -394,3 +868,702 @@ func TestSending(t *testing.T) {
 	var defaultSMSChannel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVS", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
 	RunChannelSendTestCases(t, defaultSMSChannel, newHandler("ZVS", "Zenvia SMS"), defaultSMSSendTestCases, nil)
 }
+
+var fromNumberSendTestCases = []ChannelSendTestCase{
+	{Label: "Default From Number",
+		Text:           "Simple Message",
+		URN:            "whatsapp:250788383383",
+		Status:         "W",
+		ExternalID:     "55555",
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"Simple Message"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Overridden From Number",
+		Text:           "Simple Message",
+		URN:            "whatsapp:250788383383",
+		Metadata:       json.RawMessage(`{"from":"+5511999990001"}`),
+		Status:         "W",
+		ExternalID:     "55555",
+		ResponseBody:   `{"id": "55555"}`,
+		ResponseStatus: 200,
+		RequestBody:    `{"from":"5511999990001","to":"250788383383","contents":[{"type":"text","text":"Simple Message"}]}`,
+		SendPrep:       setSendURL},
+	{Label: "Unknown From Number",
+		Text:     "Simple Message",
+		URN:      "whatsapp:250788383383",
+		Metadata: json.RawMessage(`{"from":"5511999990003"}`),
+		Error:    "from number 5511999990003 is not one of the numbers of channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab",
+		SendPrep: setSendURL},
+}
+
+func TestSendingFromNumber(t *testing.T) {
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token", "from_numbers": []interface{}{"+5511999990001", "5511999990002"}})
+	RunChannelSendTestCases(t, channel, newHandler("ZVW", "Zenvia WhatsApp"), fromNumberSendTestCases, nil)
+
+	// without any configured numbers, overrides aren't allowed
+	channel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
+	RunChannelSendTestCases(t, channel, newHandler("ZVW", "Zenvia WhatsApp"), []ChannelSendTestCase{
+		{Label: "From Number Without Config",
+			Text:     "Simple Message",
+			URN:      "whatsapp:250788383383",
+			Metadata: json.RawMessage(`{"from":"5511999990001"}`),
+			Error:    "from number 5511999990001 is not one of the numbers of channel: 8eb23e93-5ecb-45ba-b726-3b064e0c56ab",
+			SendPrep: setSendURL},
+	}, nil)
+}
+
+func TestReceiveTimestamps(t *testing.T) {
+	clock := utils.NewFakeClock(time.Date(2017, 5, 3, 3, 0, 0, 0, time.UTC))
+	h := newHandler("ZVW", "Zenvia WhatsApp").(*handler)
+	h.SetClock(clock)
+
+	// a timestamp ahead of our clock is replaced by the current time
+	RunChannelTestCases(t, testWhatsappChannels, h, []ChannelHandleTestCase{
+		{Label: "Receive From The Future", URL: receiveWhatsappURL, Data: validReceive, Status: 200, Response: "Message Accepted",
+			Text: Sp("Msg"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 3, 0, 0, 0, time.UTC))},
+	})
+
+	// once our clock reaches the timestamp, it's used as is
+	clock.Set(time.Date(2017, 5, 3, 3, 4, 45, 0, time.UTC))
+	RunChannelTestCases(t, testWhatsappChannels, h, []ChannelHandleTestCase{
+		{Label: "Receive At Timestamp", URL: receiveWhatsappURL, Data: validReceive, Status: 200, Response: "Message Accepted",
+			Text: Sp("Msg"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 3, 4, 45, 0, time.UTC))},
+	})
+
+	clock.Advance(time.Hour)
+	RunChannelTestCases(t, testWhatsappChannels, h, []ChannelHandleTestCase{
+		{Label: "Receive From The Past", URL: receiveWhatsappURL, Data: validReceive, Status: 200, Response: "Message Accepted",
+			Text: Sp("Msg"), URN: Sp("whatsapp:254791541111"), Date: Tp(time.Date(2017, 5, 3, 3, 4, 45, 0, time.UTC))},
+	})
+}
+
+func TestAllowedSenders(t *testing.T) {
+	channels := []courier.Channel{
+		courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token", "allowed_senders": []interface{}{"+254791541111"}}),
+	}
+
+	RunChannelTestCases(t, channels, newHandler("ZVW", "Zenvia WhatsApp"), []ChannelHandleTestCase{
+		{Label: "Receive Allowed Sender", URL: receiveWhatsappURL, Data: validReceive, Status: 200, Response: "Message Accepted",
+			Text: Sp("Msg"), URN: Sp("whatsapp:254791541111")},
+		{Label: "Receive Blocked Sender", URL: receiveWhatsappURL, Data: strings.Replace(validReceive, "254791541111", "254791541112", 1), Status: 200,
+			Response: "ignoring request, sender not on allowlist"},
+	})
+}
+
+func TestInboundFilter(t *testing.T) {
+	channels := []courier.Channel{
+		courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token", "inbound_filter_prefix": "#help"}),
+	}
+
+	RunChannelTestCases(t, channels, newHandler("ZVW", "Zenvia WhatsApp"), []ChannelHandleTestCase{
+		{Label: "Receive Matching Msg", URL: receiveWhatsappURL, Data: strings.Replace(validReceive, `"text": "Msg"`, `"text": "#help me"`, 1), Status: 200,
+			Response: "Message Accepted", Text: Sp("#help me"), URN: Sp("whatsapp:254791541111")},
+		{Label: "Receive Non Matching Msg", URL: receiveWhatsappURL, Data: validReceive, Status: 200,
+			Response: "ignoring request, message doesn't match inbound filter"},
+	})
+}
+
+func partStatus(partID string, code string) string {
+	return fmt.Sprintf(`{
+	"id": "string",
+	"type": "MESSAGE_STATUS",
+	"channel": "sms",
+	"messageId": "%s",
+	"aggregateId": "hs765939216",
+	"messageStatus": {
+	  "timestamp": "2021-03-12T12:15:31Z",
+	  "code": "%s"
+	}
+}`, partID, code)
+}
+
+func TestAggregateStatus(t *testing.T) {
+	// a message is only delivered once all of its parts are
+	RunChannelTestCases(t, testSMSChannels, newHandler("ZVS", "Zenvia SMS"), []ChannelHandleTestCase{
+		{Label: "Part 1 Sent", URL: statusSMSURL, Data: partStatus("part-1", "SENT"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("S"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+		{Label: "Part 2 Sent", URL: statusSMSURL, Data: partStatus("part-2", "SENT"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("S"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+		{Label: "Part 1 Delivered", URL: statusSMSURL, Data: partStatus("part-1", "DELIVERED"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("S"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+		{Label: "Part 2 Delivered", URL: statusSMSURL, Data: partStatus("part-2", "DELIVERED"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("D"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+	})
+
+	// which for messages we know the number of parts of includes the parts yet to report
+	h := newHandler("ZVS", "Zenvia SMS")
+	recordParts := func(r *http.Request) {
+		h.(*handler).recordParts(testSMSChannels[0], "hs765939216", 3)
+	}
+	RunChannelTestCases(t, testSMSChannels, h, []ChannelHandleTestCase{
+		{Label: "Part 1 Delivered", URL: statusSMSURL, Data: partStatus("part-1", "DELIVERED"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("S"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true, PrepRequest: recordParts},
+		{Label: "Part 2 Delivered", URL: statusSMSURL, Data: partStatus("part-2", "DELIVERED"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("S"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+		{Label: "Part 3 Delivered", URL: statusSMSURL, Data: partStatus("part-3", "DELIVERED"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("D"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+	})
+
+	// and has failed if any of its parts has
+	h = newHandler("ZVS", "Zenvia SMS")
+	RunChannelTestCases(t, testSMSChannels, h, []ChannelHandleTestCase{
+		{Label: "Part 1 Delivered", URL: statusSMSURL, Data: partStatus("part-1", "DELIVERED"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("S"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true, PrepRequest: recordParts},
+		{Label: "Part 2 Not Delivered", URL: statusSMSURL, Data: partStatus("part-2", "NOT_DELIVERED"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("F"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+		{Label: "Part 3 Delivered", URL: statusSMSURL, Data: partStatus("part-3", "DELIVERED"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("F"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+	})
+}
+
+func TestSendRecordsParts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id": "55555"}`))
+	}))
+	defer server.Close()
+
+	defer func(length int) { maxMsgLength = length }(maxMsgLength)
+	maxMsgLength = 160
+
+	mb := courier.NewMockBackend()
+	h := newHandler("ZVS", "Zenvia SMS")
+	h.(*handler).smsSendURL = server.URL
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	numParts := func() int {
+		rc := mb.RedisPool().Get()
+		defer rc.Close()
+		n, _ := redis.Int(rc.Do("GET", partsKey(testSMSChannels[0], "55555")))
+		return n
+	}
+
+	// messages sent in one part have nothing to aggregate
+	msg := mb.NewOutgoingMsg(testSMSChannels[0], courier.NewMsgID(10), "tel:+5511999999999", "Simple Message", false, nil, "", 0, "")
+	_, err := h.SendMsg(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, 0, numParts())
+
+	// but we remember how many parts others are sent in
+	msg = mb.NewOutgoingMsg(testSMSChannels[0], courier.NewMsgID(11), "tel:+5511999999999", strings.Repeat("a", 100)+" "+strings.Repeat("b", 100), false, nil, "", 0, "")
+	_, err = h.SendMsg(context.Background(), msg)
+	require.NoError(t, err)
+	assert.Equal(t, 2, numParts())
+}
+
+func timedStatus(code string, timestamp string) string {
+	return fmt.Sprintf(`{
+	"id": "string",
+	"type": "MESSAGE_STATUS",
+	"channel": "whatsapp",
+	"messageId": "hs765939216",
+	"messageStatus": {
+	  "timestamp": "%s",
+	  "code": "%s"
+	}
+}`, timestamp, code)
+}
+
+func TestStatusOrdering(t *testing.T) {
+	// status updates which arrive out of order can't take a message back to an earlier status
+	RunChannelTestCases(t, testWhatsappChannels, newHandler("ZVW", "Zenvia WhatsApp"), []ChannelHandleTestCase{
+		{Label: "Delivered", URL: statusWhatsppURL, Data: timedStatus("DELIVERED", "2021-03-12T12:15:35Z"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("D"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+		{Label: "Earlier Sent", URL: statusWhatsppURL, Data: timedStatus("SENT", "2021-03-12T12:15:31Z"), Status: 200,
+			Response: "ignoring status update older than the latest one"},
+		{Label: "Later Sent", URL: statusWhatsppURL, Data: timedStatus("SENT", "2021-03-12T12:15:40Z"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("S"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+		{Label: "Earlier Queued", URL: statusWhatsppURL, Data: timedStatus("QUEUED", "2021-03-12T12:15:38Z"), Status: 200,
+			Response: "ignoring status update older than the latest one"},
+		{Label: "Earlier Read", URL: statusWhatsppURL, Data: timedStatus("READ", "2021-03-12T12:15:33Z"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("D"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+		{Label: "Earlier Not Delivered", URL: statusWhatsppURL, Data: timedStatus("NOT_DELIVERED", "2021-03-12T12:15:32Z"), Status: 200, Response: "Accepted",
+			MsgStatus: Sp("F"), ExternalID: Sp("hs765939216"), NoQueueErrorCheck: true},
+	})
+}
+
+func TestEmojiHandling(t *testing.T) {
+	channels := []courier.Channel{
+		courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token", "emoji_handling": "replace"}),
+	}
+
+	RunChannelTestCases(t, channels, newHandler("ZVW", "Zenvia WhatsApp"), []ChannelHandleTestCase{
+		{Label: "Receive Emoji Replaced", URL: receiveWhatsappURL, Data: strings.Replace(validReceive, `"text": "Msg"`, `"text": "Msg 👍🏽"`, 1), Status: 200,
+			Response: "Message Accepted", Text: Sp("Msg [emoji]"), URN: Sp("whatsapp:254791541111")},
+	})
+}
+
+func TestSelfTest(t *testing.T) {
+	var requestBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requestBody = string(body)
+		w.WriteHeader(200)
+		w.Write([]byte(`{"id": "55555"}`))
+	}))
+	defer server.Close()
+
+	mb := courier.NewMockBackend()
+	h := newHandler("ZVW", "Zenvia WhatsApp")
+	h.(*handler).whatsappSendURL = server.URL
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	// no test destination configured
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
+	_, err := h.(courier.SelfTester).SelfTestMsg(channel)
+	assert.EqualError(t, err, "invalid self test URN: scheme cannot be empty")
+
+	channel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token", "self_test_urn": "whatsapp:250788383383"})
+	msg, err := h.(courier.SelfTester).SelfTestMsg(channel)
+	assert.NoError(t, err)
+	assert.Equal(t, urns.URN("whatsapp:250788383383"), msg.URN())
+	assert.Equal(t, "courier self test", msg.Text())
+
+	// and the message can be sent like any other
+	status, err := h.(courier.SendWrapper).WrapSend(h.SendMsg)(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"from":"2020","to":"250788383383","contents":[{"type":"text","text":"courier self test"}]}`, requestBody)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "55555", status.ExternalID())
+	assert.Len(t, status.Logs(), 1)
+}
+
+func TestSendTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(200)
+		w.Write([]byte(`{"id": "55555"}`))
+	}))
+	defer server.Close()
+
+	defer func(timeout time.Duration) { sendTimeout = timeout }(sendTimeout)
+	sendTimeout = 10 * time.Millisecond
+
+	mb := courier.NewMockBackend()
+	h := newHandler("ZVW", "Zenvia WhatsApp")
+	h.(*handler).whatsappSendURL = server.URL
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token", "max_retries": 0})
+	msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "whatsapp:250788383383", "Simple Message", false, nil, "", 0, "")
+
+	start := time.Now()
+	status, err := h.SendMsg(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Contains(t, status.Logs()[0].Error, "context deadline exceeded")
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestSendRetries(t *testing.T) {
+	attempts := 0
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts <= failures {
+			w.WriteHeader(503)
+			w.Write([]byte(`{"code": "SERVICE_UNAVAILABLE"}`))
+			return
+		}
+		w.WriteHeader(200)
+		w.Write([]byte(`{"id": "55555"}`))
+	}))
+	defer server.Close()
+
+	mb := courier.NewMockBackend()
+	h := newHandler("ZVW", "Zenvia WhatsApp")
+	h.(*handler).whatsappSendURL = server.URL
+	h.(*handler).SetRetryBackoff(time.Millisecond)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token", "max_retries": 3})
+	msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "whatsapp:250788383383", "Simple Message", false, nil, "", 0, "")
+
+	// a send which succeeds after a retry is wired with both attempts logged
+	failures = 1
+	status, err := h.SendMsg(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, "55555", status.ExternalID())
+	assert.Equal(t, []string{"Message Send Error", "Message Sent"}, LogDescriptions(status.Logs()))
+	assert.Equal(t, []string{"received non 200 status: 503"}, LogErrors(status.Logs()))
+	assert.Nil(t, status.Extra())
+
+	// a send which fails every attempt records how many attempts were made and the last error
+	attempts = 0
+	failures = 10
+	status, err = h.SendMsg(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, 4, attempts)
+	assert.Len(t, ErroredLogs(status.Logs()), 4)
+	assert.Equal(t, 4, status.Extra()["send_attempts"])
+	assert.Equal(t, "received non 200 status: 503", status.Extra()["last_error"])
+}
+
+func TestNotifyProcessing(t *testing.T) {
+	var requests []string
+	var responseStatus int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.URL.Path+" "+string(body))
+		w.WriteHeader(responseStatus)
+	}))
+	defer server.Close()
+
+	mb := courier.NewMockBackend()
+	h := newHandler("ZVW", "Zenvia WhatsApp")
+	h.(*handler).whatsappSendURL = server.URL
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+	notifier := h.(courier.ProcessingNotifier)
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
+	msg := mb.NewIncomingMsg(channel, "whatsapp:254791541111", "Msg").WithExternalID("hs765939216")
+
+	// supported accounts get both a read receipt and a typing indicator
+	responseStatus = 200
+	logs, err := notifier.NotifyProcessing(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 2)
+	assert.Equal(t, []string{"/hs765939216/read ", `/typing {"from":"2020","to":"254791541111"}`}, requests)
+
+	// unsupported accounts are ignored after the read receipt fails
+	requests = nil
+	responseStatus = 404
+	logs, err = notifier.NotifyProcessing(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 1)
+	assert.Equal(t, []string{"/hs765939216/read "}, requests)
+
+	// other errors are returned
+	requests = nil
+	responseStatus = 401
+	logs, err = notifier.NotifyProcessing(context.Background(), msg)
+	assert.EqualError(t, err, "received non 200 status: 401")
+	assert.Len(t, logs, 1)
+
+	// SMS channels don't support either
+	requests = nil
+	smsChannel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVS", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
+	logs, err = notifier.NotifyProcessing(context.Background(), mb.NewIncomingMsg(smsChannel, "tel:+254791541111", "Msg").WithExternalID("hs765939216"))
+	assert.NoError(t, err)
+	assert.Len(t, logs, 0)
+	assert.Len(t, requests, 0)
+}
+
+func TestNotifyProcessingOnReceive(t *testing.T) {
+	requests := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.URL.Path
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	channels := []courier.Channel{
+		courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token", "processing_notifications": true}),
+	}
+	h := newHandler("ZVW", "Zenvia WhatsApp")
+	h.(*handler).whatsappSendURL = server.URL
+
+	RunChannelTestCases(t, channels, h, []ChannelHandleTestCase{
+		{Label: "Receive Valid", URL: receiveWhatsappURL, Data: validReceive, Status: 200, Response: "Message Accepted",
+			Text: Sp("Msg"), URN: Sp("whatsapp:254791541111")},
+	})
+
+	for _, expected := range []string{"/string/read", "/typing"} {
+		select {
+		case path := <-requests:
+			assert.Equal(t, expected, path)
+		case <-time.After(time.Second):
+			assert.Fail(t, "expected request not made", expected)
+		}
+	}
+}
+
+func TestValidateURN(t *testing.T) {
+	tcs := []struct {
+		channelType courier.ChannelType
+		urn         urns.URN
+		expectedErr string
+	}{
+		{"ZVW", "whatsapp:250788383383", ""},
+		{"ZVW", "tel:+250788383383", ""},
+		{"ZVW", "tel:11912345678", ""},
+		{"ZVW", "whatsapp:25078838338a", "invalid number: 25078838338a"},
+		{"ZVW", "telegram:12345", "unsupported URN scheme for Zenvia WhatsApp: telegram"},
+		{"ZVS", "tel:+250788383383", ""},
+		{"ZVS", "tel:12", "invalid number: 12"},
+		{"ZVS", "whatsapp:250788383383", "unsupported URN scheme for Zenvia SMS: whatsapp"},
+	}
+
+	for _, tc := range tcs {
+		name := map[courier.ChannelType]string{"ZVW": "Zenvia WhatsApp", "ZVS": "Zenvia SMS"}[tc.channelType]
+		err := newHandler(tc.channelType, name).(courier.URNValidator).ValidateURN(tc.urn)
+		if tc.expectedErr == "" {
+			assert.NoError(t, err, "unexpected error for %s on %s", tc.urn, tc.channelType)
+		} else {
+			assert.EqualError(t, err, tc.expectedErr, "error mismatch for %s on %s", tc.urn, tc.channelType)
+		}
+	}
+}
+
+func TestSendingUnits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"id": "55555"}`))
+	}))
+	defer server.Close()
+
+	defer func(length int) { maxMsgLength = length }(maxMsgLength)
+
+	mb := courier.NewMockBackend()
+
+	tcs := []struct {
+		channelType  courier.ChannelType
+		text         string
+		maxMsgLength int
+		units        interface{}
+	}{
+		{"ZVS", "Simple Message", 1152, 1},
+		{"ZVS", strings.Repeat("a", 160), 1152, 1}, // single GSM7 segment
+		{"ZVS", strings.Repeat("a", 161), 1152, 2}, // concatenated GSM7 segments hold 153 chars
+		{"ZVS", strings.Repeat("a", 307), 1152, 3},
+		{"ZVS", strings.Repeat("á", 70), 1152, 1},                                  // single UCS2 segment
+		{"ZVS", strings.Repeat("á", 71), 1152, 2},                                  // concatenated UCS2 segments hold 67 chars
+		{"ZVS", strings.Repeat("a", 100) + " " + strings.Repeat("b", 100), 160, 2}, // split into two parts of one segment each
+		{"ZVW", strings.Repeat("a", 161), 1152, nil},                               // not counted by the handler
+	}
+
+	for _, tc := range tcs {
+		maxMsgLength = tc.maxMsgLength
+		h := newHandler(tc.channelType, "Zenvia")
+		h.(*handler).whatsappSendURL = server.URL
+		h.(*handler).smsSendURL = server.URL
+		h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+		channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", string(tc.channelType), "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "tel:+5511912345678", tc.text, false, nil, "", 0, "")
+
+		status, err := h.SendMsg(context.Background(), msg)
+		assert.NoError(t, err)
+		assert.Equal(t, courier.MsgWired, status.Status())
+		assert.Equal(t, tc.units, status.Extra()[courier.MsgStatusExtraUnits], "units mismatch for %s text of length %d", tc.channelType, len(tc.text))
+	}
+}
+
+// mockShortener shortens links to a numbered path on a short domain, failing for any link containing "fail"
+type mockShortener struct {
+	links []string
+}
+
+func (s *mockShortener) Shorten(ctx context.Context, link string) (string, error) {
+	if strings.Contains(link, "fail") {
+		return "", fmt.Errorf("unable to shorten %s", link)
+	}
+	s.links = append(s.links, link)
+	return fmt.Sprintf("https://sho.rt/%d", len(s.links)), nil
+}
+
+func TestSendingShortenedLinks(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(200)
+		w.Write([]byte(`{"id": "55555"}`))
+	}))
+	defer server.Close()
+
+	mb := courier.NewMockBackend()
+	longLink := "https://example.com/surveys/2022/feedback?contact=5511912345678&campaign=spring"
+
+	tcs := []struct {
+		channelType courier.ChannelType
+		text        string
+		expected    string
+	}{
+		{"ZVS", "Tell us what you think: " + longLink + ".", "Tell us what you think: https://sho.rt/1."},
+		{"ZVS", "No links here", "No links here"},
+		{"ZVS", "Can't shorten https://example.com/fail/this/very/long/link/please", "Can't shorten https://example.com/fail/this/very/long/link/please"},
+		{"ZVW", "Tell us what you think: " + longLink, "Tell us what you think: " + longLink}, // only SMS links are shortened
+	}
+
+	for _, tc := range tcs {
+		shortener := &mockShortener{}
+		h := newHandler(tc.channelType, "Zenvia")
+		h.(*handler).whatsappSendURL = server.URL
+		h.(*handler).smsSendURL = server.URL
+		h.(*handler).linkShortener = func(courier.Channel) LinkShortener { return shortener }
+		h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+		channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", string(tc.channelType), "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "tel:+5511912345678", tc.text, false, nil, "", 0, "")
+
+		status, err := h.SendMsg(context.Background(), msg)
+		assert.NoError(t, err)
+		assert.Equal(t, courier.MsgWired, status.Status())
+
+		sent := &mtPayload{}
+		assert.NoError(t, json.Unmarshal(body, sent))
+		assert.Equal(t, tc.expected, sent.Contents[0].Text, "text mismatch for %s", tc.text)
+		assert.LessOrEqual(t, len(sent.Contents[0].Text), len(tc.text))
+	}
+
+	// channels without a shortener configured send links as they are
+	h := newHandler("ZVS", "Zenvia")
+	h.(*handler).smsSendURL = server.URL
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVS", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
+	msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "tel:+5511912345678", longLink, false, nil, "", 0, "")
+
+	_, err := h.SendMsg(context.Background(), msg)
+	assert.NoError(t, err)
+
+	sent := &mtPayload{}
+	assert.NoError(t, json.Unmarshal(body, sent))
+	assert.Equal(t, longLink, sent.Contents[0].Text)
+}
+
+func TestSendingUploadedMedia(t *testing.T) {
+	var requests []string
+	var sent []byte
+	uploadStatus := 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+
+		switch r.URL.Path {
+		case "/media/image.jpg":
+			w.Write([]byte("imagebytes"))
+		case "/upload":
+			file, header, err := r.FormFile("file")
+			assert.NoError(t, err)
+			content, _ := ioutil.ReadAll(file)
+			assert.Equal(t, "imagebytes", string(content))
+			assert.Equal(t, "image.jpg", header.Filename)
+			assert.Equal(t, "image/jpeg", r.FormValue("fileMimeType"))
+			assert.Equal(t, "zv-api-token", r.Header.Get("X-API-TOKEN"))
+
+			w.WriteHeader(uploadStatus)
+			w.Write([]byte(`{"id": "file-123"}`))
+		case "/send":
+			sent, _ = ioutil.ReadAll(r.Body)
+			w.Write([]byte(`{"id": "55555"}`))
+		}
+	}))
+	defer server.Close()
+
+	mb := courier.NewMockBackend()
+	h := newHandler("ZVW", "Zenvia WhatsApp")
+	h.(*handler).whatsappSendURL = server.URL + "/send"
+	h.(*handler).mediaUploadURL = server.URL + "/upload"
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", map[string]interface{}{"api_key": "zv-api-token"})
+	send := func() courier.MsgStatus {
+		requests, sent = nil, nil
+		msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "whatsapp:250788383383", "My pic!", false, nil, "", 0, "")
+		msg.WithAttachment("image/jpeg:" + server.URL + "/media/image.jpg")
+		status, err := h.SendMsg(context.Background(), msg)
+		assert.NoError(t, err)
+		return status
+	}
+
+	// media Zenvia can't fetch is uploaded first and sent by the id of the upload
+	status := send()
+	assert.Equal(t, courier.MsgWired, status.Status())
+	assert.Equal(t, []string{"GET /media/image.jpg", "POST /upload", "POST /send"}, requests)
+	assert.JSONEq(t, `{"from":"2020","to":"250788383383","contents":[{"type":"file","fileId":"file-123","fileMimeType":"image/jpeg"},{"type":"text","text":"My pic!"}]}`, string(sent))
+
+	// if the upload fails, the message isn't sent
+	uploadStatus = 500
+	status = send()
+	assert.Equal(t, courier.MsgErrored, status.Status())
+	assert.Equal(t, []string{"GET /media/image.jpg", "POST /upload"}, requests)
+	assert.Nil(t, sent)
+}
+
+func TestIsPublicURL(t *testing.T) {
+	tcs := []struct {
+		url    string
+		public bool
+	}{
+		{"https://foo.bar/image.jpg", true},
+		{"http://8.8.8.8/image.jpg", true},
+		{"http://localhost:8000/image.jpg", false},
+		{"http://127.0.0.1/image.jpg", false},
+		{"http://10.0.0.12/image.jpg", false},
+		{"http://192.168.1.5/image.jpg", false},
+		{"http://[::1]/image.jpg", false},
+		{"http://media/image.jpg", false},
+		{"http://media.internal/image.jpg", false},
+		{"ftp://foo.bar/image.jpg", false},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.public, isPublicURL(tc.url), "public mismatch for %s", tc.url)
+	}
+}
+
+func TestSendingWithoutToken(t *testing.T) {
+	mb := courier.NewMockBackend()
+	h := newHandler("ZVW", "Zenvia WhatsApp")
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", nil)
+	msg := mb.NewOutgoingMsg(channel, courier.NewMsgID(10), "whatsapp:250788383383", "Hello", false, nil, "", 0, "")
+
+	_, err := h.(courier.SendWrapper).WrapSend(h.SendMsg)(context.Background(), msg)
+	assert.EqualError(t, err, "missing api_key for ZVW channel")
+}
+
+func TestAckResponse(t *testing.T) {
+	mb := courier.NewMockBackend()
+	h := newHandler("ZVW", "Zenvia WhatsApp").(*handler)
+	h.Initialize(courier.NewServer(courier.NewConfig(), mb))
+
+	request := func(config map[string]interface{}, receive func(context.Context, courier.Channel, http.ResponseWriter, *http.Request) ([]courier.Event, error), url string, body string) *httptest.ResponseRecorder {
+		config["api_key"] = "zv-api-token"
+		channel := courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZVW", "2020", "BR", config)
+		w := httptest.NewRecorder()
+		_, err := receive(context.Background(), channel, w, httptest.NewRequest(http.MethodPost, url, strings.NewReader(body)))
+		assert.NoError(t, err)
+		return w
+	}
+	ack := map[string]interface{}{"ack_response": `{"received":true}`}
+
+	// by default messages and statuses get our standard responses
+	w := request(map[string]interface{}{}, h.receiveMessage, receiveWhatsappURL, validReceive)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Message Accepted")
+
+	// but channels can acknowledge them with a particular body
+	w = request(ack, h.receiveMessage, receiveWhatsappURL, validReceive)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"received":true}`, w.Body.String())
+	msg, err := mb.GetLastQueueMsg()
+	assert.NoError(t, err)
+	assert.Equal(t, "Msg", msg.Text())
+
+	w = request(ack, h.receiveStatus, statusWhatsppURL, validStatus)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"received":true}`, w.Body.String())
+	status, err := mb.GetLastMsgStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, courier.MsgSent, status.Status())
+
+	// including those we ignore, so they aren't retried either
+	w = request(ack, h.receiveMessage, receiveWhatsappURL, strings.Replace(validReceive, `"direction": "IN"`, `"direction": "OUT"`, 1))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"received":true}`, w.Body.String())
+
+	// or with an empty body
+	w = request(map[string]interface{}{"ack_response": ""}, h.receiveMessage, receiveWhatsappURL, validReceive)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Body.String())
+
+	// requests we can't handle still get our standard errors
+	w = request(ack, h.receiveStatus, statusWhatsppURL, `{"type":"MESSAGE"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unsupported event type: MESSAGE")
+}
@@ -21,6 +21,9 @@ var (
 	sendURL      = "https://api-rest.zenvia.com/services/send-sms"
 )
 
+// channels which ignore statuses, like one-way notification channels, can turn off status callbacks
+const configStatusCallbacks = "status_callbacks"
+
 func init() {
 	courier.RegisterHandler(newHandler())
 }
@@ -183,6 +186,9 @@ func (h *handler) SendMsg(ctx context.Context, msg courier.Msg) (courier.MsgStat
 		zvMsg.SendSMSRequest.Msg = part
 		zvMsg.SendSMSRequest.ID = msg.ID().String()
 		zvMsg.SendSMSRequest.CallbackOption = "FINAL"
+		if !msg.Channel().BoolConfigForKey(configStatusCallbacks, true) {
+			zvMsg.SendSMSRequest.CallbackOption = "NONE"
+		}
 
 		requestBody := new(bytes.Buffer)
 		json.NewEncoder(requestBody).Encode(zvMsg)
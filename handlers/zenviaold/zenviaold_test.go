@@ -206,3 +206,18 @@ func TestSending(t *testing.T) {
 	var defaultChannel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZV", "2020", "BR", map[string]interface{}{"username": "zv-username", "password": "zv-password"})
 	RunChannelSendTestCases(t, defaultChannel, newHandler(), defaultSendTestCases, nil)
 }
+
+func TestSendingWithoutStatusCallbacks(t *testing.T) {
+	maxMsgLength = 160
+	var channel = courier.NewMockChannel("8eb23e93-5ecb-45ba-b726-3b064e0c56ab", "ZV", "2020", "BR", map[string]interface{}{"username": "zv-username", "password": "zv-password", "status_callbacks": false})
+	RunChannelSendTestCases(t, channel, newHandler(), []ChannelSendTestCase{
+		{Label: "Plain Send",
+			Text:           "Simple Message ☺",
+			URN:            "tel:+250788383383",
+			Status:         "W",
+			ResponseBody:   `{"sendSmsResponse":{"statusCode":"00","statusDescription":"Ok","detailCode":"000","detailDescription":"Message Sent"}}`,
+			ResponseStatus: 200,
+			RequestBody:    `{"sendSmsRequest":{"to":"250788383383","schedule":"","msg":"Simple Message ☺","callbackOption":"NONE","id":"10","aggregateId":""}}`,
+			SendPrep:       setSendURL},
+	}, nil)
+}
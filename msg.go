@@ -98,6 +98,7 @@ type Msg interface {
 	ResponseToID() MsgID
 	ResponseToExternalID() string
 	IsResend() bool
+	AlreadyWritten() bool
 
 	Channel() Channel
 
@@ -107,11 +108,13 @@ type Msg interface {
 	HighPriority() bool
 
 	WithContactName(name string) Msg
+	WithText(text string) Msg
 	WithReceivedOn(date time.Time) Msg
 	WithExternalID(id string) Msg
 	WithID(id MsgID) Msg
 	WithUUID(uuid MsgUUID) Msg
 	WithAttachment(url string) Msg
+	WithAttachments(urls []string) Msg
 	WithURNAuth(auth string) Msg
 	WithMetadata(metadata json.RawMessage) Msg
 
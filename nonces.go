@@ -0,0 +1,74 @@
+package courier
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// NonceStore is where we remember nonces, such as the external ids of incoming messages, so that we can tell when one
+// is used again. Handlers remember them in the backend's redis unless a separate store has been registered.
+type NonceStore interface {
+	// Claim remembers the passed in nonce for the passed in TTL, returning false if it's already remembered
+	Claim(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+
+	// Release forgets the passed in nonce so that it can be claimed again
+	Release(ctx context.Context, nonce string) error
+}
+
+// RegisterNonceStore registers the store nonces are remembered in instead of the backend's redis, nil meaning we go
+// back to using the backend's redis
+func RegisterNonceStore(store NonceStore) {
+	nonceStoreMutex.Lock()
+	defer nonceStoreMutex.Unlock()
+
+	registeredNonceStore = store
+}
+
+// GetNonceStore returns the registered nonce store, or the passed in default if one hasn't been registered
+func GetNonceStore(defaultStore NonceStore) NonceStore {
+	nonceStoreMutex.RLock()
+	defer nonceStoreMutex.RUnlock()
+
+	if registeredNonceStore != nil {
+		return registeredNonceStore
+	}
+	return defaultStore
+}
+
+var registeredNonceStore NonceStore
+var nonceStoreMutex sync.RWMutex
+
+// NewRedisNonceStore creates a new nonce store which remembers nonces in the passed in redis pool
+func NewRedisNonceStore(rp *redis.Pool) NonceStore {
+	return &redisNonceStore{rp: rp}
+}
+
+type redisNonceStore struct {
+	rp *redis.Pool
+}
+
+func (s *redisNonceStore) Claim(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	rc := s.rp.Get()
+	defer rc.Close()
+
+	// SET NX only succeeds if the nonce isn't already remembered, replying nil otherwise
+	_, err := redis.String(rc.Do("SET", "nonce:"+nonce, "1", "PX", ttl.Milliseconds(), "NX"))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *redisNonceStore) Release(ctx context.Context, nonce string) error {
+	rc := s.rp.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("DEL", "nonce:"+nonce)
+	return err
+}
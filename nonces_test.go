@@ -0,0 +1,76 @@
+package courier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+type testNonceStore struct {
+	claimed map[string]time.Duration
+}
+
+func (s *testNonceStore) Claim(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	if _, seen := s.claimed[nonce]; seen {
+		return false, nil
+	}
+	s.claimed[nonce] = ttl
+	return true, nil
+}
+
+func (s *testNonceStore) Release(ctx context.Context, nonce string) error {
+	delete(s.claimed, nonce)
+	return nil
+}
+
+func TestNonceStore(t *testing.T) {
+	defer RegisterNonceStore(nil)
+
+	backendStore := &testNonceStore{claimed: map[string]time.Duration{}}
+	otherStore := &testNonceStore{claimed: map[string]time.Duration{}}
+
+	// without a registered store we use the backend's
+	assert.Equal(t, backendStore, GetNonceStore(backendStore))
+
+	RegisterNonceStore(otherStore)
+	assert.Equal(t, otherStore, GetNonceStore(backendStore))
+
+	// unregistering it goes back to the backend's
+	RegisterNonceStore(nil)
+	assert.Equal(t, backendStore, GetNonceStore(backendStore))
+}
+
+func TestRedisNonceStore(t *testing.T) {
+	ctx := context.Background()
+	rp := NewMockBackend().RedisPool()
+	store := NewRedisNonceStore(rp)
+
+	// nonces can only be claimed once
+	claimed, err := store.Claim(ctx, "abc", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = store.Claim(ctx, "abc", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	claimed, err = store.Claim(ctx, "def", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	// and are remembered for their TTL
+	rc := rp.Get()
+	defer rc.Close()
+	ttl, err := redis.Int(rc.Do("PTTL", "nonce:abc"))
+	assert.NoError(t, err)
+	assert.InDelta(t, 60000, ttl, 1000)
+
+	// unless released
+	assert.NoError(t, store.Release(ctx, "abc"))
+	claimed, err = store.Claim(ctx, "abc", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
@@ -0,0 +1,63 @@
+package courier
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redactedSecret is what secrets in logged payloads are replaced with
+const redactedSecret = "**********"
+
+// secretConfigKeys are the keys of channel configs whose values are secrets, redacted wherever they appear in logged
+// payloads, which catches secrets providers echo back or which we send in places our patterns don't cover
+var secretConfigKeys = []string{ConfigAPIKey, ConfigAuthToken, ConfigPassword, ConfigSecret, ConfigSendAuthorization, ConfigLinkShortenerToken}
+
+var (
+	// headers which carry credentials
+	secretHeaderRegex = regexp.MustCompile(`(?im)^((?:proxy-)?authorization|x-api-(?:token|key)|api-key|cookie|set-cookie):[^\r\n]*`)
+
+	// JSON fields and query or form params whose names say they are secrets
+	secretFieldRegex = regexp.MustCompile(`(?i)("[\w-]*(?:token|secret|password|api_?key)[\w-]*"\s*:\s*")(?:[^"\\]|\\.)*"`)
+	secretParamRegex = regexp.MustCompile(`(?i)((?:^|[?&\s])[\w-]*(?:token|secret|password|api_?key)[\w-]*=)[^&\s]*`)
+)
+
+// shouldLogPayloads returns whether the payloads of a send on the passed in channel should be logged, which is the case
+// for a random 1 in every N sends if the channel is configured to log them
+func shouldLogPayloads(channel Channel) bool {
+	every := channel.IntConfigForKey(ConfigLogPayloads, 0)
+	return every > 0 && rand.Intn(every) == 0
+}
+
+// logPayloads logs the requests and responses of the passed in channel logs of a send, with their secrets redacted
+func logPayloads(log *logrus.Entry, channel Channel, logs []*ChannelLog) {
+	for _, l := range logs {
+		if l == nil {
+			continue
+		}
+		log.WithFields(logrus.Fields{
+			"description": l.Description,
+			"url":         redactSecrets(channel, l.URL),
+			"status_code": l.StatusCode,
+			"request":     redactSecrets(channel, l.Request),
+			"response":    redactSecrets(channel, l.Response),
+		}).Info("send payload")
+	}
+}
+
+// redactSecrets returns the passed in payload with the secrets of the passed in channel, credential headers and fields
+// or params named like secrets replaced
+func redactSecrets(channel Channel, payload string) string {
+	for _, key := range secretConfigKeys {
+		if secret := channel.StringConfigForKey(key, ""); secret != "" {
+			payload = strings.ReplaceAll(payload, secret, redactedSecret)
+		}
+	}
+
+	payload = secretHeaderRegex.ReplaceAllString(payload, "$1: "+redactedSecret)
+	payload = secretFieldRegex.ReplaceAllString(payload, "${1}"+redactedSecret+`"`)
+	payload = secretParamRegex.ReplaceAllString(payload, "${1}"+redactedSecret)
+	return payload
+}
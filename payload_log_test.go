@@ -0,0 +1,74 @@
+package courier
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldLogPayloads(t *testing.T) {
+	// channels which aren't configured to log payloads never do
+	channel := NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "AC", "2020", "US", nil)
+	for i := 0; i < 100; i++ {
+		assert.False(t, shouldLogPayloads(channel))
+	}
+
+	// others log those of roughly 1 in every N sends
+	channel = NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "AC", "2020", "US", map[string]interface{}{"log_payloads": 10})
+	logged := 0
+	for i := 0; i < 10000; i++ {
+		if shouldLogPayloads(channel) {
+			logged++
+		}
+	}
+	assert.InDelta(t, 1000, logged, 200)
+
+	// and 1 means every send
+	channel = NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "AC", "2020", "US", map[string]interface{}{"log_payloads": 1})
+	for i := 0; i < 100; i++ {
+		assert.True(t, shouldLogPayloads(channel))
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	channel := NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "AC", "2020", "US", map[string]interface{}{"api_key": "sesame123"})
+
+	tcs := []struct {
+		payload  string
+		redacted string
+	}{
+		{"POST /send HTTP/1.1\r\nAuthorization: Bearer xoxb-abc123\r\nContent-Type: application/json\r\n\r\n{}", "POST /send HTTP/1.1\r\nAuthorization: **********\r\nContent-Type: application/json\r\n\r\n{}"},
+		{"POST /send HTTP/1.1\r\nX-API-TOKEN: zv-api-token\r\n\r\n{}", "POST /send HTTP/1.1\r\nX-API-TOKEN: **********\r\n\r\n{}"},
+		{`{"to":"+12065551212","auth_token":"abc\"123","text":"Hi"}`, `{"to":"+12065551212","auth_token":"**********","text":"Hi"}`},
+		{`{"Password": "hunter2"}`, `{"Password": "**********"}`},
+		{"https://example.com/send?to=12065551212&token=abc123&text=Hi", "https://example.com/send?to=12065551212&token=**********&text=Hi"},
+		{"POST /send HTTP/1.1\r\n\r\nusername=bob&password=hunter2", "POST /send HTTP/1.1\r\n\r\nusername=bob&password=**********"},
+		{`{"credentials":"sesame123"}`, `{"credentials":"**********"}`},
+		{`{"to":"+12065551212","text":"my tokens are gone"}`, `{"to":"+12065551212","text":"my tokens are gone"}`},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.redacted, redactSecrets(channel, tc.payload), "redaction mismatch for %s", tc.payload)
+	}
+}
+
+func TestLogPayloads(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	channel := NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "AC", "2020", "US", map[string]interface{}{"auth_token": "sesame123"})
+
+	logPayloads(logrus.NewEntry(logger), channel, []*ChannelLog{
+		{Description: "Message Sent", URL: "https://example.com/send?key=sesame123", StatusCode: 200, Request: "POST /send HTTP/1.1\r\nAuthorization: Token sesame123\r\n\r\n{\"text\":\"Hi\"}", Response: `{"id":"123"}`},
+	})
+
+	if assert.Len(t, hook.AllEntries(), 1) {
+		entry := hook.LastEntry()
+		assert.Equal(t, "send payload", entry.Message)
+		assert.Equal(t, "Message Sent", entry.Data["description"])
+		assert.Equal(t, "https://example.com/send?key=**********", entry.Data["url"])
+		assert.Equal(t, 200, entry.Data["status_code"])
+		assert.Equal(t, "POST /send HTTP/1.1\r\nAuthorization: **********\r\n\r\n{\"text\":\"Hi\"}", entry.Data["request"])
+		assert.Equal(t, `{"id":"123"}`, entry.Data["response"])
+	}
+}
@@ -0,0 +1,120 @@
+package courier
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+)
+
+// maxRateLimitDelay is the longest we will hold a sender waiting on a channel's rate limit
+const maxRateLimitDelay = 10 * time.Second
+
+// maxSendJitter is the widest window a channel can spread its sends over
+const maxSendJitter = 10 * time.Second
+
+// lowRateLimitRemaining is when we start slowing down if a provider doesn't tell us its total limit
+const lowRateLimitRemaining = 10
+
+// ChannelRateLimiter tracks the rate limits providers report for each channel so that we can slow down our sends
+// before the provider starts rejecting them
+type ChannelRateLimiter struct {
+	clock  utils.Clock
+	limits map[ChannelUUID]*utils.RateLimit
+	mutex  sync.Mutex
+}
+
+// NewChannelRateLimiter creates a new empty rate limiter which uses the passed in clock for the current time
+func NewChannelRateLimiter(clock utils.Clock) *ChannelRateLimiter {
+	return &ChannelRateLimiter{clock: clock, limits: make(map[ChannelUUID]*utils.RateLimit)}
+}
+
+// Observe records the latest rate limit reported in the passed in logs of requests made for the channel
+func (l *ChannelRateLimiter) Observe(channel ChannelUUID, logs []*ChannelLog) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, log := range logs {
+		if log != nil && log.RateLimit != nil {
+			l.limits[channel] = log.RateLimit
+		}
+	}
+}
+
+// Delay returns how long we should wait before making our next request for the channel. If we have no remaining
+// requests we wait until the limit resets, and if we are running low we spread the remaining requests until then.
+func (l *ChannelRateLimiter) Delay(channel ChannelUUID) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.clock.Now()
+	rl := l.limits[channel]
+	if rl == nil {
+		return 0
+	}
+
+	// without a reset we don't know how long to wait, and once it has passed the limit no longer applies
+	if rl.Reset.IsZero() || !now.Before(rl.Reset) {
+		delete(l.limits, channel)
+		return 0
+	}
+
+	low := lowRateLimitRemaining
+	if rl.Limit > 0 {
+		low = rl.Limit / 10
+	}
+
+	var delay time.Duration
+	if rl.Remaining <= 0 {
+		delay = rl.Reset.Sub(now)
+	} else if rl.Remaining <= low {
+		delay = rl.Reset.Sub(now) / time.Duration(rl.Remaining+1)
+	}
+
+	if delay > maxRateLimitDelay {
+		delay = maxRateLimitDelay
+	}
+	return delay
+}
+
+// Wait blocks until we can make our next request for the channel or the passed in context is done
+func (l *ChannelRateLimiter) Wait(ctx context.Context, channel ChannelUUID) {
+	delay := l.Delay(channel)
+	if delay <= 0 {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+}
+
+// sendJitter returns a random delay within the send jitter window configured on the passed in channel, which spreads
+// out bursts of sends like broadcasts without the channel needing to know the provider's rate limit
+func sendJitter(channel Channel) time.Duration {
+	window := time.Duration(channel.IntConfigForKey(ConfigSendJitter, 0)) * time.Millisecond
+	if window <= 0 {
+		return 0
+	}
+	if window > maxSendJitter {
+		window = maxSendJitter
+	}
+	return time.Duration(rand.Int63n(int64(window)))
+}
+
+// waitSendJitter blocks for a random delay within the send jitter window of the channel or until the passed in
+// context is done
+func waitSendJitter(ctx context.Context, channel Channel) {
+	delay := sendJitter(channel)
+	if delay <= 0 {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+}
@@ -0,0 +1,107 @@
+package courier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelRateLimiter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := utils.NewFakeClock(now)
+	limiter := NewChannelRateLimiter(clock)
+	channel, _ := NewChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c95d")
+	other, _ := NewChannelUUID("dbc126ed-66bc-4e28-b67b-81dc3327c96a")
+
+	observe := func(rl *utils.RateLimit) {
+		limiter.Observe(channel, []*ChannelLog{{Description: "Message Sent"}, {Description: "Message Sent", RateLimit: rl}})
+	}
+
+	// nothing observed, no delay
+	assert.Equal(t, time.Duration(0), limiter.Delay(channel))
+
+	// plenty remaining, no delay
+	observe(&utils.RateLimit{Limit: 100, Remaining: 50, Reset: now.Add(time.Minute)})
+	assert.Equal(t, time.Duration(0), limiter.Delay(channel))
+
+	// running low, remaining requests are spread until the reset
+	observe(&utils.RateLimit{Limit: 100, Remaining: 4, Reset: now.Add(5 * time.Second)})
+	assert.Equal(t, time.Second, limiter.Delay(channel))
+	assert.Equal(t, time.Duration(0), limiter.Delay(other))
+
+	// without a reported limit, we consider 10 remaining as low
+	observe(&utils.RateLimit{Remaining: 11, Reset: now.Add(6 * time.Second)})
+	assert.Equal(t, time.Duration(0), limiter.Delay(channel))
+	observe(&utils.RateLimit{Remaining: 5, Reset: now.Add(6 * time.Second)})
+	assert.Equal(t, time.Second, limiter.Delay(channel))
+
+	// none remaining, wait until the reset
+	observe(&utils.RateLimit{Limit: 100, Remaining: 0, Reset: now.Add(3 * time.Second)})
+	assert.Equal(t, 3*time.Second, limiter.Delay(channel))
+
+	// but never longer than our max
+	observe(&utils.RateLimit{Remaining: 0, Reset: now.Add(time.Hour)})
+	assert.Equal(t, maxRateLimitDelay, limiter.Delay(channel))
+
+	// logs without rate limits don't clear what we know
+	limiter.Observe(channel, []*ChannelLog{{Description: "Message Sent"}})
+	assert.Equal(t, maxRateLimitDelay, limiter.Delay(channel))
+
+	// as we approach the reset, we wait less
+	observe(&utils.RateLimit{Remaining: 0, Reset: now.Add(20 * time.Second)})
+	clock.Advance(15 * time.Second)
+	assert.Equal(t, 5*time.Second, limiter.Delay(channel))
+
+	// and once the reset has passed, there's no delay even if we go back in time
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, time.Duration(0), limiter.Delay(channel))
+	clock.Set(now)
+	assert.Equal(t, time.Duration(0), limiter.Delay(channel))
+
+	// waiting gives up when the context is done
+	observe(&utils.RateLimit{Remaining: 0, Reset: now.Add(time.Hour)})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	limiter.Wait(ctx, channel)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestSendJitter(t *testing.T) {
+	// channels without a jitter window send straight away
+	channel := NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "AC", "2020", "US", nil)
+	assert.Equal(t, time.Duration(0), sendJitter(channel))
+
+	// others are delayed within their window
+	channel = NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "AC", "2020", "US", map[string]interface{}{"send_jitter": 50})
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		delay := sendJitter(channel)
+		assert.GreaterOrEqual(t, delay, time.Duration(0))
+		assert.Less(t, delay, 50*time.Millisecond)
+		delays[delay] = true
+	}
+	assert.Greater(t, len(delays), 1, "sends should be spread over the window")
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		waitSendJitter(context.Background(), channel)
+		assert.Less(t, time.Since(start), 50*time.Millisecond+25*time.Millisecond)
+	}
+
+	// but never more than our max
+	channel = NewMockChannel("dbc126ed-66bc-4e28-b67b-81dc3327c95d", "AC", "2020", "US", map[string]interface{}{"send_jitter": 3600000})
+	for i := 0; i < 100; i++ {
+		assert.Less(t, sendJitter(channel), maxSendJitter)
+	}
+
+	// and waiting gives up when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	waitSendJitter(ctx, channel)
+	assert.Less(t, time.Since(start), time.Second)
+}
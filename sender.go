@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/nyaruka/courier/utils"
 	"github.com/nyaruka/librato"
 	"github.com/sirupsen/logrus"
 )
@@ -14,6 +15,7 @@ type Foreman struct {
 	server           Server
 	senders          []*Sender
 	availableSenders chan *Sender
+	rateLimiter      *ChannelRateLimiter
 	quit             chan bool
 }
 
@@ -23,6 +25,7 @@ func NewForeman(server Server, maxSenders int) *Foreman {
 		server:           server,
 		senders:          make([]*Sender, maxSenders),
 		availableSenders: make(chan *Sender, maxSenders),
+		rateLimiter:      NewChannelRateLimiter(utils.RealClock),
 		quit:             make(chan bool),
 	}
 
@@ -151,6 +154,9 @@ func (w *Sender) Stop() {
 	close(w.job)
 }
 
+// SendTimeout is the most time any individual send is given, including all the requests it makes
+const SendTimeout = time.Second * 35
+
 func (w *Sender) sendMessage(msg Msg) {
 	log := logrus.WithField("comp", "sender").WithField("sender_id", w.id).WithField("channel_uuid", msg.Channel().UUID())
 
@@ -159,7 +165,7 @@ func (w *Sender) sendMessage(msg Msg) {
 	backend := server.Backend()
 
 	// we don't want any individual send taking more than 35s
-	sendCTX, cancel := context.WithTimeout(context.Background(), time.Second*35)
+	sendCTX, cancel := context.WithTimeout(context.Background(), SendTimeout)
 	defer cancel()
 
 	log = log.WithField("msg_id", msg.ID().String()).WithField("msg_text", msg.Text()).WithField("msg_urn", msg.URN().Identity())
@@ -207,6 +213,12 @@ func (w *Sender) sendMessage(msg Msg) {
 		status.AddLog(NewChannelLogFromError("Message Loop", msg.Channel(), msg.ID(), 0, fmt.Errorf("message loop detected, failing message without send")))
 		log.Error("message loop detected, failing message")
 	} else {
+		// slow down if the provider has told us we're close to its rate limit
+		w.foreman.rateLimiter.Wait(sendCTX, msg.Channel().UUID())
+
+		// and spread out bursts of sends if the channel asks us to
+		waitSendJitter(sendCTX, msg.Channel())
+
 		// send our message
 		status, err = server.SendMsg(sendCTX, msg)
 		duration := time.Now().Sub(start)
@@ -218,6 +230,21 @@ func (w *Sender) sendMessage(msg Msg) {
 				status = backend.NewMsgStatusForID(msg.Channel(), msg.ID(), MsgErrored)
 				status.AddLog(NewChannelLogFromError("Sending Error", msg.Channel(), msg.ID(), duration, err))
 			}
+
+			// permanent failures won't be fixed by retrying so we fail them and pass them to our dead letter sink
+			deadLettered, dlErr := deadLetterIfPermanent(sendCTX, msg, status, err)
+			if dlErr != nil {
+				log.WithError(dlErr).Error("error dead lettering message")
+			} else if deadLettered {
+				log.Warning("permanent send failure, message dead lettered")
+			}
+		}
+
+		w.foreman.rateLimiter.Observe(msg.Channel().UUID(), status.Logs())
+
+		// log the full payloads of a sample of sends, for debugging channels without logging all their sends
+		if shouldLogPayloads(msg.Channel()) {
+			logPayloads(log, msg.Channel(), status.Logs())
 		}
 
 		// report to librato and log locally
@@ -12,6 +12,7 @@ import (
 	"os"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -67,12 +68,18 @@ func NewServerWithLogger(config *Config, backend Backend, logger *logrus.Logger)
 	chanRouter := chi.NewRouter()
 	router.Mount("/c/", chanRouter)
 
+	var receiveSlots chan bool
+	if config.MaxInFlightReceives > 0 {
+		receiveSlots = make(chan bool, config.MaxInFlightReceives)
+	}
+
 	return &server{
 		config:  config,
 		backend: backend,
 
-		router:     router,
-		chanRouter: chanRouter,
+		router:       router,
+		chanRouter:   chanRouter,
+		receiveSlots: receiveSlots,
 
 		stopChan:  make(chan bool),
 		waitGroup: &sync.WaitGroup{},
@@ -209,8 +216,27 @@ func (s *server) SendMsg(ctx context.Context, msg Msg) (MsgStatus, error) {
 		return nil, fmt.Errorf("unable to find handler for channel type: %s", msg.Channel().ChannelType())
 	}
 
-	// have the handler send it
-	return handler.SendMsg(ctx, msg)
+	// messages to URNs the handler can't deliver to will never succeed so fail them without sending
+	if validator, isValidator := handler.(URNValidator); isValidator {
+		if err := validator.ValidateURN(msg.URN()); err != nil {
+			return nil, NewPermanentSendError(DeadLetterInvalidDestination, err)
+		}
+	}
+
+	// have the handler send it, wrapped in any behavior it adds to its sends
+	send := SendFunc(handler.SendMsg)
+	if wrapper, isWrapper := handler.(SendWrapper); isWrapper {
+		send = wrapper.WrapSend(send)
+	}
+	status, err := send(ctx, msg)
+
+	// sends that went out count as a single unit unless the handler counted them
+	if err == nil && status != nil && status.Status() != MsgErrored && status.Status() != MsgFailed {
+		if _, counted := status.Extra()[MsgStatusExtraUnits]; !counted {
+			status.SetExtra(MsgStatusExtraUnits, 1)
+		}
+	}
+	return status, err
 }
 
 func (s *server) WaitGroup() *sync.WaitGroup { return s.waitGroup }
@@ -237,8 +263,14 @@ type server struct {
 	stopped   bool
 
 	routes []string
+
+	// receiveSlots are taken by the channel requests being handled, nil if we don't limit how many there are at once
+	receiveSlots chan bool
 }
 
+// receiveRetryAfter is how many seconds we ask channels to wait before retrying requests we're too busy to handle
+const receiveRetryAfter = 5
+
 func (s *server) initializeChannelHandlers() {
 	includes := s.config.IncludeChannels
 	excludes := s.config.ExcludeChannels
@@ -263,6 +295,19 @@ func (s *server) initializeChannelHandlers() {
 
 func (s *server) channelHandleWrapper(handler ChannelHandler, handlerFunc ChannelHandleFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// reject requests outright when we're already handling as many as we're allowed to, rather than letting a flood
+		// of them exhaust our resources, channels retrying them later
+		if s.receiveSlots != nil {
+			select {
+			case s.receiveSlots <- true:
+				defer func() { <-s.receiveSlots }()
+			default:
+				w.Header().Set("Retry-After", strconv.Itoa(receiveRetryAfter))
+				WriteDataResponse(r.Context(), w, http.StatusTooManyRequests, "Too Many Requests", []interface{}{NewErrorData("too many requests in flight, try again later")})
+				return
+			}
+		}
+
 		start := time.Now()
 
 		// stuff a few things in our context that help with logging
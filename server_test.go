@@ -1,7 +1,10 @@
 package courier
 
 import (
+	"context"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
@@ -55,6 +58,57 @@ func TestServer(t *testing.T) {
 	assert.Contains(t, string(rr.Body), "method not allowed")
 }
 
+func TestMaxInFlightReceives(t *testing.T) {
+	config := NewConfig()
+	config.MaxInFlightReceives = 2
+
+	s := NewServer(config, NewMockBackend())
+
+	started := make(chan bool)
+	release := make(chan bool)
+	s.AddHandlerRoute(NewHandler(), http.MethodPost, "flood", func(ctx context.Context, channel Channel, w http.ResponseWriter, r *http.Request) ([]Event, error) {
+		started <- true
+		<-release
+		return nil, WriteIgnored(ctx, w, r, "handled")
+	})
+
+	receive := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.Router().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/c/dm/e4bb1578-29da-4fa5-a214-9da19dd24230/flood", nil))
+		return w
+	}
+
+	// take up all the slots with requests which are still being handled
+	var wg sync.WaitGroup
+	handled := make([]*httptest.ResponseRecorder, 2)
+	for i := range handled {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			handled[i] = receive()
+		}(i)
+		<-started
+	}
+
+	// the flood of requests which follows them is rejected without being handled
+	for i := 0; i < 5; i++ {
+		w := receive()
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "5", w.Header().Get("Retry-After"))
+		assert.Contains(t, w.Body.String(), "too many requests in flight")
+	}
+
+	close(release)
+	wg.Wait()
+	for _, w := range handled {
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// once they're done, requests are handled again
+	go func() { <-started }()
+	assert.Equal(t, http.StatusOK, receive().Code)
+}
+
 func TestSanitizeBody(t *testing.T) {
 	tcs := []struct {
 		Label  string
@@ -17,6 +17,13 @@ const (
 	NilMsgStatus MsgStatusValue = ""
 )
 
+// MsgStatusExtraSentOn is the status extra holding when the provider says it sent a message, as an RFC3339 string
+const MsgStatusExtraSentOn = "sent_on"
+
+// MsgStatusExtraUnits is the status extra holding how many billable units sending a message consumed, e.g. the number of
+// SMS segments, which defaults to 1 for handlers that don't count them
+const MsgStatusExtraUnits = "units"
+
 //-----------------------------------------------------------------------------
 // MsgStatusUpdate Interface
 //-----------------------------------------------------------------------------
@@ -38,6 +45,9 @@ type MsgStatus interface {
 	Status() MsgStatusValue
 	SetStatus(MsgStatusValue)
 
+	Extra() map[string]interface{}
+	SetExtra(key string, value interface{})
+
 	Logs() []*ChannelLog
 	AddLog(log *ChannelLog)
 }
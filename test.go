@@ -609,12 +609,14 @@ func (m *mockMsg) ResponseToID() MsgID          { return m.responseToID }
 func (m *mockMsg) ResponseToExternalID() string { return m.responseToExternalID }
 func (m *mockMsg) Metadata() json.RawMessage    { return m.metadata }
 func (m *mockMsg) IsResend() bool               { return m.isResend }
+func (m *mockMsg) AlreadyWritten() bool         { return m.alreadyWritten }
 
 func (m *mockMsg) ReceivedOn() *time.Time { return m.receivedOn }
 func (m *mockMsg) SentOn() *time.Time     { return m.sentOn }
 func (m *mockMsg) WiredOn() *time.Time    { return m.wiredOn }
 
 func (m *mockMsg) WithContactName(name string) Msg   { m.contactName = name; return m }
+func (m *mockMsg) WithText(text string) Msg          { m.text = text; return m }
 func (m *mockMsg) WithURNAuth(auth string) Msg       { m.urnAuth = auth; return m }
 func (m *mockMsg) WithReceivedOn(date time.Time) Msg { m.receivedOn = &date; return m }
 func (m *mockMsg) WithExternalID(id string) Msg      { m.externalID = id; return m }
@@ -624,6 +626,7 @@ func (m *mockMsg) WithAttachment(url string) Msg {
 	m.attachments = append(m.attachments, url)
 	return m
 }
+func (m *mockMsg) WithAttachments(urls []string) Msg         { m.attachments = urls; return m }
 func (m *mockMsg) WithMetadata(metadata json.RawMessage) Msg { m.metadata = metadata; return m }
 
 //-----------------------------------------------------------------------------
@@ -638,6 +641,7 @@ type mockMsgStatus struct {
 	externalID string
 	status     MsgStatusValue
 	createdOn  time.Time
+	extra      map[string]interface{}
 
 	logs []*ChannelLog
 }
@@ -667,6 +671,14 @@ func (m *mockMsgStatus) SetExternalID(id string) { m.externalID = id }
 func (m *mockMsgStatus) Status() MsgStatusValue          { return m.status }
 func (m *mockMsgStatus) SetStatus(status MsgStatusValue) { m.status = status }
 
+func (m *mockMsgStatus) Extra() map[string]interface{} { return m.extra }
+func (m *mockMsgStatus) SetExtra(key string, value interface{}) {
+	if m.extra == nil {
+		m.extra = make(map[string]interface{})
+	}
+	m.extra[key] = value
+}
+
 func (m *mockMsgStatus) Logs() []*ChannelLog    { return m.logs }
 func (m *mockMsgStatus) AddLog(log *ChannelLog) { m.logs = append(m.logs, log) }
 
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff generates the delays between retries of something, starting at Base and growing by Multiplier with each
+// retry up to Max. Jitter is the fraction of each delay by which it is randomly varied, e.g. 0.2 for up to 20% either
+// way, so that things retrying at the same time spread out. A zero Max means delays aren't capped and a Multiplier
+// less than 1 that they don't grow.
+type Backoff struct {
+	Base       time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+
+	retries int
+}
+
+// Next returns the delay before the next retry
+func (b *Backoff) Next() time.Duration {
+	max := time.Duration(math.MaxInt64)
+	if b.Max > 0 {
+		max = b.Max
+	}
+
+	// working in floats means delays which would overflow a duration just become infinite and are capped like any other,
+	// jitter being applied after capping so that delays at the max still spread out
+	delay := math.Min(float64(b.Base)*math.Pow(math.Max(b.Multiplier, 1), float64(b.retries)), float64(max))
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (rand.Float64()*2 - 1)
+	}
+	b.retries++
+
+	if delay >= float64(max) {
+		return max
+	}
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay)
+}
+
+// Reset starts the delays over from Base
+func (b *Backoff) Reset() {
+	b.retries = 0
+}
@@ -0,0 +1,99 @@
+package utils_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	tcs := []struct {
+		backoff  utils.Backoff
+		expected []time.Duration
+	}{
+		// delays grow by the multiplier
+		{utils.Backoff{Base: time.Second, Multiplier: 2}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{utils.Backoff{Base: 100 * time.Millisecond, Multiplier: 1.5}, []time.Duration{100 * time.Millisecond, 150 * time.Millisecond, 225 * time.Millisecond}},
+
+		// up to the max
+		{utils.Backoff{Base: time.Second, Max: 5 * time.Second, Multiplier: 2}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{utils.Backoff{Base: 10 * time.Second, Max: 5 * time.Second, Multiplier: 2}, []time.Duration{5 * time.Second, 5 * time.Second}},
+
+		// and don't grow at all without a multiplier
+		{utils.Backoff{Base: time.Second}, []time.Duration{time.Second, time.Second, time.Second}},
+		{utils.Backoff{Base: time.Second, Multiplier: 0.5}, []time.Duration{time.Second, time.Second}},
+		{utils.Backoff{}, []time.Duration{0, 0}},
+	}
+
+	for _, tc := range tcs {
+		backoff := tc.backoff
+		actual := make([]time.Duration, len(tc.expected))
+		for i := range actual {
+			actual[i] = backoff.Next()
+		}
+		assert.Equal(t, tc.expected, actual, "delays mismatch for %+v", tc.backoff)
+	}
+
+	// delays which would overflow are capped instead
+	backoff := &utils.Backoff{Base: time.Hour, Max: 24 * time.Hour, Multiplier: 10}
+	for i := 0; i < 100; i++ {
+		backoff.Next()
+	}
+	assert.Equal(t, 24*time.Hour, backoff.Next())
+
+	backoff = &utils.Backoff{Base: time.Hour, Multiplier: 10}
+	for i := 0; i < 100; i++ {
+		backoff.Next()
+	}
+	assert.Equal(t, time.Duration(math.MaxInt64), backoff.Next())
+
+	// resetting starts delays over
+	backoff = &utils.Backoff{Base: time.Second, Multiplier: 2}
+	backoff.Next()
+	backoff.Next()
+	backoff.Reset()
+	assert.Equal(t, time.Second, backoff.Next())
+}
+
+func TestBackoffJitter(t *testing.T) {
+	tcs := []struct {
+		backoff utils.Backoff
+		retry   int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{utils.Backoff{Base: time.Second, Multiplier: 2, Jitter: 0.2}, 0, 800 * time.Millisecond, 1200 * time.Millisecond},
+		{utils.Backoff{Base: time.Second, Multiplier: 2, Jitter: 0.2}, 3, 6400 * time.Millisecond, 9600 * time.Millisecond},
+		{utils.Backoff{Base: time.Second, Multiplier: 2, Jitter: 1}, 1, 0, 4 * time.Second},
+
+		// jitter never takes delays past the max
+		{utils.Backoff{Base: time.Second, Max: 4 * time.Second, Multiplier: 2, Jitter: 0.5}, 2, 2 * time.Second, 4 * time.Second},
+		{utils.Backoff{Base: time.Second, Max: 4 * time.Second, Multiplier: 2, Jitter: 0.5}, 5, 2 * time.Second, 4 * time.Second},
+	}
+
+	for _, tc := range tcs {
+		varied := false
+		var first time.Duration
+
+		for i := 0; i < 100; i++ {
+			backoff := tc.backoff
+			for r := 0; r < tc.retry; r++ {
+				backoff.Next()
+			}
+			delay := backoff.Next()
+
+			assert.GreaterOrEqual(t, delay, tc.min, "delay below bounds for %+v retry %d", tc.backoff, tc.retry)
+			assert.LessOrEqual(t, delay, tc.max, "delay above bounds for %+v retry %d", tc.backoff, tc.retry)
+
+			if i == 0 {
+				first = delay
+			} else if delay != first {
+				varied = true
+			}
+		}
+		assert.True(t, varied, "delays never varied for %+v retry %d", tc.backoff, tc.retry)
+	}
+}
@@ -0,0 +1,25 @@
+package utils_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClock(t *testing.T) {
+	before := time.Now()
+	assert.False(t, utils.RealClock.Now().Before(before))
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := utils.NewFakeClock(start)
+	assert.Equal(t, start, clock.Now())
+	assert.Equal(t, start, clock.Now())
+
+	clock.Advance(24 * time.Hour)
+	assert.Equal(t, time.Date(2021, 6, 2, 12, 0, 0, 0, time.UTC), clock.Now())
+
+	clock.Set(start)
+	assert.Equal(t, start, clock.Now())
+}
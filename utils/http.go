@@ -3,9 +3,13 @@ package utils
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +30,8 @@ type RequestResponse struct {
 	Body          []byte
 	ContentLength int
 	Elapsed       time.Duration
+	RateLimit     *RateLimit
+	TraceID       string
 }
 
 const (
@@ -56,6 +62,13 @@ func MakeHTTPRequest(req *http.Request) (*RequestResponse, error) {
 func MakeHTTPRequestWithClient(req *http.Request, client *http.Client) (*RequestResponse, error) {
 	req.Header.Set("User-Agent", HTTPUserAgent)
 
+	// if our request has its own deadline, that takes precedence over the client timeout
+	if _, hasDeadline := req.Context().Deadline(); hasDeadline && client.Timeout > 0 {
+		withoutTimeout := *client
+		withoutTimeout.Timeout = 0
+		client = &withoutTimeout
+	}
+
 	start := time.Now()
 	requestTrace, err := httputil.DumpRequestOut(req, true)
 	if err != nil {
@@ -75,6 +88,77 @@ func MakeHTTPRequestWithClient(req *http.Request, client *http.Client) (*Request
 	return rr, err
 }
 
+// BuildMultipartRequest builds a POST request to the passed in URL whose body is a multipart form of the passed in fields
+// followed by the file, if there is one. The file part has the passed in content type, or application/octet-stream if
+// that's empty. The body is streamed as the request is sent rather than buffered up front, so the request must be sent
+// or its body closed.
+func BuildMultipartRequest(url string, fields map[string]string, file io.Reader, fileFieldName, fileName, fileContentType string) (*http.Request, error) {
+	body, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		pw.CloseWithError(writeMultipart(writer, fields, file, fileFieldName, fileName, fileContentType))
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req, nil
+}
+
+// escapes the quotes in the names of multipart form fields and files, as the multipart package does
+var multipartQuoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// writeMultipart writes the fields, in order of their names, and the file to the passed in multipart writer
+func writeMultipart(writer *multipart.Writer, fields map[string]string, file io.Reader, fileFieldName, fileName, fileContentType string) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := writer.WriteField(name, fields[name]); err != nil {
+			return err
+		}
+	}
+
+	if file != nil {
+		if fileContentType == "" {
+			fileContentType = "application/octet-stream"
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, multipartQuoteEscaper.Replace(fileFieldName), multipartQuoteEscaper.Replace(fileName)))
+		header.Set("Content-Type", fileContentType)
+
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, file); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+// traceIDHeaders are the response headers providers return the id of a request in, which they will ask for when we
+// file support tickets with them
+var traceIDHeaders = []string{"X-Slack-Req-Id", "X-Request-Id", "X-Trace-Id", "X-Correlation-Id", "X-Amzn-Trace-Id", "Cf-Ray"}
+
+// ParseTraceID returns the request id the provider returned in the passed in response headers, if any
+func ParseTraceID(header http.Header) string {
+	for _, name := range traceIDHeaders {
+		if id := strings.TrimSpace(header.Get(name)); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
 // newRRFromResponse creates a new RequestResponse based on the passed in http request and error (when we received no response)
 func newRRFromRequestAndError(r *http.Request, requestTrace string, requestError error) (*RequestResponse, error) {
 	rr := RequestResponse{ContentLength: -1}
@@ -95,6 +179,8 @@ func newRRFromResponse(method string, requestTrace string, r *http.Response) (*R
 	rr.Method = method
 	rr.URL = r.Request.URL.String()
 	rr.StatusCode = r.StatusCode
+	rr.RateLimit = ParseRateLimitHeaders(r.Header, time.Now())
+	rr.TraceID = ParseTraceID(r.Header)
 
 	// set our content length if we have its header
 
@@ -1,6 +1,15 @@
 package utils
 
-import "testing"
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestClient(t *testing.T) {
 	client := GetHTTPClient()
@@ -22,3 +31,56 @@ func TestClient(t *testing.T) {
 		t.Error("GetHTTPClient should always return same client")
 	}
 }
+
+func TestParseTraceID(t *testing.T) {
+	assert.Equal(t, "", ParseTraceID(http.Header{}))
+	assert.Equal(t, "7d3f2a", ParseTraceID(http.Header{"X-Request-Id": []string{" 7d3f2a "}}))
+	assert.Equal(t, "Root=1-67891233", ParseTraceID(http.Header{"X-Amzn-Trace-Id": []string{"Root=1-67891233"}}))
+
+	// provider specific headers take precedence over generic ones
+	assert.Equal(t, "req-1", ParseTraceID(http.Header{"X-Request-Id": []string{"req-2"}, "X-Slack-Req-Id": []string{"req-1"}}))
+}
+
+func TestBuildMultipartRequest(t *testing.T) {
+	req, err := BuildMultipartRequest("https://example.com/upload", map[string]string{"channels": "C0123ABCDEF", "filename": "image.jpg"}, strings.NewReader("...file bytes..."), "file", "image.jpg", "")
+	assert.NoError(t, err)
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "https://example.com/upload", req.URL.String())
+
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/form-data", mediaType)
+
+	// fields are written in order of their names, followed by the file
+	reader := multipart.NewReader(req.Body, params["boundary"])
+	for _, expected := range []struct{ name, filename, contentType, content string }{
+		{"channels", "", "", "C0123ABCDEF"},
+		{"filename", "", "", "image.jpg"},
+		{"file", "image.jpg", "application/octet-stream", "...file bytes..."},
+	} {
+		part, err := reader.NextPart()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.name, part.FormName())
+		assert.Equal(t, expected.filename, part.FileName())
+		assert.Equal(t, expected.contentType, part.Header.Get("Content-Type"))
+		assert.Equal(t, expected.content, string(content))
+	}
+	_, err = reader.NextPart()
+	assert.Equal(t, io.EOF, err)
+
+	// files can be given an explicit content type
+	req, err = BuildMultipartRequest("https://example.com/upload", nil, strings.NewReader("...file bytes..."), "file", `my "image".jpg`, "image/jpeg")
+	assert.NoError(t, err)
+	assert.NoError(t, req.ParseMultipartForm(1024))
+	assert.Equal(t, `my "image".jpg`, req.MultipartForm.File["file"][0].Filename)
+	assert.Equal(t, "image/jpeg", req.MultipartForm.File["file"][0].Header.Get("Content-Type"))
+
+	// and without a file, only the fields are written
+	req, err = BuildMultipartRequest("https://example.com/upload", map[string]string{"channels": "C0123ABCDEF"}, nil, "", "", "")
+	assert.NoError(t, err)
+	assert.NoError(t, req.ParseMultipartForm(1024))
+	assert.Equal(t, "C0123ABCDEF", req.FormValue("channels"))
+	assert.Nil(t, req.MultipartForm.File["file"])
+}
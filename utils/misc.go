@@ -6,11 +6,14 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"mime"
 	"net/url"
 	"path"
 	"regexp"
 	"strings"
 	"unicode/utf8"
+
+	"github.com/gabriel-vasile/mimetype"
 )
 
 // SignHMAC256 encrypts value with HMAC256 by using a private key
@@ -110,6 +113,35 @@ func BasePathForURL(rawURL string) (string, error) {
 	return path.Base(parsedURL.Path), nil
 }
 
+// FilenameForMimeType ensures the passed in filename has an extension matching the passed in MIME type, appending one
+// if it's missing or replacing one which is for a different type. Filenames for unknown MIME types are left as they are.
+func FilenameForMimeType(filename string, mimeType string) string {
+	mimeType, _, _ = mime.ParseMediaType(mimeType)
+	known := mimetype.Lookup(mimeType)
+	if known == nil || known.Extension() == "" {
+		return filename
+	}
+
+	ext := path.Ext(filename)
+	if ext == "" {
+		return filename + known.Extension()
+	}
+
+	// extension is fine if it's the canonical one or any other for the same type, e.g. .jpeg for image/jpeg
+	if strings.EqualFold(ext, known.Extension()) {
+		return filename
+	}
+	extType, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(ext)))
+	if extType == "" {
+		return filename + known.Extension()
+	}
+	if known.Is(extType) {
+		return filename
+	}
+
+	return strings.TrimSuffix(filename, ext) + known.Extension()
+}
+
 // StringsToRows takes a slice of strings and re-organizes it into rows and columns
 func StringsToRows(strs []string, maxRows, maxRowRunes, paddingRunes int) [][]string {
 	// calculate rune length if it's all one row
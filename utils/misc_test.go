@@ -120,3 +120,34 @@ func TestStringsToRows(t *testing.T) {
 		assert.Equal(t, tc.expected, rows, "rows mismatch for replies %v", tc.replies)
 	}
 }
+
+func TestFilenameForMimeType(t *testing.T) {
+	tcs := []struct {
+		filename string
+		mimeType string
+		expected string
+	}{
+		// correct extensions
+		{"report.pdf", "application/pdf", "report.pdf"},
+		{"photo.JPG", "image/jpeg", "photo.JPG"},
+		{"photo.jpeg", "image/jpeg", "photo.jpeg"},
+		{"song.mp3", "audio/mpeg", "song.mp3"},
+
+		// missing extensions
+		{"report", "application/pdf", "report.pdf"},
+		{"photo", "image/png", "photo.png"},
+		{"report.v2", "application/pdf", "report.v2.pdf"},
+
+		// wrong extensions
+		{"report.png", "application/pdf", "report.pdf"},
+		{"photo.pdf", "image/jpeg; charset=binary", "photo.jpg"},
+
+		// unknown types are left alone
+		{"data.bin", "application/x-unknown", "data.bin"},
+		{"data", "", "data"},
+	}
+
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expected, utils.FilenameForMimeType(tc.filename, tc.mimeType), "filename mismatch for %s (%s)", tc.filename, tc.mimeType)
+	}
+}
@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/nyaruka/phonenumbers"
+	"github.com/pkg/errors"
+)
+
+// NormalizeE164 validates the passed in phone number and returns it in E.164 format, e.g. +250788383383. Numbers
+// without a leading + are parsed as national numbers of the default country, which should be an ISO 3166-1 alpha-2 code.
+func NormalizeE164(number string, defaultCountry string) (string, error) {
+	number = strings.TrimSpace(number)
+	if number == "" {
+		return "", errors.New("phone number cannot be empty")
+	}
+
+	parsed, err := phonenumbers.Parse(number, strings.ToUpper(defaultCountry))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to parse phone number '%s'", number)
+	}
+	if !phonenumbers.IsPossibleNumber(parsed) {
+		return "", errors.Errorf("phone number '%s' is not a possible number", number)
+	}
+
+	return phonenumbers.Format(parsed, phonenumbers.E164), nil
+}
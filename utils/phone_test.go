@@ -0,0 +1,43 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/courier/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeE164(t *testing.T) {
+	tcs := []struct {
+		number         string
+		defaultCountry string
+		normalized     string
+		err            string
+	}{
+		{"+250788383383", "", "+250788383383", ""},
+		{"+250788383383", "BR", "+250788383383", ""},
+		{"0788383383", "RW", "+250788383383", ""},
+		{" 078 838 3383 ", "rw", "+250788383383", ""},
+		{"(11) 91234-5678", "BR", "+5511912345678", ""},
+		{"+55 11 91234 5678", "EC", "+5511912345678", ""},
+		{"(202) 555-0142", "US", "+12025550142", ""},
+		{"07911 123456", "GB", "+447911123456", ""},
+		{"0712345678", "KE", "+254712345678", ""},
+
+		{"", "RW", "", "phone number cannot be empty"},
+		{"0788383383", "", "", "unable to parse phone number '0788383383': invalid country code"},
+		{"MTN", "RW", "", "unable to parse phone number 'MTN': the phone number supplied is not a number"},
+		{"+2507", "", "", "unable to parse phone number '+2507': the string supplied is too short to be a phone number"},
+		{"078838338312345678", "RW", "", "phone number '078838338312345678' is not a possible number"},
+	}
+
+	for _, tc := range tcs {
+		normalized, err := utils.NormalizeE164(tc.number, tc.defaultCountry)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "error mismatch for '%s'", tc.number)
+		} else {
+			assert.NoError(t, err, "unexpected error for '%s'", tc.number)
+			assert.Equal(t, tc.normalized, normalized, "normalized mismatch for '%s'", tc.number)
+		}
+	}
+}
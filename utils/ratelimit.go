@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is the rate limit state a provider reported in the headers of a response
+type RateLimit struct {
+	Limit     int // the number of requests allowed per window, zero if not reported
+	Remaining int // the number of requests remaining in the current window
+	Reset     time.Time
+}
+
+// resets larger than this are epoch seconds rather than a number of seconds from now
+const epochResetThreshold = 1000000000
+
+// ParseRateLimitHeaders parses the common rate limit headers in the passed in response headers, returning nil if there
+// aren't any. We support the X-RateLimit-* headers used by most providers, the standardized RateLimit-* headers, and
+// Retry-After which means we have no remaining requests until the given time.
+func ParseRateLimitHeaders(header http.Header, now time.Time) *RateLimit {
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		remaining, err := strconv.Atoi(strings.TrimSpace(header.Get(prefix + "Remaining")))
+		if err != nil {
+			continue
+		}
+
+		rl := &RateLimit{Remaining: remaining}
+		rl.Limit, _ = strconv.Atoi(strings.TrimSpace(header.Get(prefix + "Limit")))
+
+		if reset, err := strconv.ParseFloat(strings.TrimSpace(header.Get(prefix+"Reset")), 64); err == nil {
+			if reset > epochResetThreshold {
+				rl.Reset = time.Unix(0, int64(reset*float64(time.Second)))
+			} else {
+				rl.Reset = now.Add(time.Duration(reset * float64(time.Second)))
+			}
+		}
+		return rl
+	}
+
+	if retryAfter := strings.TrimSpace(header.Get("Retry-After")); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return &RateLimit{Reset: now.Add(time.Duration(seconds) * time.Second)}
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return &RateLimit{Reset: date}
+		}
+	}
+
+	return nil
+}
+
+// maxTokenBuckets is how many buckets we hold before forgetting those which have refilled
+const maxTokenBuckets = 10000
+
+// TokenBuckets spaces out events for each of a set of keys, each key having a bucket of a single token which is refilled
+// at the rate events for that key are allowed. Events which find their bucket empty borrow against its next refill.
+type TokenBuckets struct {
+	clock   Clock
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	rate    float64
+}
+
+// NewTokenBuckets creates a new empty set of buckets which uses the passed in clock for the current time
+func NewTokenBuckets(clock Clock) *TokenBuckets {
+	return &TokenBuckets{clock: clock, buckets: make(map[string]*tokenBucket)}
+}
+
+// Reserve takes a token from the bucket for the passed in key, which is refilled at the passed in rate per second,
+// returning how long the caller should wait before its event
+func (b *TokenBuckets) Reserve(key string, rate float64) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := b.clock.Now()
+
+	bucket := b.buckets[key]
+	if bucket == nil {
+		if len(b.buckets) >= maxTokenBuckets {
+			b.forgetRefilled(now)
+		}
+		bucket = &tokenBucket{tokens: 1, updated: now}
+		b.buckets[key] = bucket
+	}
+
+	bucket.rate = rate
+	bucket.refill(now)
+	bucket.tokens--
+
+	if bucket.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bucket.tokens / rate * float64(time.Second))
+}
+
+// forgetRefilled removes the buckets which have refilled, as those keys haven't had events in a while
+func (b *TokenBuckets) forgetRefilled(now time.Time) {
+	for key, bucket := range b.buckets {
+		if bucket.refill(now); bucket.tokens >= 1 {
+			delete(b.buckets, key)
+		}
+	}
+}
+
+// refill adds the tokens the bucket has earned since it was last updated, up to its single token
+func (t *tokenBucket) refill(now time.Time) {
+	if now.After(t.updated) {
+		t.tokens += now.Sub(t.updated).Seconds() * t.rate
+		t.updated = now
+	}
+	if t.tokens > 1 {
+		t.tokens = 1
+	}
+}
@@ -0,0 +1,91 @@
+package utils_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/courier/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimitHeaders(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tcs := []struct {
+		headers  map[string]string
+		expected *utils.RateLimit
+	}{
+		{map[string]string{}, nil},
+		{map[string]string{"X-RateLimit-Remaining": "foo"}, nil},
+		{
+			map[string]string{"X-RateLimit-Limit": "100", "X-RateLimit-Remaining": "42", "X-RateLimit-Reset": "30"},
+			&utils.RateLimit{Limit: 100, Remaining: 42, Reset: now.Add(30 * time.Second)},
+		},
+		{
+			map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "1622549100"},
+			&utils.RateLimit{Remaining: 0, Reset: time.Unix(1622549100, 0)},
+		},
+		{
+			map[string]string{"X-RateLimit-Remaining": "5"},
+			&utils.RateLimit{Remaining: 5},
+		},
+		{
+			map[string]string{"RateLimit-Limit": "10", "RateLimit-Remaining": "1", "RateLimit-Reset": "2.5"},
+			&utils.RateLimit{Limit: 10, Remaining: 1, Reset: now.Add(2500 * time.Millisecond)},
+		},
+		{
+			map[string]string{"Retry-After": "120"},
+			&utils.RateLimit{Reset: now.Add(2 * time.Minute)},
+		},
+		{
+			map[string]string{"Retry-After": "Tue, 01 Jun 2021 12:05:00 GMT"},
+			&utils.RateLimit{Reset: time.Date(2021, 6, 1, 12, 5, 0, 0, time.UTC)},
+		},
+		{map[string]string{"Retry-After": "soon"}, nil},
+	}
+
+	for _, tc := range tcs {
+		header := http.Header{}
+		for k, v := range tc.headers {
+			header.Set(k, v)
+		}
+
+		rl := utils.ParseRateLimitHeaders(header, now)
+		if tc.expected == nil {
+			assert.Nil(t, rl, "expected nil for headers %v", tc.headers)
+		} else if assert.NotNil(t, rl, "expected rate limit for headers %v", tc.headers) {
+			assert.Equal(t, tc.expected.Limit, rl.Limit)
+			assert.Equal(t, tc.expected.Remaining, rl.Remaining)
+			assert.True(t, tc.expected.Reset.Equal(rl.Reset), "reset mismatch for headers %v: %s", tc.headers, rl.Reset)
+		}
+	}
+}
+
+func TestTokenBuckets(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := utils.NewFakeClock(now)
+	buckets := utils.NewTokenBuckets(clock)
+
+	// first event for a key goes straight away, and following ones are spaced out at the rate
+	assert.Equal(t, time.Duration(0), buckets.Reserve("C1", 1))
+	assert.Equal(t, time.Second, buckets.Reserve("C1", 1))
+	assert.Equal(t, 2*time.Second, buckets.Reserve("C1", 1))
+
+	// other keys have their own buckets
+	assert.Equal(t, time.Duration(0), buckets.Reserve("C2", 1))
+
+	// buckets refill as time passes
+	clock.Advance(2500 * time.Millisecond)
+	assert.Equal(t, 500*time.Millisecond, buckets.Reserve("C1", 1))
+	assert.Equal(t, time.Duration(0), buckets.Reserve("C2", 1))
+
+	// but never hold more than a single token
+	clock.Advance(time.Minute)
+	assert.Equal(t, time.Duration(0), buckets.Reserve("C1", 1))
+	assert.Equal(t, time.Second, buckets.Reserve("C1", 1))
+
+	// faster rates space events less
+	assert.Equal(t, time.Duration(0), buckets.Reserve("C3", 4))
+	assert.Equal(t, 250*time.Millisecond, buckets.Reserve("C3", 4))
+}